@@ -0,0 +1,259 @@
+package minienv
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Access tokens are added to the urls of an environment's editor, log and app tabs, so the proxies in the
+// environment only serve requests from the session the urls were made for. A token is
+// <base64url payload>.<key id>.<base64url hmac>, signed with a key derived from the api server's key, the
+// environment and its claim. Environments are deployed with their derived keys ($accessTokenKeys), so a
+// leaked key is only good for one claim, and tokens stop verifying when the claim is released.
+
+// the query parameter the token is passed in
+const AccessTokenParam = "minienvToken"
+
+// tokens expire this long after they're issued, unless MINIENV_ACCESS_TOKEN_SECONDS is set
+const DefaultAccessTokenSeconds int64 = 4 * 60 * 60
+
+// where the generated key is kept when MINIENV_ACCESS_TOKEN_KEYS isn't set, so all api servers share it
+const AccessTokenKeyStateKey = "access-token-key"
+const GeneratedAccessTokenKeyId = "generated"
+
+type AccessTokenClaims struct {
+	EnvId string `json:"env"`
+	SessionId string `json:"sid"`
+	// see getAccessTokenClaimHash
+	ClaimHash string `json:"cid"`
+	// the ports the token opens; "<appProxyPort>-<port>" for app tabs
+	Ports []string `json:"ports"`
+	IssuedAt int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+type AccessTokenKey struct {
+	Id string
+	Secret []byte
+}
+
+// the first key signs tokens; the others only verify them. To rotate, add the new key last, and move it
+// first once the environments deployed before it have been released.
+var accessTokenKeys []*AccessTokenKey
+var accessTokenSeconds = DefaultAccessTokenSeconds
+
+func (claims *AccessTokenClaims) AllowsPort(port string) bool {
+	return containsString(claims.Ports, port)
+}
+
+// parseAccessTokenKeys parses MINIENV_ACCESS_TOKEN_KEYS, a comma separated list of <id>:<secret>
+func parseAccessTokenKeys(s string) ([]*AccessTokenKey, error) {
+	var keys []*AccessTokenKey
+	for _, element := range splitList(s) {
+		parts := strings.SplitN(element, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || len(parts[1]) < 16 {
+			return nil, errors.New("access token keys must be <id>:<secret>, with secrets of at least 16 characters")
+		}
+		keys = append(keys, &AccessTokenKey{Id: parts[0], Secret: []byte(parts[1])})
+	}
+	return keys, nil
+}
+
+// loadGeneratedAccessTokenKey returns the key in the state store, generating it if there is none yet
+func loadGeneratedAccessTokenKey() (*AccessTokenKey, error) {
+	secret, err := stateStore.GetState(AccessTokenKeyStateKey)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		generated := make([]byte, 32)
+		_, err = rand.Read(generated)
+		if err != nil {
+			return nil, err
+		}
+		swapped, err := stateStore.CompareAndSwapState(AccessTokenKeyStateKey, nil, generated)
+		if err != nil {
+			return nil, err
+		} else if ! swapped {
+			// another api server generated it first
+			return loadGeneratedAccessTokenKey()
+		}
+		secret = generated
+	}
+	return &AccessTokenKey{Id: GeneratedAccessTokenKeyId, Secret: secret}, nil
+}
+
+// getAccessTokenClaimHash identifies the claim in tokens without revealing the claim token
+func getAccessTokenClaimHash(claimToken string) string {
+	hash := sha256.Sum256([]byte("minienv-claim:" + claimToken))
+	return hex.EncodeToString(hash[:8])
+}
+
+func deriveAccessTokenKey(key *AccessTokenKey, envId string, claimHash string) []byte {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte("minienv-access:" + envId + ":" + claimHash))
+	return mac.Sum(nil)
+}
+
+// getEnvAccessTokenKeys returns the keys the environment's proxies verify tokens with, as <id>:<base64url key>,...
+func getEnvAccessTokenKeys(envId string, claimToken string) string {
+	claimHash := getAccessTokenClaimHash(claimToken)
+	var keys []string
+	for _, key := range accessTokenKeys {
+		keys = append(keys, key.Id + ":" + base64.RawURLEncoding.EncodeToString(deriveAccessTokenKey(key, envId, claimHash)))
+	}
+	return strings.Join(keys, ",")
+}
+
+// ParseAccessTokenKeys parses the keys an environment is deployed with ($accessTokenKeys), for VerifyAccessToken
+func ParseAccessTokenKeys(s string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, element := range splitList(s) {
+		parts := strings.SplitN(element, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid access token key '%s'", parts[0])
+		}
+		key, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid access token key '%s'", parts[0])
+		}
+		keys[parts[0]] = key
+	}
+	return keys, nil
+}
+
+func issueAccessToken(envId string, claimToken string, sessionId string, ports []string) (string, error) {
+	if len(accessTokenKeys) == 0 {
+		return "", errors.New("no access token key")
+	}
+	key := accessTokenKeys[0]
+	now := time.Now().Unix()
+	claims := &AccessTokenClaims{
+		EnvId: envId,
+		SessionId: sessionId,
+		ClaimHash: getAccessTokenClaimHash(claimToken),
+		Ports: ports,
+		IssuedAt: now,
+		ExpiresAt: now + accessTokenSeconds,
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payloadStr := base64.RawURLEncoding.EncodeToString(payload)
+	signature := signAccessToken(deriveAccessTokenKey(key, envId, claims.ClaimHash), payloadStr, key.Id)
+	return payloadStr + "." + key.Id + "." + signature, nil
+}
+
+func signAccessToken(key []byte, payload string, keyId string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload + "." + keyId))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func parseAccessToken(token string) (*AccessTokenClaims, string, string, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, "", "", "", errors.New("malformed access token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, "", "", "", errors.New("malformed access token")
+	}
+	var claims AccessTokenClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, "", "", "", errors.New("malformed access token")
+	}
+	return &claims, parts[0], parts[1], parts[2], nil
+}
+
+// VerifyAccessToken checks a token passed to one of the environment's proxies. keys are the environment's
+// keys (see ParseAccessTokenKeys); envId and claimToken are the environment's, as it was deployed with.
+// The caller still checks the claims allow the port being accessed, and match the session in the host name.
+func VerifyAccessToken(token string, keys map[string][]byte, envId string, claimToken string) (*AccessTokenClaims, error) {
+	claims, payload, keyId, signature, err := parseAccessToken(token)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[keyId]
+	if ! ok {
+		return nil, fmt.Errorf("unknown access token key '%s'", keyId)
+	}
+	if subtle.ConstantTimeCompare([]byte(signAccessToken(key, payload, keyId)), []byte(signature)) != 1 {
+		return nil, errors.New("invalid access token signature")
+	} else if claims.EnvId != envId || claims.ClaimHash != getAccessTokenClaimHash(claimToken) {
+		// issued for another environment, or a claim that has been released
+		return nil, errors.New("access token revoked")
+	} else if claims.ExpiresAt <= time.Now().Unix() {
+		return nil, errors.New("access token expired")
+	}
+	return claims, nil
+}
+
+// VerifyAccessToken checks a token against the environment it was issued for, as it is now
+func (apiServer *ApiServer) VerifyAccessToken(token string) (*AccessTokenClaims, error) {
+	claims, _, _, _, err := parseAccessToken(token)
+	if err != nil {
+		return nil, ErrAccessTokenInvalid.WithCause(err)
+	}
+	syncEnvironments(apiServer)
+	var environment *Environment
+	for _, element := range getEnvironments(apiServer) {
+		if element.Id == claims.EnvId {
+			environment = element
+		}
+	}
+	if environment == nil || environment.ClaimToken == "" {
+		return nil, ErrAccessTokenInvalid.WithMessage("access token revoked")
+	}
+	keys, err := ParseAccessTokenKeys(getEnvAccessTokenKeys(environment.Id, environment.ClaimToken))
+	if err != nil {
+		return nil, ErrAccessTokenInvalid.WithCause(err)
+	}
+	claims, err = VerifyAccessToken(token, keys, environment.Id, environment.ClaimToken)
+	if err != nil {
+		return nil, ErrAccessTokenInvalid.WithMessage("%v", err)
+	}
+	return claims, nil
+}
+
+// getEnvAccessPorts returns the ports the urls of the environment use, as in its access tokens
+func getEnvAccessPorts(details *DeploymentDetails) []string {
+	ports := []string{details.LogPort, details.EditorPort}
+	if details.Tabs != nil {
+		for _, tab := range *details.Tabs {
+			ports = append(ports, details.AppProxyPort + "-" + strconv.Itoa(tab.Port))
+		}
+	}
+	return ports
+}
+
+// addAccessToken adds the token to the query of the url, ahead of any fragment
+func addAccessToken(rawUrl string, token string) string {
+	if token == "" {
+		return rawUrl
+	}
+	fragment := ""
+	if i := strings.Index(rawUrl, "#"); i >= 0 {
+		rawUrl, fragment = rawUrl[:i], rawUrl[i:]
+	}
+	separator := "?"
+	if strings.HasSuffix(rawUrl, "?") || strings.HasSuffix(rawUrl, "&") {
+		separator = ""
+	} else if strings.Contains(rawUrl, "?") {
+		separator = "&"
+	}
+	return rawUrl + separator + AccessTokenParam + "=" + url.QueryEscape(token) + fragment
+}
@@ -0,0 +1,146 @@
+package minienv
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func setTestAccessTokenKeys(t *testing.T, s string) {
+	keys, err := parseAccessTokenKeys(s)
+	if err != nil {
+		t.Fatalf("Error parsing access token keys: %v", err)
+	}
+	previousKeys := accessTokenKeys
+	previousSeconds := accessTokenSeconds
+	accessTokenKeys = keys
+	t.Cleanup(func() {
+		accessTokenKeys = previousKeys
+		accessTokenSeconds = previousSeconds
+	})
+}
+
+func verifyTestAccessToken(token string, envId string, claimToken string) (*AccessTokenClaims, error) {
+	keys, err := ParseAccessTokenKeys(getEnvAccessTokenKeys(envId, claimToken))
+	if err != nil {
+		return nil, err
+	}
+	return VerifyAccessToken(token, keys, envId, claimToken)
+}
+
+func TestAccessTokenSignAndVerify(t *testing.T) {
+	setTestAccessTokenKeys(t, "k1:0123456789abcdef")
+	token, err := issueAccessToken("1", "claim", "session", []string{"8001", "8003-8080"})
+	if err != nil {
+		t.Fatalf("Expected no error issuing token, got %v", err)
+	}
+	if strings.Contains(token, "claim") {
+		t.Errorf("Expected the claim token to stay out of the access token, got %s", token)
+	}
+	claims, err := verifyTestAccessToken(token, "1", "claim")
+	if err != nil {
+		t.Fatalf("Expected token to verify, got %v", err)
+	}
+	if claims.EnvId != "1" || claims.SessionId != "session" || ! claims.AllowsPort("8003-8080") || claims.AllowsPort("8002") {
+		t.Errorf("Expected the issued claims, got %+v", claims)
+	}
+	// any change to the token breaks the signature
+	parts := strings.Split(token, ".")
+	otherToken, _ := issueAccessToken("1", "claim", "other-session", []string{"8001", "8002"})
+	tampered := []string{
+		strings.Split(otherToken, ".")[0] + "." + parts[1] + "." + parts[2],
+		parts[0] + "." + parts[1] + "." + parts[2][1:],
+		parts[0] + "." + parts[1],
+		"not-a-token",
+	}
+	for _, element := range tampered {
+		if _, err := verifyTestAccessToken(element, "1", "claim"); err == nil {
+			t.Errorf("Expected error verifying %s", element)
+		}
+	}
+}
+
+func TestAccessTokenExpiry(t *testing.T) {
+	setTestAccessTokenKeys(t, "k1:0123456789abcdef")
+	accessTokenSeconds = 0
+	token, _ := issueAccessToken("1", "claim", "session", []string{"8001"})
+	if _, err := verifyTestAccessToken(token, "1", "claim"); err == nil || ! strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected expired token, got %v", err)
+	}
+}
+
+func TestAccessTokenKeyRotation(t *testing.T) {
+	setTestAccessTokenKeys(t, "old:0123456789abcdef")
+	oldToken, _ := issueAccessToken("1", "claim", "session", []string{"8001"})
+	// the new key is added last, so environments deployed with it still verify tokens signed with the old one
+	setTestAccessTokenKeys(t, "old:0123456789abcdef,new:fedcba9876543210")
+	if _, err := verifyTestAccessToken(oldToken, "1", "claim"); err != nil {
+		t.Errorf("Expected token signed with the old key to verify, got %v", err)
+	}
+	// then moved first, to sign tokens
+	setTestAccessTokenKeys(t, "new:fedcba9876543210,old:0123456789abcdef")
+	newToken, _ := issueAccessToken("1", "claim", "session", []string{"8001"})
+	if strings.Split(newToken, ".")[1] != "new" {
+		t.Errorf("Expected token signed with the new key, got %s", newToken)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := verifyTestAccessToken(token, "1", "claim"); err != nil {
+			t.Errorf("Expected token to verify during rotation, got %v", err)
+		}
+	}
+	// and the old key is removed
+	setTestAccessTokenKeys(t, "new:fedcba9876543210")
+	if _, err := verifyTestAccessToken(oldToken, "1", "claim"); err == nil {
+		t.Errorf("Expected token signed with a removed key to fail")
+	}
+	if _, err := verifyTestAccessToken(newToken, "1", "claim"); err != nil {
+		t.Errorf("Expected token signed with the new key to verify, got %v", err)
+	}
+}
+
+func TestAccessTokenRevocation(t *testing.T) {
+	setTestStateStore(t)
+	setTestAccessTokenKeys(t, "k1:0123456789abcdef")
+	token, _ := issueAccessToken("1", "claim", "session", []string{"8001"})
+	// a token for one claim doesn't open the env once it's claimed again, or other envs
+	keys, _ := ParseAccessTokenKeys(getEnvAccessTokenKeys("1", "claim"))
+	if _, err := VerifyAccessToken(token, keys, "1", "next-claim"); err == nil || ! strings.Contains(err.Error(), "revoked") {
+		t.Errorf("Expected token for a released claim to be revoked, got %v", err)
+	}
+	if _, err := VerifyAccessToken(token, keys, "2", "claim"); err == nil {
+		t.Errorf("Expected token for another env to fail")
+	}
+	if _, err := verifyTestAccessToken(token, "1", "next-claim"); err == nil {
+		t.Errorf("Expected the keys of the next claim to refuse the token")
+	}
+	// the api server checks the env as it is now
+	apiServer := &ApiServer{Environments: []*Environment{{Id: "1", Status: StatusRunning, ClaimToken: "claim"}}}
+	if _, err := apiServer.VerifyAccessToken(token); err != nil {
+		t.Errorf("Expected token for a claimed env to verify, got %v", err)
+	}
+	apiServer.Environments[0].ClaimToken = ""
+	if _, err := apiServer.VerifyAccessToken(token); ! errors.Is(err, ErrAccessTokenInvalid) {
+		t.Errorf("Expected %v for a released env, got %v", ErrAccessTokenInvalid, err)
+	}
+}
+
+func TestAddAccessToken(t *testing.T) {
+	tests := []struct {
+		url string
+		token string
+		expected string
+	}{
+		{"https://s-8001.example.com", "a.b.c", "https://s-8001.example.com?minienvToken=a.b.c"},
+		{"https://s-8001.example.com/path", "a+b/c", "https://s-8001.example.com/path?minienvToken=a%2Bb%2Fc"},
+		{"https://s-8001.example.com/path?x=1", "a.b.c", "https://s-8001.example.com/path?x=1&minienvToken=a.b.c"},
+		{"https://s-8001.example.com/path?", "a.b.c", "https://s-8001.example.com/path?minienvToken=a.b.c"},
+		{"https://s-8001.example.com/path#section", "a.b.c", "https://s-8001.example.com/path?minienvToken=a.b.c#section"},
+		{"https://s-8001.example.com/path?x=1#/route?y=2", "a.b.c", "https://s-8001.example.com/path?x=1&minienvToken=a.b.c#/route?y=2"},
+		{"https://s-8001.example.com/path#section", "", "https://s-8001.example.com/path#section"},
+	}
+	for _, test := range tests {
+		if actual := addAccessToken(test.url, test.token); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.url, test.expected, actual)
+		}
+	}
+}
@@ -2,7 +2,7 @@ package minienv
 
 import (
 	"errors"
-	"log"
+	"fmt"
 	"net/http"
 	"os"
 	"strconv"
@@ -21,6 +21,9 @@ func (apiServer *ApiServer) GetOrCreateSession(id string) *Session {
 	var session *Session = nil
 	if id != "" {
 		session, _ = sessionStore.GetSession(id)
+		if session != nil {
+			sessionStore.Touch(id)
+		}
 	}
 	if session == nil {
 		random, _ := uuid.NewRandom()
@@ -39,6 +42,23 @@ func (apiServer *ApiServer) SetSession(id string, session *Session) (error) {
 	return sessionStore.SetSession(id, session)
 }
 
+func (apiServer *ApiServer) DeleteSession(id string) (error) {
+	return sessionStore.DeleteSession(id)
+}
+
+// ListSessions pages through all sessions; it requires the admin token
+func (apiServer *ApiServer) ListSessions(request *SessionListRequest) (*SessionListResponse, error) {
+	err := authorizeAdmin(request.AdminToken)
+	if err != nil {
+		return nil, err
+	}
+	sessions, next, err := sessionStore.ListSessions(request.Cursor, request.Count)
+	if err != nil {
+		return nil, ErrBackendUnavailable.WithCause(err)
+	}
+	return &SessionListResponse{Sessions: sessions, Cursor: next}, nil
+}
+
 func (apiServer *ApiServer) AddCorsAndCacheHeadersThenServe(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Access-Control-Allow-Origin", allowOrigin)
@@ -53,74 +73,156 @@ func (apiServer *ApiServer) AddCorsAndCacheHeadersThenServe(handler http.Handler
 	}
 }
 
-func (apiServer *ApiServer) Claim(request *ClaimRequest) (*ClaimResponse){
+// Claim claims an idle environment for the session; only the session (or its user) may use the claim,
+// unless it's shared with ShareClaim
+func (apiServer *ApiServer) Claim(request *ClaimRequest, session *Session) (*ClaimResponse, error) {
+	if session == nil {
+		return nil, ErrSessionRequired
+	}
+	if request.Ticket != "" {
+		return apiServer.pollClaimTicket(request.Ticket, session)
+	}
+	err := checkClaimRate(session, request.ClientIp)
+	if err != nil {
+		return nil, err
+	}
 	var claimResponse = ClaimResponse{}
+	syncEnvironments(apiServer)
+	err = checkClaimLimits(apiServer, session, request.ClientIp)
+	if err != nil {
+		return nil, err
+	}
 	var environment *Environment
-	for _, element := range apiServer.Environments {
-		if element.Status == StatusIdle {
-			environment = element
-			break
+	claimTokenStr := ""
+	if ! isClaimQueued() {
+		environment, claimTokenStr, err = claimIdleEnvironment(apiServer, session, request.ClientIp)
+		if errors.Is(err, ErrClaimLimitExceeded) {
+			return nil, err
+		} else if err != nil {
+			return nil, ErrBackendUnavailable.WithCause(err)
 		}
 	}
-	if environment == nil {
-		log.Println("Claim failed; no environments available.")
+	if environment == nil && claimQueueEnabled {
+		// wait in line behind the sessions already queued
+		return apiServer.queueClaim(session, request.ClientIp)
+	} else if environment == nil {
+		logPrintln("Claim failed; no environments available.")
 		claimResponse.ClaimGranted = false
 		claimResponse.Message = "No environments available"
 	} else {
-		log.Printf("Claimed environment %s.\n", environment.Id)
-		// ok, grant claim and create new environment
-		claimToken, _ := uuid.NewRandom()
-		claimTokenStr := strings.Replace(claimToken.String(), "-", "", -1)
+		logPrintf("Claimed environment %s.\n", environment.Id)
 		claimResponse.ClaimGranted = true
 		claimResponse.ClaimToken = claimTokenStr
-		// update environment
-		environment.ClaimToken = claimResponse.ClaimToken
-		environment.Status = StatusClaimed
-		environment.LastActivity = time.Now().Unix()
 	}
-	return &claimResponse
+	return &claimResponse, nil
+}
+
+// claimIdleEnvironment claims the first idle environment for the session, returning it and the claim token.
+// The claim limits are checked again as the environment is taken, and once it's saved (see checkSavedClaimLimits),
+// so concurrent claims can't take the session, its user or the ip over a limit; ErrClaimLimitExceeded is returned then.
+func claimIdleEnvironment(apiServer *ApiServer, session *Session, clientIp string) (*Environment, string, error) {
+	claimToken, _ := uuid.NewRandom()
+	claimTokenStr := strings.Replace(claimToken.String(), "-", "", -1)
+	for _, element := range getEnvironments(apiServer) {
+		if element.Status != StatusIdle {
+			continue
+		}
+		var counts *claimCounts
+		// another api server may claim the same environment; only one save succeeds
+		err := updateEnvironment(element, func(environment *Environment) bool {
+			counts = countEnvironmentClaims(getEnvironments(apiServer), session, clientIp, environment.Id)
+			if environment.Status != StatusIdle || counts.isLimitReached() {
+				return false
+			}
+			environment.ClaimToken = claimTokenStr
+			environment.ClaimSessionId = session.Id
+			environment.ClaimUserId = session.UserId
+			environment.ClaimIp = clientIp
+			environment.Status = StatusClaimed
+			environment.ClaimedAt = time.Now().Unix()
+			environment.LastActivity = environment.ClaimedAt
+			return true
+		})
+		if err == nil {
+			err = checkSavedClaimLimits(element, session, clientIp)
+			if err != nil {
+				return nil, "", err
+			}
+			return element, claimTokenStr, nil
+		} else if counts != nil && counts.isLimitReached() {
+			return nil, "", checkClaimCounts(session, clientIp, counts)
+		}
+	}
+	return nil, "", nil
 }
 
+// Whitelist returns the catalog for users; defaults of env vars may be secrets, so only their names are included
 func (apiServer *ApiServer) Whitelist() (*WhitelistResponse) {
 	var whitelistResponse = WhitelistResponse{}
-	whitelistResponse.Repos = whitelistRepos
+	for _, repo := range getWhitelistRepos() {
+		whitelistResponse.Repos = append(whitelistResponse.Repos, getPublicWhitelistRepo(repo))
+	}
 	return &whitelistResponse
 }
 
+// Health reports whether the session store can be reached, for liveness and readiness probes
+func (apiServer *ApiServer) Health() (*HealthResponse) {
+	healthResponse := &HealthResponse{Healthy: true, SessionStore: fmt.Sprintf("%T", sessionStore)}
+	if checker, ok := sessionStore.(HealthChecker); ok {
+		if err := checker.Health(); err != nil {
+			healthResponse.Healthy = false
+			healthResponse.Error = err.Error()
+		}
+	}
+	return healthResponse
+}
+
 func (apiServer *ApiServer) Ping(pingRequest *PingRequest, session *Session) (*PingResponse, error) {
 	var pingResponse = PingResponse{}
-	var environment *Environment
-	for _, element := range apiServer.Environments {
-		if element.ClaimToken == pingRequest.ClaimToken {
-			environment = element
-			break
+	syncEnvironments(apiServer)
+	environment := findEnvironmentByClaimToken(apiServer, pingRequest.ClaimToken)
+	if environment != nil {
+		err := authorizeClaim(environment, session)
+		if err != nil {
+			return nil, err
 		}
+		touchEnvironment(environment)
 	}
-	if environment == nil {
+	if environment == nil || environment.ClaimToken != pingRequest.ClaimToken {
+		// the claim may have expired on the leader while the activity was saved
 		pingResponse.ClaimGranted = false
 		pingResponse.Up = false
 	} else {
-		environment.LastActivity = time.Now().Unix()
 		pingResponse.ClaimGranted = true
 		pingResponse.Up = environment.Status == StatusRunning
 		pingResponse.Repo = environment.Repo
 		pingResponse.Branch = environment.Branch
+		pingResponse.Tag = environment.Tag
+		pingResponse.PullRequest = environment.PullRequest
+		pingResponse.Commit = environment.Commit
 		if pingResponse.Up && pingRequest.GetEnvDetails {
 			// make sure to check if it is really running
 			exists, err := isEnvDeployed(environment.Id, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 			if err != nil {
-				log.Println("Error querying Kubernetes: ", err)
-				return nil, err
+				logPrintln("Error querying Kubernetes: ", err)
+				return nil, ErrBackendUnavailable.WithCause(err)
 			}
 			pingResponse.Up = exists
 			if exists {
 				pingResponse.EnvDetails = getEnvUpResponse(environment.Details, session)
 			} else {
-				environment.Status = StatusClaimed
-				environment.Repo = ""
-				environment.Branch = ""
-				environment.Details = nil
-				environment.Props = nil
+				sessionId := environment.SessionId
+				err = updateEnvironment(environment, func(environment *Environment) bool {
+					if environment.ClaimToken != pingRequest.ClaimToken || environment.Status != StatusRunning {
+						return false
+					}
+					environment.Status = StatusClaimed
+					clearEnvDeployment(environment)
+					return true
+				})
+				if err == nil {
+					clearEnvSession(sessionId, environment.Id)
+				}
 			}
 		}
 	}
@@ -131,98 +233,225 @@ func (apiServer *ApiServer) Info(envInfoRequest *EnvInfoRequest, session *Sessio
 	if envInfoRequest.Branch == "" {
 		envInfoRequest.Branch = DefaultBranch
 	}
-	if whitelistRepos != nil {
-		repoWhitelisted := false
-		for _, element := range whitelistRepos {
-			if envInfoRequest.Repo == element.Url && envInfoRequest.Branch == element.Branch {
-				repoWhitelisted = true
-				break
-			}
-		}
-		if ! repoWhitelisted {
-			log.Println("Info request failed; repo not whitelisted.")
-			return nil, errors.New("requested repo not whitelisted")
-		}
+	ref := getRequestedRef(envInfoRequest.Branch, envInfoRequest.Tag, envInfoRequest.PullRequest, envInfoRequest.Commit)
+	if ! IsRepoAllowed(envInfoRequest.Repo, ref) {
+		logPrintln("Info request failed; repo not whitelisted.")
+		return nil, ErrRepoNotAllowed
+	}
+	envVars, err := getCatalogEnvVars(getWhitelistRepo(envInfoRequest.Repo, ref), envInfoRequest.EnvVars)
+	if err != nil {
+		logPrintf("Info request failed; %v\n", err)
+		return nil, ErrEnvVarNotAllowed.WithMessage("%v", err)
+	}
+	repo := &DeploymentRepo{
+		Repo: envInfoRequest.Repo,
+		Branch: envInfoRequest.Branch,
+		Tag: envInfoRequest.Tag,
+		PullRequest: envInfoRequest.PullRequest,
+		Commit: envInfoRequest.Commit,
+		Username: envInfoRequest.Username,
+		Password: envInfoRequest.Password,
+		ComposePath: envInfoRequest.ComposePath,
+		ComposeFiles: envInfoRequest.ComposeFiles,
+		Profiles: envInfoRequest.Profiles,
+		EnvVars: envVars,
+	}
+	err = applyGitCredential(repo, envInfoRequest.Credential)
+	if err != nil {
+		logPrintf("Info request failed; invalid git credential: %v\n", err)
+		return nil, ErrCredentialInvalid.WithCause(err)
 	}
-	// create response
-	var envInfoResponse = EnvInfoResponse{}
-	return &envInfoResponse, nil
+	err = resolveRepoCommit(repo)
+	if err != nil {
+		logPrintf("Info request failed; unable to resolve ref: %v\n", err)
+		return nil, ErrRefNotFound.WithCause(err)
+	}
+	// nothing is claimed or deployed; the repo is only read
+	return analyzeRepo(repo), nil
 }
 
 func (apiServer *ApiServer) Up(envUpRequest *EnvUpRequest, session *Session) (*EnvUpResponse, error) {
 	if envUpRequest.Branch == "" {
 		envUpRequest.Branch = DefaultBranch
 	}
-	var environment *Environment
-	for _, element := range apiServer.Environments {
-		if element.ClaimToken == envUpRequest.ClaimToken {
-			environment = element
-			break
-		}
+	if err := checkUpRate(session, envUpRequest.ClientIp); err != nil {
+		return nil, err
 	}
+	syncEnvironments(apiServer)
+	environment := findEnvironmentByClaimToken(apiServer, envUpRequest.ClaimToken)
 	if environment == nil {
-		log.Println("Up request failed; claim no longer valid.")
-		return nil, errors.New("invalid claim token")
+		logPrintln("Up request failed; claim no longer valid.")
+		return nil, ErrClaimInvalid
+	} else if err := authorizeClaim(environment, session); err != nil {
+		return nil, err
 	} else {
-		if whitelistRepos != nil {
-			repoWhitelisted := false
-			for _, element := range whitelistRepos {
-				if envUpRequest.Repo == element.Url && envUpRequest.Branch == element.Branch {
-					repoWhitelisted = true
-					break
-				}
-			}
-			if ! repoWhitelisted {
-				log.Println("Up request failed; repo not whitelisted.")
-				return nil, errors.New("requested repo not whitelisted")
-			}
+		ref := getRequestedRef(envUpRequest.Branch, envUpRequest.Tag, envUpRequest.PullRequest, envUpRequest.Commit)
+		if ! IsRepoAllowed(envUpRequest.Repo, ref) {
+			logPrintln("Up request failed; repo not whitelisted.")
+			return nil, ErrRepoNotAllowed
+		}
+		whitelistRepo := getWhitelistRepo(envUpRequest.Repo, ref)
+		envVars, err := getCatalogEnvVars(whitelistRepo, envUpRequest.EnvVars)
+		if err != nil {
+			logPrintf("Up request failed; %v\n", err)
+			return nil, ErrEnvVarNotAllowed.WithMessage("%v", err)
+		}
+		// resolve the requested ref now, so compose parsing and the checkout in the pod use the same commit
+		repo := &DeploymentRepo{
+			Repo: envUpRequest.Repo,
+			Branch: envUpRequest.Branch,
+			Tag: envUpRequest.Tag,
+			PullRequest: envUpRequest.PullRequest,
+			Commit: envUpRequest.Commit,
+			Username: envUpRequest.Username,
+			Password: envUpRequest.Password,
+			ComposePath: envUpRequest.ComposePath,
+			ComposeFiles: envUpRequest.ComposeFiles,
+			Profiles: envUpRequest.Profiles,
+			EnvVars: envVars,
+		}
+		if whitelistRepo != nil {
+			repo.ResourceProfile = whitelistRepo.ResourceProfile
+			repo.Pool = whitelistRepo.Pool
+			repo.ShareServerCredential = whitelistRepo.ShareGitCredential
+		}
+		err = applyGitCredential(repo, envUpRequest.Credential)
+		if err != nil {
+			logPrintf("Up request failed; invalid git credential: %v\n", err)
+			return nil, ErrCredentialInvalid.WithCause(err)
+		}
+		err = resolveRepoCommit(repo)
+		if err != nil {
+			logPrintf("Up request failed; unable to resolve ref: %v\n", err)
+			return nil, ErrRefNotFound.WithCause(err)
+		}
+		manifest, err := loadRepoManifest(repo)
+		if err != nil {
+			logPrintf("Up request failed; unable to load manifest: %v\n", err)
+			return nil, ErrManifestInvalid.WithCause(err)
 		}
+		applyRepoManifest(repo, manifest)
+		// variables without values are fine here, as long as they're requested; they're checked against the schema
+		project, _, err := analyzeDockerCompose(repo)
+		if err != nil {
+			logPrintf("Up request failed; unable to load compose files: %v\n", err)
+			// compose errors are the repo's, anything else is the repo host's
+			return nil, toApiError(err, ErrBackendUnavailable)
+		}
+		schemas := getEnvVarSchema(manifest, project, project.DotEnv)
+		envVars, err = validateEnvVars(schemas, envUpRequest.EnvVars, envVars)
+		if err != nil {
+			logPrintf("Up request failed; %v\n", err)
+			return nil, ErrEnvVarsInvalid.WithCause(err).WithDetails(err)
+		}
+		repo.EnvVars = envVars
 		// create response
 		var envUpResponse *EnvUpResponse
-		log.Printf("Checking if deployment exists for env %s...\n", environment.Id)
+		logPrintf("Checking if deployment exists for env %s...\n", environment.Id)
 		exists, err := isEnvDeployed(environment.Id, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 		if err != nil {
-			log.Printf("Error checking if deployment exists for env %s: %s\n", environment.Id, err)
-			return nil, errors.New("unable to find deployment")
+			logPrintf("Error checking if deployment exists for env %s: %s\n", environment.Id, err)
+			return nil, ErrBackendUnavailable.WithCause(err)
 		} else if exists {
-			log.Printf("Env deployed for claim %s.\n", environment.Id)
+			logPrintf("Env deployed for claim %s.\n", environment.Id)
 			// mw:commented out to allow re-deployment
 			//if environment.Status == StatusRunning && strings.EqualFold(envUpRequest.Repo, environment.Repo) && strings.EqualFold(envUpRequest.Branch, environment.Branch) {
-			//	log.Println("Returning existing environment details...")
+			//	logPrintln("Returning existing environment details...")
 			//	envUpResponse = getEnvUpResponse(environment.Details, session)
 			//}
 		}
 		if envUpResponse == nil {
-			log.Printf("Creating new deployment...")
+			logPrintf("Creating new deployment...")
 			// change status to claimed, so the scheduler doesn't think it has stopped when the old repo is shutdown
-			environment.Status = StatusClaimed
-			repo := &DeploymentRepo{
-				Repo: envUpRequest.Repo,
-				Branch: envUpRequest.Branch,
-				Username: envUpRequest.Username,
-				Password: envUpRequest.Password,
+			err = updateEnvironment(environment, func(environment *Environment) bool {
+				if environment.ClaimToken != envUpRequest.ClaimToken {
+					return false
+				}
+				environment.Status = StatusClaimed
+				return true
+			})
+			if errors.Is(err, ErrConflict) {
+				logPrintln("Up request failed; claim no longer valid.")
+				return nil, ErrClaimInvalid
+			} else if err != nil {
+				return nil, ErrBackendUnavailable.WithCause(err)
 			}
-			details, err := deployEnv(session, apiServer.EnvManager, minienvVersion, environment.Id, environment.ClaimToken, nodeNameOverride, nodeHostProtocol, repo, envUpRequest.EnvVars, storageDriver, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+			details, err := deployEnv(session, apiServer.EnvManager, minienvVersion, environment.Id, environment.ClaimToken, nodeNameOverride, nodeHostProtocol, repo, envVars, storageDriver, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 			if err != nil || details == nil {
-				log.Print("Error creating deployment: ", err)
-				return nil, errors.New("error creating deployment")
+				logPrint("Error creating deployment: ", err)
+				if err == nil {
+					return nil, ErrDeploymentFailed
+				}
+				// compose errors are the repo's, anything else is ours
+				return nil, toApiError(err, ErrDeploymentFailed)
 			} else {
-				envUpResponse = getEnvUpResponse(details, session)
-				environment.Status = StatusRunning
-				environment.Repo = envUpRequest.Repo
-				environment.Branch = envUpRequest.Branch
-				environment.Details = details
-				if envUpRequest.ExpirationSeconds >= 0 {
-					environment.ExpirationSeconds = envUpRequest.ExpirationSeconds
-				} else {
-					environment.ExpirationSeconds = DefaultEnvExpirationSeconds
+				err = updateEnvironment(environment, func(environment *Environment) bool {
+					if environment.ClaimToken != envUpRequest.ClaimToken {
+						return false
+					}
+					environment.Status = StatusRunning
+					environment.Repo = envUpRequest.Repo
+					environment.Branch = envUpRequest.Branch
+					environment.Tag = envUpRequest.Tag
+					environment.PullRequest = envUpRequest.PullRequest
+					environment.Commit = repo.Commit
+					environment.GitCredsSecret = getEnvGitCredsSecretNameIfRequired(environment.Id, repo)
+					if session != nil {
+						environment.SessionId = session.Id
+					}
+					environment.Details = details
+					environment.ExpirationSeconds = getCatalogExpirationSeconds(whitelistRepo, envUpRequest.ExpirationSeconds)
+					return true
+				})
+				if errors.Is(err, ErrConflict) {
+					// the claim expired while deploying
+					logPrintf("Up request failed; claim on env %s expired during deployment.\n", environment.Id)
+					deleteEnv(environment.Id, envUpRequest.ClaimToken, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+					return nil, ErrClaimInvalid
 				}
+				envUpResponse = getEnvUpResponse(details, session)
 			}
 		}
 		return envUpResponse, nil
 	}
 }
 
+// Down tears down the environment and releases the claim; the environment is re-provisioned for the next claim
+func (apiServer *ApiServer) Down(envDownRequest *EnvDownRequest, session *Session) (error) {
+	syncEnvironments(apiServer)
+	environment := findEnvironmentByClaimToken(apiServer, envDownRequest.ClaimToken)
+	if environment == nil {
+		logPrintln("Down request failed; claim no longer valid.")
+		return ErrClaimInvalid
+	}
+	err := authorizeClaim(environment, session)
+	if err != nil {
+		return err
+	}
+	logPrintf("Releasing environment %s...\n", environment.Id)
+	err = recycleEnvironment(apiServer, environment, func(environment *Environment) bool {
+		return environment.ClaimToken == envDownRequest.ClaimToken
+	})
+	if errors.Is(err, ErrConflict) {
+		return ErrClaimInvalid
+	} else if err != nil {
+		return ErrBackendUnavailable.WithCause(err)
+	}
+	return nil
+}
+
+// getRequestedRef returns the ref a request is for, as compared against the whitelist branch
+func getRequestedRef(branch string, tag string, pullRequest int, commit string) string {
+	if commit != "" {
+		return commit
+	} else if pullRequest > 0 {
+		return fmt.Sprintf("pull/%d", pullRequest)
+	} else if tag != "" {
+		return tag
+	}
+	return branch
+}
+
 func getEnvUpResponse(details *DeploymentDetails, session *Session) (*EnvUpResponse) {
 	sessionIdStr := ""
 	if session != nil {
@@ -231,18 +460,28 @@ func getEnvUpResponse(details *DeploymentDetails, session *Session) (*EnvUpRespo
 		session.EnvServiceName = getEnvServiceName(details.EnvId, details.ClaimToken)
 		sessionStore.SetSession(session.Id, session)
 	}
+	// the proxies check the token is for the session in the host name
+	accessToken, err := issueAccessToken(details.EnvId, details.ClaimToken, sessionIdStr, getEnvAccessPorts(details))
+	if err != nil {
+		logPrintf("Error issuing access token for env %s: %v\n", details.EnvId, err)
+	}
+	// the proxies in the environment expect host names of <hex time>-<session id>-<port>, as before access
+	// tokens; the time makes the host names of each env new to the browser, so no cookies or cached pages of
+	// an earlier env are sent to it. The token's session is the id after the time.
 	sessionIdStr = strconv.FormatInt(int64(time.Now().Unix()), 16) + "-" + sessionIdStr
 	envUpResponse := &EnvUpResponse{}
-	envUpResponse.LogUrl = strings.Replace(details.LogUrl, "$sessionId", sessionIdStr, -1)
-	envUpResponse.EditorUrl = strings.Replace(details.EditorUrl, "$sessionId", sessionIdStr, -1)
+	envUpResponse.LogUrl = addAccessToken(strings.Replace(details.LogUrl, "$sessionId", sessionIdStr, -1), accessToken)
+	envUpResponse.EditorUrl = addAccessToken(strings.Replace(details.EditorUrl, "$sessionId", sessionIdStr, -1), accessToken)
 	envUpResponse.Tabs = []DeploymentTab{}
 	if details.Tabs != nil {
 		for _, element := range *details.Tabs {
 			tab := DeploymentTab{
 				Port: element.Port,
-				Url: strings.Replace(element.Url, "$sessionId", sessionIdStr, -1),
+				Url: addAccessToken(strings.Replace(element.Url, "$sessionId", sessionIdStr, -1), accessToken),
+				Hide: element.Hide,
 				Name: element.Name,
 				Path: element.Path,
+				Service: element.Service,
 			}
 			envUpResponse.Tabs = append(envUpResponse.Tabs, tab)
 		}
@@ -273,14 +512,35 @@ func (apiServer *ApiServer) Init() {
 	if apiServer.EnvManager == nil {
 		apiServer.EnvManager = NewBaseKubeEnvManager()
 	}
+	gitCredsInUrl, _ = strconv.ParseBool(os.Getenv("MINIENV_GIT_CREDS_IN_URL"))
+	if err := checkDeploymentYamlTemplate(apiServer.EnvManager.GetDeploymentYamlTemplate()); err != nil {
+		logFatalf("Invalid deployment template: %v\n", err)
+	}
 	minienvVersion = os.Getenv("MINIENV_VERSION")
-	redisAddress := os.Getenv("MINIENV_REDIS_ADDRESS")
-	redisPassword := os.Getenv("MINIENV_REDIS_PASSWORD")
-	redisDb := os.Getenv("MINIENV_REDIS_DB")
-	if redisAddress != "" {
-		redisSessionStore, err := NewRedisSessionStore(redisAddress, redisPassword, redisDb)
+	setLogRedactedEnvVars(append(DefaultRedactedEnvVars, splitList(os.Getenv("MINIENV_LOG_REDACT_ENV_VARS"))...))
+	if i, err := strconv.ParseInt(os.Getenv("MINIENV_SESSION_TTL_SECONDS"), 10, 64); err == nil {
+		// 0 disables expiration
+		sessionTtlSeconds = i
+	}
+	if i, err := strconv.Atoi(os.Getenv("MINIENV_SESSION_MAX_COUNT")); err == nil {
+		// 0 for no limit
+		sessionMaxCount = i
+	}
+	if path := getFileSessionStorePath(os.Getenv("MINIENV_SESSION_STORE")); path != "" {
+		fileSessionStore, err := NewFileSessionStore(path)
 		if err != nil {
-			sessionStore = nil
+			logFatalf("Error opening session store: %v\n", err)
+		}
+		sessionStore = fileSessionStore
+	}
+	if sessionStore == nil && os.Getenv("MINIENV_REDIS_ADDRESS") != "" {
+		// when strict, a redis that's misconfigured or down stops the server instead of falling back to memory
+		redisStrict, _ := strconv.ParseBool(os.Getenv("MINIENV_REDIS_STRICT"))
+		redisSessionStore, err := initRedisSessionStore()
+		if err != nil && redisStrict {
+			logFatalf("Error connecting to Redis: %v\n", err)
+		} else if err != nil {
+			logPrintf("WARNING: Error connecting to Redis, sessions and state will only be kept in memory: %v\n", err)
 		} else {
 			sessionStore = redisSessionStore
 		}
@@ -288,12 +548,43 @@ func (apiServer *ApiServer) Init() {
 	if sessionStore == nil {
 		sessionStore = NewInMemorySessionStore()
 	}
+	if store, ok := sessionStore.(StateStore); ok {
+		stateStore = store
+	} else {
+		stateStore = NewInMemorySessionStore()
+	}
+	adminToken = os.Getenv("MINIENV_ADMIN_TOKEN")
+	addLogRedactedValue(adminToken)
+	keys, err := parseAccessTokenKeys(os.Getenv("MINIENV_ACCESS_TOKEN_KEYS"))
+	if err != nil {
+		logFatalf("Error parsing access token keys: %v\n", err)
+	} else if len(keys) > 0 {
+		for _, key := range keys {
+			addLogRedactedValue(string(key.Secret))
+		}
+		accessTokenKeys = keys
+	} else {
+		key, err := loadGeneratedAccessTokenKey()
+		if err != nil {
+			logFatalf("Error loading access token key: %v\n", err)
+		}
+		accessTokenKeys = []*AccessTokenKey{key}
+	}
+	if i, err := strconv.ParseInt(os.Getenv("MINIENV_ACCESS_TOKEN_SECONDS"), 10, 64); err == nil && i > 0 {
+		accessTokenSeconds = i
+	}
+	claimQueueEnabled, _ = strconv.ParseBool(os.Getenv("MINIENV_CLAIM_QUEUE"))
+	initClaimLimits()
+	if i, err := strconv.Atoi(os.Getenv("MINIENV_CLAIM_QUEUE_MAX")); err == nil && i > 0 {
+		claimQueueMax = i
+	}
 	kubeServiceProtocol := os.Getenv("KUBERNETES_SERVICE_PROTOCOL")
 	kubeServiceHost := os.Getenv("KUBERNETES_SERVICE_HOST")
 	kubeServicePort := os.Getenv("KUBERNETES_SERVICE_PORT")
 	kubeServiceTokenPathEnv := os.Getenv("KUBERNETES_TOKEN_PATH")
 	if len(kubeServiceTokenPathEnv) > 0 {
 		kubeServiceToken = loadFile(kubeServiceTokenPathEnv)
+		addLogRedactedValue(kubeServiceToken)
 	} else {
 		kubeServiceToken = ""
 	}
@@ -316,41 +607,63 @@ func (apiServer *ApiServer) Init() {
 		storageDriver = "aufs"
 	}
 	allowOrigin = os.Getenv("MINIENV_ALLOW_ORIGIN")
+	// relative to the root of the repo
+	composePath = strings.Trim(os.Getenv("MINIENV_COMPOSE_PATH"), "/")
+	composeFiles = splitList(os.Getenv("MINIENV_COMPOSE_FILES"))
+	repoProviderHosts = parseRepoProviderHosts(os.Getenv("MINIENV_REPO_PROVIDERS"))
+	if i, err := strconv.ParseInt(os.Getenv("MINIENV_GIT_FETCH_MAX_BYTES"), 10, 64); err == nil {
+		// 0 for no limit
+		gitFetchMaxBytes = i
+	}
+	if i, err := strconv.ParseInt(os.Getenv("MINIENV_GIT_CACHE_MAX_BYTES"), 10, 64); err == nil && i > 0 {
+		gitCacheMaxBytes = i
+	}
+	gitCredentialsFile := os.Getenv("MINIENV_GIT_CREDENTIALS_FILE")
+	if gitCredentialsFile != "" {
+		credentials, err := loadGitCredentials(gitCredentialsFile)
+		if err != nil {
+			logFatalf("Error loading git credentials: %v\n", err)
+		}
+		gitCredentials = credentials
+	}
 	envCount := 1
 	if i, err := strconv.Atoi(os.Getenv("MINIENV_PROVISION_COUNT")); err == nil {
 		envCount = i
 	}
-	whitelistReposStr := os.Getenv("MINIENV_REPO_WHITELIST")
-	if whitelistReposStr == "" {
-		whitelistRepos = nil
+	whitelistEnforced, _ = strconv.ParseBool(os.Getenv("MINIENV_WHITELIST_ENFORCE"))
+	repoCatalogFile = os.Getenv("MINIENV_REPO_CATALOG_FILE")
+	if repoCatalogFile != "" {
+		// the catalog replaces MINIENV_REPO_WHITELIST and MINIENV_REPO_DENYLIST
+		err := reloadRepoCatalog(true)
+		if err != nil {
+			logFatalf("Error loading repo catalog: %v\n", err)
+		}
+		startRepoCatalogReloadTimer()
 	} else {
-		whitelistRepoStrs := strings.Split(whitelistReposStr, ",")
-		if len(whitelistRepoStrs) <= 0 {
-			whitelistRepos = nil
-		} else {
-			whitelistRepos = []*WhitelistRepo{}
-			var name string
-			var url string
-			var branch string
-			for _, element := range whitelistRepoStrs {
-				elementStrs := strings.Split(element, "|")
-				if len(elementStrs) >= 2 {
-					name = elementStrs[0]
-					url = elementStrs[1]
-					if len(elementStrs) == 3 {
-						branch = elementStrs[2]
-					} else {
-						branch = DefaultBranch
-					}
-				} else {
-					name = element
-					url = element
-					branch = DefaultBranch
-				}
-				whitelistRepo := &WhitelistRepo{Name: name, Url: url, Branch: branch}
-				whitelistRepos = append(whitelistRepos, whitelistRepo)
-			}
+		whitelist, err := parseWhitelistRepos(os.Getenv("MINIENV_REPO_WHITELIST"))
+		if err != nil {
+			logFatalf("Error parsing repo whitelist: %v\n", err)
 		}
+		denylist, err := parseWhitelistRepos(os.Getenv("MINIENV_REPO_DENYLIST"))
+		if err != nil {
+			logFatalf("Error parsing repo denylist: %v\n", err)
+		}
+		setWhitelistRepos(whitelist, denylist)
+	}
+	err = syncManagedWhitelistRepos()
+	if err != nil {
+		logPrintf("Error loading whitelist from state store: %v\n", err)
+	}
+	if _, ok := stateStore.(*InMemorySessionStore); ! ok {
+		// other api servers may change the whitelist
+		startWhitelistSyncTimer()
+	}
+	initLeaderElection()
+	if isLeader() {
+		initEnvironments(apiServer, envCount)
+	} else {
+		// the leader reconciles the pool with the cluster
+		loadEnvironmentPool(apiServer, envCount)
 	}
-	initEnvironments(apiServer, envCount)
+	startEnvironmentCheckTimer(apiServer)
 }
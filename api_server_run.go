@@ -2,8 +2,8 @@ package minienv
 
 import (
 	"io/ioutil"
-	"log"
 	"strconv"
+	"strings"
 	"time"
 
 )
@@ -29,53 +29,126 @@ var nodeHostProtocol string
 var storageDriver string
 var allowOrigin string
 var whitelistRepos []*WhitelistRepo
+var composePath string
+var composeFiles []string
 
 func loadFile(fp string) string {
 	b, err := ioutil.ReadFile(fp) // just pass the file name
 	if err != nil {
-		log.Fatalf("Cannot read file")
+		logFatalf("Cannot read file")
 	}
 	return string(b)
 }
 
+// splitList splits a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, element := range strings.Split(s, ",") {
+		element = strings.TrimSpace(element)
+		if element != "" {
+			list = append(list, element)
+		}
+	}
+	return list
+}
+
+// initEnvironments reconciles the pool with the cluster, for the leader; it works on the pool directly, as
+// nothing else uses it yet
 func initEnvironments(apiServer *ApiServer, envCount int) {
-	log.Printf("Provisioning %d environments...\n", envCount)
+	logPrintf("Provisioning %d environments...\n", envCount)
+	savedEnvironments, err := loadEnvironments()
+	if err != nil {
+		logPrintf("Error loading saved environments: %v\n", err)
+	}
 	for i := 0; i < envCount; i++ {
 		environment := &Environment{Id: strconv.Itoa(i + 1)}
+		savedEnvironment := savedEnvironments[environment.Id]
+		if savedEnvironment != nil {
+			// saves replace the saved version, whichever state the environment ends up in
+			environment.Version = savedEnvironment.Version
+			environment.savedState = savedEnvironment.savedState
+		}
 		apiServer.Environments = append(apiServer.Environments, environment)
 		// check if environment running
 		getDeploymentResp, err := getEnvDeployment(environment.Id, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 		running := false
 		if err == nil && getDeploymentResp != nil {
-			log.Printf("Loading running environment %s...\n", environment.Id)
+			logPrintf("Loading running environment %s...\n", environment.Id)
+			var annotations *GetDeploymentSpecTemplateMetadataAnnotation
 			if getDeploymentResp.Spec != nil &&
 				getDeploymentResp.Spec.Template != nil &&
-				getDeploymentResp.Spec.Template.Metadata != nil &&
-				getDeploymentResp.Spec.Template.Metadata.Annotations != nil &&
-				getDeploymentResp.Spec.Template.Metadata.Annotations.Repo != "" &&
-				getDeploymentResp.Spec.Template.Metadata.Annotations.RepoWithCreds != "" &&
-				getDeploymentResp.Spec.Template.Metadata.Annotations.ClaimToken != "" &&
-				getDeploymentResp.Spec.Template.Metadata.Annotations.EnvDetails != "" {
-				log.Printf("Loading environment %s from deployment metadata.\n", environment.Id)
+				getDeploymentResp.Spec.Template.Metadata != nil {
+				annotations = getDeploymentResp.Spec.Template.Metadata.Annotations
+			}
+			if savedEnvironment != nil &&
+				savedEnvironment.Status == StatusRunning &&
+				(annotations == nil || annotations.ClaimToken == "" || annotations.ClaimToken == savedEnvironment.ClaimToken) {
+				logPrintf("Loading environment %s from saved state.\n", environment.Id)
 				running = true
-				details  := apiServer.EnvManager.DeserializeDeploymentDetails(getDeploymentResp.Spec.Template.Metadata.Annotations.EnvDetails)
+				*environment = *savedEnvironment
+				if environment.Details == nil && annotations != nil && annotations.EnvDetails != "" {
+					environment.Details = apiServer.EnvManager.DeserializeDeploymentDetails(annotations.EnvDetails)
+				}
+			} else if annotations != nil &&
+				annotations.Repo != "" &&
+				annotations.ClaimToken != "" &&
+				annotations.EnvDetails != "" {
+				logPrintf("Loading environment %s from deployment metadata.\n", environment.Id)
+				running = true
+				details  := apiServer.EnvManager.DeserializeDeploymentDetails(annotations.EnvDetails)
 				environment.Status = StatusRunning
-				environment.ClaimToken = getDeploymentResp.Spec.Template.Metadata.Annotations.ClaimToken
+				environment.ClaimToken = annotations.ClaimToken
 				environment.LastActivity = time.Now().Unix()
-				environment.Repo = getDeploymentResp.Spec.Template.Metadata.Annotations.Repo
-				environment.RepoWithCreds = getDeploymentResp.Spec.Template.Metadata.Annotations.RepoWithCreds
-				environment.Branch = getDeploymentResp.Spec.Template.Metadata.Annotations.Branch
+				environment.Repo = annotations.Repo
+				// credentials stay in the secret; only its name is kept
+				environment.GitCredsSecret = annotations.GitCredsSecret
+				environment.Branch = annotations.Branch
+				environment.Commit = annotations.Commit
 				environment.Details = details
 			} else {
-				log.Printf("Insufficient deployment metadata for environment %s.\n", environment.Id)
-				deleteEnv(environment.Id, environment.ClaimToken, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+				logPrintf("Insufficient deployment metadata for environment %s.\n", environment.Id)
+				claimToken := ""
+				if annotations != nil && annotations.ClaimToken != "" {
+					claimToken = annotations.ClaimToken
+				} else if savedEnvironment != nil {
+					claimToken = savedEnvironment.ClaimToken
+				}
+				deleteEnv(environment.Id, claimToken, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 			}
+		} else if err == nil && savedEnvironment != nil && savedEnvironment.Status == StatusClaimed && isEnvProvisioned(environment.Id, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace) {
+			// claimed, but not deployed yet; the claim expires as usual unless the client is still pinging
+			logPrintf("Loading claimed environment %s from saved state.\n", environment.Id)
+			running = true
+			*environment = *savedEnvironment
+			environment.LastActivity = time.Now().Unix()
+		} else if savedEnvironment != nil && savedEnvironment.Status == StatusRunning {
+			logPrintf("Environment %s no longer deployed.\n", environment.Id)
+			clearEnvSession(savedEnvironment.SessionId, savedEnvironment.Id)
 		}
 		if ! running {
-			log.Printf("Provisioning environment %s...\n", environment.Id)
+			logPrintf("Provisioning environment %s...\n", environment.Id)
 			environment.Status = StatusProvisioning
 			deployProvisioner(apiServer.EnvManager, minienvVersion, environment.Id, nodeNameOverride, storageDriver, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 		}
+		saveEnvironment(environment)
+	}
+	sessionIds, err := findEnvSessionIds()
+	if err != nil {
+		logPrintf("Error finding sessions of running environments: %v\n", err)
+	}
+	for _, environment := range apiServer.Environments {
+		if environment.Status == StatusRunning && environment.SessionId == "" {
+			environment.SessionId = sessionIds[environment.Id]
+			if environment.SessionId != "" {
+				saveEnvironment(environment)
+			}
+		}
+	}
+	// forget environments beyond the pool size
+	for envId := range savedEnvironments {
+		if i, err := strconv.Atoi(envId); err != nil || i < 1 || i > envCount {
+			deleteEnvironmentState(envId)
+		}
 	}
 	// scale down, if necessary
 	i := envCount
@@ -84,7 +157,7 @@ func initEnvironments(apiServer *ApiServer, envCount int) {
 		pvcName := getPersistentVolumeClaimName(envId)
 		response, _ := getPersistentVolumeClaim(pvcName, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 		if response != nil {
-			log.Printf("De-provisioning environment %s...\n", envId)
+			logPrintf("De-provisioning environment %s...\n", envId)
 			// get the deployment in order to find the claim token
 			getDeploymentResp, err := getEnvDeployment(envId, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 			if err == nil &&
@@ -114,71 +187,125 @@ func initEnvironments(apiServer *ApiServer, envCount int) {
 	checkEnvironments(apiServer)
 }
 
+// recycleEnvironment tears down the environment and re-provisions it, if check still holds for its latest version
+func recycleEnvironment(apiServer *ApiServer, environment *Environment, check func(environment *Environment) bool) (error) {
+	claimToken := ""
+	sessionId := ""
+	err := updateEnvironment(environment, func(environment *Environment) bool {
+		if ! check(environment) {
+			return false
+		}
+		claimToken = environment.ClaimToken
+		sessionId = environment.SessionId
+		resetEnvironment(environment)
+		environment.Status = StatusProvisioning
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	clearEnvSession(sessionId, environment.Id)
+	deleteEnv(environment.Id, claimToken, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+	logPrintf("Re-provisioning environment %s...\n", environment.Id)
+	deployProvisioner(apiServer.EnvManager, minienvVersion, environment.Id, nodeNameOverride, storageDriver, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+	return err
+}
+
 func startEnvironmentCheckTimer(apiServer *ApiServer) {
 	timer := time.NewTimer(time.Second * time.Duration(CheckEnvTimerSeconds))
 	go func() {
 		<-timer.C
-		checkEnvironments(apiServer)
+		if isLeader() {
+			checkEnvironments(apiServer)
+		} else {
+			// keep up with the leader, so a new leader starts from the latest state
+			syncEnvironments(apiServer)
+		}
+		startEnvironmentCheckTimer(apiServer)
 	}()
 }
 
 func checkEnvironments(apiServer *ApiServer) {
-	for i := 0; i < len(apiServer.Environments); i++ {
-		environment := apiServer.Environments[i]
-		log.Printf("Checking environment %s; current status=%d\n", environment.Id, environment.Status)
-		if environment.Status == StatusProvisioning {
+	// pick up claims and activity handled by other api servers
+	syncEnvironments(apiServer)
+	for _, environment := range getEnvironments(apiServer) {
+		logPrintf("Checking environment %s; current status=%d\n", environment.Id, environment.Status)
+		if environment.Status == StatusProvisioning && environment.savedState == nil {
+			// added by an api server that wasn't the leader, and never saved by the leader
+			provisionEnvironment(apiServer, environment)
+		} else if environment.Status == StatusProvisioning {
 			running, err := isProvisionerRunning(environment.Id, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 			if err != nil {
-				log.Println("Error checking provisioner status.", err)
+				logPrintln("Error checking provisioner status.", err)
 			} else if ! running {
-				log.Printf("Environment %s provisioning complete.\n", environment.Id)
-				environment.Status = StatusIdle
+				err = updateEnvironment(environment, func(environment *Environment) bool {
+					if environment.Status != StatusProvisioning {
+						return false
+					}
+					environment.Status = StatusIdle
+					return true
+				})
+				if err != nil {
+					logPrintf("Environment %s not marked provisioned: %v\n", environment.Id, err)
+					continue
+				}
+				logPrintf("Environment %s provisioning complete.\n", environment.Id)
 				deleteProvisioner(environment.Id, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 			} else {
-				log.Printf("Environment %s still provisioning...\n", environment.Id)
+				logPrintf("Environment %s still provisioning...\n", environment.Id)
 			}
 		} else if environment.Status == StatusRunning {
-			if time.Now().Unix() - environment.LastActivity > DefaultEnvExpirationSeconds {
-				log.Printf("Environment %s no longer active.\n", environment.Id)
-				claimToken := environment.ClaimToken
-				environment.Status = StatusIdle
-				environment.ClaimToken = ""
-				environment.LastActivity = 0
-				environment.Repo = ""
-				environment.Branch = ""
-				environment.Details = nil
-				environment.Props = nil
-				deleteEnv(environment.Id, claimToken, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
-				// re-provision
-				log.Printf("Re-provisioning environment %s...\n", environment.Id)
-				environment.Status = StatusProvisioning
-				deployProvisioner(apiServer.EnvManager, minienvVersion, environment.Id, nodeNameOverride, storageDriver, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+			expirationSeconds := environment.ExpirationSeconds
+			if expirationSeconds <= 0 {
+				expirationSeconds = DefaultEnvExpirationSeconds
+			}
+			if time.Now().Unix() - environment.LastActivity > expirationSeconds {
+				logPrintf("Environment %s no longer active.\n", environment.Id)
+				lastActivity := environment.LastActivity
+				// pinged through another api server if it changed; checked again next time
+				recycleEnvironment(apiServer, environment, func(environment *Environment) bool {
+					return environment.Status == StatusRunning && environment.LastActivity == lastActivity
+				})
 			} else {
-				log.Printf("Checking if environment %s is still deployed...\n", environment.Id)
+				logPrintf("Checking if environment %s is still deployed...\n", environment.Id)
 				deployed, err := isEnvDeployed(environment.Id, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 				if err == nil && ! deployed {
-					log.Printf("Environment %s no longer deployed.\n", environment.Id)
-					environment.Status = StatusIdle
-					environment.ClaimToken = ""
-					environment.LastActivity = 0
-					environment.Repo = ""
-					environment.Branch = ""
-					environment.Details = nil
-					environment.Props = nil
+					logPrintf("Environment %s no longer deployed.\n", environment.Id)
+					sessionId := environment.SessionId
+					resetEnvironment(environment)
+					if saveEnvironment(environment) != nil {
+						continue
+					}
+					clearEnvSession(sessionId, environment.Id)
 				}
 			}
 		}  else if environment.Status == StatusClaimed {
 			if time.Now().Unix() - environment.LastActivity > ExpireClaimNoActivitySeconds {
-				log.Printf("Environment %s claim expired.\n", environment.Id)
-				environment.Status = StatusIdle
-				environment.ClaimToken = ""
-				environment.LastActivity = 0
-				environment.Repo = ""
-				environment.Branch = ""
-				environment.Details = nil
-				environment.Props = nil
+				logPrintf("Environment %s claim expired.\n", environment.Id)
+				sessionId := environment.SessionId
+				resetEnvironment(environment)
+				if saveEnvironment(environment) != nil {
+					continue
+				}
+				clearEnvSession(sessionId, environment.Id)
 			}
 		}
 	}
-	startEnvironmentCheckTimer(apiServer)
-}
\ No newline at end of file
+	promoteClaimTickets(apiServer)
+}
+
+// provisionEnvironment provisions an environment the pool has but the state store doesn't, as initEnvironments
+// does; it's saved first, so only one leader provisions it
+func provisionEnvironment(apiServer *ApiServer, environment *Environment) {
+	err := saveEnvironment(environment)
+	if err != nil {
+		// saved by the previous leader after all; checked again next time
+		logPrintf("Environment %s not provisioned: %v\n", environment.Id, err)
+		return
+	}
+	logPrintf("Provisioning environment %s...\n", environment.Id)
+	err = deployProvisioner(apiServer.EnvManager, minienvVersion, environment.Id, nodeNameOverride, storageDriver, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+	if err != nil {
+		logPrintf("Error provisioning environment %s: %v\n", environment.Id, err)
+	}
+}
@@ -0,0 +1,140 @@
+package minienv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func setTestStateStore(t *testing.T) *InMemorySessionStore {
+	previous := stateStore
+	store := NewInMemorySessionStore()
+	stateStore = store
+	t.Cleanup(func() { stateStore = previous })
+	return store
+}
+
+func setTestKubeServer(t *testing.T, handler http.HandlerFunc) {
+	server := httptest.NewServer(handler)
+	previous := kubeServiceBaseUrl
+	kubeServiceBaseUrl = server.URL
+	t.Cleanup(func() {
+		kubeServiceBaseUrl = previous
+		server.Close()
+	})
+}
+
+func TestPingBackendUnavailable(t *testing.T) {
+	setTestStateStore(t)
+	setTestKubeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("unavailable"))
+	})
+	session := &Session{Id: "s1"}
+	apiServer := &ApiServer{Environments: []*Environment{{Id: "1", Status: StatusRunning, ClaimToken: "claim", ClaimSessionId: session.Id}}}
+	_, err := apiServer.Ping(&PingRequest{ClaimToken: "claim", GetEnvDetails: true}, session)
+	if ! errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Expected %v, got %v", ErrBackendUnavailable, err)
+	}
+	var apiError *ApiError
+	if ! errors.As(err, &apiError) || apiError.Status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %v", http.StatusServiceUnavailable, err)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	repoUrl, shas := newTestGitRepo(t, map[string]string{
+		"minienv.yml": `
+description: Test app
+envVars:
+  - name: API_KEY
+    secret: true
+    required: true
+`,
+		"docker-compose.yml": `
+services:
+  web:
+    image: nginx:${NGINX_TAG:-latest}
+    ports:
+      - "8080:80"
+      - "53:53/udp"
+    environment:
+      DB_URL: ${DB_URL}
+      API_KEY: ${API_KEY}
+      MODE: ${MODE}
+  worker:
+    build: .
+    privileged: true
+`,
+	})
+	setTestWhitelist(t, "App|" + repoUrl + "|master", "")
+	getWhitelistRepos()[0].EnvVars = map[string]string{"DB_URL": "postgres://user:catalog-secret@db"}
+	apiServer := &ApiServer{}
+	response, err := apiServer.Info(&EnvInfoRequest{
+		Repo: repoUrl,
+		Username: "user",
+		Password: "git-password",
+		EnvVars: map[string]string{"API_KEY": "requested-secret"},
+	}, &Session{Id: "s1"})
+	if err != nil {
+		t.Fatalf("Expected info, got %v", err)
+	}
+	if response.Repo != repoUrl || response.Branch != DefaultBranch || response.Commit != shas[0] {
+		t.Errorf("Expected %s at %s, got %s at %s (%s)", repoUrl, shas[0], response.Repo, response.Commit, response.Branch)
+	}
+	if response.Manifest == nil || response.Manifest.Description != "Test app" || fmt.Sprint(response.ComposeFiles) != "[docker-compose.yml]" {
+		t.Errorf("Expected manifest and compose files, got %+v, %v", response.Manifest, response.ComposeFiles)
+	}
+	var services []string
+	for _, service := range response.Services {
+		services = append(services, fmt.Sprintf("%s|%s|%t|%t|%v", service.Name, service.Image, service.Build, service.Privileged, service.Ports))
+	}
+	if fmt.Sprint(services) != "[web|nginx:latest|false|false|[8080 53] worker||true|true|[]]" {
+		t.Errorf("Expected web and worker services, got %v", services)
+	}
+	if len(response.Tabs) != 1 || response.Tabs[0].Service != "web" || response.Tabs[0].Port != 8080 {
+		t.Errorf("Expected a tab for the published tcp port, got %+v", response.Tabs)
+	}
+	// the catalog and the request supply DB_URL and API_KEY
+	if fmt.Sprint(response.RequiredEnvVars) != "[MODE]" {
+		t.Errorf("Expected [MODE] required, got %v", response.RequiredEnvVars)
+	}
+	var envVars []string
+	for _, envVar := range response.EnvVars {
+		envVars = append(envVars, fmt.Sprintf("%s|%s|%t", envVar.Name, envVar.Source, envVar.Secret))
+	}
+	if fmt.Sprint(envVars) != "[API_KEY|manifest|true DB_URL|compose|false MODE|compose|false NGINX_TAG|compose|false]" {
+		t.Errorf("Expected the env var schema, got %v", envVars)
+	}
+	if fmt.Sprint(response.Images) != "[nginx:latest]" {
+		t.Errorf("Expected [nginx:latest], got %v", response.Images)
+	}
+	warnings := strings.Join(response.Warnings, "\n")
+	if ! strings.Contains(warnings, "service 'worker' runs privileged") || ! strings.Contains(warnings, "udp port 53 of service 'web'") {
+		t.Errorf("Expected privileged and udp warnings, got %v", response.Warnings)
+	}
+	// nothing from the catalog, the request or the credentials is reported back
+	data, err := json.Marshal(response)
+	if err != nil {
+		t.Fatalf("Error marshalling response: %v", err)
+	}
+	for _, secret := range []string{"catalog-secret", "git-password", "requested-secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("Expected no '%s' in the response, got %s", secret, data)
+		}
+	}
+}
+
+func TestInfoRepoNotAllowed(t *testing.T) {
+	setTestWhitelist(t, "App|github.com/org/app|master", "")
+	apiServer := &ApiServer{}
+	for _, repo := range []string{"https://github.com/org/other", "file:///tmp/repo"} {
+		if _, err := apiServer.Info(&EnvInfoRequest{Repo: repo}, &Session{Id: "s1"}); ! errors.Is(err, ErrRepoNotAllowed) {
+			t.Errorf("%s: expected %v, got %v", repo, ErrRepoNotAllowed, err)
+		}
+	}
+}
@@ -1,37 +1,175 @@
 package minienv
 
+import "regexp"
+
+// Environment is a slot in the pool; it's saved to the state store on every transition (see env_state.go)
 type Environment struct {
-	Id string
-	Status int
-	ClaimToken string
-	LastActivity int64
-	Repo string
-	RepoWithCreds string
-	Branch string
-	Details *DeploymentDetails
-	ExpirationSeconds int64
-	Props  *map[string]interface{}
+	Id string `json:"id"`
+	// incremented on every save; a save fails if another api server saved a newer version
+	Version int64 `json:"version"`
+	Status int `json:"status"`
+	ClaimToken string `json:"claimToken"`
+	// the session and user that claimed the environment; only they, and the sessions the claim was shared with, may use it
+	ClaimSessionId string `json:"claimSessionId"`
+	ClaimUserId string `json:"claimUserId"`
+	// the address the claim was made from, for the per-ip claim limit
+	ClaimIp string `json:"claimIp"`
+	SharedSessionIds []string `json:"sharedSessionIds"`
+	// outstanding invitations to share or take over the claim
+	ClaimShares []*ClaimShare `json:"claimShares"`
+	// the session that deployed the environment, if known
+	SessionId string `json:"sessionId"`
+	ClaimedAt int64 `json:"claimedAt"`
+	LastActivity int64 `json:"lastActivity"`
+	Repo string `json:"repo"`
+	GitCredsSecret string `json:"gitCredsSecret"`
+	Branch string `json:"branch"`
+	Tag string `json:"tag"`
+	PullRequest int `json:"pullRequest"`
+	Commit string `json:"commit"`
+	Details *DeploymentDetails `json:"details"`
+	ExpirationSeconds int64 `json:"expirationSeconds"`
+	Props  *map[string]interface{} `json:"props"`
+	// the last activity saved, so pings only save it now and then
+	savedActivity int64
+	// the state as last saved or loaded, which a save swaps out
+	savedState []byte
+	// the environment in the pool this is a copy of (see getEnvironments); saving the copy replaces it
+	pooled *Environment
 }
 
 type WhitelistRepo struct {
-	Name string `json:"name"`
-	Url string `json:"url"`
-	Branch string `json:"branch"`
+	Name string `yaml:"name" json:"name"`
+	Url string `yaml:"url" json:"url"`
+	Branch string `yaml:"branch" json:"branch"`
+	Description string `yaml:"description" json:"description,omitempty"`
+	Icon string `yaml:"icon" json:"icon,omitempty"`
+	// defaults for the env vars passed to the deployment, which requests may override; only admins see the values
+	EnvVars map[string]string `yaml:"envVars" json:"envVars,omitempty"`
+	// names of EnvVars, in the public whitelist
+	EnvVarNames []string `yaml:"-" json:"envVarNames,omitempty"`
+	// env vars requests may set; any may be set when nil
+	AllowedEnvVars []string `yaml:"allowedEnvVars" json:"allowedEnvVars,omitempty"`
+	MaxExpirationSeconds int64 `yaml:"maxExpirationSeconds" json:"maxExpirationSeconds,omitempty"`
+	ResourceProfile string `yaml:"resourceProfile" json:"resourceProfile,omitempty"`
+	Pool string `yaml:"pool" json:"pool,omitempty"`
+	// gives server-side git credentials used for the repo to its envs, so pods can fetch it; users can read them
+	ShareGitCredential bool `yaml:"shareGitCredential" json:"shareGitCredential,omitempty"`
+	urlRegexp *regexp.Regexp
+	branchRegexp *regexp.Regexp
 }
 
 type ClaimRequest struct {
+	// polls a place in the claim queue, instead of claiming
+	Ticket string `json:"ticket"`
+	// set by the embedding server (see GetClientIp), for the per-ip limits
+	ClientIp string `json:"-"`
+}
+
+// ClaimShare is an invitation to use a claim; only the hash of its token is kept
+type ClaimShare struct {
+	TokenHash string `json:"tokenHash"`
+	// hand the claim over instead of sharing it
+	Transfer bool `json:"transfer"`
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+type ClaimShareRequest struct {
+	ClaimToken string `json:"claimToken"`
+	Transfer bool `json:"transfer"`
+	ExpirationSeconds int64 `json:"expirationSeconds"`
+}
+
+type ClaimShareResponse struct {
+	ShareToken string `json:"shareToken"`
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+type ClaimAcceptRequest struct {
+	ShareToken string `json:"shareToken"`
 }
 
 type ClaimResponse struct {
 	ClaimGranted bool `json:"claimGranted"`
 	ClaimToken string `json:"claimToken"`
 	Message string `json:"message"`
+	// set when queued; poll with the ticket until the claim is granted
+	Ticket string `json:"ticket,omitempty"`
+	// 1 for the next in line
+	Position int `json:"position,omitempty"`
+	// 0 until enough claims have been promoted to estimate it
+	EstimatedWaitSeconds int64 `json:"estimatedWaitSeconds,omitempty"`
 }
 
 type WhitelistResponse struct {
 	Repos []*WhitelistRepo `json:"repos"`
 }
 
+// WhitelistAdminRequest adds, updates or removes a whitelist entry managed through the admin api;
+// entries are identified by name
+type WhitelistAdminRequest struct {
+	AdminToken string `json:"adminToken"`
+	// who made the change, for the audit
+	Actor string `json:"actor"`
+	Name string `json:"name"`
+	Repo *WhitelistRepo `json:"repo"`
+}
+
+type WhitelistListRequest struct {
+	AdminToken string `json:"adminToken"`
+}
+
+type WhitelistAuditRequest struct {
+	AdminToken string `json:"adminToken"`
+	Count int `json:"count"`
+}
+
+type WhitelistAuditEntry struct {
+	Timestamp int64 `json:"timestamp"`
+	Actor string `json:"actor"`
+	Action string `json:"action"`
+	Name string `json:"name"`
+	Repo *WhitelistRepo `json:"repo"`
+	Previous *WhitelistRepo `json:"previous"`
+}
+
+type WhitelistAuditResponse struct {
+	Entries []*WhitelistAuditEntry `json:"entries"`
+}
+
+type SessionListRequest struct {
+	AdminToken string `json:"adminToken"`
+	Cursor string `json:"cursor"`
+	Count int `json:"count"`
+}
+
+type SessionListResponse struct {
+	Sessions []*Session `json:"sessions"`
+	// pass as the cursor of the next request; empty after the last page
+	Cursor string `json:"cursor"`
+}
+
+type HealthResponse struct {
+	Healthy bool `json:"healthy"`
+	SessionStore string `json:"sessionStore"`
+	Error string `json:"error,omitempty"`
+}
+
+type ClaimLimitStatsRequest struct {
+	AdminToken string `json:"adminToken"`
+}
+
+// ClaimLimitStatsResponse counts the requests refused by the claim limits since the api server started
+type ClaimLimitStatsResponse struct {
+	ClaimsRateLimited int64 `json:"claimsRateLimited"`
+	UpsRateLimited int64 `json:"upsRateLimited"`
+	ClaimsOverSessionLimit int64 `json:"claimsOverSessionLimit"`
+	ClaimsOverUserLimit int64 `json:"claimsOverUserLimit"`
+	ClaimsOverIpLimit int64 `json:"claimsOverIpLimit"`
+	// the rate limit buckets currently tracked
+	RateLimitBuckets int `json:"rateLimitBuckets"`
+}
+
 type PingRequest struct {
 	ClaimToken string `json:"claimToken"`
 	GetEnvDetails bool `json:"getEnvDetails"`
@@ -42,27 +180,73 @@ type PingResponse struct {
 	Up bool `json:"up"`
 	Repo string `json:"repo"`
 	Branch string `json:"branch"`
+	Tag string `json:"tag"`
+	PullRequest int `json:"pullRequest"`
+	Commit string `json:"commit"`
 	EnvDetails *EnvUpResponse `json:"envDetails"`
 }
 
 type EnvInfoRequest struct {
 	Repo string `json:"repo"`
 	Branch string `json:"branch"`
+	Tag string `json:"tag"`
+	PullRequest int `json:"pullRequest"`
+	Commit string `json:"commit"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Credential string `json:"credential"`
+	ComposePath string `json:"composePath"`
+	ComposeFiles []string `json:"composeFiles"`
+	Profiles []string `json:"profiles"`
+	EnvVars map[string]string `json:"envVars"`
 }
 
 type EnvInfoResponse struct {
+	Repo string `json:"repo"`
+	Branch string `json:"branch"`
+	Commit string `json:"commit"`
+	Manifest *RepoManifest `json:"manifest"`
+	ComposeFiles []string `json:"composeFiles"`
+	Services []*EnvInfoService `json:"services"`
+	Tabs []DeploymentTab `json:"tabs"`
+	// variables referenced by the compose files without a default, which have no value in the .env file or request
+	RequiredEnvVars []string `json:"requiredEnvVars"`
+	// the variables Up accepts, from the manifest and compose files
+	EnvVars []*EnvVarSchema `json:"envVars"`
+	Images []string `json:"images"`
+	Warnings []string `json:"warnings"`
+}
+
+type EnvInfoService struct {
+	Name string `json:"name"`
+	Image string `json:"image"`
+	Build bool `json:"build"`
+	Privileged bool `json:"privileged"`
+	// the published ports
+	Ports []int `json:"ports"`
 }
 
 type EnvUpRequest struct {
 	ClaimToken string `json:"claimToken"`
 	Repo string `json:"repo"`
 	Branch string `json:"branch"`
+	Tag string `json:"tag"`
+	PullRequest int `json:"pullRequest"`
+	Commit string `json:"commit"`
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Credential string `json:"credential"`
 	ExpirationSeconds int64 `json:"expirationSeconds"`
 	EnvVars map[string]string `json:"envVars"`
+	ComposePath string `json:"composePath"`
+	ComposeFiles []string `json:"composeFiles"`
+	Profiles []string `json:"profiles"`
+	// set by the embedding server (see GetClientIp), for the per-ip rate limit
+	ClientIp string `json:"-"`
+}
+
+type EnvDownRequest struct {
+	ClaimToken string `json:"claimToken"`
 }
 
 type EnvUpResponse struct {
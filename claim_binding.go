@@ -0,0 +1,176 @@
+package minienv
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// share tokens are valid this long, unless the request asks for less
+const DefaultClaimShareSeconds int64 = 10 * 60
+
+// findEnvironmentByClaimToken compares the token against every environment in constant time,
+// so response times don't reveal how much of a token matched; it returns a copy of the environment
+func findEnvironmentByClaimToken(apiServer *ApiServer, claimToken string) *Environment {
+	var environment *Environment
+	if claimToken == "" {
+		return nil
+	}
+	for _, element := range getEnvironments(apiServer) {
+		if subtle.ConstantTimeCompare([]byte(element.ClaimToken), []byte(claimToken)) == 1 {
+			environment = element
+		}
+	}
+	return environment
+}
+
+func isClaimOwner(environment *Environment, session *Session) bool {
+	if session == nil {
+		return false
+	} else if environment.ClaimUserId != "" && session.UserId == environment.ClaimUserId {
+		return true
+	}
+	return environment.ClaimSessionId == session.Id
+}
+
+// authorizeClaim returns nil if the session may use the claim. Claims made before claims were bound to
+// sessions (e.g. loaded from deployment annotations), or whose binding was cleared, have no session; they
+// are bound to the first session that uses them, and only usable by it (or the sessions it shares with).
+func authorizeClaim(environment *Environment, session *Session) (error) {
+	if isClaimOwner(environment, session) {
+		return nil
+	} else if environment.ClaimSessionId == "" && environment.ClaimUserId == "" {
+		if session == nil {
+			return ErrSessionRequired
+		}
+		claimToken := environment.ClaimToken
+		err := updateEnvironment(environment, func(environment *Environment) bool {
+			if environment.ClaimToken != claimToken || environment.ClaimSessionId != "" || environment.ClaimUserId != "" {
+				return false
+			}
+			environment.ClaimSessionId = session.Id
+			environment.ClaimUserId = session.UserId
+			return true
+		})
+		if err == nil {
+			logPrintf("Claim on environment %s bound to session %s.\n", environment.Id, session.Id)
+			return nil
+		} else if ! errors.Is(err, ErrConflict) {
+			return ErrBackendUnavailable.WithCause(err)
+		} else if environment.ClaimToken != claimToken {
+			return ErrClaimInvalid
+		} else if isClaimOwner(environment, session) {
+			// bound by this session through another api server
+			return nil
+		}
+	}
+	if session != nil && containsString(environment.SharedSessionIds, session.Id) {
+		return nil
+	}
+	logPrintf("Claim on environment %s used by another session.\n", environment.Id)
+	return ErrClaimNotOwned
+}
+
+func hashShareToken(shareToken string) string {
+	hash := sha256.Sum256([]byte(shareToken))
+	return hex.EncodeToString(hash[:])
+}
+
+// ShareClaim creates a one-time token another session can accept to share the claim,
+// or to take it over if the request is for a transfer; only the session (or user) that claimed it may
+func (apiServer *ApiServer) ShareClaim(request *ClaimShareRequest, session *Session) (*ClaimShareResponse, error) {
+	syncEnvironments(apiServer)
+	environment := findEnvironmentByClaimToken(apiServer, request.ClaimToken)
+	if environment == nil {
+		return nil, ErrClaimInvalid
+	} else if ! isClaimOwner(environment, session) {
+		return nil, ErrClaimNotOwned
+	}
+	expirationSeconds := request.ExpirationSeconds
+	if expirationSeconds <= 0 || expirationSeconds > DefaultClaimShareSeconds {
+		expirationSeconds = DefaultClaimShareSeconds
+	}
+	random, _ := uuid.NewRandom()
+	shareToken := strings.Replace(random.String(), "-", "", -1)
+	now := time.Now().Unix()
+	share := &ClaimShare{TokenHash: hashShareToken(shareToken), Transfer: request.Transfer, ExpiresAt: now + expirationSeconds}
+	err := updateEnvironment(environment, func(environment *Environment) bool {
+		if environment.ClaimToken != request.ClaimToken {
+			return false
+		}
+		// drop expired shares as new ones are added
+		var shares []*ClaimShare
+		for _, element := range environment.ClaimShares {
+			if element.ExpiresAt > now {
+				shares = append(shares, element)
+			}
+		}
+		environment.ClaimShares = append(shares, share)
+		return true
+	})
+	if errors.Is(err, ErrConflict) {
+		return nil, ErrClaimInvalid
+	} else if err != nil {
+		return nil, ErrBackendUnavailable.WithCause(err)
+	}
+	logPrintf("Claim on environment %s shared (transfer=%t).\n", environment.Id, request.Transfer)
+	return &ClaimShareResponse{ShareToken: shareToken, ExpiresAt: share.ExpiresAt}, nil
+}
+
+// AcceptClaim redeems a share token for the session, returning the claim token
+func (apiServer *ApiServer) AcceptClaim(request *ClaimAcceptRequest, session *Session) (*ClaimResponse, error) {
+	if session == nil {
+		return nil, ErrSessionRequired
+	} else if request.ShareToken == "" {
+		return nil, ErrClaimInvalid
+	}
+	tokenHash := hashShareToken(request.ShareToken)
+	now := time.Now().Unix()
+	syncEnvironments(apiServer)
+	for _, element := range getEnvironments(apiServer) {
+		var share *ClaimShare
+		claimToken := element.ClaimToken
+		err := updateEnvironment(element, func(environment *Environment) bool {
+			share = nil
+			var shares []*ClaimShare
+			for _, s := range environment.ClaimShares {
+				if subtle.ConstantTimeCompare([]byte(s.TokenHash), []byte(tokenHash)) == 1 {
+					share = s
+				} else {
+					shares = append(shares, s)
+				}
+			}
+			if share == nil || environment.ClaimToken != claimToken {
+				share = nil
+				return false
+			}
+			// the token is spent either way
+			environment.ClaimShares = shares
+			if share.ExpiresAt <= now {
+				return true
+			}
+			if share.Transfer {
+				environment.ClaimSessionId = session.Id
+				environment.ClaimUserId = session.UserId
+			} else if ! containsString(environment.SharedSessionIds, session.Id) {
+				environment.SharedSessionIds = append(environment.SharedSessionIds, session.Id)
+			}
+			return true
+		})
+		if share == nil {
+			continue
+		} else if err != nil {
+			return nil, ErrBackendUnavailable.WithCause(err)
+		} else if share.ExpiresAt <= now {
+			break
+		}
+		logPrintf("Claim on environment %s accepted by session %s (transfer=%t).\n", element.Id, session.Id, share.Transfer)
+		return &ClaimResponse{ClaimGranted: true, ClaimToken: element.ClaimToken}, nil
+	}
+	return nil, ErrClaimInvalid.WithMessage("invalid or expired share token")
+}
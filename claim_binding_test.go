@@ -0,0 +1,72 @@
+package minienv
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAuthorizeClaim(t *testing.T) {
+	environment := &Environment{Id: "1", ClaimToken: "claim", ClaimSessionId: "s1", ClaimUserId: "u1", SharedSessionIds: []string{"s2"}}
+	tests := []struct {
+		name string
+		session *Session
+		expected error
+	}{
+		{"claiming session", &Session{Id: "s1"}, nil},
+		{"claiming user", &Session{Id: "s3", UserId: "u1"}, nil},
+		{"shared session", &Session{Id: "s2"}, nil},
+		{"other session", &Session{Id: "s3"}, ErrClaimNotOwned},
+		{"other user", &Session{Id: "s3", UserId: "u2"}, ErrClaimNotOwned},
+		{"no session", nil, ErrClaimNotOwned},
+	}
+	for _, test := range tests {
+		if err := authorizeClaim(environment, test.session); ! errors.Is(err, test.expected) {
+			t.Errorf("%s: Expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestAuthorizeUnboundClaim(t *testing.T) {
+	setTestStateStore(t)
+	saveTestEnvironments(t, &Environment{Id: "1", Version: 1, Status: StatusClaimed, ClaimToken: "claim"})
+	apiServer1 := newTestApiServer(1)
+	apiServer2 := newTestApiServer(1)
+	if err := authorizeClaim(getEnvironments(apiServer1)[0], nil); ! errors.Is(err, ErrSessionRequired) {
+		t.Errorf("Expected %v, got %v", ErrSessionRequired, err)
+	}
+	if err := authorizeClaim(getEnvironments(apiServer1)[0], &Session{Id: "s1", UserId: "u1"}); err != nil {
+		t.Fatalf("Expected the first session to be bound to the claim, got %v", err)
+	}
+	if saved := getSavedEnvironment(t, "1"); saved.ClaimSessionId != "s1" || saved.ClaimUserId != "u1" {
+		t.Errorf("Expected the claim saved bound to s1/u1, got %s/%s", saved.ClaimSessionId, saved.ClaimUserId)
+	}
+	if environment := getEnvironments(apiServer1)[0]; environment.ClaimSessionId != "s1" {
+		t.Errorf("Expected the pool to have the binding, got %s", environment.ClaimSessionId)
+	}
+	// the other api server hasn't synced the binding yet
+	stale := getEnvironments(apiServer2)[0]
+	if err := authorizeClaim(stale, &Session{Id: "s2"}); ! errors.Is(err, ErrClaimNotOwned) {
+		t.Errorf("Expected %v for a second session, got %v", ErrClaimNotOwned, err)
+	}
+	if err := authorizeClaim(getEnvironments(apiServer2)[0], &Session{Id: "s1"}); err != nil {
+		t.Errorf("Expected the bound session to be authorized, got %v", err)
+	}
+}
+
+func TestAuthorizeUnboundClaimReleased(t *testing.T) {
+	setTestStateStore(t)
+	saveTestEnvironments(t, &Environment{Id: "1", Version: 1, Status: StatusClaimed, ClaimToken: "claim"})
+	apiServer := newTestApiServer(1)
+	stale := getEnvironments(apiServer)[0]
+	released := getEnvironments(apiServer)[0]
+	resetEnvironment(released)
+	if err := saveEnvironment(released); err != nil {
+		t.Fatalf("Error releasing the claim: %v", err)
+	}
+	if err := authorizeClaim(stale, &Session{Id: "s1"}); ! errors.Is(err, ErrClaimInvalid) {
+		t.Errorf("Expected %v, got %v", ErrClaimInvalid, err)
+	}
+	if saved := getSavedEnvironment(t, "1"); saved.ClaimSessionId != "" || saved.Status != StatusIdle {
+		t.Errorf("Expected the released environment to stay idle, got status %d bound to %s", saved.Status, saved.ClaimSessionId)
+	}
+}
@@ -0,0 +1,334 @@
+package minienv
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Claim limits keep one client from taking the whole pool. MINIENV_CLAIM_MAX_PER_SESSION, _PER_USER and _PER_IP
+// cap the environments claimed at once (0, the default, for no limit); they're counted from the shared pool and the
+// claim queue, so they hold across api servers. MINIENV_CLAIM_RATE_PER_MINUTE and MINIENV_UP_RATE_PER_MINUTE rate
+// limit Claim and Up per session (or user) and per ip, allowing bursts of MINIENV_CLAIM_RATE_BURST and
+// MINIENV_UP_RATE_BURST.
+// Rate limits are kept in memory, so each api server allows the rate.
+
+// buckets are dropped once they've been full this long
+const RateLimitBucketIdleSeconds = 10 * 60
+
+var claimMaxPerSession = 0
+var claimMaxPerUser = 0
+var claimMaxPerIp = 0
+var claimRateLimiter *RateLimiter
+var upRateLimiter *RateLimiter
+// the number of proxies (e.g. the ingress) in front of the api server that append to X-Forwarded-For, which
+// GetClientIp trusts; 1 with MINIENV_TRUST_FORWARDED_FOR, or set with MINIENV_TRUSTED_PROXY_HOPS
+var trustedProxyHops = 0
+
+var claimLimitStatsMutex sync.Mutex
+var claimLimitStats ClaimLimitStatsResponse
+
+// RateLimiter is a token bucket per key; each bucket holds up to Burst tokens and refills at Rate per second
+type RateLimiter struct {
+	Rate float64
+	Burst float64
+	mutex sync.Mutex
+	buckets map[string]*rateLimitBucket
+	// returns the current time; time.Now unless set by tests
+	now func() time.Time
+}
+
+type rateLimitBucket struct {
+	tokens float64
+	updatedAt time.Time
+}
+
+func NewRateLimiter(perMinute float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{Rate: perMinute / 60, Burst: float64(burst), buckets: make(map[string]*rateLimitBucket), now: time.Now}
+}
+
+// Allow takes a token from each key's bucket, or, if any is empty, returns false and the seconds until it isn't
+func (limiter *RateLimiter) Allow(keys ...string) (bool, int64) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	now := limiter.now()
+	var buckets []*rateLimitBucket
+	for _, key := range keys {
+		bucket := limiter.buckets[key]
+		if bucket == nil {
+			bucket = &rateLimitBucket{tokens: limiter.Burst, updatedAt: now}
+			limiter.buckets[key] = bucket
+		}
+		bucket.tokens = math.Min(limiter.Burst, bucket.tokens + now.Sub(bucket.updatedAt).Seconds() * limiter.Rate)
+		bucket.updatedAt = now
+		if bucket.tokens < 1 {
+			return false, int64(math.Ceil((1 - bucket.tokens) / limiter.Rate))
+		}
+		buckets = append(buckets, bucket)
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true, 0
+}
+
+// prune drops the buckets that have refilled and not been used since, so clients that come and go don't add up
+func (limiter *RateLimiter) prune() {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	now := limiter.now()
+	for key, bucket := range limiter.buckets {
+		fullAt := bucket.updatedAt.Add(time.Duration((limiter.Burst - bucket.tokens) / limiter.Rate * float64(time.Second)))
+		if now.Sub(fullAt) > time.Second * RateLimitBucketIdleSeconds {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+func (limiter *RateLimiter) count() int {
+	if limiter == nil {
+		return 0
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return len(limiter.buckets)
+}
+
+func initClaimLimits() {
+	claimMaxPerSession, _ = strconv.Atoi(os.Getenv("MINIENV_CLAIM_MAX_PER_SESSION"))
+	claimMaxPerUser, _ = strconv.Atoi(os.Getenv("MINIENV_CLAIM_MAX_PER_USER"))
+	claimMaxPerIp, _ = strconv.Atoi(os.Getenv("MINIENV_CLAIM_MAX_PER_IP"))
+	trustedProxyHops = 0
+	if trustForwardedFor, _ := strconv.ParseBool(os.Getenv("MINIENV_TRUST_FORWARDED_FOR")); trustForwardedFor {
+		trustedProxyHops = 1
+	}
+	if hops, err := strconv.Atoi(os.Getenv("MINIENV_TRUSTED_PROXY_HOPS")); err == nil && hops >= 0 {
+		trustedProxyHops = hops
+	}
+	claimRateLimiter = newRateLimiterFromEnv("MINIENV_CLAIM_RATE_PER_MINUTE", "MINIENV_CLAIM_RATE_BURST")
+	upRateLimiter = newRateLimiterFromEnv("MINIENV_UP_RATE_PER_MINUTE", "MINIENV_UP_RATE_BURST")
+	if claimRateLimiter != nil || upRateLimiter != nil {
+		startRateLimitPruneTimer()
+	}
+}
+
+// newRateLimiterFromEnv returns nil, for no rate limit, unless the rate is set
+func newRateLimiterFromEnv(rateEnvVar string, burstEnvVar string) *RateLimiter {
+	perMinute, err := strconv.ParseFloat(os.Getenv(rateEnvVar), 64)
+	if err != nil || perMinute <= 0 {
+		return nil
+	}
+	burst, err := strconv.Atoi(os.Getenv(burstEnvVar))
+	if err != nil || burst <= 0 {
+		burst = int(math.Ceil(perMinute))
+	}
+	return NewRateLimiter(perMinute, burst)
+}
+
+func startRateLimitPruneTimer() {
+	timer := time.NewTimer(time.Minute)
+	go func() {
+		<-timer.C
+		if claimRateLimiter != nil {
+			claimRateLimiter.prune()
+		}
+		if upRateLimiter != nil {
+			upRateLimiter.prune()
+		}
+		startRateLimitPruneTimer()
+	}()
+}
+
+// GetClientIp returns the address of the client, for the ClientIp of requests. Proxies append the address they
+// got the request from to X-Forwarded-For, so with trusted proxies the client is the entry added by the first
+// of them, counting from the right; entries to the left of it are whatever the client sent.
+func GetClientIp(r *http.Request) string {
+	if trustedProxyHops > 0 {
+		var forwardedFor []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, element := range strings.Split(header, ",") {
+				if element = strings.TrimSpace(element); element != "" {
+					forwardedFor = append(forwardedFor, element)
+				}
+			}
+		}
+		// fewer entries than proxies means the request didn't come through all of them
+		if len(forwardedFor) >= trustedProxyHops {
+			return forwardedFor[len(forwardedFor) - trustedProxyHops]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// getRateLimitKeys returns the buckets a request from the session and ip draws on
+func getRateLimitKeys(session *Session, clientIp string) []string {
+	var keys []string
+	if session != nil && session.UserId != "" {
+		keys = append(keys, "user:" + session.UserId)
+	} else if session != nil {
+		keys = append(keys, "session:" + session.Id)
+	}
+	if clientIp != "" {
+		keys = append(keys, "ip:" + clientIp)
+	}
+	return keys
+}
+
+func countClaimLimit(counter *int64) {
+	claimLimitStatsMutex.Lock()
+	*counter++
+	claimLimitStatsMutex.Unlock()
+}
+
+func checkClaimRate(session *Session, clientIp string) (error) {
+	if claimRateLimiter == nil {
+		return nil
+	}
+	allowed, retryAfter := claimRateLimiter.Allow(getRateLimitKeys(session, clientIp)...)
+	if ! allowed {
+		logPrintf("Claim rate limited for %s.\n", strings.Join(getRateLimitKeys(session, clientIp), ", "))
+		countClaimLimit(&claimLimitStats.ClaimsRateLimited)
+		return ErrRateLimited.WithRetryAfter(retryAfter)
+	}
+	return nil
+}
+
+func checkUpRate(session *Session, clientIp string) (error) {
+	if upRateLimiter == nil {
+		return nil
+	}
+	allowed, retryAfter := upRateLimiter.Allow(getRateLimitKeys(session, clientIp)...)
+	if ! allowed {
+		logPrintf("Up rate limited for %s.\n", strings.Join(getRateLimitKeys(session, clientIp), ", "))
+		countClaimLimit(&claimLimitStats.UpsRateLimited)
+		return ErrRateLimited.WithRetryAfter(retryAfter)
+	}
+	return nil
+}
+
+// claimCounts are the claims held (or waited for, in the claim queue) by a session, its user and its ip
+type claimCounts struct {
+	Session int
+	User int
+	Ip int
+}
+
+// countClaims counts the claims held by the session, its user and the ip
+func countClaims(apiServer *ApiServer, session *Session, clientIp string) (*claimCounts) {
+	return countEnvironmentClaims(getEnvironments(apiServer), session, clientIp, "")
+}
+
+// countEnvironmentClaims counts the claims on the environments, other than the one excluded
+func countEnvironmentClaims(environments []*Environment, session *Session, clientIp string, excludeEnvId string) (*claimCounts) {
+	counts := &claimCounts{}
+	for _, environment := range environments {
+		if environment.ClaimToken == "" || environment.Id == excludeEnvId {
+			continue
+		}
+		if environment.ClaimSessionId == session.Id {
+			counts.Session++
+		}
+		if session.UserId != "" && environment.ClaimUserId == session.UserId {
+			counts.User++
+		}
+		if clientIp != "" && environment.ClaimIp == clientIp {
+			counts.Ip++
+		}
+	}
+	return counts
+}
+
+// checkSavedClaimLimits checks the claim just saved on the environment against the claims other api servers saved.
+// Claims made at the same time all pass the checks made before saving them; once saved, each sees the others, so
+// a claim that took its session, user or ip over a limit is released again. Claims racing for the last slot may
+// both be released, but never both kept.
+func checkSavedClaimLimits(environment *Environment, session *Session, clientIp string) (error) {
+	if claimMaxPerSession <= 0 && claimMaxPerUser <= 0 && claimMaxPerIp <= 0 {
+		return nil
+	}
+	saved, err := loadEnvironments()
+	if err != nil {
+		// the claim passed the check made as it was saved
+		logPrintf("Error loading environments to check claim limits: %v\n", err)
+		return nil
+	}
+	var environments []*Environment
+	for _, element := range saved {
+		environments = append(environments, element)
+	}
+	counts := countEnvironmentClaims(environments, session, clientIp, environment.Id)
+	if ! counts.isLimitReached() {
+		return nil
+	}
+	logPrintf("Releasing claim on environment %s made while at a claim limit.\n", environment.Id)
+	claimToken := environment.ClaimToken
+	err = updateEnvironment(environment, func(environment *Environment) bool {
+		if environment.ClaimToken != claimToken {
+			return false
+		}
+		resetEnvironment(environment)
+		return true
+	})
+	if err != nil && ! errors.Is(err, ErrConflict) {
+		logPrintf("Error releasing claim on environment %s: %v\n", environment.Id, err)
+	}
+	return checkClaimCounts(session, clientIp, counts)
+}
+
+// isLimitReached returns true if the counts are at any of the limits
+func (counts *claimCounts) isLimitReached() bool {
+	return (claimMaxPerSession > 0 && counts.Session >= claimMaxPerSession) ||
+		(claimMaxPerUser > 0 && counts.User >= claimMaxPerUser) ||
+		(claimMaxPerIp > 0 && counts.Ip >= claimMaxPerIp)
+}
+
+// checkClaimLimits returns ErrClaimLimitExceeded if the session, its user or the ip already hold as many claims as allowed
+func checkClaimLimits(apiServer *ApiServer, session *Session, clientIp string) (error) {
+	return checkClaimCounts(session, clientIp, countClaims(apiServer, session, clientIp))
+}
+
+// checkClaimCounts returns ErrClaimLimitExceeded if the counts for the session, its user or the ip are at a limit
+func checkClaimCounts(session *Session, clientIp string, counts *claimCounts) (error) {
+	// claims free up as they're released or expire
+	retryAfter := int64(ExpireClaimNoActivitySeconds)
+	if claimMaxPerSession > 0 && counts.Session >= claimMaxPerSession {
+		logPrintf("Claim refused; session %s has %d claims.\n", session.Id, counts.Session)
+		countClaimLimit(&claimLimitStats.ClaimsOverSessionLimit)
+		return ErrClaimLimitExceeded.WithMessage("at most %d environments may be claimed per session", claimMaxPerSession).WithRetryAfter(retryAfter)
+	} else if claimMaxPerUser > 0 && counts.User >= claimMaxPerUser {
+		logPrintf("Claim refused; user %s has %d claims.\n", session.UserId, counts.User)
+		countClaimLimit(&claimLimitStats.ClaimsOverUserLimit)
+		return ErrClaimLimitExceeded.WithMessage("at most %d environments may be claimed per user", claimMaxPerUser).WithRetryAfter(retryAfter)
+	} else if claimMaxPerIp > 0 && counts.Ip >= claimMaxPerIp {
+		logPrintf("Claim refused; %s has %d claims.\n", clientIp, counts.Ip)
+		countClaimLimit(&claimLimitStats.ClaimsOverIpLimit)
+		return ErrClaimLimitExceeded.WithMessage("at most %d environments may be claimed per address", claimMaxPerIp).WithRetryAfter(retryAfter)
+	}
+	return nil
+}
+
+// ClaimLimitStats returns the counts of requests refused by the claim limits, for monitoring; it requires the admin token
+func (apiServer *ApiServer) ClaimLimitStats(request *ClaimLimitStatsRequest) (*ClaimLimitStatsResponse, error) {
+	err := authorizeAdmin(request.AdminToken)
+	if err != nil {
+		return nil, err
+	}
+	claimLimitStatsMutex.Lock()
+	stats := claimLimitStats
+	claimLimitStatsMutex.Unlock()
+	stats.RateLimitBuckets = claimRateLimiter.count() + upRateLimiter.count()
+	return &stats, nil
+}
@@ -0,0 +1,302 @@
+package minienv
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setTestClaimMax(t *testing.T, perSession int, perUser int, perIp int) {
+	previousSession, previousUser, previousIp := claimMaxPerSession, claimMaxPerUser, claimMaxPerIp
+	claimMaxPerSession, claimMaxPerUser, claimMaxPerIp = perSession, perUser, perIp
+	t.Cleanup(func() {
+		claimMaxPerSession, claimMaxPerUser, claimMaxPerIp = previousSession, previousUser, previousIp
+	})
+}
+
+func TestConcurrentClaimsKeepLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		perSession int
+		perUser int
+		perIp int
+		session func(i int) *Session
+		clientIp func(i int) string
+	}{
+		{"session", 1, 0, 0, func(i int) *Session { return &Session{Id: "s1"} }, func(i int) string { return fmt.Sprintf("10.0.0.%d", i) }},
+		{"user", 0, 2, 0, func(i int) *Session { return &Session{Id: fmt.Sprintf("s%d", i), UserId: "u1"} }, func(i int) string { return "" }},
+		{"ip", 0, 0, 1, func(i int) *Session { return &Session{Id: fmt.Sprintf("s%d", i)} }, func(i int) string { return "10.0.0.1" }},
+	}
+	for _, test := range tests {
+		setTestStateStore(t)
+		setTestClaimMax(t, test.perSession, test.perUser, test.perIp)
+		envCount := 8
+		for i := 1; i <= envCount; i++ {
+			saveTestEnvironments(t, &Environment{Id: fmt.Sprintf("%d", i), Version: 1, Status: StatusIdle})
+		}
+		apiServers := []*ApiServer{newTestApiServer(envCount), newTestApiServer(envCount)}
+		var wait sync.WaitGroup
+		for i := 0; i < envCount; i++ {
+			wait.Add(1)
+			go func(i int) {
+				defer wait.Done()
+				_, err := apiServers[i % 2].Claim(&ClaimRequest{ClientIp: test.clientIp(i)}, test.session(i))
+				if err != nil && ! errors.Is(err, ErrClaimLimitExceeded) {
+					t.Errorf("%s: Expected %v, got %v", test.name, ErrClaimLimitExceeded, err)
+				}
+			}(i)
+		}
+		wait.Wait()
+		saved, _ := loadEnvironments()
+		claimed := 0
+		for _, environment := range saved {
+			if environment.ClaimToken != "" {
+				claimed++
+			}
+		}
+		max := test.perSession + test.perUser + test.perIp
+		if claimed > max {
+			t.Errorf("%s: Expected at most %d claims, got %d", test.name, max, claimed)
+		}
+	}
+}
+
+func TestClaimIdleEnvironmentChecksLimits(t *testing.T) {
+	setTestStateStore(t)
+	setTestClaimMax(t, 0, 0, 1)
+	saveTestEnvironments(t,
+		&Environment{Id: "1", Version: 1, Status: StatusIdle},
+		&Environment{Id: "2", Version: 1, Status: StatusIdle},
+	)
+	apiServer1 := newTestApiServer(2)
+	apiServer2 := newTestApiServer(2)
+	if environment, _, err := claimIdleEnvironment(apiServer1, &Session{Id: "s1"}, "10.0.0.1"); environment == nil || err != nil {
+		t.Fatalf("Expected a claim, got %v, %v", environment, err)
+	}
+	// the other api server hasn't synced the claim, but the saved claims are checked
+	environment, _, err := claimIdleEnvironment(apiServer2, &Session{Id: "s2"}, "10.0.0.1")
+	if environment != nil || ! errors.Is(err, ErrClaimLimitExceeded) {
+		t.Errorf("Expected %v, got %v, %v", ErrClaimLimitExceeded, environment, err)
+	}
+	if saved := getSavedEnvironment(t, "2"); saved.Status != StatusIdle || saved.ClaimToken != "" {
+		t.Errorf("Expected the claim over the limit to be released, got status %d", saved.Status)
+	}
+	if environment, _, err := claimIdleEnvironment(apiServer2, &Session{Id: "s3"}, "10.0.0.2"); environment == nil || err != nil {
+		t.Errorf("Expected a claim from another ip, got %v, %v", environment, err)
+	}
+}
+
+func TestGetClientIp(t *testing.T) {
+	defer func(hops int) { trustedProxyHops = hops }(trustedProxyHops)
+	tests := []struct {
+		hops int
+		remoteAddr string
+		forwardedFor []string
+		expected string
+	}{
+		{0, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{0, "10.0.0.1:1234", []string{"1.2.3.4"}, "10.0.0.1"},
+		{1, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{1, "10.0.0.1:1234", []string{"1.2.3.4"}, "1.2.3.4"},
+		// the client's own entries are to the left of the one the ingress appended
+		{1, "10.0.0.1:1234", []string{"6.6.6.6, 1.2.3.4"}, "1.2.3.4"},
+		{1, "10.0.0.1:1234", []string{"6.6.6.6", "1.2.3.4"}, "1.2.3.4"},
+		{2, "10.0.0.1:1234", []string{"6.6.6.6, 1.2.3.4, 10.1.0.1"}, "1.2.3.4"},
+		{2, "10.0.0.1:1234", []string{"1.2.3.4"}, "10.0.0.1"},
+		{1, "10.0.0.1:1234", []string{" 2001:db8::1 "}, "2001:db8::1"},
+		{0, "[2001:db8::2]:1234", nil, "2001:db8::2"},
+		{0, "pipe", nil, "pipe"},
+	}
+	for _, test := range tests {
+		trustedProxyHops = test.hops
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, forwardedFor := range test.forwardedFor {
+			r.Header.Add("X-Forwarded-For", forwardedFor)
+		}
+		if actual := GetClientIp(r); actual != test.expected {
+			t.Errorf("%d hops, %v: Expected %s, got %s", test.hops, test.forwardedFor, test.expected, actual)
+		}
+	}
+}
+
+func TestInitClaimLimitsProxyHops(t *testing.T) {
+	defer func(hops int) { trustedProxyHops = hops }(trustedProxyHops)
+	tests := []struct {
+		trust string
+		hops string
+		expected int
+	}{
+		{"", "", 0},
+		{"true", "", 1},
+		{"false", "", 0},
+		{"true", "2", 2},
+		{"", "3", 3},
+		{"true", "bad", 1},
+	}
+	for _, test := range tests {
+		t.Setenv("MINIENV_TRUST_FORWARDED_FOR", test.trust)
+		t.Setenv("MINIENV_TRUSTED_PROXY_HOPS", test.hops)
+		initClaimLimits()
+		if trustedProxyHops != test.expected {
+			t.Errorf("%s, %s: Expected %d, got %d", test.trust, test.hops, test.expected, trustedProxyHops)
+		}
+	}
+}
+
+// newTestRateLimiter returns a limiter whose clock only moves when the returned func is called
+func newTestRateLimiter(perMinute float64, burst int) (*RateLimiter, func(seconds float64)) {
+	limiter := NewRateLimiter(perMinute, burst)
+	now := time.Unix(1000000, 0)
+	limiter.now = func() time.Time { return now }
+	return limiter, func(seconds float64) {
+		now = now.Add(time.Duration(seconds * float64(time.Second)))
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	tests := []struct {
+		name string
+		perMinute float64
+		burst int
+		// seconds to wait before each request, and whether it's allowed
+		waits []float64
+		allowed []bool
+		retryAfter int64
+	}{
+		{"burst", 60, 3, []float64{0, 0, 0, 0}, []bool{true, true, true, false}, 1},
+		{"refill", 60, 2, []float64{0, 0, 0, 1, 0}, []bool{true, true, false, true, false}, 1},
+		{"refill up to burst", 60, 2, []float64{0, 0, 100, 0, 0, 0}, []bool{true, true, true, true, false, false}, 1},
+		{"slow rate", 6, 1, []float64{0, 5, 5}, []bool{true, false, true}, 0},
+		{"slow rate retry", 6, 1, []float64{0, 4}, []bool{true, false}, 6},
+		{"default burst", 0.5, 0, []float64{0, 0}, []bool{true, false}, 120},
+	}
+	for _, test := range tests {
+		limiter, wait := newTestRateLimiter(test.perMinute, test.burst)
+		var retryAfter int64
+		for i, seconds := range test.waits {
+			wait(seconds)
+			var allowed bool
+			allowed, retryAfter = limiter.Allow("key")
+			if allowed != test.allowed[i] {
+				t.Errorf("%s: Expected request %d allowed=%v", test.name, i, test.allowed[i])
+			}
+		}
+		if retryAfter != test.retryAfter {
+			t.Errorf("%s: Expected retry after %d, got %d", test.name, test.retryAfter, retryAfter)
+		}
+	}
+}
+
+func TestRateLimiterAllowKeys(t *testing.T) {
+	limiter, wait := newTestRateLimiter(60, 1)
+	if allowed, _ := limiter.Allow("session:s1", "ip:10.0.0.1"); ! allowed {
+		t.Fatalf("Expected the first request to be allowed")
+	}
+	// the ip's bucket is empty, so the new session's isn't drawn on
+	if allowed, _ := limiter.Allow("session:s2", "ip:10.0.0.1"); allowed {
+		t.Errorf("Expected the request from the same ip to be limited")
+	}
+	if allowed, _ := limiter.Allow("session:s2", "ip:10.0.0.2"); ! allowed {
+		t.Errorf("Expected the new session to have its token")
+	}
+	wait(1)
+	if allowed, _ := limiter.Allow("session:s1", "ip:10.0.0.1"); ! allowed {
+		t.Errorf("Expected the request to be allowed once refilled")
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	limiter, wait := newTestRateLimiter(60, 2)
+	limiter.Allow("a")
+	limiter.Allow("b")
+	limiter.Allow("b")
+	// a is full after 1s and b after 2s
+	wait(RateLimitBucketIdleSeconds + 1.5)
+	limiter.prune()
+	if limiter.count() != 1 || limiter.buckets["b"] == nil {
+		t.Errorf("Expected only b to be kept, got %d buckets", limiter.count())
+	}
+	wait(1)
+	limiter.prune()
+	if limiter.count() != 0 {
+		t.Errorf("Expected no buckets, got %d", limiter.count())
+	}
+	var nilLimiter *RateLimiter
+	if nilLimiter.count() != 0 {
+		t.Errorf("Expected no buckets without a limiter")
+	}
+}
+
+func TestCheckClaimCounts(t *testing.T) {
+	setTestClaimMax(t, 1, 2, 3)
+	session := &Session{Id: "s1", UserId: "u1"}
+	tests := []struct {
+		counts claimCounts
+		message string
+	}{
+		{claimCounts{0, 1, 2}, ""},
+		{claimCounts{1, 0, 0}, "at most 1 environments may be claimed per session"},
+		{claimCounts{0, 2, 0}, "at most 2 environments may be claimed per user"},
+		{claimCounts{0, 0, 3}, "at most 3 environments may be claimed per address"},
+		// the session limit is reported first
+		{claimCounts{1, 2, 3}, "at most 1 environments may be claimed per session"},
+	}
+	for _, test := range tests {
+		err := checkClaimCounts(session, "10.0.0.1", &test.counts)
+		if test.message == "" {
+			if err != nil {
+				t.Errorf("%+v: Expected no error, got %v", test.counts, err)
+			}
+			continue
+		}
+		var apiErr *ApiError
+		if ! errors.As(err, &apiErr) || apiErr.Code != ErrClaimLimitExceeded.Code {
+			t.Errorf("%+v: Expected %v, got %v", test.counts, ErrClaimLimitExceeded, err)
+		} else if apiErr.Message != test.message || apiErr.RetryAfterSeconds != ExpireClaimNoActivitySeconds {
+			t.Errorf("%+v: Expected '%s' retry after %d, got '%s' retry after %d", test.counts, test.message, ExpireClaimNoActivitySeconds, apiErr.Message, apiErr.RetryAfterSeconds)
+		}
+	}
+	setTestClaimMax(t, 0, 0, 0)
+	if err := checkClaimCounts(session, "10.0.0.1", &claimCounts{100, 100, 100}); err != nil {
+		t.Errorf("Expected no limits, got %v", err)
+	}
+}
+
+func TestClaimLimitStats(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	defer func(limiter *RateLimiter) { claimRateLimiter = limiter }(claimRateLimiter)
+	defer func(limiter *RateLimiter) { upRateLimiter = limiter }(upRateLimiter)
+	claimLimitStatsMutex.Lock()
+	previous := claimLimitStats
+	claimLimitStats = ClaimLimitStatsResponse{}
+	claimLimitStatsMutex.Unlock()
+	t.Cleanup(func() {
+		claimLimitStatsMutex.Lock()
+		claimLimitStats = previous
+		claimLimitStatsMutex.Unlock()
+	})
+	adminToken = "admin-token"
+	setTestClaimMax(t, 0, 0, 1)
+	claimRateLimiter, _ = newTestRateLimiter(60, 1)
+	upRateLimiter = nil
+	apiServer := &ApiServer{}
+	session := &Session{Id: "s1"}
+	checkClaimRate(session, "10.0.0.1")
+	checkClaimRate(session, "10.0.0.1")
+	checkClaimCounts(session, "10.0.0.1", &claimCounts{Ip: 1})
+	if _, err := apiServer.ClaimLimitStats(&ClaimLimitStatsRequest{AdminToken: "wrong"}); ! errors.Is(err, ErrAdminUnauthorized) {
+		t.Errorf("Expected %v, got %v", ErrAdminUnauthorized, err)
+	}
+	stats, err := apiServer.ClaimLimitStats(&ClaimLimitStatsRequest{AdminToken: "admin-token"})
+	if err != nil {
+		t.Fatalf("Expected stats, got %v", err)
+	}
+	expected := ClaimLimitStatsResponse{ClaimsRateLimited: 1, ClaimsOverIpLimit: 1, RateLimitBuckets: 2}
+	if *stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *stats)
+	}
+}
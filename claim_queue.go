@@ -0,0 +1,320 @@
+package minienv
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// When MINIENV_CLAIM_QUEUE is set, claims made while no environment is idle get a ticket instead, which the
+// client polls (a ClaimRequest with the ticket) until it's promoted to a claim as environments free up. Tickets
+// not polled for ExpireClaimNoActivitySeconds are dropped, like claims. The queue is kept in the state store,
+// so any api server can take the polls; the leader promotes tickets as it checks the environments.
+
+const ClaimQueueStateKey = "claim-queue"
+const DefaultClaimQueueMax = 100
+
+// how many times a change to the queue is retried when other api servers change it first
+const ClaimQueueUpdateAttempts = 10
+
+// weight of the latest interval in the average time between promotions
+const claimQueueAverageWeight = 0.3
+
+var claimQueueEnabled = false
+var claimQueueMax = DefaultClaimQueueMax
+
+type ClaimTicket struct {
+	Id string `json:"id"`
+	SessionId string `json:"sessionId"`
+	UserId string `json:"userId"`
+	ClientIp string `json:"clientIp"`
+	QueuedAt int64 `json:"queuedAt"`
+	LastActivity int64 `json:"lastActivity"`
+	// set once promoted, until the claim token is handed to the client
+	EnvId string `json:"envId"`
+	ClaimToken string `json:"claimToken"`
+}
+
+type claimQueue struct {
+	Tickets []*ClaimTicket `json:"tickets"`
+	LastPromotedAt int64 `json:"lastPromotedAt"`
+	AveragePromotionSeconds float64 `json:"averagePromotionSeconds"`
+}
+
+func loadClaimQueue() (*claimQueue, []byte, error) {
+	bs, err := stateStore.GetState(ClaimQueueStateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	queue := &claimQueue{}
+	if bs != nil {
+		err = json.Unmarshal(bs, queue)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// drop abandoned tickets
+	now := time.Now().Unix()
+	var tickets []*ClaimTicket
+	for _, ticket := range queue.Tickets {
+		if now - ticket.LastActivity <= ExpireClaimNoActivitySeconds {
+			tickets = append(tickets, ticket)
+		}
+	}
+	queue.Tickets = tickets
+	return queue, bs, nil
+}
+
+// updateClaimQueue applies update to the latest queue and saves it, unless update returns false
+func updateClaimQueue(update func(queue *claimQueue) bool) (error) {
+	for i := 0; i < ClaimQueueUpdateAttempts; i++ {
+		queue, previous, err := loadClaimQueue()
+		if err != nil {
+			return err
+		}
+		if ! update(queue) {
+			return nil
+		}
+		bs, err := json.Marshal(queue)
+		if err != nil {
+			return err
+		}
+		swapped, err := stateStore.CompareAndSwapState(ClaimQueueStateKey, previous, bs)
+		if err != nil {
+			return err
+		} else if swapped {
+			return nil
+		}
+	}
+	return errors.New("claim queue changed by other api servers too often")
+}
+
+// waiting returns the tickets not promoted yet, in order
+func (queue *claimQueue) waiting() []*ClaimTicket {
+	var tickets []*ClaimTicket
+	for _, ticket := range queue.Tickets {
+		if ticket.ClaimToken == "" {
+			tickets = append(tickets, ticket)
+		}
+	}
+	return tickets
+}
+
+func (queue *claimQueue) find(ticketId string) *ClaimTicket {
+	var found *ClaimTicket
+	for _, ticket := range queue.Tickets {
+		if subtle.ConstantTimeCompare([]byte(ticket.Id), []byte(ticketId)) == 1 {
+			found = ticket
+		}
+	}
+	return found
+}
+
+func (queue *claimQueue) remove(ticketId string) {
+	var tickets []*ClaimTicket
+	for _, ticket := range queue.Tickets {
+		if ticket.Id != ticketId {
+			tickets = append(tickets, ticket)
+		}
+	}
+	queue.Tickets = tickets
+}
+
+// getPosition returns the 1-based position of the ticket among the waiting tickets, and the estimated wait
+func (queue *claimQueue) getPosition(ticketId string) (int, int64) {
+	for i, ticket := range queue.waiting() {
+		if ticket.Id == ticketId {
+			return i + 1, int64(float64(i + 1) * queue.AveragePromotionSeconds)
+		}
+	}
+	return 0, 0
+}
+
+// isClaimQueued returns true if sessions are waiting for an environment; new claims go behind them
+func isClaimQueued() bool {
+	if ! claimQueueEnabled {
+		return false
+	}
+	queue, _, err := loadClaimQueue()
+	if err != nil {
+		logPrintf("Error loading claim queue: %v\n", err)
+		return false
+	}
+	return len(queue.waiting()) > 0
+}
+
+func (apiServer *ApiServer) queueClaim(session *Session, clientIp string) (*ClaimResponse, error) {
+	random, _ := uuid.NewRandom()
+	now := time.Now().Unix()
+	ticket := &ClaimTicket{
+		Id: strings.Replace(random.String(), "-", "", -1),
+		SessionId: session.Id,
+		UserId: session.UserId,
+		ClientIp: clientIp,
+		QueuedAt: now,
+		LastActivity: now,
+	}
+	held := countClaims(apiServer, session, clientIp)
+	var counts claimCounts
+	full := false
+	limited := false
+	err := updateClaimQueue(func(queue *claimQueue) bool {
+		full = false
+		limited = false
+		// waiting tickets count towards the limits, as they'll be promoted to claims
+		counts = *held
+		for _, element := range queue.waiting() {
+			if element.SessionId == session.Id {
+				// already queued; keep the place in line
+				ticket = element
+				ticket.LastActivity = now
+				return true
+			}
+			if session.UserId != "" && element.UserId == session.UserId {
+				counts.User++
+			}
+			if clientIp != "" && element.ClientIp == clientIp {
+				counts.Ip++
+			}
+		}
+		if counts.isLimitReached() {
+			limited = true
+			return false
+		} else if len(queue.waiting()) >= claimQueueMax {
+			full = true
+			return false
+		}
+		queue.Tickets = append(queue.Tickets, ticket)
+		return true
+	})
+	if err != nil {
+		return nil, ErrBackendUnavailable.WithCause(err)
+	} else if limited {
+		return nil, checkClaimCounts(session, clientIp, &counts)
+	} else if full {
+		logPrintln("Claim failed; no environments available and the claim queue is full.")
+		return &ClaimResponse{ClaimGranted: false, Message: "No environments available"}, nil
+	}
+	// the leader promotes the ticket once an environment frees up
+	return apiServer.pollClaimTicket(ticket.Id, session)
+}
+
+// pollClaimTicket returns the claim if the ticket was promoted, otherwise its place in the queue. Polls only
+// keep the ticket from expiring, and hand over the claim; promotion is left to the leader.
+func (apiServer *ApiServer) pollClaimTicket(ticketId string, session *Session) (*ClaimResponse, error) {
+	var ticket *ClaimTicket
+	var position int
+	var estimatedWaitSeconds int64
+	err := updateClaimQueue(func(queue *claimQueue) bool {
+		ticket = queue.find(ticketId)
+		if ticket == nil || ticket.SessionId != session.Id {
+			return false
+		}
+		if ticket.ClaimToken != "" {
+			queue.remove(ticket.Id)
+		} else {
+			ticket.LastActivity = time.Now().Unix()
+			position, estimatedWaitSeconds = queue.getPosition(ticket.Id)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, ErrBackendUnavailable.WithCause(err)
+	} else if ticket == nil {
+		return nil, ErrClaimInvalid.WithMessage("invalid or expired ticket")
+	} else if ticket.SessionId != session.Id {
+		return nil, ErrClaimNotOwned
+	} else if ticket.ClaimToken != "" {
+		logPrintf("Claimed environment %s from the queue.\n", ticket.EnvId)
+		return &ClaimResponse{ClaimGranted: true, ClaimToken: ticket.ClaimToken}, nil
+	}
+	return &ClaimResponse{
+		ClaimGranted: false,
+		Message: "Waiting for an environment",
+		Ticket: ticket.Id,
+		Position: position,
+		EstimatedWaitSeconds: estimatedWaitSeconds,
+	}, nil
+}
+
+// promoteClaimTickets claims idle environments for the tickets at the front of the queue, skipping those over
+// the claim limits; it's run by the leader as it checks the environments, so only one api server promotes
+// tickets at a time
+func promoteClaimTickets(apiServer *ApiServer) {
+	if ! claimQueueEnabled {
+		return
+	}
+	// tickets whose session, user or ip got to a limit since they were queued wait until it frees up
+	skipped := make(map[string]bool)
+	for true {
+		queue, _, err := loadClaimQueue()
+		if err != nil {
+			logPrintf("Error loading claim queue: %v\n", err)
+			return
+		}
+		var next *ClaimTicket
+		for _, ticket := range queue.waiting() {
+			if ! skipped[ticket.Id] && ! countClaims(apiServer, &Session{Id: ticket.SessionId, UserId: ticket.UserId}, ticket.ClientIp).isLimitReached() {
+				next = ticket
+				break
+			}
+		}
+		if next == nil {
+			return
+		}
+		environment, claimToken, err := claimIdleEnvironment(apiServer, &Session{Id: next.SessionId, UserId: next.UserId}, next.ClientIp)
+		if errors.Is(err, ErrClaimLimitExceeded) {
+			skipped[next.Id] = true
+			continue
+		} else if err != nil || environment == nil {
+			return
+		}
+		promoted := false
+		err = updateClaimQueue(func(queue *claimQueue) bool {
+			promoted = false
+			ticket := queue.find(next.Id)
+			if ticket == nil || ticket.ClaimToken != "" {
+				// abandoned, or promoted by another api server
+				return false
+			}
+			now := time.Now().Unix()
+			ticket.EnvId = environment.Id
+			ticket.ClaimToken = claimToken
+			// only time spent with sessions waiting counts towards the average
+			since := queue.LastPromotedAt
+			if ticket.QueuedAt > since {
+				since = ticket.QueuedAt
+			}
+			if queue.AveragePromotionSeconds == 0 {
+				queue.AveragePromotionSeconds = float64(now - since)
+			} else {
+				queue.AveragePromotionSeconds = queue.AveragePromotionSeconds * (1 - claimQueueAverageWeight) + float64(now - since) * claimQueueAverageWeight
+			}
+			queue.LastPromotedAt = now
+			promoted = true
+			return true
+		})
+		if err != nil || ! promoted {
+			if err != nil {
+				logPrintf("Error promoting claim ticket: %v\n", err)
+			}
+			// give the environment back
+			updateEnvironment(environment, func(environment *Environment) bool {
+				if environment.ClaimToken != claimToken {
+					return false
+				}
+				resetEnvironment(environment)
+				return true
+			})
+			if err != nil {
+				return
+			}
+			continue
+		}
+		logPrintf("Promoted claim ticket to environment %s.\n", environment.Id)
+	}
+}
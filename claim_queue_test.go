@@ -0,0 +1,211 @@
+package minienv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func setTestClaimQueue(t *testing.T, enabled bool) {
+	previous := claimQueueEnabled
+	claimQueueEnabled = enabled
+	t.Cleanup(func() {
+		claimQueueEnabled = previous
+	})
+}
+
+func saveTestClaimQueue(t *testing.T, tickets ...*ClaimTicket) {
+	bs, _ := json.Marshal(&claimQueue{Tickets: tickets})
+	if err := stateStore.SetState(ClaimQueueStateKey, bs); err != nil {
+		t.Fatalf("Error saving claim queue: %v", err)
+	}
+}
+
+func getTestClaimQueue(t *testing.T) *claimQueue {
+	queue, _, err := loadClaimQueue()
+	if err != nil {
+		t.Fatalf("Error loading claim queue: %v", err)
+	}
+	return queue
+}
+
+func TestQueueClaimOrder(t *testing.T) {
+	setTestStateStore(t)
+	setTestClaimQueue(t, true)
+	saveTestEnvironments(t, &Environment{Id: "1", Version: 1, Status: StatusClaimed, ClaimToken: "claim"})
+	apiServer := newTestApiServer(1)
+	for i := 1; i <= 3; i++ {
+		response, err := apiServer.Claim(&ClaimRequest{}, &Session{Id: fmt.Sprintf("s%d", i)})
+		if err != nil || response.ClaimGranted || response.Position != i {
+			t.Fatalf("Expected session s%d queued at %d, got %v, %v", i, i, response, err)
+		}
+	}
+	// queuing again keeps the place in line
+	response, err := apiServer.Claim(&ClaimRequest{}, &Session{Id: "s2"})
+	if err != nil || response.Position != 2 {
+		t.Errorf("Expected s2 to stay at 2, got %v, %v", response, err)
+	}
+	if ! isClaimQueued() {
+		t.Errorf("Expected claims to be queued")
+	}
+}
+
+func TestPollClaimTicketDoesNotPromote(t *testing.T) {
+	setTestStateStore(t)
+	setTestClaimQueue(t, true)
+	saveTestEnvironments(t, &Environment{Id: "1", Version: 1, Status: StatusClaimed, ClaimToken: "claim"})
+	apiServer := newTestApiServer(1)
+	queued, err := apiServer.Claim(&ClaimRequest{}, &Session{Id: "s1"})
+	if err != nil || queued.Ticket == "" {
+		t.Fatalf("Expected a ticket, got %v, %v", queued, err)
+	}
+	released := getEnvironments(apiServer)[0]
+	resetEnvironment(released)
+	if err := saveEnvironment(released); err != nil {
+		t.Fatalf("Error releasing the environment: %v", err)
+	}
+	before := getTestClaimQueue(t).Tickets[0].LastActivity - 10
+	queue := getTestClaimQueue(t)
+	queue.Tickets[0].LastActivity = before
+	saveTestClaimQueue(t, queue.Tickets...)
+	response, err := apiServer.Claim(&ClaimRequest{Ticket: queued.Ticket}, &Session{Id: "s1"})
+	if err != nil || response.ClaimGranted || response.Position != 1 {
+		t.Errorf("Expected the ticket to wait for the leader, got %v, %v", response, err)
+	}
+	if environment := getSavedEnvironment(t, "1"); environment.Status != StatusIdle {
+		t.Errorf("Expected the environment to stay idle, got %d", environment.Status)
+	}
+	if ticket := getTestClaimQueue(t).Tickets[0]; ticket.LastActivity <= before {
+		t.Errorf("Expected the poll to refresh the ticket")
+	}
+	if _, err := apiServer.Claim(&ClaimRequest{Ticket: queued.Ticket}, &Session{Id: "s2"}); ! errors.Is(err, ErrClaimNotOwned) {
+		t.Errorf("Expected %v polling another session's ticket, got %v", ErrClaimNotOwned, err)
+	}
+}
+
+func TestPromoteClaimTickets(t *testing.T) {
+	setTestStateStore(t)
+	setTestClaimQueue(t, true)
+	saveTestEnvironments(t,
+		&Environment{Id: "1", Version: 1, Status: StatusClaimed, ClaimToken: "claim1", LastActivity: time.Now().Unix()},
+		&Environment{Id: "2", Version: 1, Status: StatusClaimed, ClaimToken: "claim2", LastActivity: time.Now().Unix()},
+	)
+	apiServer := newTestApiServer(2)
+	var tickets []string
+	for i := 1; i <= 3; i++ {
+		response, _ := apiServer.Claim(&ClaimRequest{}, &Session{Id: fmt.Sprintf("s%d", i)})
+		tickets = append(tickets, response.Ticket)
+	}
+	released := getEnvironments(apiServer)[1]
+	resetEnvironment(released)
+	saveEnvironment(released)
+	promoteClaimTickets(apiServer)
+	response, err := apiServer.Claim(&ClaimRequest{Ticket: tickets[0]}, &Session{Id: "s1"})
+	if err != nil || ! response.ClaimGranted {
+		t.Fatalf("Expected the first ticket to be promoted, got %v, %v", response, err)
+	}
+	if environment := getSavedEnvironment(t, "2"); environment.ClaimToken != response.ClaimToken || environment.ClaimSessionId != "s1" {
+		t.Errorf("Expected environment 2 claimed for s1, got %s", environment.ClaimSessionId)
+	}
+	for i, position := range []int{1, 2} {
+		response, err := apiServer.Claim(&ClaimRequest{Ticket: tickets[i + 1]}, &Session{Id: fmt.Sprintf("s%d", i + 2)})
+		if err != nil || response.ClaimGranted || response.Position != position {
+			t.Errorf("Expected s%d at %d, got %v, %v", i + 2, position, response, err)
+		}
+	}
+	// the promoted ticket is handed over once
+	if _, err := apiServer.Claim(&ClaimRequest{Ticket: tickets[0]}, &Session{Id: "s1"}); ! errors.Is(err, ErrClaimInvalid) {
+		t.Errorf("Expected %v, got %v", ErrClaimInvalid, err)
+	}
+}
+
+func TestClaimQueueExpiresTickets(t *testing.T) {
+	setTestStateStore(t)
+	now := time.Now().Unix()
+	saveTestClaimQueue(t,
+		&ClaimTicket{Id: "abandoned", SessionId: "s1", LastActivity: now - ExpireClaimNoActivitySeconds - 1},
+		&ClaimTicket{Id: "waiting", SessionId: "s2", LastActivity: now},
+	)
+	queue := getTestClaimQueue(t)
+	if len(queue.Tickets) != 1 || queue.Tickets[0].Id != "waiting" {
+		t.Fatalf("Expected only the waiting ticket, got %d tickets", len(queue.Tickets))
+	}
+	if position, _ := queue.getPosition("waiting"); position != 1 {
+		t.Errorf("Expected position 1, got %d", position)
+	}
+	apiServer := newTestApiServer(0)
+	if _, err := apiServer.pollClaimTicket("abandoned", &Session{Id: "s1"}); ! errors.Is(err, ErrClaimInvalid) {
+		t.Errorf("Expected %v, got %v", ErrClaimInvalid, err)
+	}
+}
+
+func setTestClaimMaxPerIp(t *testing.T, max int) {
+	previous := claimMaxPerIp
+	claimMaxPerIp = max
+	t.Cleanup(func() {
+		claimMaxPerIp = previous
+	})
+}
+
+func TestQueueClaimCountsWaitingTickets(t *testing.T) {
+	setTestStateStore(t)
+	setTestClaimQueue(t, true)
+	setTestClaimMaxPerIp(t, 2)
+	saveTestEnvironments(t, &Environment{Id: "1", Version: 1, Status: StatusClaimed, ClaimToken: "claim", ClaimIp: "10.0.0.1"})
+	apiServer := newTestApiServer(1)
+	tests := []struct {
+		session *Session
+		clientIp string
+		expected error
+	}{
+		{&Session{Id: "s1"}, "10.0.0.1", nil},
+		{&Session{Id: "s2"}, "10.0.0.1", ErrClaimLimitExceeded},
+		{&Session{Id: "s1"}, "10.0.0.1", nil},
+		{&Session{Id: "s3"}, "10.0.0.2", nil},
+	}
+	for i, test := range tests {
+		if _, err := apiServer.Claim(&ClaimRequest{ClientIp: test.clientIp}, test.session); ! errors.Is(err, test.expected) {
+			t.Errorf("%d: Expected %v, got %v", i, test.expected, err)
+		}
+	}
+	if waiting := len(getTestClaimQueue(t).waiting()); waiting != 2 {
+		t.Errorf("Expected 2 waiting tickets, got %d", waiting)
+	}
+}
+
+func TestPromoteClaimTicketsSkipsTicketsOverLimits(t *testing.T) {
+	setTestStateStore(t)
+	setTestClaimQueue(t, true)
+	setTestClaimMaxPerIp(t, 1)
+	saveTestEnvironments(t,
+		&Environment{Id: "1", Version: 1, Status: StatusIdle},
+		&Environment{Id: "2", Version: 1, Status: StatusIdle},
+	)
+	apiServer := newTestApiServer(2)
+	// queued while holding nothing, e.g. before the limit was lowered
+	now := time.Now().Unix()
+	saveTestClaimQueue(t,
+		&ClaimTicket{Id: "t1", SessionId: "s1", ClientIp: "10.0.0.1", QueuedAt: now, LastActivity: now},
+		&ClaimTicket{Id: "t2", SessionId: "s2", ClientIp: "10.0.0.1", QueuedAt: now, LastActivity: now},
+		&ClaimTicket{Id: "t3", SessionId: "s3", ClientIp: "10.0.0.2", QueuedAt: now, LastActivity: now},
+	)
+	promoteClaimTickets(apiServer)
+	queue := getTestClaimQueue(t)
+	for _, test := range []struct {
+		ticketId string
+		promoted bool
+	}{
+		{"t1", true},
+		{"t2", false},
+		{"t3", true},
+	} {
+		if ticket := queue.find(test.ticketId); ticket == nil || (ticket.ClaimToken != "") != test.promoted {
+			t.Errorf("Expected ticket %s promoted=%v", test.ticketId, test.promoted)
+		}
+	}
+	if position, _ := queue.getPosition("t2"); position != 1 {
+		t.Errorf("Expected t2 to keep its place at 1, got %d", position)
+	}
+}
@@ -0,0 +1,692 @@
+package minienv
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const ProtocolTcp = "tcp"
+const ProtocolUdp = "udp"
+
+// ranges larger than this are ignored; each port in a range becomes a tab
+const MaxComposePortRange = 100
+const MaxComposePort = 65535
+
+// labels used by services to control their tabs; each may also be scoped to a single port,
+// e.g. "minienv.tab.8080.name", which takes precedence over the service-wide label
+const LabelTabName = "name"
+const LabelTabPath = "path"
+const LabelTabHide = "hide"
+const LabelTabOrder = "order"
+const LabelTabPrefix = "minienv.tab."
+
+type ComposeProject struct {
+	Services []*ComposeService
+	// variables referenced without a default that have no value
+	MissingEnvVars []string
+	// problems found while parsing, such as invalid ports
+	Warnings []string
+	// variables referenced by the compose files
+	EnvVars []*ComposeEnvVar
+	// variables from the .env file next to the compose files
+	DotEnv map[string]string
+	// paths of the compose files, in the order they're merged
+	Files []string
+	// the active profiles, from the request and COMPOSE_PROFILES
+	Profiles []string
+}
+
+type ComposeEnvVar struct {
+	Name string
+	Default string
+	HasDefault bool
+}
+
+type ComposeService struct {
+	Name string
+	Image string
+	Build bool
+	Privileged bool
+	NetworkMode string
+	CapAdd []string
+	// host paths and volume names mounted by the service
+	Volumes []string
+	Ports []*ComposePort
+	Expose []*ComposePort
+	Labels map[string]string
+}
+
+type ComposePort struct {
+	HostIp string
+	Published int
+	Target int
+	Protocol string
+}
+
+// compose files tried, in order, when none are configured; the first one found is used
+var DefaultComposeFiles = []string{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"}
+
+const ComposeDotEnvFile = ".env"
+const ComposeProfilesEnvVar = "COMPOSE_PROFILES"
+
+type composeFileYaml struct {
+	Version interface{} `yaml:"version"`
+	Services map[string]*composeServiceYaml `yaml:"services"`
+}
+
+type composeServiceYaml struct {
+	Image string `yaml:"image"`
+	Build interface{} `yaml:"build"`
+	Privileged bool `yaml:"privileged"`
+	NetworkMode string `yaml:"network_mode"`
+	CapAdd []string `yaml:"cap_add"`
+	Volumes []interface{} `yaml:"volumes"`
+	Ports []interface{} `yaml:"ports"`
+	Expose []interface{} `yaml:"expose"`
+	Labels interface{} `yaml:"labels"`
+	Profiles []string `yaml:"profiles"`
+}
+
+// loadDockerCompose downloads the compose files for the repo, along with the .env file next to them,
+// and parses them into a single project. When no files are configured the first of DefaultComposeFiles
+// found is used, together with its override file (e.g. docker-compose.override.yml), if any. The project is
+// kept on the repo, so the tabs and the details of a deployment come from the same download.
+func loadDockerCompose(repo *DeploymentRepo) (*ComposeProject, error) {
+	if repo.composeProject != nil {
+		return repo.composeProject, nil
+	}
+	fileNames, files, dotEnv, err := downloadDockerCompose(repo)
+	if err != nil {
+		return nil, err
+	}
+	project, err := parseDockerComposeFiles(files, getComposeEnv(repo, dotEnv), repo.Profiles)
+	if err != nil {
+		return nil, err
+	}
+	project.DotEnv = dotEnv
+	project.Files = fileNames
+	repo.composeProject = project
+	return project, nil
+}
+
+// analyzeDockerCompose loads the compose files like loadDockerCompose, but without failing on variables
+// that have no value yet; those are returned in the project's MissingEnvVars, along with the names of the files used
+func analyzeDockerCompose(repo *DeploymentRepo) (*ComposeProject, []string, error) {
+	fileNames, files, dotEnv, err := downloadDockerCompose(repo)
+	if err != nil {
+		return nil, fileNames, err
+	}
+	interpolator := &composeInterpolator{Env: getComposeEnv(repo, dotEnv), Lenient: true}
+	project, err := parseComposeProject(files, interpolator, repo.Profiles)
+	if err != nil {
+		return nil, fileNames, err
+	}
+	project.DotEnv = dotEnv
+	project.Files = fileNames
+	return project, fileNames, nil
+}
+
+func downloadDockerCompose(repo *DeploymentRepo) ([]string, [][]byte, map[string]string, error) {
+	dir := repo.ComposePath
+	if dir == "" {
+		dir = composePath
+	}
+	fileNames := repo.ComposeFiles
+	if len(fileNames) == 0 {
+		fileNames = composeFiles
+	}
+	var files [][]byte
+	if len(fileNames) > 0 {
+		for _, fileName := range fileNames {
+			filePath, err := getComposeFilePath(dir, fileName)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			data, err := getRepoFile(repo, filePath)
+			if err != nil {
+				logPrintf("Error downloading compose file '%s': %v\n", fileName, err)
+				if err == errRepoFileNotFound {
+					err = ErrComposeNotFound.WithMessage("compose file '%s' not found", filePath)
+				}
+				return nil, nil, nil, err
+			}
+			files = append(files, data)
+		}
+	} else {
+		found := ""
+		for _, fileName := range DefaultComposeFiles {
+			filePath, err := getComposeFilePath(dir, fileName)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			data, err := getRepoFile(repo, filePath)
+			if err == errRepoFileNotFound {
+				continue
+			} else if err != nil {
+				logPrintf("Error downloading compose file '%s': %v\n", fileName, err)
+				return nil, nil, nil, err
+			}
+			found = fileName
+			files = append(files, data)
+			break
+		}
+		if found == "" {
+			logPrintf("No compose file found in repo '%s'.\n", repo.Repo)
+			return nil, nil, nil, ErrComposeNotFound
+		}
+		fileNames = []string{found}
+		for _, fileName := range getComposeOverrideFiles(found) {
+			filePath, err := getComposeFilePath(dir, fileName)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			data, err := getRepoFile(repo, filePath)
+			if err == nil {
+				fileNames = append(fileNames, fileName)
+				files = append(files, data)
+				break
+			} else if err != errRepoFileNotFound {
+				logPrintf("Error downloading compose override file '%s': %v\n", fileName, err)
+				return nil, nil, nil, err
+			}
+		}
+	}
+	var paths []string
+	for _, fileName := range fileNames {
+		filePath, _ := getComposeFilePath(dir, fileName)
+		paths = append(paths, filePath)
+	}
+	dotEnv := make(map[string]string)
+	dotEnvPath, _ := getComposeFilePath(dir, ComposeDotEnvFile)
+	data, err := getRepoFile(repo, dotEnvPath)
+	if err == nil {
+		dotEnv = parseDotEnv(data)
+	}
+	return paths, files, dotEnv, nil
+}
+
+// getComposeEnv returns the variables for interpolation; variables from the request take precedence over the .env file
+func getComposeEnv(repo *DeploymentRepo, dotEnv map[string]string) map[string]string {
+	env := make(map[string]string)
+	for k, v := range dotEnv {
+		env[k] = v
+	}
+	for k, v := range repo.EnvVars {
+		env[k] = v
+	}
+	return env
+}
+
+// getComposeFilePath returns the path of the file in the repo; absolute paths and ".." segments in the directory
+// or file name are refused, so requests can't read files outside the repo
+func getComposeFilePath(dir string, fileName string) (string, error) {
+	for _, p := range []string{dir, fileName} {
+		if err := checkRepoFilePath(p); err != nil {
+			return "", ErrBadRequest.WithMessage("invalid compose path; %v", err)
+		}
+	}
+	return path.Join(dir, fileName), nil
+}
+
+func getComposeOverrideFiles(fileName string) []string {
+	base := strings.TrimSuffix(strings.TrimSuffix(fileName, ".yml"), ".yaml")
+	return []string{base + ".override.yml", base + ".override.yaml"}
+}
+
+// parseDotEnv parses KEY=VALUE lines, ignoring blank lines and comments
+func parseDotEnv(data []byte) map[string]string {
+	env := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		value := ""
+		if len(parts) == 2 {
+			value = strings.TrimSpace(parts[1])
+			if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+				value = value[1 : len(value)-1]
+			}
+		}
+		env[key] = value
+	}
+	return env
+}
+
+// parseDockerCompose parses a single compose file without any variables or profiles
+func parseDockerCompose(data []byte) (*ComposeProject, error) {
+	return parseDockerComposeFiles([][]byte{data}, nil, nil)
+}
+
+// parseDockerComposeFiles interpolates each file using env and merges them in order,
+// later files overriding earlier ones. Services assigned to profiles are only included
+// when one of their profiles is active, either from profiles or COMPOSE_PROFILES in env.
+func parseDockerComposeFiles(files [][]byte, env map[string]string, profiles []string) (*ComposeProject, error) {
+	return parseComposeProject(files, &composeInterpolator{Env: env}, profiles)
+}
+
+func parseComposeProject(files [][]byte, interpolator *composeInterpolator, profiles []string) (*ComposeProject, error) {
+	env := interpolator.Env
+	services := make(map[string]*composeServiceYaml)
+	for _, data := range files {
+		fileServices, err := loadComposeServices(data, interpolator)
+		if err != nil {
+			return nil, ErrComposeInvalid.WithCause(err)
+		}
+		mergeComposeServices(services, fileServices)
+	}
+	activeProfiles := make(map[string]bool)
+	for _, profile := range profiles {
+		activeProfiles[profile] = true
+	}
+	for _, profile := range splitList(env[ComposeProfilesEnvVar]) {
+		activeProfiles[profile] = true
+	}
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	project := &ComposeProject{}
+	for profile := range activeProfiles {
+		project.Profiles = append(project.Profiles, profile)
+	}
+	sort.Strings(project.Profiles)
+	for _, name := range names {
+		serviceYaml := services[name]
+		if serviceYaml == nil {
+			serviceYaml = &composeServiceYaml{}
+		}
+		if ! isComposeServiceActive(serviceYaml, activeProfiles) {
+			continue
+		}
+		service := &ComposeService{
+			Name: name,
+			Image: serviceYaml.Image,
+			Build: serviceYaml.Build != nil,
+			Privileged: serviceYaml.Privileged,
+			NetworkMode: serviceYaml.NetworkMode,
+			CapAdd: serviceYaml.CapAdd,
+		}
+		service.Labels = parseComposeMapping(serviceYaml.Labels)
+		for _, v := range serviceYaml.Ports {
+			ports, err := parseComposePort(v)
+			if err != nil {
+				logPrintf("Ignoring port for service '%s': %v\n", name, err)
+				project.Warnings = append(project.Warnings, fmt.Sprintf("ignoring port of service '%s': %v", name, err))
+				continue
+			}
+			service.Ports = append(service.Ports, ports...)
+		}
+		for _, v := range serviceYaml.Expose {
+			ports, err := parseComposeExpose(v)
+			if err != nil {
+				logPrintf("Ignoring exposed port for service '%s': %v\n", name, err)
+				project.Warnings = append(project.Warnings, fmt.Sprintf("ignoring exposed port of service '%s': %v", name, err))
+				continue
+			}
+			service.Expose = append(service.Expose, ports...)
+		}
+		for _, v := range serviceYaml.Volumes {
+			service.Volumes = append(service.Volumes, parseComposeVolumeSource(v))
+		}
+		project.Services = append(project.Services, service)
+	}
+	project.MissingEnvVars = interpolator.Missing
+	project.EnvVars = interpolator.References
+	return project, nil
+}
+
+// parseComposeVolumeSource returns the host path or volume name of a volume in the short ("./data:/data:ro")
+// or long (type, source, target) syntax
+func parseComposeVolumeSource(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		parts := strings.Split(value, ":")
+		if len(parts) == 1 {
+			// anonymous volume
+			return ""
+		}
+		return parts[0]
+	case map[interface{}]interface{}:
+		if source, ok := value["source"]; ok && source != nil {
+			return fmt.Sprintf("%v", source)
+		}
+	}
+	return ""
+}
+
+func loadComposeServices(data []byte, interpolator *composeInterpolator) (map[string]*composeServiceYaml, error) {
+	raw := make(map[interface{}]interface{})
+	err := yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+	interpolated, err := interpolator.interpolateValue(raw)
+	if err != nil {
+		return nil, err
+	}
+	data, err = yaml.Marshal(interpolated)
+	if err != nil {
+		return nil, err
+	}
+	var file composeFileYaml
+	err = yaml.Unmarshal(data, &file)
+	if err != nil {
+		return nil, err
+	}
+	services := file.Services
+	if services == nil && file.Version == nil {
+		// version 1 files have no services key; every top-level key is a service
+		services = make(map[string]*composeServiceYaml)
+		err = yaml.Unmarshal(data, &services)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return services, nil
+}
+
+// mergeComposeServices applies overrides the way compose does: scalars are replaced,
+// ports, expose, cap_add and volumes are appended and labels are merged by key
+func mergeComposeServices(services map[string]*composeServiceYaml, overrides map[string]*composeServiceYaml) {
+	for name, override := range overrides {
+		service := services[name]
+		if service == nil {
+			services[name] = override
+			continue
+		} else if override == nil {
+			continue
+		}
+		if override.Image != "" {
+			service.Image = override.Image
+		}
+		if override.Build != nil {
+			service.Build = override.Build
+		}
+		if override.Privileged {
+			service.Privileged = true
+		}
+		if override.NetworkMode != "" {
+			service.NetworkMode = override.NetworkMode
+		}
+		service.CapAdd = append(service.CapAdd, override.CapAdd...)
+		service.Volumes = append(service.Volumes, override.Volumes...)
+		service.Ports = append(service.Ports, override.Ports...)
+		service.Expose = append(service.Expose, override.Expose...)
+		if override.Profiles != nil {
+			service.Profiles = override.Profiles
+		}
+		if override.Labels != nil {
+			labels := parseComposeMapping(service.Labels)
+			for k, v := range parseComposeMapping(override.Labels) {
+				labels[k] = v
+			}
+			service.Labels = labels
+		}
+	}
+}
+
+func isComposeServiceActive(service *composeServiceYaml, activeProfiles map[string]bool) bool {
+	if len(service.Profiles) == 0 {
+		return true
+	}
+	for _, profile := range service.Profiles {
+		if activeProfiles[profile] {
+			return true
+		}
+	}
+	// COMPOSE_PROFILES=* enables every profile
+	return activeProfiles["*"]
+}
+
+// parseComposeMapping accepts either a map or a list of "KEY=VALUE" strings, as used by labels and environment
+func parseComposeMapping(v interface{}) map[string]string {
+	mapping := make(map[string]string)
+	switch value := v.(type) {
+	case map[string]string:
+		for k, v := range value {
+			mapping[k] = v
+		}
+	case map[interface{}]interface{}:
+		for k, v := range value {
+			if v == nil {
+				mapping[fmt.Sprintf("%v", k)] = ""
+			} else {
+				mapping[fmt.Sprintf("%v", k)] = fmt.Sprintf("%v", v)
+			}
+		}
+	case []interface{}:
+		for _, element := range value {
+			parts := strings.SplitN(fmt.Sprintf("%v", element), "=", 2)
+			if len(parts) == 2 {
+				mapping[parts[0]] = parts[1]
+			} else {
+				mapping[parts[0]] = ""
+			}
+		}
+	}
+	return mapping
+}
+
+// parseComposePort handles the short syntax ("8080", "8080:80", "127.0.0.1:8080:80/udp", "3000-3005:3000-3005"),
+// bare integers and the long syntax (target, published, host_ip, protocol)
+func parseComposePort(v interface{}) ([]*ComposePort, error) {
+	switch value := v.(type) {
+	case int:
+		return expandComposePorts("", "", strconv.Itoa(value), ProtocolTcp)
+	case string:
+		return parseComposePortString(value)
+	case map[interface{}]interface{}:
+		return parseComposePortMap(value)
+	default:
+		return nil, fmt.Errorf("unsupported port definition '%v'", v)
+	}
+}
+
+func parseComposePortString(s string) ([]*ComposePort, error) {
+	s = strings.TrimSpace(s)
+	protocol := ProtocolTcp
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		protocol = strings.ToLower(s[i+1:])
+		s = s[:i]
+	}
+	hostIp := ""
+	if strings.HasPrefix(s, "[") {
+		// ipv6 host address, e.g. "[::1]:8080:80"
+		end := strings.Index(s, "]")
+		if end < 0 || end+1 >= len(s) || s[end+1] != ':' {
+			return nil, fmt.Errorf("invalid port definition '%s'", s)
+		}
+		hostIp = s[1:end]
+		s = s[end+2:]
+	}
+	parts := strings.Split(s, ":")
+	var published string
+	var target string
+	switch len(parts) {
+	case 1:
+		target = parts[0]
+	case 2:
+		published = parts[0]
+		target = parts[1]
+	case 3:
+		hostIp = parts[0]
+		published = parts[1]
+		target = parts[2]
+	default:
+		return nil, fmt.Errorf("invalid port definition '%s'", s)
+	}
+	return expandComposePorts(hostIp, published, target, protocol)
+}
+
+func parseComposePortMap(m map[interface{}]interface{}) ([]*ComposePort, error) {
+	hostIp := ""
+	published := ""
+	target := ""
+	protocol := ProtocolTcp
+	for k, v := range m {
+		key, _ := k.(string)
+		value := fmt.Sprintf("%v", v)
+		switch strings.ToLower(key) {
+		case "host_ip":
+			hostIp = value
+		case "published":
+			published = value
+		case "target":
+			target = value
+		case "protocol":
+			protocol = strings.ToLower(value)
+		}
+	}
+	if target == "" {
+		return nil, errors.New("port definition is missing target")
+	}
+	return expandComposePorts(hostIp, published, target, protocol)
+}
+
+func parseComposeExpose(v interface{}) ([]*ComposePort, error) {
+	s := fmt.Sprintf("%v", v)
+	protocol := ProtocolTcp
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		protocol = strings.ToLower(s[i+1:])
+		s = s[:i]
+	}
+	return expandComposePorts("", "", s, protocol)
+}
+
+func expandComposePorts(hostIp string, published string, target string, protocol string) ([]*ComposePort, error) {
+	targetStart, targetEnd, err := parseComposePortRange(target)
+	if err != nil {
+		return nil, err
+	}
+	publishedStart, publishedEnd := 0, 0
+	if published != "" {
+		publishedStart, publishedEnd, err = parseComposePortRange(published)
+		if err != nil {
+			return nil, err
+		}
+	}
+	count := targetEnd - targetStart + 1
+	if count > MaxComposePortRange {
+		return nil, fmt.Errorf("port range '%s' is larger than %d ports", target, MaxComposePortRange)
+	}
+	if published != "" && count > 1 && publishedEnd-publishedStart+1 != count {
+		return nil, fmt.Errorf("port ranges '%s' and '%s' do not match", published, target)
+	}
+	var ports []*ComposePort
+	for i := 0; i < count; i++ {
+		port := &ComposePort{HostIp: hostIp, Target: targetStart + i, Protocol: protocol}
+		if published != "" {
+			if count > 1 {
+				port.Published = publishedStart + i
+			} else {
+				// a single target may be published on any port in a range; use the first
+				port.Published = publishedStart
+			}
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// parseComposePortRange parses "8080" or "8080-8085"; ports must be between 1 and MaxComposePort
+func parseComposePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	start, err := strconv.Atoi(parts[0])
+	if err != nil || start < 1 || start > MaxComposePort {
+		return 0, 0, fmt.Errorf("invalid port '%s'", s)
+	}
+	end := start
+	if len(parts) == 2 {
+		end, err = strconv.Atoi(parts[1])
+		if err != nil || end < start || end > MaxComposePort {
+			return 0, 0, fmt.Errorf("invalid port range '%s'", s)
+		}
+	}
+	return start, end, nil
+}
+
+// HostPort returns the port the service is reachable on inside the environment
+func (port *ComposePort) HostPort() int {
+	if port.Published > 0 {
+		return port.Published
+	}
+	return port.Target
+}
+
+// getTabLabel returns the port-specific label, falling back to the service-wide label
+func (service *ComposeService) getTabLabel(port int, name string) (string, bool) {
+	value, ok := service.Labels[fmt.Sprintf("%s%d.%s", LabelTabPrefix, port, name)]
+	if ! ok {
+		value, ok = service.Labels[LabelTabPrefix + name]
+	}
+	return strings.TrimSpace(value), ok
+}
+
+// getComposeTabs returns one tab per published tcp port, ordered by service name and then declaration order; a
+// port already used by an earlier service is skipped. Exposed ports are only reachable by the other services,
+// so they get no tabs.
+// Tabs with a "minienv.tab.order" label are moved ahead of the rest, lowest order first.
+func getComposeTabs(project *ComposeProject) []*DeploymentTab {
+	tabs := []*DeploymentTab{}
+	orders := make(map[*DeploymentTab]int)
+	used := make(map[int]bool)
+	for _, service := range project.Services {
+		for _, port := range service.Ports {
+			if port.Protocol != ProtocolTcp {
+				continue
+			}
+			hostPort := port.HostPort()
+			if used[hostPort] {
+				continue
+			}
+			used[hostPort] = true
+			tab := &DeploymentTab{}
+			tab.Port = hostPort
+			tab.Name = strconv.Itoa(hostPort)
+			tab.Service = service.Name
+			if name, ok := service.getTabLabel(hostPort, LabelTabName); ok && name != "" {
+				tab.Name = name
+			}
+			if path, ok := service.getTabLabel(hostPort, LabelTabPath); ok && path != "" {
+				if ! strings.HasPrefix(path, "/") {
+					path = "/" + path
+				}
+				tab.Path = path
+			}
+			if hide, ok := service.getTabLabel(hostPort, LabelTabHide); ok {
+				// a bare label (no value) hides the tab
+				hidden, err := strconv.ParseBool(hide)
+				tab.Hide = hide == "" || (err == nil && hidden)
+			}
+			if orderStr, ok := service.getTabLabel(hostPort, LabelTabOrder); ok {
+				order, err := strconv.Atoi(orderStr)
+				if err != nil {
+					logPrintf("Ignoring invalid tab order '%s' for service '%s'\n", orderStr, service.Name)
+				} else {
+					orders[tab] = order
+				}
+			}
+			tabs = append(tabs, tab)
+		}
+	}
+	sort.SliceStable(tabs, func(i, j int) bool {
+		orderI, okI := orders[tabs[i]]
+		orderJ, okJ := orders[tabs[j]]
+		if okI && okJ {
+			return orderI < orderJ
+		}
+		return okI && ! okJ
+	})
+	return tabs
+}
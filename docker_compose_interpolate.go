@@ -0,0 +1,207 @@
+package minienv
+
+import (
+	"fmt"
+	"strings"
+)
+
+// composeInterpolator substitutes $VAR and ${VAR} references in compose values, supporting
+// the ${VAR:-default}, ${VAR-default}, ${VAR:?error}, ${VAR?error}, ${VAR:+alt} and ${VAR+alt}
+// forms; "$$" is an escaped "$". Unset variables without a default resolve to an empty string.
+// Such variables are recorded in Missing; when Lenient, variables marked required with "?" are
+// recorded there too rather than failing, so a repo can be analyzed before its variables are known.
+// Every variable referenced is recorded in References, in order, with its default if it has one.
+type composeInterpolator struct {
+	Env map[string]string
+	Lenient bool
+	Missing []string
+	References []*ComposeEnvVar
+}
+
+func (interpolator *composeInterpolator) interpolateValue(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case string:
+		return interpolator.interpolate(value)
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{})
+		for k, element := range value {
+			interpolated, err := interpolator.interpolateValue(element)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = interpolated
+		}
+		return m, nil
+	case []interface{}:
+		slc := make([]interface{}, len(value))
+		for i, element := range value {
+			interpolated, err := interpolator.interpolateValue(element)
+			if err != nil {
+				return nil, err
+			}
+			slc[i] = interpolated
+		}
+		return slc, nil
+	default:
+		return v, nil
+	}
+}
+
+func (interpolator *composeInterpolator) interpolate(s string) (string, error) {
+	if ! strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if s[i+1] == '$' {
+			b.WriteByte('$')
+			i++
+		} else if s[i+1] == '{' {
+			end := findClosingBrace(s, i+1)
+			if end < 0 {
+				return "", fmt.Errorf("invalid interpolation format for '%s'", s)
+			}
+			value, err := interpolator.expand(s[i+2 : end])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i = end
+		} else {
+			end := i + 1
+			for end < len(s) && isEnvVarNameChar(s[end], end == i+1) {
+				end++
+			}
+			if end == i+1 {
+				b.WriteByte(s[i])
+				continue
+			}
+			b.WriteString(interpolator.lookup(s[i+1 : end]))
+			i = end - 1
+		}
+	}
+	return b.String(), nil
+}
+
+func (interpolator *composeInterpolator) expand(expr string) (string, error) {
+	n := 0
+	for n < len(expr) && isEnvVarNameChar(expr[n], n == 0) {
+		n++
+	}
+	name := expr[:n]
+	if name == "" {
+		return "", fmt.Errorf("invalid interpolation format for '${%s}'", expr)
+	}
+	value, set := interpolator.Env[name]
+	operator := expr[n:]
+	if strings.HasPrefix(operator, ":-") {
+		interpolator.addReference(name, operator[2:], true)
+	} else if strings.HasPrefix(operator, "-") {
+		interpolator.addReference(name, operator[1:], true)
+	} else if operator != "" {
+		interpolator.addReference(name, "", false)
+	}
+	switch {
+	case operator == "":
+		return interpolator.lookup(name), nil
+	case strings.HasPrefix(operator, ":-"):
+		if ! set || value == "" {
+			return interpolator.interpolate(operator[2:])
+		}
+		return value, nil
+	case strings.HasPrefix(operator, "-"):
+		if ! set {
+			return interpolator.interpolate(operator[1:])
+		}
+		return value, nil
+	case strings.HasPrefix(operator, ":?"):
+		if ! set || value == "" {
+			return interpolator.missing(name, operator[2:])
+		}
+		return value, nil
+	case strings.HasPrefix(operator, "?"):
+		if ! set {
+			return interpolator.missing(name, operator[1:])
+		}
+		return value, nil
+	case strings.HasPrefix(operator, ":+"):
+		if set && value != "" {
+			return interpolator.interpolate(operator[2:])
+		}
+		return "", nil
+	case strings.HasPrefix(operator, "+"):
+		if set {
+			return interpolator.interpolate(operator[1:])
+		}
+		return "", nil
+	default:
+		return "", fmt.Errorf("invalid interpolation format for '${%s}'", expr)
+	}
+}
+
+func (interpolator *composeInterpolator) lookup(name string) string {
+	interpolator.addReference(name, "", false)
+	value, set := interpolator.Env[name]
+	if ! set {
+		interpolator.addMissing(name)
+	}
+	return value
+}
+
+func (interpolator *composeInterpolator) missing(name string, message string) (string, error) {
+	if ! interpolator.Lenient {
+		return "", fmt.Errorf("required variable %s is missing a value: %s", name, message)
+	}
+	interpolator.addMissing(name)
+	return "", nil
+}
+
+// addReference records a variable the first time it's referenced; a default given by a later reference is kept
+func (interpolator *composeInterpolator) addReference(name string, defaultValue string, hasDefault bool) {
+	for _, element := range interpolator.References {
+		if element.Name == name {
+			if hasDefault && ! element.HasDefault {
+				element.Default = defaultValue
+				element.HasDefault = true
+			}
+			return
+		}
+	}
+	interpolator.References = append(interpolator.References, &ComposeEnvVar{Name: name, Default: defaultValue, HasDefault: hasDefault})
+}
+
+func (interpolator *composeInterpolator) addMissing(name string) {
+	for _, element := range interpolator.Missing {
+		if element == name {
+			return
+		}
+	}
+	interpolator.Missing = append(interpolator.Missing, name)
+}
+
+// findClosingBrace returns the index of the brace closing the one at open, allowing nested ${...}
+func findClosingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		if s[i] == '{' {
+			depth++
+		} else if s[i] == '}' {
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isEnvVarNameChar(c byte, first bool) bool {
+	if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+		return true
+	}
+	return ! first && c >= '0' && c <= '9'
+}
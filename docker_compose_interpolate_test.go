@@ -0,0 +1,121 @@
+package minienv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestComposeInterpolate(t *testing.T) {
+	env := map[string]string{"SET": "value", "EMPTY": "", "OTHER": "other"}
+	tests := []struct {
+		name string
+		input string
+		expected string
+	}{
+		{"no variables", "plain text", "plain text"},
+		{"bare", "$SET", "value"},
+		{"braces", "${SET}", "value"},
+		{"embedded", "a-${SET}-b", "a-value-b"},
+		{"bare name ends at non name char", "$SET.txt", "value.txt"},
+		{"escaped", "$$SET", "$SET"},
+		{"escaped braces", "$${SET}", "${SET}"},
+		{"trailing dollar", "cost$", "cost$"},
+		{"dollar before non name char", "$-1", "$-1"},
+		{"unset", "${UNSET}", ""},
+		{"unset bare", "x$UNSET", "x"},
+		{"colon default unset", "${UNSET:-d}", "d"},
+		{"colon default empty", "${EMPTY:-d}", "d"},
+		{"colon default set", "${SET:-d}", "value"},
+		{"default unset", "${UNSET-d}", "d"},
+		{"default empty", "${EMPTY-d}", ""},
+		{"empty default", "${UNSET:-}", ""},
+		{"nested default", "${UNSET:-${OTHER}}", "other"},
+		{"nested default with escape", "${UNSET:-$$x}", "$x"},
+		{"colon required set", "${SET:?missing}", "value"},
+		{"required empty", "${EMPTY?missing}", ""},
+		{"colon alternate set", "${SET:+alt}", "alt"},
+		{"colon alternate empty", "${EMPTY:+alt}", ""},
+		{"colon alternate unset", "${UNSET:+alt}", ""},
+		{"alternate empty", "${EMPTY+alt}", "alt"},
+		{"alternate unset", "${UNSET+alt}", ""},
+		{"several", "${SET}:${OTHER}:$$", "value:other:$"},
+	}
+	for _, test := range tests {
+		interpolator := &composeInterpolator{Env: env}
+		actual, err := interpolator.interpolate(test.input)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", test.name, err)
+		} else if actual != test.expected {
+			t.Errorf("%s: expected '%s', got '%s'", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestComposeInterpolateErrors(t *testing.T) {
+	env := map[string]string{"EMPTY": ""}
+	tests := []struct {
+		name string
+		input string
+		expected string
+	}{
+		{"unclosed brace", "${UNSET", "invalid interpolation format"},
+		{"empty name", "${}", "invalid interpolation format"},
+		{"invalid name", "${-x}", "invalid interpolation format"},
+		{"invalid operator", "${UNSET!x}", "invalid interpolation format"},
+		{"colon required unset", "${UNSET:?set it}", "required variable UNSET is missing a value: set it"},
+		{"colon required empty", "${EMPTY:?set it}", "required variable EMPTY"},
+		{"required unset", "${UNSET?set it}", "required variable UNSET"},
+		{"required in default", "${UNSET:-${OTHER:?x}}", "required variable OTHER"},
+	}
+	for _, test := range tests {
+		interpolator := &composeInterpolator{Env: env}
+		_, err := interpolator.interpolate(test.input)
+		if err == nil || ! strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected error '%s', got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestComposeInterpolateLenient(t *testing.T) {
+	interpolator := &composeInterpolator{Env: map[string]string{"EMPTY": ""}, Lenient: true}
+	actual, err := interpolator.interpolate("${REQUIRED:?x}-${EMPTY:?x}-$UNSET-${UNSET}-${DEFAULTED:-d}")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if actual != "----d" {
+		t.Errorf("Expected '----d', got '%s'", actual)
+	}
+	expected := []string{"REQUIRED", "EMPTY", "UNSET"}
+	if strings.Join(interpolator.Missing, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected missing %v, got %v", expected, interpolator.Missing)
+	}
+}
+
+func TestComposeInterpolateReferences(t *testing.T) {
+	interpolator := &composeInterpolator{Env: map[string]string{}}
+	_, err := interpolator.interpolateValue(map[interface{}]interface{}{
+		"image": "${IMAGE}",
+		"ports": []interface{}{"${PORT}:80", 8080},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// a default given by a later reference is kept
+	interpolator.interpolate("${IMAGE:-nginx} ${TAG-latest} ${TAG:-other}")
+	references := make(map[string]*ComposeEnvVar)
+	for _, reference := range interpolator.References {
+		references[reference.Name] = reference
+	}
+	if len(references) != 3 || len(interpolator.References) != 3 {
+		t.Fatalf("Expected 3 references, got %d", len(interpolator.References))
+	}
+	if reference := references["IMAGE"]; ! reference.HasDefault || reference.Default != "nginx" {
+		t.Errorf("Expected IMAGE default 'nginx', got %+v", reference)
+	}
+	if reference := references["TAG"]; ! reference.HasDefault || reference.Default != "latest" {
+		t.Errorf("Expected TAG default 'latest', got %+v", reference)
+	}
+	if reference := references["PORT"]; reference.HasDefault {
+		t.Errorf("Expected PORT without default, got %+v", reference)
+	}
+}
@@ -0,0 +1,240 @@
+package minienv
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func formatComposePorts(ports []*ComposePort) string {
+	var formatted []string
+	for _, port := range ports {
+		formatted = append(formatted, fmt.Sprintf("%s|%d|%d|%s", port.HostIp, port.Published, port.Target, port.Protocol))
+	}
+	return strings.Join(formatted, ",")
+}
+
+func TestParseComposePort(t *testing.T) {
+	tests := []struct {
+		port string
+		expected string
+	}{
+		// short syntax
+		{`"80"`, "|0|80|tcp"},
+		{`80`, "|0|80|tcp"},
+		{`"8080:80"`, "|8080|80|tcp"},
+		{`"127.0.0.1:8080:80"`, "127.0.0.1|8080|80|tcp"},
+		{`"127.0.0.1::80"`, "127.0.0.1|0|80|tcp"},
+		// ranges
+		{`"3000-3002"`, "|0|3000|tcp,|0|3001|tcp,|0|3002|tcp"},
+		{`"9090-9091:8080-8081"`, "|9090|8080|tcp,|9091|8081|tcp"},
+		{`"9000-9010:80"`, "|9000|80|tcp"},
+		// ipv6 host addresses
+		{`"[::1]:8080:80"`, "::1|8080|80|tcp"},
+		{`"[2001:db8::1]:8080-8081:80-81/udp"`, "2001:db8::1|8080|80|udp,2001:db8::1|8081|81|udp"},
+		// protocol suffixes
+		{`"53:53/udp"`, "|53|53|udp"},
+		{`"8080:80/TCP"`, "|8080|80|tcp"},
+		{`"127.0.0.1:5000:5000/sctp"`, "127.0.0.1|5000|5000|sctp"},
+		// long syntax
+		{`{target: 80}`, "|0|80|tcp"},
+		{`{target: 80, published: 8080}`, "|8080|80|tcp"},
+		{`{target: 80, published: "8080", host_ip: 127.0.0.1, protocol: udp}`, "127.0.0.1|8080|80|udp"},
+		{`{target: 80, published: 8080-8081}`, "|8080|80|tcp"},
+		{`{target: 65535, published: 1}`, "|1|65535|tcp"},
+	}
+	for _, test := range tests {
+		var v interface{}
+		if err := yaml.Unmarshal([]byte(test.port), &v); err != nil {
+			t.Fatalf("%s: error parsing yaml: %v", test.port, err)
+		}
+		ports, err := parseComposePort(v)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", test.port, err)
+		} else if actual := formatComposePorts(ports); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.port, test.expected, actual)
+		}
+	}
+}
+
+func TestParseComposePortInvalid(t *testing.T) {
+	tests := []string{
+		`0`,
+		`65536`,
+		`-1`,
+		`"0:80"`,
+		`"8080:0"`,
+		`"70000:80"`,
+		`"8080:65536"`,
+		`"65535-65536"`,
+		`"8080-8079"`,
+		`"1-200"`,
+		`"8080-8082:80-81"`,
+		`"http"`,
+		`"1.2.3.4:5:6:7"`,
+		`"[::1:8080:80"`,
+		`"[::1]8080:80"`,
+		`{published: 8080}`,
+		`{target: 0}`,
+		`{target: 80, published: 99999}`,
+		`[80]`,
+	}
+	for _, test := range tests {
+		var v interface{}
+		if err := yaml.Unmarshal([]byte(test), &v); err != nil {
+			t.Fatalf("%s: error parsing yaml: %v", test, err)
+		}
+		if ports, err := parseComposePort(v); err == nil {
+			t.Errorf("%s: expected error, got %s", test, formatComposePorts(ports))
+		}
+	}
+}
+
+func TestParseComposeExpose(t *testing.T) {
+	tests := []struct {
+		expose interface{}
+		expected string
+		valid bool
+	}{
+		{3000, "|0|3000|tcp", true},
+		{"3000-3001", "|0|3000|tcp,|0|3001|tcp", true},
+		{"5000/udp", "|0|5000|udp", true},
+		{0, "", false},
+		{"65536", "", false},
+	}
+	for _, test := range tests {
+		ports, err := parseComposeExpose(test.expose)
+		if (err == nil) != test.valid || formatComposePorts(ports) != test.expected {
+			t.Errorf("%v: expected %s (valid=%t), got %s, %v", test.expose, test.expected, test.valid, formatComposePorts(ports), err)
+		}
+	}
+}
+
+func TestGetComposeTabsPorts(t *testing.T) {
+	project, err := parseDockerComposeFiles([][]byte{[]byte(`
+services:
+  web:
+    image: nginx
+    ports:
+      - "8080:80"
+      - "53:53/udp"
+      - "70000:80"
+    expose:
+      - "3000"
+  api:
+    image: api
+    ports:
+      - "8080:8080"
+      - target: 9000
+    expose:
+      - "9001"
+  db:
+    image: postgres
+    expose:
+      - "5432"
+`)}, nil, nil)
+	if err != nil {
+		t.Fatalf("Error parsing compose file: %v", err)
+	}
+	var tabs []string
+	for _, tab := range getComposeTabs(project) {
+		tabs = append(tabs, fmt.Sprintf("%s:%d", tab.Service, tab.Port))
+	}
+	// published tcp ports only, in service name order, without ports already used
+	if fmt.Sprint(tabs) != "[api:8080 api:9000]" {
+		t.Errorf("Expected [api:8080 api:9000], got %v", tabs)
+	}
+	if len(project.Warnings) != 1 || ! strings.Contains(project.Warnings[0], "70000") {
+		t.Errorf("Expected a warning for the invalid port, got %v", project.Warnings)
+	}
+}
+
+func TestGetComposeTabsLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		labels string
+		expected string
+	}{
+		{"no labels", ``, "8080||false,9090||false"},
+		{"map name and path", `
+      minienv.tab.name: Web
+      minienv.tab.path: /app`, "Web|/app|false,Web|/app|false"},
+		{"list name and path", `
+      - minienv.tab.name=Web
+      - minienv.tab.path=app`, "Web|/app|false,Web|/app|false"},
+		{"map port scoped", `
+      minienv.tab.name: Web
+      minienv.tab.9090.name: Admin
+      minienv.tab.9090.path: admin/`, "Web||false,Admin|/admin/|false"},
+		{"list port scoped", `
+      - minienv.tab.name=Web
+      - minienv.tab.9090.name=Admin
+      - "minienv.tab.9090.path=/admin?x=1"`, "Web||false,Admin|/admin?x=1|false"},
+		{"map hide", `
+      minienv.tab.9090.hide: "true"`, "8080||false,9090||true"},
+		{"map bare hide", `
+      minienv.tab.hide:`, "8080||true,9090||true"},
+		{"list bare hide", `
+      - minienv.tab.8080.hide`, "8080||true,9090||false"},
+		{"list hide false", `
+      - minienv.tab.hide=true
+      - minienv.tab.9090.hide=false`, "8080||true,9090||false"},
+		{"invalid hide", `
+      minienv.tab.hide: "maybe"`, "8080||false,9090||false"},
+		{"blank name and path", `
+      minienv.tab.name: " "
+      minienv.tab.path: ""`, "8080||false,9090||false"},
+		{"map order", `
+      minienv.tab.9090.order: "1"`, "9090||false,8080||false"},
+		{"list invalid order", `
+      - minienv.tab.9090.order=first`, "8080||false,9090||false"},
+		{"other labels", `
+      com.example.name: other
+      minienv.tabs.name: other`, "8080||false,9090||false"},
+	}
+	for _, test := range tests {
+		compose := "services:\n  web:\n    image: nginx\n    ports:\n      - \"8080:80\"\n      - \"9090:90\"\n"
+		if test.labels != "" {
+			compose += "    labels:" + test.labels + "\n"
+		}
+		project, err := parseDockerComposeFiles([][]byte{[]byte(compose)}, nil, nil)
+		if err != nil {
+			t.Fatalf("%s: error parsing compose file: %v", test.name, err)
+		}
+		var tabs []string
+		for _, tab := range getComposeTabs(project) {
+			tabs = append(tabs, fmt.Sprintf("%s|%s|%t", tab.Name, tab.Path, tab.Hide))
+		}
+		if actual := strings.Join(tabs, ","); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestGetComposeTabsLabelsFromOverrides(t *testing.T) {
+	project, err := parseDockerComposeFiles([][]byte{[]byte(`
+services:
+  web:
+    image: nginx
+    ports:
+      - "8080:80"
+    labels:
+      - minienv.tab.name=Web
+      - minienv.tab.path=/base
+`), []byte(`
+services:
+  web:
+    labels:
+      minienv.tab.path: /override
+      minienv.tab.hide: "false"
+`)}, nil, nil)
+	if err != nil {
+		t.Fatalf("Error parsing compose files: %v", err)
+	}
+	tabs := getComposeTabs(project)
+	if len(tabs) != 1 || tabs[0].Name != "Web" || tabs[0].Path != "/override" || tabs[0].Hide {
+		t.Errorf("Expected the labels of both files merged, got %+v", tabs)
+	}
+}
@@ -0,0 +1,247 @@
+package minienv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// environments are saved in the state store at env/<id>, so the pool survives restarts and is shared by api servers
+const EnvStateKeyPrefix = "env/"
+
+// pings save the last activity once it's this far ahead of the saved one, rather than on every ping
+const EnvStateActivitySaveSeconds int64 = 60
+
+// how many times updateEnvironment retries a change other api servers keep beating it to
+const EnvStateUpdateAttempts = 5
+
+// guards the environments in the pool, which syncs and saves replace while requests are handled. Requests and
+// checks work on copies (see getEnvironments), which saves publish to the pool once the state store has them.
+var environmentsMutex sync.RWMutex
+
+func getEnvStateKey(envId string) string {
+	return EnvStateKeyPrefix + envId
+}
+
+// saveEnvironment saves the next version of the environment. If another api server saved it since it was
+// loaded, the environment is reloaded from the state store and ErrConflict is returned.
+func saveEnvironment(environment *Environment) (error) {
+	environment.Version++
+	bs, err := json.Marshal(environment)
+	if err != nil {
+		environment.Version--
+		logPrintf("Error serializing environment %s: %v\n", environment.Id, err)
+		return err
+	}
+	swapped, err := stateStore.CompareAndSwapState(getEnvStateKey(environment.Id), environment.savedState, bs)
+	if err != nil {
+		environment.Version--
+		logPrintf("Error saving environment %s: %v\n", environment.Id, err)
+		return err
+	} else if ! swapped {
+		logPrintf("Environment %s was changed by another api server; reloading it.\n", environment.Id)
+		reloadEnvironment(environment)
+		publishEnvironment(environment)
+		return ErrConflict
+	}
+	environment.savedActivity = environment.LastActivity
+	environment.savedState = bs
+	publishEnvironment(environment)
+	return nil
+}
+
+// getEnvironments returns copies of the environments in the pool, to read and update
+func getEnvironments(apiServer *ApiServer) []*Environment {
+	environmentsMutex.RLock()
+	defer environmentsMutex.RUnlock()
+	environments := make([]*Environment, len(apiServer.Environments))
+	for i, element := range apiServer.Environments {
+		copied := *element
+		copied.pooled = element
+		environments[i] = &copied
+	}
+	return environments
+}
+
+// publishEnvironment replaces the environment in the pool with the copy, unless the pool has a newer version
+func publishEnvironment(environment *Environment) {
+	if environment.pooled == nil {
+		return
+	}
+	environmentsMutex.Lock()
+	defer environmentsMutex.Unlock()
+	pooled := environment.pooled
+	if pooled.Version <= environment.Version {
+		*pooled = *environment
+		pooled.pooled = nil
+	}
+}
+
+// updateEnvironment applies update and saves the environment, re-applying it to the latest version on conflicts.
+// update returns false if the change no longer applies, in which case ErrConflict is returned.
+func updateEnvironment(environment *Environment, update func(environment *Environment) bool) (error) {
+	for i := 0; i < EnvStateUpdateAttempts; i++ {
+		if ! update(environment) {
+			return ErrConflict
+		}
+		err := saveEnvironment(environment)
+		if ! errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+func unmarshalEnvironment(envId string, bs []byte) (*Environment, error) {
+	var environment Environment
+	err := json.Unmarshal(bs, &environment)
+	if err != nil {
+		return nil, err
+	}
+	environment.Id = envId
+	environment.savedActivity = environment.LastActivity
+	environment.savedState = bs
+	return &environment, nil
+}
+
+// loadEnvironments returns the saved environments by id
+func loadEnvironments() (map[string]*Environment, error) {
+	state, err := stateStore.ListState(EnvStateKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	environments := make(map[string]*Environment)
+	for key, value := range state {
+		envId := strings.TrimPrefix(key, EnvStateKeyPrefix)
+		environment, err := unmarshalEnvironment(envId, value)
+		if err != nil {
+			logPrintf("Error loading environment %s: %v\n", envId, err)
+			continue
+		}
+		environments[envId] = environment
+	}
+	return environments, nil
+}
+
+func reloadEnvironment(environment *Environment) {
+	bs, err := stateStore.GetState(getEnvStateKey(environment.Id))
+	if err != nil || bs == nil {
+		logPrintf("Error reloading environment %s: %v\n", environment.Id, err)
+		return
+	}
+	saved, err := unmarshalEnvironment(environment.Id, bs)
+	if err != nil {
+		logPrintf("Error reloading environment %s: %v\n", environment.Id, err)
+		return
+	}
+	saved.pooled = environment.pooled
+	*environment = *saved
+}
+
+// syncEnvironments replaces environments other api servers changed with their saved state
+func syncEnvironments(apiServer *ApiServer) {
+	state, err := stateStore.ListState(EnvStateKeyPrefix)
+	if err != nil {
+		logPrintf("Error syncing environments: %v\n", err)
+		return
+	}
+	environmentsMutex.Lock()
+	defer environmentsMutex.Unlock()
+	for _, environment := range apiServer.Environments {
+		bs := state[getEnvStateKey(environment.Id)]
+		if bs == nil || bytes.Equal(bs, environment.savedState) {
+			continue
+		}
+		saved, err := unmarshalEnvironment(environment.Id, bs)
+		if err != nil {
+			logPrintf("Error syncing environment %s: %v\n", environment.Id, err)
+			continue
+		}
+		*environment = *saved
+	}
+}
+
+// loadEnvironmentPool builds the pool from the saved environments, for api servers that aren't the leader;
+// environments not saved yet are assumed to be provisioning until the leader saves them, or provisions them
+// if the leader went away first
+func loadEnvironmentPool(apiServer *ApiServer, envCount int) {
+	savedEnvironments, err := loadEnvironments()
+	if err != nil {
+		logPrintf("Error loading saved environments: %v\n", err)
+	}
+	for i := 0; i < envCount; i++ {
+		environment := savedEnvironments[strconv.Itoa(i + 1)]
+		if environment == nil {
+			environment = &Environment{Id: strconv.Itoa(i + 1), Status: StatusProvisioning}
+		}
+		apiServer.Environments = append(apiServer.Environments, environment)
+	}
+}
+
+func deleteEnvironmentState(envId string) {
+	err := stateStore.DeleteState(getEnvStateKey(envId))
+	if err != nil {
+		logPrintf("Error deleting saved environment %s: %v\n", envId, err)
+	}
+}
+
+// touchEnvironment records activity on the environment, saving it if the saved activity is getting stale.
+// Claims expire quickly, so their activity is saved more often; the leader may be another api server.
+func touchEnvironment(environment *Environment) {
+	claimToken := environment.ClaimToken
+	now := time.Now().Unix()
+	environment.LastActivity = now
+	if environment.pooled != nil {
+		environmentsMutex.Lock()
+		if environment.pooled.ClaimToken == claimToken {
+			environment.pooled.LastActivity = now
+		}
+		environmentsMutex.Unlock()
+	}
+	saveSeconds := EnvStateActivitySaveSeconds
+	if environment.Status == StatusClaimed {
+		saveSeconds = ExpireClaimNoActivitySeconds / 3
+	}
+	if now - environment.savedActivity >= saveSeconds {
+		updateEnvironment(environment, func(environment *Environment) bool {
+			if environment.ClaimToken != claimToken {
+				return false
+			}
+			environment.LastActivity = now
+			return true
+		})
+	}
+}
+
+// clearEnvDeployment forgets what was deployed to the environment; once it's saved, the caller
+// clears the environment from its session, unless another api server changed it first
+func clearEnvDeployment(environment *Environment) {
+	environment.Repo = ""
+	environment.GitCredsSecret = ""
+	environment.Branch = ""
+	environment.Tag = ""
+	environment.PullRequest = 0
+	environment.Commit = ""
+	environment.Details = nil
+	environment.ExpirationSeconds = 0
+	environment.Props = nil
+	environment.SessionId = ""
+}
+
+// resetEnvironment returns the environment to the pool; the caller saves it once its new status is set
+func resetEnvironment(environment *Environment) {
+	environment.Status = StatusIdle
+	environment.ClaimToken = ""
+	environment.ClaimSessionId = ""
+	environment.ClaimUserId = ""
+	environment.ClaimIp = ""
+	environment.SharedSessionIds = nil
+	environment.ClaimShares = nil
+	environment.ClaimedAt = 0
+	environment.LastActivity = 0
+	clearEnvDeployment(environment)
+}
@@ -0,0 +1,287 @@
+package minienv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testKube stands in for the kubernetes api, for the provisioning of environments
+type testKube struct {
+	mutex sync.Mutex
+	requests []string
+	// labels of the provisioner pods still running
+	provisioning map[string]bool
+}
+
+func newTestKube(t *testing.T) *testKube {
+	kube := &testKube{provisioning: make(map[string]bool)}
+	setTestKubeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		kube.mutex.Lock()
+		defer kube.mutex.Unlock()
+		kube.requests = append(kube.requests, r.Method + " " + r.URL.Path)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/pods") && r.Method == "GET":
+			var items []string
+			for label, running := range kube.provisioning {
+				if running {
+					items = append(items, fmt.Sprintf(`{"metadata":{"name":"%s-pod","labels":{"app":"%s"}},"status":{"phase":"Running"}}`, label, label))
+				}
+			}
+			fmt.Fprintf(w, `{"kind":"PodList","items":[%s]}`, strings.Join(items, ","))
+		case strings.Contains(r.URL.Path, "/persistentvolumeclaims"):
+			w.Write([]byte(`{"kind":"PersistentVolumeClaim"}`))
+		case strings.HasSuffix(r.URL.Path, "/jobs") && r.Method == "POST":
+			w.Write([]byte(`{"kind":"Job"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status"}`))
+		}
+	})
+	return kube
+}
+
+func (kube *testKube) setProvisioning(envId string, running bool) {
+	kube.mutex.Lock()
+	kube.provisioning[getProvisionerAppLabel(envId)] = running
+	kube.mutex.Unlock()
+}
+
+func (kube *testKube) count(request string) int {
+	kube.mutex.Lock()
+	defer kube.mutex.Unlock()
+	count := 0
+	for _, element := range kube.requests {
+		if element == request {
+			count++
+		}
+	}
+	return count
+}
+
+func saveTestEnvironments(t *testing.T, environments ...*Environment) {
+	for _, environment := range environments {
+		bs, _ := json.Marshal(environment)
+		if err := stateStore.SetState(getEnvStateKey(environment.Id), bs); err != nil {
+			t.Fatalf("Error saving environment %s: %v", environment.Id, err)
+		}
+	}
+}
+
+func newTestApiServer(envCount int) *ApiServer {
+	apiServer := &ApiServer{EnvManager: &BaseKubeEnvManager{}}
+	loadEnvironmentPool(apiServer, envCount)
+	return apiServer
+}
+
+func getSavedEnvironment(t *testing.T, envId string) *Environment {
+	bs, err := stateStore.GetState(getEnvStateKey(envId))
+	if err != nil || bs == nil {
+		t.Fatalf("Expected environment %s to be saved, got %v", envId, err)
+	}
+	environment, err := unmarshalEnvironment(envId, bs)
+	if err != nil {
+		t.Fatalf("Error loading environment %s: %v", envId, err)
+	}
+	return environment
+}
+
+func TestSaveEnvironmentConflict(t *testing.T) {
+	setTestStateStore(t)
+	saveTestEnvironments(t, &Environment{Id: "1", Version: 1, Status: StatusIdle})
+	apiServer1 := newTestApiServer(1)
+	apiServer2 := newTestApiServer(1)
+	environment1 := getEnvironments(apiServer1)[0]
+	environment2 := getEnvironments(apiServer2)[0]
+	environment1.Status = StatusClaimed
+	environment1.ClaimToken = "claim1"
+	if err := saveEnvironment(environment1); err != nil {
+		t.Fatalf("Expected save to succeed, got %v", err)
+	}
+	environment2.Status = StatusClaimed
+	environment2.ClaimToken = "claim2"
+	if err := saveEnvironment(environment2); ! errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected %v, got %v", ErrConflict, err)
+	}
+	// the losing copy is reloaded, and both pools have the saved version
+	if environment2.ClaimToken != "claim1" || environment2.Version != 2 {
+		t.Errorf("Expected the saved version, got %s version %d", environment2.ClaimToken, environment2.Version)
+	}
+	for i, apiServer := range []*ApiServer{apiServer1, apiServer2} {
+		if pooled := getEnvironments(apiServer)[0]; pooled.ClaimToken != "claim1" || pooled.Version != 2 {
+			t.Errorf("Expected api server %d to have the saved version, got %s version %d", i + 1, pooled.ClaimToken, pooled.Version)
+		}
+	}
+	if saved := getSavedEnvironment(t, "1"); saved.ClaimToken != "claim1" || saved.Version != 2 {
+		t.Errorf("Expected claim1 version 2 to be saved, got %s version %d", saved.ClaimToken, saved.Version)
+	}
+}
+
+func TestUpdateEnvironmentReappliesOnConflict(t *testing.T) {
+	setTestStateStore(t)
+	saveTestEnvironments(t, &Environment{Id: "1", Version: 1, Status: StatusClaimed, ClaimToken: "claim"})
+	apiServer := newTestApiServer(1)
+	stale := getEnvironments(apiServer)[0]
+	current := getEnvironments(apiServer)[0]
+	updateEnvironment(current, func(environment *Environment) bool {
+		environment.SharedSessionIds = append(environment.SharedSessionIds, "s1")
+		return true
+	})
+	attempts := 0
+	err := updateEnvironment(stale, func(environment *Environment) bool {
+		attempts++
+		environment.SharedSessionIds = append(environment.SharedSessionIds, "s2")
+		return true
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("Expected the update to be re-applied once, got %d attempts, %v", attempts, err)
+	}
+	if saved := getSavedEnvironment(t, "1"); strings.Join(saved.SharedSessionIds, ",") != "s1,s2" || saved.Version != 3 {
+		t.Errorf("Expected both updates in version 3, got %v version %d", saved.SharedSessionIds, saved.Version)
+	}
+	// updates that no longer apply aren't saved
+	err = updateEnvironment(stale, func(environment *Environment) bool {
+		return environment.ClaimToken == "other"
+	})
+	if ! errors.Is(err, ErrConflict) {
+		t.Errorf("Expected %v, got %v", ErrConflict, err)
+	}
+}
+
+func TestClaimIdleEnvironmentAcrossApiServers(t *testing.T) {
+	setTestStateStore(t)
+	envCount := 4
+	for i := 1; i <= envCount; i++ {
+		saveTestEnvironments(t, &Environment{Id: fmt.Sprintf("%d", i), Version: 1, Status: StatusIdle})
+	}
+	apiServers := []*ApiServer{newTestApiServer(envCount), newTestApiServer(envCount)}
+	var mutex sync.Mutex
+	claimed := make(map[string]string)
+	var wait sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			apiServer := apiServers[i % 2]
+			syncEnvironments(apiServer)
+			session := &Session{Id: fmt.Sprintf("s%d", i)}
+			environment, claimToken, _ := claimIdleEnvironment(apiServer, session, "")
+			if environment == nil {
+				return
+			}
+			// pings through the other api server
+			syncEnvironments(apiServers[(i + 1) % 2])
+			if pinged := findEnvironmentByClaimToken(apiServers[(i + 1) % 2], claimToken); pinged != nil {
+				touchEnvironment(pinged)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if previous, ok := claimed[environment.Id]; ok {
+				t.Errorf("Environment %s claimed by %s and %s", environment.Id, previous, session.Id)
+			}
+			claimed[environment.Id] = claimToken
+		}(i)
+	}
+	wait.Wait()
+	if len(claimed) != envCount {
+		t.Fatalf("Expected %d claims, got %d", envCount, len(claimed))
+	}
+	for envId, claimToken := range claimed {
+		if saved := getSavedEnvironment(t, envId); saved.Status != StatusClaimed || saved.ClaimToken != claimToken {
+			t.Errorf("Expected environment %s saved with its claim, got status %d", envId, saved.Status)
+		}
+	}
+	for i, apiServer := range apiServers {
+		syncEnvironments(apiServer)
+		for _, environment := range getEnvironments(apiServer) {
+			if environment.ClaimToken != claimed[environment.Id] {
+				t.Errorf("Expected api server %d to have the claim on environment %s", i + 1, environment.Id)
+			}
+		}
+	}
+}
+
+func TestSyncEnvironments(t *testing.T) {
+	setTestStateStore(t)
+	saveTestEnvironments(t, &Environment{Id: "1", Version: 1, Status: StatusIdle})
+	apiServer1 := newTestApiServer(1)
+	apiServer2 := newTestApiServer(1)
+	environment, claimToken, _ := claimIdleEnvironment(apiServer1, &Session{Id: "s1"}, "")
+	if environment == nil {
+		t.Fatalf("Expected an environment to be claimed")
+	}
+	if findEnvironmentByClaimToken(apiServer2, claimToken) != nil {
+		t.Errorf("Expected the claim to be unknown before syncing")
+	}
+	syncEnvironments(apiServer2)
+	synced := findEnvironmentByClaimToken(apiServer2, claimToken)
+	if synced == nil || synced.ClaimSessionId != "s1" {
+		t.Fatalf("Expected the claim after syncing, got %v", synced)
+	}
+	// copies aren't the pool
+	synced.ClaimToken = "changed"
+	if findEnvironmentByClaimToken(apiServer2, claimToken) == nil {
+		t.Errorf("Expected changes to a copy to stay out of the pool until saved")
+	}
+}
+
+func TestCheckEnvironmentsProvisionsUnsavedEnvironments(t *testing.T) {
+	setTestStateStore(t)
+	kube := newTestKube(t)
+	// the leader saved environment 1, then went away before saving environment 2
+	saveTestEnvironments(t, &Environment{Id: "1", Version: 1, Status: StatusIdle})
+	apiServer := newTestApiServer(2)
+	if environment := getEnvironments(apiServer)[1]; environment.Status != StatusProvisioning {
+		t.Fatalf("Expected unsaved environment to be provisioning, got %d", environment.Status)
+	}
+	// this api server takes over as the leader
+	kube.setProvisioning("2", true)
+	checkEnvironments(apiServer)
+	if count := kube.count("POST /apis/batch/v1/namespaces//jobs"); count != 1 {
+		t.Errorf("Expected 1 provisioner job, got %d", count)
+	}
+	if saved := getSavedEnvironment(t, "2"); saved.Status != StatusProvisioning {
+		t.Errorf("Expected environment 2 saved as provisioning, got %d", saved.Status)
+	}
+	// not provisioned again while the provisioner runs
+	checkEnvironments(apiServer)
+	if count := kube.count("POST /apis/batch/v1/namespaces//jobs"); count != 1 {
+		t.Errorf("Expected 1 provisioner job, got %d", count)
+	}
+	if environment := getEnvironments(apiServer)[1]; environment.Status != StatusProvisioning {
+		t.Errorf("Expected environment 2 still provisioning, got %d", environment.Status)
+	}
+	kube.setProvisioning("2", false)
+	checkEnvironments(apiServer)
+	if saved := getSavedEnvironment(t, "2"); saved.Status != StatusIdle {
+		t.Errorf("Expected environment 2 saved as idle, got %d", saved.Status)
+	}
+	if environment := getEnvironments(apiServer)[1]; environment.Status != StatusIdle {
+		t.Errorf("Expected environment 2 idle in the pool, got %d", environment.Status)
+	}
+}
+
+func TestCheckEnvironmentsExpiresClaims(t *testing.T) {
+	setTestStateStore(t)
+	newTestKube(t)
+	saveTestEnvironments(t,
+		&Environment{Id: "1", Version: 1, Status: StatusClaimed, ClaimToken: "expired", LastActivity: 1},
+		&Environment{Id: "2", Version: 1, Status: StatusClaimed, ClaimToken: "active", LastActivity: 1},
+	)
+	apiServer := newTestApiServer(2)
+	// pinged through another api server since the leader synced
+	pinged := getEnvironments(newTestApiServer(2))[1]
+	pinged.savedActivity = 0
+	touchEnvironment(pinged)
+	checkEnvironments(apiServer)
+	if saved := getSavedEnvironment(t, "1"); saved.Status != StatusIdle || saved.ClaimToken != "" {
+		t.Errorf("Expected expired claim to be released, got status %d", saved.Status)
+	}
+	if saved := getSavedEnvironment(t, "2"); saved.Status != StatusClaimed || saved.ClaimToken != "active" {
+		t.Errorf("Expected active claim to be kept, got status %d", saved.Status)
+	}
+}
@@ -0,0 +1,203 @@
+package minienv
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const EnvVarTypeString = "string"
+const EnvVarTypeNumber = "number"
+const EnvVarTypeBoolean = "boolean"
+const EnvVarTypeUrl = "url"
+
+const EnvVarSourceManifest = "manifest"
+const EnvVarSourceCompose = "compose"
+
+// EnvVarSchema describes a variable a repo expects, declared in its manifest or found in its compose files
+type EnvVarSchema struct {
+	Name string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Type string `json:"type"`
+	Required bool `json:"required"`
+	Default string `json:"default,omitempty"`
+	AllowedValues []string `json:"allowedValues,omitempty"`
+	// secret values are masked in the logs and should be masked by the ui
+	Secret bool `json:"secret"`
+	Source string `json:"source"`
+}
+
+// envVarSchemaYaml is the manifest form; defaults and allowed values may be written as numbers or booleans
+type envVarSchemaYaml struct {
+	Name string `yaml:"name"`
+	Description string `yaml:"description"`
+	Type string `yaml:"type"`
+	Required bool `yaml:"required"`
+	Default interface{} `yaml:"default"`
+	AllowedValues []interface{} `yaml:"allowedValues"`
+	Secret bool `yaml:"secret"`
+}
+
+type EnvVarFieldError struct {
+	Name string `json:"name"`
+	Message string `json:"message"`
+}
+
+// EnvVarValidationError lists every variable that failed validation, so they can be shown next to their fields
+type EnvVarValidationError struct {
+	Fields []*EnvVarFieldError `json:"fields"`
+}
+
+func (err *EnvVarValidationError) Error() string {
+	var messages []string
+	for _, field := range err.Fields {
+		messages = append(messages, fmt.Sprintf("%s: %s", field.Name, field.Message))
+	}
+	return "invalid env vars; " + strings.Join(messages, "; ")
+}
+
+func (schemaYaml *envVarSchemaYaml) toSchema() (*EnvVarSchema, error) {
+	name := strings.TrimSpace(schemaYaml.Name)
+	if name == "" {
+		return nil, fmt.Errorf("env var is missing a name")
+	}
+	for i := 0; i < len(name); i++ {
+		if ! isEnvVarNameChar(name[i], i == 0) {
+			return nil, fmt.Errorf("invalid env var name '%s'", name)
+		}
+	}
+	schema := &EnvVarSchema{
+		Name: name,
+		Description: schemaYaml.Description,
+		Type: strings.ToLower(schemaYaml.Type),
+		Required: schemaYaml.Required,
+		Secret: schemaYaml.Secret,
+		Source: EnvVarSourceManifest,
+	}
+	if schema.Type == "" {
+		schema.Type = EnvVarTypeString
+	}
+	switch schema.Type {
+	case EnvVarTypeString, EnvVarTypeNumber, EnvVarTypeBoolean, EnvVarTypeUrl:
+	default:
+		return nil, fmt.Errorf("env var '%s' has unknown type '%s'", name, schemaYaml.Type)
+	}
+	if schemaYaml.Default != nil {
+		schema.Default = fmt.Sprintf("%v", schemaYaml.Default)
+	}
+	for _, value := range schemaYaml.AllowedValues {
+		schema.AllowedValues = append(schema.AllowedValues, fmt.Sprintf("%v", value))
+	}
+	if schema.Default != "" {
+		message := schema.validate(schema.Default)
+		if message != "" {
+			return nil, fmt.Errorf("env var '%s' has an invalid default: %s", name, message)
+		}
+	}
+	return schema, nil
+}
+
+// validate returns why value is invalid, or "" if it's valid
+func (schema *EnvVarSchema) validate(value string) string {
+	switch schema.Type {
+	case EnvVarTypeNumber:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "must be a number"
+		}
+	case EnvVarTypeBoolean:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "must be true or false"
+		}
+	case EnvVarTypeUrl:
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			return "must be a url"
+		}
+	}
+	if len(schema.AllowedValues) > 0 && ! containsString(schema.AllowedValues, value) {
+		return fmt.Sprintf("must be one of %s", strings.Join(schema.AllowedValues, ", "))
+	}
+	return ""
+}
+
+// getEnvVarSchema returns the variables declared by the manifest, followed by those referenced by the compose files,
+// sorted by name; a compose variable is required when it has no default and no value in the .env file
+func getEnvVarSchema(manifest *RepoManifest, project *ComposeProject, dotEnv map[string]string) []*EnvVarSchema {
+	schemas := []*EnvVarSchema{}
+	declared := make(map[string]bool)
+	if manifest != nil {
+		for _, schema := range manifest.EnvVars {
+			schemas = append(schemas, schema)
+			declared[schema.Name] = true
+		}
+	}
+	if project == nil {
+		return schemas
+	}
+	var composeSchemas []*EnvVarSchema
+	for _, envVar := range project.EnvVars {
+		if declared[envVar.Name] || envVar.Name == ComposeProfilesEnvVar {
+			continue
+		}
+		schema := &EnvVarSchema{Name: envVar.Name, Type: EnvVarTypeString, Default: envVar.Default, Source: EnvVarSourceCompose}
+		if value, ok := dotEnv[envVar.Name]; ok {
+			schema.Default = value
+		} else {
+			schema.Required = ! envVar.HasDefault
+		}
+		composeSchemas = append(composeSchemas, schema)
+	}
+	sort.Slice(composeSchemas, func(i, j int) bool {
+		return composeSchemas[i].Name < composeSchemas[j].Name
+	})
+	return append(schemas, composeSchemas...)
+}
+
+// validateEnvVars checks the env vars for a deployment against the schema, returning them with manifest
+// defaults added. Requested variables the schema doesn't know are rejected when the manifest or the compose
+// files declare any variables; variables from the catalog aren't checked, as they are set by the server.
+func validateEnvVars(schemas []*EnvVarSchema, requested map[string]string, envVars map[string]string) (map[string]string, error) {
+	validated := make(map[string]string)
+	for k, v := range envVars {
+		validated[k] = v
+	}
+	validationErr := &EnvVarValidationError{}
+	known := make(map[string]*EnvVarSchema)
+	for _, schema := range schemas {
+		known[schema.Name] = schema
+		value, ok := validated[schema.Name]
+		if ! ok || value == "" {
+			if schema.Source == EnvVarSourceManifest && schema.Default != "" {
+				validated[schema.Name] = schema.Default
+			} else if schema.Required {
+				validationErr.Fields = append(validationErr.Fields, &EnvVarFieldError{Name: schema.Name, Message: "is required"})
+			}
+			continue
+		}
+		if schema.Secret {
+			addLogRedactedRequestValue(value)
+		}
+		message := schema.validate(value)
+		if message != "" {
+			validationErr.Fields = append(validationErr.Fields, &EnvVarFieldError{Name: schema.Name, Message: message})
+		}
+	}
+	if len(schemas) > 0 {
+		var names []string
+		for name := range requested {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			// profiles are selected by the request, rather than declared
+			if known[name] == nil && name != ComposeProfilesEnvVar {
+				validationErr.Fields = append(validationErr.Fields, &EnvVarFieldError{Name: name, Message: "is not a known variable"})
+			}
+		}
+	}
+	if len(validationErr.Fields) > 0 {
+		return nil, validationErr
+	}
+	return validated, nil
+}
@@ -0,0 +1,65 @@
+package minienv
+
+import (
+	"testing"
+)
+
+func TestValidateEnvVars(t *testing.T) {
+	manifest := []*EnvVarSchema{
+		{Name: "PORT", Type: EnvVarTypeNumber, Default: "8080", Source: EnvVarSourceManifest},
+		{Name: "API_KEY", Type: EnvVarTypeString, Required: true, Secret: true, Source: EnvVarSourceManifest},
+	}
+	compose := []*EnvVarSchema{
+		{Name: "TAG", Type: EnvVarTypeString, Required: true, Source: EnvVarSourceCompose},
+	}
+	tests := []struct {
+		name string
+		schemas []*EnvVarSchema
+		requested map[string]string
+		valid bool
+	}{
+		{"manifest", manifest, map[string]string{"API_KEY": "k-1234"}, true},
+		{"manifest missing required", manifest, map[string]string{"PORT": "80"}, false},
+		{"manifest invalid number", manifest, map[string]string{"API_KEY": "k-1234", "PORT": "x"}, false},
+		{"manifest unknown", manifest, map[string]string{"API_KEY": "k-1234", "OTHER": "1"}, false},
+		{"compose", compose, map[string]string{"TAG": "1"}, true},
+		{"compose unknown", compose, map[string]string{"TAG": "1", "OTHER": "1"}, false},
+		{"compose profiles", compose, map[string]string{"TAG": "1", ComposeProfilesEnvVar: "debug"}, true},
+		{"merged", append(append([]*EnvVarSchema{}, manifest...), compose...), map[string]string{"API_KEY": "k-1234", "TAG": "1"}, true},
+		{"merged unknown", append(append([]*EnvVarSchema{}, manifest...), compose...), map[string]string{"API_KEY": "k-1234", "TAG": "1", "OTHER": "1"}, false},
+		{"no schema", nil, map[string]string{"OTHER": "1"}, true},
+	}
+	for _, test := range tests {
+		_, err := validateEnvVars(test.schemas, test.requested, test.requested)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %t, got %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestValidateEnvVarsDefaults(t *testing.T) {
+	schemas := []*EnvVarSchema{
+		{Name: "PORT", Type: EnvVarTypeNumber, Default: "8080", Source: EnvVarSourceManifest},
+		{Name: "TAG", Type: EnvVarTypeString, Default: "latest", Source: EnvVarSourceCompose},
+	}
+	// catalog env vars aren't checked against the schema
+	validated, err := validateEnvVars(schemas, map[string]string{}, map[string]string{"CATALOG": "1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if validated["PORT"] != "8080" || validated["CATALOG"] != "1" {
+		t.Errorf("Expected manifest default and catalog var, got %v", validated)
+	}
+	// compose defaults are applied by compose itself
+	if _, ok := validated["TAG"]; ok {
+		t.Errorf("Expected no compose default, got %v", validated)
+	}
+}
+
+func TestValidateEnvVarsRedactsSecrets(t *testing.T) {
+	schemas := []*EnvVarSchema{{Name: "API_KEY", Type: EnvVarTypeString, Secret: true, Source: EnvVarSourceManifest}}
+	validateEnvVars(schemas, map[string]string{"API_KEY": "secret-api-key"}, map[string]string{"API_KEY": "secret-api-key"})
+	if redacted := redactLogMessage("key secret-api-key"); redacted != "key " + RedactedText {
+		t.Errorf("Expected secret value to be redacted, got %s", redacted)
+	}
+}
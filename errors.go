@@ -0,0 +1,123 @@
+package minienv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ApiError is returned by the api server operations. Code identifies the error for clients, Status is the http status
+// to respond with and Message is safe to show to users; Cause, which may contain internal details, is only logged.
+type ApiError struct {
+	Code string
+	Status int
+	Message string
+	Cause error
+	// additional machine-readable information, e.g. the fields that failed validation
+	Details interface{}
+	// sent as the Retry-After header, when set
+	RetryAfterSeconds int64
+}
+
+var ErrBadRequest = &ApiError{Code: "bad_request", Status: http.StatusBadRequest, Message: "invalid request"}
+var ErrClaimInvalid = &ApiError{Code: "claim_invalid", Status: http.StatusUnauthorized, Message: "invalid claim token"}
+var ErrClaimNotOwned = &ApiError{Code: "claim_not_owned", Status: http.StatusForbidden, Message: "claim belongs to another session"}
+var ErrAccessTokenInvalid = &ApiError{Code: "access_token_invalid", Status: http.StatusUnauthorized, Message: "invalid access token"}
+var ErrSessionRequired = &ApiError{Code: "session_required", Status: http.StatusBadRequest, Message: "session required"}
+var ErrRepoNotAllowed = &ApiError{Code: "repo_not_allowed", Status: http.StatusForbidden, Message: "requested repo not whitelisted"}
+var ErrEnvVarNotAllowed = &ApiError{Code: "env_var_not_allowed", Status: http.StatusForbidden, Message: "requested env var not allowed"}
+var ErrEnvVarsInvalid = &ApiError{Code: "env_vars_invalid", Status: http.StatusBadRequest, Message: "invalid env vars"}
+var ErrCredentialInvalid = &ApiError{Code: "credential_invalid", Status: http.StatusBadRequest, Message: "invalid git credential"}
+var ErrRefNotFound = &ApiError{Code: "ref_not_found", Status: http.StatusNotFound, Message: "unable to resolve requested ref"}
+var ErrManifestInvalid = &ApiError{Code: "manifest_invalid", Status: http.StatusUnprocessableEntity, Message: "invalid repo manifest"}
+var ErrComposeNotFound = &ApiError{Code: "compose_not_found", Status: http.StatusUnprocessableEntity, Message: "no compose file found"}
+var ErrComposeInvalid = &ApiError{Code: "compose_invalid", Status: http.StatusUnprocessableEntity, Message: "invalid compose file"}
+var ErrDeploymentFailed = &ApiError{Code: "deployment_failed", Status: http.StatusInternalServerError, Message: "error creating deployment"}
+var ErrBackendUnavailable = &ApiError{Code: "backend_unavailable", Status: http.StatusServiceUnavailable, Message: "backend unavailable"}
+var ErrAdminApiDisabled = &ApiError{Code: "admin_api_disabled", Status: http.StatusNotFound, Message: "admin api disabled"}
+var ErrAdminUnauthorized = &ApiError{Code: "admin_unauthorized", Status: http.StatusUnauthorized, Message: "invalid admin token"}
+var ErrNotFound = &ApiError{Code: "not_found", Status: http.StatusNotFound, Message: "not found"}
+var ErrRateLimited = &ApiError{Code: "rate_limited", Status: http.StatusTooManyRequests, Message: "too many requests"}
+var ErrClaimLimitExceeded = &ApiError{Code: "claim_limit_exceeded", Status: http.StatusTooManyRequests, Message: "too many environments claimed"}
+var ErrConflict = &ApiError{Code: "conflict", Status: http.StatusConflict, Message: "conflict"}
+var ErrInternal = &ApiError{Code: "internal", Status: http.StatusInternalServerError, Message: "internal error"}
+
+type apiErrorEnvelope struct {
+	Error *apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code string `json:"code"`
+	Message string `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (err *ApiError) Error() string {
+	if err.Cause != nil {
+		return fmt.Sprintf("%s: %v", err.Message, err.Cause)
+	}
+	return err.Message
+}
+
+func (err *ApiError) Unwrap() error {
+	return err.Cause
+}
+
+// Is matches any ApiError with the same code, so errors.Is(err, ErrClaimInvalid) holds for copies made by WithCause
+func (err *ApiError) Is(target error) bool {
+	apiErr, ok := target.(*ApiError)
+	return ok && apiErr.Code == err.Code
+}
+
+// WithCause returns a copy of the error wrapping cause
+func (err *ApiError) WithCause(cause error) *ApiError {
+	apiErr := *err
+	apiErr.Cause = cause
+	return &apiErr
+}
+
+// WithMessage returns a copy of the error with a more specific message, which must be safe to show to users
+func (err *ApiError) WithMessage(format string, v ...interface{}) *ApiError {
+	apiErr := *err
+	apiErr.Message = fmt.Sprintf(format, v...)
+	return &apiErr
+}
+
+func (err *ApiError) WithRetryAfter(seconds int64) *ApiError {
+	apiErr := *err
+	apiErr.RetryAfterSeconds = seconds
+	return &apiErr
+}
+
+func (err *ApiError) WithDetails(details interface{}) *ApiError {
+	apiErr := *err
+	apiErr.Details = details
+	return &apiErr
+}
+
+// toApiError returns err if it's (or wraps) an ApiError, otherwise fallback wrapping err
+func toApiError(err error, fallback *ApiError) *ApiError {
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return fallback.WithCause(err)
+}
+
+// WriteApiError writes err as a json envelope, e.g. {"error": {"code": "claim_invalid", "message": "invalid claim token"}},
+// with the error's http status; errors other than ApiError are written as internal errors
+func WriteApiError(w http.ResponseWriter, err error) {
+	apiErr := toApiError(err, ErrInternal)
+	if apiErr.Cause != nil {
+		logPrintf("Api error %s: %v\n", apiErr.Code, apiErr.Cause)
+	}
+	envelope := &apiErrorEnvelope{Error: &apiErrorBody{Code: apiErr.Code, Message: apiErr.Message, Details: apiErr.Details}}
+	w.Header().Set("Content-Type", "application/json")
+	if apiErr.RetryAfterSeconds > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(apiErr.RetryAfterSeconds, 10))
+	}
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(envelope)
+}
@@ -0,0 +1,288 @@
+package minienv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const GitCredentialTypeToken = "token"
+const GitCredentialTypeBasic = "basic"
+const GitCredentialTypeSsh = "ssh"
+const GitCredentialTypeGitHubApp = "github-app"
+
+const DefaultGitHubApiUrl = "https://api.github.com"
+
+// installation tokens are renewed this long before they expire
+const GitHubAppTokenRenewSeconds int64 = 5 * 60
+
+// GitCredential is a credential configured on the server, so users only send its name, or nothing at all
+// when the credential applies to the repo by host or url. Secrets may be given inline or, preferably,
+// as files mounted from a Kubernetes secret.
+type GitCredential struct {
+	Name string `yaml:"name" json:"name"`
+	Type string `yaml:"type" json:"type"`
+	// hosts (e.g. "github.com") and repo url prefixes (e.g. "https://github.com/our-org/") the credential may be used for;
+	// a credential with neither may be used for any repo, but only when requested by name
+	Hosts []string `yaml:"hosts" json:"hosts"`
+	Repos []string `yaml:"repos" json:"repos"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	PasswordFile string `yaml:"passwordFile" json:"passwordFile"`
+	Token string `yaml:"token" json:"token"`
+	TokenFile string `yaml:"tokenFile" json:"tokenFile"`
+	PrivateKey string `yaml:"privateKey" json:"privateKey"`
+	PrivateKeyFile string `yaml:"privateKeyFile" json:"privateKeyFile"`
+	KnownHostsFile string `yaml:"knownHostsFile" json:"knownHostsFile"`
+	InsecureIgnoreHostKey bool `yaml:"insecureIgnoreHostKey" json:"insecureIgnoreHostKey"`
+	AppId int64 `yaml:"appId" json:"appId"`
+	InstallationId int64 `yaml:"installationId" json:"installationId"`
+	ApiUrl string `yaml:"apiUrl" json:"apiUrl"`
+}
+
+type gitCredentialsFileYaml struct {
+	Credentials []*GitCredential `yaml:"credentials"`
+}
+
+type GitSshKey struct {
+	PrivateKey string
+	KnownHostsFile string
+	InsecureIgnoreHostKey bool
+}
+
+type gitHubAppToken struct {
+	Token string
+	ExpiresAt int64
+}
+
+type gitHubAccessTokenResponse struct {
+	Token string `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var gitCredentials []*GitCredential
+var gitHubAppTokens = make(map[string]*gitHubAppToken)
+var gitHubAppTokensMutex sync.Mutex
+
+// loadGitCredentials reads the credentials file configured with MINIENV_GIT_CREDENTIALS_FILE (yaml or json)
+func loadGitCredentials(fp string) ([]*GitCredential, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	var file gitCredentialsFileYaml
+	err = yaml.Unmarshal(data, &file)
+	if err != nil {
+		return nil, err
+	}
+	for _, credential := range file.Credentials {
+		if credential.Name == "" {
+			return nil, errors.New("git credential is missing a name")
+		}
+		switch credential.Type {
+		case GitCredentialTypeToken, GitCredentialTypeBasic, GitCredentialTypeSsh, GitCredentialTypeGitHubApp:
+		default:
+			return nil, fmt.Errorf("git credential '%s' has unknown type '%s'", credential.Name, credential.Type)
+		}
+		if credential.PrivateKey != "" || credential.PrivateKeyFile != "" {
+			// read now so the key is not needed on every request
+			privateKey, err := readSecretValue(credential.PrivateKey, credential.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			credential.PrivateKey = privateKey
+			credential.PrivateKeyFile = ""
+		}
+	}
+	return file.Credentials, nil
+}
+
+func readSecretValue(value string, fp string) (string, error) {
+	if fp == "" {
+		return value, nil
+	}
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func getGitCredential(name string) *GitCredential {
+	for _, credential := range gitCredentials {
+		if credential.Name == name {
+			return credential
+		}
+	}
+	return nil
+}
+
+func (credential *GitCredential) matchesRepo(repo string) bool {
+	repoUrl, err := parseRepoUrl(repo)
+	for _, host := range credential.Hosts {
+		if err == nil && strings.EqualFold(host, repoUrl.Host) {
+			return true
+		}
+	}
+	for _, prefix := range credential.Repos {
+		if strings.HasPrefix(strings.ToLower(repo), strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyGitCredential sets the credentials of the repo from the named server-side credential or,
+// when no name is given and the request carried no credentials, the first credential configured for the repo.
+// Server credentials are marked, so they're kept out of the env unless the catalog entry shares them.
+func applyGitCredential(repo *DeploymentRepo, name string) error {
+	var credential *GitCredential
+	if name != "" {
+		credential = getGitCredential(name)
+		if credential == nil {
+			return fmt.Errorf("unknown git credential '%s'", name)
+		}
+		if (len(credential.Hosts) > 0 || len(credential.Repos) > 0) && ! credential.matchesRepo(repo.Repo) {
+			return fmt.Errorf("git credential '%s' may not be used for repo '%s'", name, repo.Repo)
+		}
+	} else if repo.Username == "" && repo.Password == "" {
+		for _, element := range gitCredentials {
+			if element.matchesRepo(repo.Repo) {
+				credential = element
+				break
+			}
+		}
+	}
+	if credential == nil {
+		return nil
+	}
+	logPrintf("Using git credential '%s' for repo '%s'.\n", credential.Name, repo.Repo)
+	repo.Username = ""
+	repo.Password = ""
+	repo.SshKey = nil
+	repo.ServerCredential = true
+	switch credential.Type {
+	case GitCredentialTypeToken:
+		token, err := readSecretValue(credential.Token, credential.TokenFile)
+		if err != nil {
+			return err
+		}
+		addLogRedactedRequestValue(token)
+		repo.Username = credential.Username
+		repo.Password = token
+	case GitCredentialTypeBasic:
+		password, err := readSecretValue(credential.Password, credential.PasswordFile)
+		if err != nil {
+			return err
+		}
+		addLogRedactedRequestValue(password)
+		repo.Username = credential.Username
+		repo.Password = password
+	case GitCredentialTypeSsh:
+		repo.SshKey = &GitSshKey{
+			PrivateKey: credential.PrivateKey,
+			KnownHostsFile: credential.KnownHostsFile,
+			InsecureIgnoreHostKey: credential.InsecureIgnoreHostKey,
+		}
+	case GitCredentialTypeGitHubApp:
+		token, err := getGitHubAppInstallationToken(credential)
+		if err != nil {
+			return err
+		}
+		repo.Username = "x-access-token"
+		repo.Password = token
+	}
+	return nil
+}
+
+// getGitHubAppInstallationToken mints an installation token using a jwt signed with the app's private key;
+// tokens are cached until shortly before they expire
+func getGitHubAppInstallationToken(credential *GitCredential) (string, error) {
+	now := time.Now().Unix()
+	gitHubAppTokensMutex.Lock()
+	cached := gitHubAppTokens[credential.Name]
+	gitHubAppTokensMutex.Unlock()
+	if cached != nil && cached.ExpiresAt - GitHubAppTokenRenewSeconds > now {
+		return cached.Token, nil
+	}
+	jwt, err := getGitHubAppJwt(credential.AppId, credential.PrivateKey, now)
+	if err != nil {
+		return "", err
+	}
+	apiUrl := credential.ApiUrl
+	if apiUrl == "" {
+		apiUrl = DefaultGitHubApiUrl
+	}
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", strings.TrimSuffix(apiUrl, "/"), credential.InstallationId)
+	req, err := http.NewRequest("POST", url, bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Accept", "application/vnd.github+json")
+	req.Header.Add("Authorization", "Bearer " + jwt)
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		logPrintln("Error creating GitHub app installation token: ", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("unable to create GitHub app installation token: %s", resp.Status)
+	}
+	var accessTokenResp gitHubAccessTokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&accessTokenResp)
+	if err != nil {
+		return "", err
+	}
+	addLogRedactedRequestValue(accessTokenResp.Token)
+	gitHubAppTokensMutex.Lock()
+	gitHubAppTokens[credential.Name] = &gitHubAppToken{Token: accessTokenResp.Token, ExpiresAt: accessTokenResp.ExpiresAt.Unix()}
+	gitHubAppTokensMutex.Unlock()
+	return accessTokenResp.Token, nil
+}
+
+func getGitHubAppJwt(appId int64, privateKeyPem string, now int64) (string, error) {
+	block, _ := pem.Decode([]byte(privateKeyPem))
+	if block == nil {
+		return "", errors.New("invalid GitHub app private key")
+	}
+	var privateKey *rsa.PrivateKey
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err == nil {
+		privateKey = key
+	} else {
+		pkcs8Key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return "", err
+		}
+		rsaKey, ok := pkcs8Key.(*rsa.PrivateKey)
+		if ! ok {
+			return "", errors.New("GitHub app private key is not an rsa key")
+		}
+		privateKey = rsaKey
+	}
+	// issued a minute in the past to allow for clock drift; GitHub allows at most 10 minutes
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"iat":%d,"exp":%d,"iss":"%d"}`, now - 60, now + 9 * 60, appId)))
+	hashed := sha256.Sum256([]byte(header + "." + payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
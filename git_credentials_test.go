@@ -0,0 +1,70 @@
+package minienv
+
+import (
+	"strings"
+	"testing"
+)
+
+func setTestGitCredentials(t *testing.T, credentials ...*GitCredential) {
+	previous := gitCredentials
+	gitCredentials = credentials
+	t.Cleanup(func() { gitCredentials = previous })
+}
+
+func TestApplyGitCredential(t *testing.T) {
+	setTestGitCredentials(t,
+		&GitCredential{Name: "org", Type: GitCredentialTypeToken, Repos: []string{"https://github.com/our-org/"}, Token: "org-token"},
+		&GitCredential{Name: "host", Type: GitCredentialTypeBasic, Hosts: []string{"gitlab.example.com"}, Username: "deploy", Password: "host-password"},
+		&GitCredential{Name: "any", Type: GitCredentialTypeToken, Token: "any-token"},
+	)
+	tests := []struct {
+		name string
+		repo *DeploymentRepo
+		credential string
+		password string
+		server bool
+	}{
+		{"by repo prefix", &DeploymentRepo{Repo: "https://github.com/our-org/app"}, "", "org-token", true},
+		{"by host", &DeploymentRepo{Repo: "https://gitlab.example.com/group/app"}, "", "host-password", true},
+		{"by name", &DeploymentRepo{Repo: "https://example.com/app"}, "any", "any-token", true},
+		{"no match", &DeploymentRepo{Repo: "https://example.com/app"}, "", "", false},
+		{"user credentials kept", &DeploymentRepo{Repo: "https://github.com/our-org/app", Password: "user-token"}, "", "user-token", false},
+		{"by name over user credentials", &DeploymentRepo{Repo: "https://github.com/our-org/app", Password: "user-token"}, "org", "org-token", true},
+	}
+	for _, test := range tests {
+		err := applyGitCredential(test.repo, test.credential)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", test.name, err)
+			continue
+		}
+		if test.repo.Password != test.password || test.repo.ServerCredential != test.server {
+			t.Errorf("%s: expected password '%s' and server credential %t, got '%s' and %t", test.name, test.password, test.server, test.repo.Password, test.repo.ServerCredential)
+		}
+	}
+	if err := applyGitCredential(&DeploymentRepo{Repo: "https://github.com/other-org/app"}, "org"); err == nil {
+		t.Errorf("Expected error for credential not allowed for the repo")
+	}
+	if err := applyGitCredential(&DeploymentRepo{Repo: "https://github.com/our-org/app"}, "missing"); err == nil {
+		t.Errorf("Expected error for unknown credential")
+	}
+}
+
+func TestServerGitCredentialNotGivenToEnv(t *testing.T) {
+	defer func(inUrl bool) { gitCredsInUrl = inUrl }(gitCredsInUrl)
+	gitCredsInUrl = true
+	setTestGitCredentials(t, &GitCredential{Name: "org", Type: GitCredentialTypeToken, Hosts: []string{"example.com"}, Username: "deploy", Token: "server-token"})
+	envManager := &BaseKubeEnvManager{}
+	details := &DeploymentDetails{EnvId: "1", ClaimToken: "token"}
+	template := "repo=$gitRepoWithCreds secret=$gitCredsSecretName"
+	repo := &DeploymentRepo{Repo: "https://example.com/org/app.git"}
+	applyGitCredential(repo, "")
+	deployment := envManager.GetDeploymentYaml(&Session{Id: "s"}, template, details, "", "", "", "", "", repo, nil)
+	if strings.Contains(deployment, "server-token") || ! strings.HasSuffix(deployment, "secret=") {
+		t.Errorf("Expected no server credentials in the deployment, got %s", deployment)
+	}
+	repo.ShareServerCredential = true
+	deployment = envManager.GetDeploymentYaml(&Session{Id: "s"}, template, details, "", "", "", "", "", repo, nil)
+	if ! strings.Contains(deployment, "server-token") || strings.HasSuffix(deployment, "secret=") {
+		t.Errorf("Expected shared server credentials in the deployment, got %s", deployment)
+	}
+}
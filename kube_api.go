@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -72,12 +71,33 @@ type GetDeploymentSpecTemplateMetadata struct {
 
 type GetDeploymentSpecTemplateMetadataAnnotation struct {
 	Repo string `json:"minienv.repo"`
-	RepoWithCreds string  `json:"minienv.repoWithCreds"`
+	GitCredsSecret string  `json:"minienv.gitCredsSecret"`
 	Branch string `json:"minienv.branch"`
+	Commit string `json:"minienv.commit"`
 	ClaimToken string `json:"minienv.claimToken"`
 	EnvDetails string `json:"minienv.envDetails"`
 }
 
+type SaveSecretBody struct {
+	ApiVersion string `json:"apiVersion"`
+	Kind string `json:"kind"`
+	Metadata *SaveSecretBodyMetadata `json:"metadata"`
+	Type string `json:"type"`
+	StringData map[string]string `json:"stringData"`
+}
+
+type SaveSecretBodyMetadata struct {
+	Name string `json:"name"`
+}
+
+type SaveSecretResponse struct {
+	Kind string `json:"kind"`
+}
+
+type DeleteSecretResponse struct {
+	StatusResponse
+}
+
 type SaveDeploymentResponse struct {
 	Kind string `json:"kind"`
 }
@@ -162,6 +182,30 @@ type DeleteServiceResponse struct {
 	StatusResponse
 }
 
+// Lease is a coordination.k8s.io/v1 lease; the same type is sent and received, so updates keep the resourceVersion
+type Lease struct {
+	ApiVersion string `json:"apiVersion"`
+	Kind string `json:"kind"`
+	Metadata *LeaseMetadata `json:"metadata"`
+	Spec *LeaseSpec `json:"spec"`
+}
+
+type LeaseMetadata struct {
+	Name string `json:"name"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type LeaseSpec struct {
+	HolderIdentity string `json:"holderIdentity"`
+	LeaseDurationSeconds int `json:"leaseDurationSeconds"`
+	// MicroTime; see LeaseTimeFormat
+	AcquireTime string `json:"acquireTime,omitempty"`
+	RenewTime string `json:"renewTime,omitempty"`
+	LeaseTransitions int `json:"leaseTransitions"`
+}
+
+const LeaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
 func getHttpClient() *http.Client {
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
@@ -179,7 +223,7 @@ func getPersistentVolume(name string, kubeServiceToken string, kubeServiceBaseUr
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error getting persistent volume: ", err)
+		logPrintln("Error getting persistent volume: ", err)
 		return nil, err
 	} else {
 		var getPersistentVolumeResp GetPersistentVolumeResponse
@@ -202,10 +246,10 @@ func savePersistentVolume(yaml string, kubeServiceToken string, kubeServiceBaseU
 	if len(kubeServiceToken) > 0 {
 		req.Header.Add("Authorization", "Bearer " + kubeServiceToken)
 	}
-	log.Print("Saving persistent volume...")
+	logPrint("Saving persistent volume...")
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Print("Error saving persistent volume: ", err)
+		logPrint("Error saving persistent volume: ", err)
 		return nil, err
 	} else {
 		var savePersistentVolumeResp SavePersistentVolumeResponse
@@ -229,7 +273,7 @@ func deletePersistentVolume(name string, kubeServiceToken string, kubeServiceBas
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error deleting persistent volume: ", err)
+		logPrintln("Error deleting persistent volume: ", err)
 		return false, err
 	} else {
 		var deletePersistentVolumeResp DeletePersistentVolumeResponse
@@ -251,7 +295,7 @@ func getPersistentVolumeClaim(name string, kubeServiceToken string, kubeServiceB
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error getting service: ", err)
+		logPrintln("Error getting service: ", err)
 		return nil, err
 	} else {
 		var getPersistentVolumeClaimResp GetPersistentVolumeClaimResponse
@@ -276,7 +320,7 @@ func savePersistentVolumeClaim(yaml string, kubeServiceToken string, kubeService
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Print("Error saving persistent volume claim: ", err)
+		logPrint("Error saving persistent volume claim: ", err)
 		return nil, err
 	} else {
 		var savePersistentVolumeClaimResp SavePersistentVolumeClaimResponse
@@ -300,7 +344,7 @@ func deletePersistentVolumeClaim(name string, kubeServiceToken string, kubeServi
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error deleting persistent volume claim: ", err)
+		logPrintln("Error deleting persistent volume claim: ", err)
 		return false, err
 	} else {
 		var deletePersistentVolumeClaimResp DeletePersistentVolumeClaimResponse
@@ -322,7 +366,7 @@ func getJob(name string, kubeServiceToken string, kubeServiceBaseUrl string, kub
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error getting job: ", err)
+		logPrintln("Error getting job: ", err)
 		return nil, err
 	} else {
 		var getJobResp GetJobResponse
@@ -347,7 +391,7 @@ func saveJob(yaml string, kubeServiceToken string, kubeServiceBaseUrl string, ku
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error saving job: ", err)
+		logPrintln("Error saving job: ", err)
 		return nil, err
 	} else {
 		var saveJobResp SaveJobResponse
@@ -363,7 +407,7 @@ func saveJob(yaml string, kubeServiceToken string, kubeServiceBaseUrl string, ku
 }
 
 func deleteJob(name string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (bool, error) {
-	log.Printf("Deleting job '%s'...\n", name)
+	logPrintf("Deleting job '%s'...\n", name)
 	url := fmt.Sprintf("%s/apis/batch/v1/namespaces/%s/jobs/%s", kubeServiceBaseUrl, kubeNamespace, name)
 	client := getHttpClient()
 	req, err := http.NewRequest("DELETE", url, nil)
@@ -372,7 +416,7 @@ func deleteJob(name string, kubeServiceToken string, kubeServiceBaseUrl string,
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error deleting job: ", err)
+		logPrintln("Error deleting job: ", err)
 		return false, err
 	} else {
 		var deleteJobResp DeleteJobResponse
@@ -385,6 +429,80 @@ func deleteJob(name string, kubeServiceToken string, kubeServiceBaseUrl string,
 	}
 }
 
+// saveSecret posts the secret as json rather than a yaml template, so values never need escaping. A secret
+// left behind by an environment that wasn't torn down cleanly is replaced.
+func saveSecret(name string, stringData map[string]string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (*SaveSecretResponse, error) {
+	body := &SaveSecretBody{
+		ApiVersion: "v1",
+		Kind: "Secret",
+		Metadata: &SaveSecretBodyMetadata{Name: name},
+		Type: "Opaque",
+		StringData: stringData,
+	}
+	logPrintf("Saving secret '%s'...\n", name)
+	url := fmt.Sprintf("%s/api/v1/namespaces/%s/secrets", kubeServiceBaseUrl, kubeNamespace)
+	saveSecretResp, status, err := sendSecret("POST", url, body, kubeServiceToken)
+	if err == nil && status == http.StatusConflict {
+		logPrintf("Secret '%s' already exists; replacing it...\n", name)
+		saveSecretResp, status, err = sendSecret("PUT", url + "/" + name, body, kubeServiceToken)
+	}
+	if err != nil {
+		logPrintln("Error saving secret: ", err)
+		return nil, err
+	} else if saveSecretResp.Kind != "Secret" {
+		return nil, fmt.Errorf("Unable to save secret (status %d)", status)
+	}
+	return saveSecretResp, nil
+}
+
+func sendSecret(method string, url string, body *SaveSecretBody, kubeServiceToken string) (*SaveSecretResponse, int, error) {
+	client := getHttpClient()
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(body)
+	req, err := http.NewRequest(method, url, b)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if len(kubeServiceToken) > 0 {
+		req.Header.Add("Authorization", "Bearer " + kubeServiceToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	var saveSecretResp SaveSecretResponse
+	err = json.NewDecoder(resp.Body).Decode(&saveSecretResp)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	return &saveSecretResp, resp.StatusCode, nil
+}
+
+func deleteSecret(name string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (bool, error) {
+	logPrintf("Deleting secret '%s'...\n", name)
+	url := fmt.Sprintf("%s/api/v1/namespaces/%s/secrets/%s", kubeServiceBaseUrl, kubeNamespace, name)
+	client := getHttpClient()
+	req, err := http.NewRequest("DELETE", url, nil)
+	if len(kubeServiceToken) > 0 {
+		req.Header.Add("Authorization", "Bearer " + kubeServiceToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		logPrintln("Error deleting secret: ", err)
+		return false, err
+	} else {
+		var deleteSecretResp DeleteSecretResponse
+		err := json.NewDecoder(resp.Body).Decode(&deleteSecretResp)
+		if err != nil {
+			return false, err
+		} else {
+			return deleteSecretResp.Status == "Success", nil
+		}
+	}
+}
+
 func getDeployment(name string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (*GetDeploymentResponse, error) {
 	url := fmt.Sprintf("%s/apis/apps/v1/namespaces/%s/deployments/%s", kubeServiceBaseUrl, kubeNamespace, name)
 	client := getHttpClient()
@@ -394,7 +512,7 @@ func getDeployment(name string, kubeServiceToken string, kubeServiceBaseUrl stri
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error getting deployment: ", err)
+		logPrintln("Error getting deployment: ", err)
 		return nil, err
 	} else {
 		var getDeploymentResp GetDeploymentResponse
@@ -417,10 +535,10 @@ func saveDeployment(yaml string, kubeServiceToken string, kubeServiceBaseUrl str
 	if len(kubeServiceToken) > 0 {
 		req.Header.Add("Authorization", "Bearer " + kubeServiceToken)
 	}
-	log.Print("Saving deployment...")
+	logPrint("Saving deployment...")
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error saving deployment: ", err)
+		logPrintln("Error saving deployment: ", err)
 		return nil, err
 	} else {
 		var saveDeploymentResp SaveDeploymentResponse
@@ -436,7 +554,7 @@ func saveDeployment(yaml string, kubeServiceToken string, kubeServiceBaseUrl str
 }
 
 func deleteDeployment(name string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (bool, error) {
-	log.Printf("Deleting deployment '%s'...\n", name)
+	logPrintf("Deleting deployment '%s'...\n", name)
 	url := fmt.Sprintf("%s/apis/apps/v1/namespaces/%s/deployments/%s", kubeServiceBaseUrl, kubeNamespace, name)
 	client := getHttpClient()
 	req, err := http.NewRequest("DELETE", url, nil)
@@ -445,7 +563,7 @@ func deleteDeployment(name string, kubeServiceToken string, kubeServiceBaseUrl s
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error deleting deployment: ", err)
+		logPrintln("Error deleting deployment: ", err)
 		return false, err
 	} else {
 		var deleteDeploymentResp DeleteDeploymentResponse
@@ -467,7 +585,7 @@ func getReplicaSets(kubeServiceToken string, kubeServiceBaseUrl string, kubeName
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error getting replica sets: ", err)
+		logPrintln("Error getting replica sets: ", err)
 		return nil, err
 	} else {
 		var getReplicaSetsResponse GetReplicaSetsResponse
@@ -483,7 +601,7 @@ func getReplicaSets(kubeServiceToken string, kubeServiceBaseUrl string, kubeName
 }
 
 func getReplicaSetName(label string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (string, error) {
-	log.Printf("Getting replica set name for label '%s'...\n", label)
+	logPrintf("Getting replica set name for label '%s'...\n", label)
 	getReplicaSetsResponse, err := getReplicaSets(kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	if err != nil {
 		return "", err
@@ -491,7 +609,7 @@ func getReplicaSetName(label string, kubeServiceToken string, kubeServiceBaseUrl
 		if getReplicaSetsResponse != nil && getReplicaSetsResponse.Items != nil && len(getReplicaSetsResponse.Items) > 0 {
 			for _, element := range getReplicaSetsResponse.Items {
 				if element.Metadata != nil && element.Metadata.Labels != nil && element.Metadata.Labels.App == label {
-					log.Printf("Replica set name for label '%s' = '%s'\n", label, element.Metadata.Name)
+					logPrintf("Replica set name for label '%s' = '%s'\n", label, element.Metadata.Name)
 					return element.Metadata.Name, nil
 				}
 			}
@@ -501,16 +619,16 @@ func getReplicaSetName(label string, kubeServiceToken string, kubeServiceBaseUrl
 }
 
 func deleteReplicaSet(label string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (bool, error) {
-	log.Printf("Deleting replica set for label '%s'...\n", label)
+	logPrintf("Deleting replica set for label '%s'...\n", label)
 	name, err := getReplicaSetName(label, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	if err != nil {
-		log.Println("Error deleting replica set: ", err)
+		logPrintln("Error deleting replica set: ", err)
 		return false, err
 	} else if name == "" {
 		return false, nil
 	}
 	// delete replica set
-	log.Printf("Deleting replica set '%s'...\n", name)
+	logPrintf("Deleting replica set '%s'...\n", name)
 	url := fmt.Sprintf("%s/apis/apps/v1/namespaces/%s/replicasets/%s", kubeServiceBaseUrl, kubeNamespace, name)
 	client := getHttpClient()
 	body := &DeleteReplicaSetBody{Kind: "DeleteOptions", OrphanDependents: false}
@@ -523,7 +641,7 @@ func deleteReplicaSet(label string, kubeServiceToken string, kubeServiceBaseUrl
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error deleting replica set: ", err)
+		logPrintln("Error deleting replica set: ", err)
 		return false, err
 	} else {
 		var deleteReplicaSetResp DeleteReplicaSetResponse
@@ -545,7 +663,7 @@ func getPods(kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace s
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error getting pods: ", err)
+		logPrintln("Error getting pods: ", err)
 		return nil, err
 	} else {
 		var getPodsResponse GetPodsResponse
@@ -561,7 +679,7 @@ func getPods(kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace s
 }
 
 func getPodName(label string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (string, error) {
-	log.Printf("Getting pod name for label '%s'...\n", label)
+	logPrintf("Getting pod name for label '%s'...\n", label)
 	getPodsResponse, err := getPods(kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	if err != nil {
 		return "", err
@@ -569,7 +687,7 @@ func getPodName(label string, kubeServiceToken string, kubeServiceBaseUrl string
 		if getPodsResponse.Items != nil && len(getPodsResponse.Items) > 0 {
 			for _, element := range getPodsResponse.Items {
 				if element.Metadata != nil && element.Metadata.Labels != nil && element.Metadata.Labels.App == label {
-					log.Printf("Pod name for label '%s' = '%s'\n", label, element.Metadata.Name)
+					logPrintf("Pod name for label '%s' = '%s'\n", label, element.Metadata.Name)
 					return element.Metadata.Name, nil
 				}
 			}
@@ -580,7 +698,7 @@ func getPodName(label string, kubeServiceToken string, kubeServiceBaseUrl string
 
 func deletePod(name string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (bool, error) {
 	// delete pod
-	log.Printf("Deleting pod '%s'...\n", name)
+	logPrintf("Deleting pod '%s'...\n", name)
 	url := fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s", kubeServiceBaseUrl, kubeNamespace, name)
 	client := getHttpClient()
 	req, err := http.NewRequest("DELETE", url, nil)
@@ -589,7 +707,7 @@ func deletePod(name string, kubeServiceToken string, kubeServiceBaseUrl string,
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error deleting pod: ", err)
+		logPrintln("Error deleting pod: ", err)
 		return false, err
 	} else {
 		var deletePodResp DeletePodResponse
@@ -603,13 +721,13 @@ func deletePod(name string, kubeServiceToken string, kubeServiceBaseUrl string,
 }
 
 func waitForPodTermination(label string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (bool, error) {
-	log.Printf("Waiting for pod termination for label '%s'...\n", label)
+	logPrintf("Waiting for pod termination for label '%s'...\n", label)
 	i := 0
 	for i < 6 {
 		i++
 		name, err := getPodName(label, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 		if err != nil {
-			log.Println("Error waiting for pod termination: ", err)
+			logPrintln("Error waiting for pod termination: ", err)
 			return false, err
 		} else if name == "" {
 			return true, nil
@@ -628,7 +746,7 @@ func getService(name string, kubeServiceToken string, kubeServiceBaseUrl string,
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error getting service: ", err)
+		logPrintln("Error getting service: ", err)
 		return nil, err
 	} else {
 		var getServiceResp GetServiceResponse
@@ -653,7 +771,7 @@ func saveService(yaml string, kubeServiceToken string, kubeServiceBaseUrl string
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Print("Error saving service: ", err)
+		logPrint("Error saving service: ", err)
 		return nil, err
 	} else {
 		var saveServiceResp SaveServiceResponse
@@ -668,8 +786,70 @@ func saveService(yaml string, kubeServiceToken string, kubeServiceBaseUrl string
 	}
 }
 
+func getLease(name string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (*Lease, error) {
+	url := fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", kubeServiceBaseUrl, kubeNamespace, name)
+	client := getHttpClient()
+	req, err := http.NewRequest("GET", url, nil)
+	if len(kubeServiceToken) > 0 {
+		req.Header.Add("Authorization", "Bearer " + kubeServiceToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		logPrintln("Error getting lease: ", err)
+		return nil, err
+	} else {
+		var getLeaseResp Lease
+		err := json.NewDecoder(resp.Body).Decode(&getLeaseResp)
+		if err != nil {
+			return nil, err
+		} else if getLeaseResp.Kind != "Lease" {
+			return nil, nil
+		} else {
+			return &getLeaseResp, nil
+		}
+	}
+}
+
+// saveLease creates the lease, or replaces it if it has a resourceVersion; it returns nil
+// if the lease was changed (or created) by someone else since it was read
+func saveLease(lease *Lease, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (*Lease, error) {
+	url := fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", kubeServiceBaseUrl, kubeNamespace)
+	method := "POST"
+	if lease.Metadata.ResourceVersion != "" {
+		url += "/" + lease.Metadata.Name
+		method = "PUT"
+	}
+	lease.ApiVersion = "coordination.k8s.io/v1"
+	lease.Kind = "Lease"
+	client := getHttpClient()
+	b := new(bytes.Buffer)
+	json.NewEncoder(b).Encode(lease)
+	req, err := http.NewRequest(method, url, b)
+	req.Header.Add("Content-Type", "application/json")
+	if len(kubeServiceToken) > 0 {
+		req.Header.Add("Authorization", "Bearer " + kubeServiceToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		logPrintln("Error saving lease: ", err)
+		return nil, err
+	} else {
+		var saveLeaseResp Lease
+		err = json.NewDecoder(resp.Body).Decode(&saveLeaseResp)
+		if err != nil {
+			return nil, err
+		} else if resp.StatusCode == http.StatusConflict {
+			return nil, nil
+		} else if saveLeaseResp.Kind != "Lease" {
+			return nil, errors.New("Unable to save lease")
+		} else {
+			return &saveLeaseResp, nil
+		}
+	}
+}
+
 func deleteService(name string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (bool, error) {
-	log.Printf("Deleting service '%s'...\n", name)
+	logPrintf("Deleting service '%s'...\n", name)
 	url := fmt.Sprintf("%s/api/v1/namespaces/%s/services/%s", kubeServiceBaseUrl, kubeNamespace, name)
 	client := getHttpClient()
 	req, err := http.NewRequest("DELETE", url, nil)
@@ -678,7 +858,7 @@ func deleteService(name string, kubeServiceToken string, kubeServiceBaseUrl stri
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println("Error deleting service: ", err)
+		logPrintln("Error deleting service: ", err)
 		return false, err
 	} else {
 		var deleteServiceResp DeleteServiceResponse
@@ -0,0 +1,47 @@
+package minienv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSaveSecretReplacesExistingSecret(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method + " " + r.URL.Path)
+		var body SaveSecretBody
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.StringData["password"] != "secret" {
+			t.Errorf("Expected the secret's data in the request, got %v", body.StringData)
+		}
+		if r.Method == "POST" {
+			// left behind by an environment that wasn't torn down cleanly
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"kind":"Status","status":"Failure","reason":"AlreadyExists"}`))
+			return
+		}
+		w.Write([]byte(`{"kind":"Secret"}`))
+	}))
+	defer server.Close()
+	_, err := saveSecret("env-1-git-creds", map[string]string{"password": "secret"}, "", server.URL, "default")
+	if err != nil {
+		t.Fatalf("Error saving secret: %v", err)
+	}
+	expected := []string{"POST /api/v1/namespaces/default/secrets", "PUT /api/v1/namespaces/default/secrets/env-1-git-creds"}
+	if len(methods) != 2 || methods[0] != expected[0] || methods[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, methods)
+	}
+}
+
+func TestSaveSecretFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"kind":"Status","status":"Failure","reason":"Forbidden"}`))
+	}))
+	defer server.Close()
+	if _, err := saveSecret("env-1-git-creds", map[string]string{}, "", server.URL, "default"); err == nil {
+		t.Errorf("Expected error saving secret")
+	}
+}
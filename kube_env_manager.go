@@ -2,10 +2,6 @@ package minienv
 
 import (
 	"strings"
-	"log"
-	"net/http"
-	"io/ioutil"
-	"gopkg.in/yaml.v2"
 	"fmt"
 	"encoding/json"
 	"strconv"
@@ -22,7 +18,8 @@ type KubeEnvManager interface {
 	GetServiceYamlTemplate() (string)
 	GetDeploymentYamlTemplate() (string)
 	GetDeploymentTabsFromDockerCompose(session *Session, repo *DeploymentRepo) (*[]*DeploymentTab, error)
-	GetDeploymentDetails(session *Session, envId string, claimToken string, repo *DeploymentRepo) (*DeploymentDetails, error)
+	// tabs are those returned by GetDeploymentTabsFromDockerCompose
+	GetDeploymentDetails(session *Session, envId string, claimToken string, repo *DeploymentRepo, tabs *[]*DeploymentTab) (*DeploymentDetails, error)
 	GetDeploymentYaml(session *Session, template string, details *DeploymentDetails, detailsString string, minienvVersion string, nodeNameOverride string, nodeHostProtocol string, storageDriver string, repo *DeploymentRepo, envVars map[string]string) (string)
 	GetServiceYaml(session *Session, template string, details *DeploymentDetails) (string)
 	GetPersistentVolumeYaml(template string, envId string, storageSize string) (string)
@@ -80,38 +77,12 @@ func (baseEnvManager *BaseKubeEnvManager) GetDeploymentYamlTemplate() (string) {
 }
 
 func (baseEnvManager *BaseKubeEnvManager) GetDeploymentTabsFromDockerCompose(_ *Session, repo *DeploymentRepo) (*[]*DeploymentTab, error) {
-	var tabs []*DeploymentTab
-	dockerComposeUrl := getDownloadUrl("docker-compose.yml", repo.Repo, repo.Branch, repo.Username, repo.Password)
-	log.Printf("Downloading docker-compose file from '%s'...\n", dockerComposeUrl)
-	client := getHttpClient()
-	req, err := http.NewRequest("GET", dockerComposeUrl, nil)
-	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != 200 {
-		log.Println("Error downloading docker-compose.yml: ", err)
-		dockerComposeUrl := getDownloadUrl("docker-compose.yaml", repo.Repo, repo.Branch, repo.Username, repo.Password)
-		req, err = http.NewRequest("GET", dockerComposeUrl, nil)
-		resp, err = client.Do(req)
-		if err != nil || resp.StatusCode != 200 {
-			log.Println("Error downloading docker-compose.yaml: ", err)
-			return nil, err
-		}
-	}
-	m := make(map[interface{}]interface{})
-	data, err := ioutil.ReadAll(resp.Body)
+	project, err := loadDockerCompose(repo)
 	if err != nil {
-		log.Println("Error downloading docker-compose file: ", err)
+		logPrintln("Error loading docker-compose files: ", err)
 		return nil, err
-	} else {
-		err = yaml.Unmarshal(data, &m)
-		if err != nil {
-			log.Println("Error parsing docker-compose file: ", err)
-			return nil, err
-		} else {
-			for k, v := range m {
-				populateTabs(v, &tabs, k.(string))
-			}
-		}
 	}
+	tabs := getComposeTabs(project)
 	return &tabs, nil
 }
 
@@ -145,11 +116,16 @@ func (baseEnvManager *BaseKubeEnvManager) GetAvailableDeploymentPort(port int, t
 	return port
 }
 
-func (baseEnvManager *BaseKubeEnvManager) GetDeploymentDetails(session *Session, envId string, claimToken string, repo *DeploymentRepo) (*DeploymentDetails, error) {
-	tabs, err := baseEnvManager.GetDeploymentTabsFromDockerCompose(session, repo)
+func (baseEnvManager *BaseKubeEnvManager) GetDeploymentDetails(session *Session, envId string, claimToken string, repo *DeploymentRepo, tabs *[]*DeploymentTab) (*DeploymentDetails, error) {
+	// the deployment runs the files and profiles the tabs were loaded from
+	project, err := loadDockerCompose(repo)
 	if err != nil {
+		logPrintln("Error loading docker-compose files: ", err)
 		return nil, err
 	}
+	if tabs == nil {
+		tabs = &[]*DeploymentTab{}
+	}
 	// ports
 	logPort := baseEnvManager.GetAvailableDeploymentPort(DefaultLogPort, tabs, nil)
 	editorPort := baseEnvManager.GetAvailableDeploymentPort(DefaultEditorPort, tabs, []int{logPort})
@@ -168,6 +144,8 @@ func (baseEnvManager *BaseKubeEnvManager) GetDeploymentDetails(session *Session,
 		tab.Url = fmt.Sprintf("%s://%s-%s-%d.%s%s", NodeHostProtocol, "$sessionId", details.AppProxyPort, tab.Port, details.NodeHostName, tab.Path)
 	}
 	details.Tabs = tabs
+	details.ComposeFiles = project.Files
+	details.ComposeProfiles = project.Profiles
 	return details, nil
 }
 
@@ -181,31 +159,62 @@ func (baseEnvManager *BaseKubeEnvManager) GetDeploymentYaml(session *Session, te
 			} else {
 				first = false
 			}
-			envVarsYaml += "          - name: " + k
-			envVarsYaml += "\n            value: \"" + v + "\""
+			envVarsYaml += "          - name: " + getYamlString(k)
+			envVarsYaml += "\n            value: " + getYamlString(v)
 		}
 	}
+	composeFiles := strings.Join(details.ComposeFiles, ":")
+	composeProfiles := strings.Join(details.ComposeProfiles, ",")
+	// compose in the pod reads these, so templates that only use $envVars run the same services too
+	for _, envVar := range [][]string{{"COMPOSE_FILE", composeFiles}, {ComposeProfilesEnvVar, composeProfiles}} {
+		if _, ok := envVars[envVar[0]]; ok || envVar[1] == "" {
+			continue
+		}
+		if envVarsYaml != "" {
+			envVarsYaml += "\n"
+		}
+		envVarsYaml += "          - name: " + envVar[0]
+		envVarsYaml += "\n            value: " + getYamlString(envVar[1])
+	}
 	deployment := template
 	deployment = strings.Replace(deployment, VarMinienvVersion, minienvVersion, -1)
 	deployment = strings.Replace(deployment, VarMinienvNodeNameOverride, nodeNameOverride, -1)
 	deployment = strings.Replace(deployment, VarMinienvNodeHostProtocol, nodeHostProtocol, -1)
 	deployment = strings.Replace(deployment, VarAllowOrigin, allowOrigin, -1)
 	deployment = strings.Replace(deployment, VarStorageDriver, storageDriver, -1)
-	deployment = strings.Replace(deployment, VarGitRepoWithCreds, getUrlWithCredentials(repo.Repo, repo.Username, repo.Password), -1) // make sure this replace is done before gitRepo
+	// pods read credentials from the secret named by $gitCredsSecretName, unless the template predates it
+	repoWithCreds := repo.Repo
+	if gitCredsInUrl && repo.hasEnvCredentials() {
+		repoWithCreds = getUrlWithCredentials(repo.Repo, repo.Username, repo.Password)
+	}
+	deployment = strings.Replace(deployment, VarGitRepoWithCreds, repoWithCreds, -1) // make sure this replace is done before gitRepo
+	deployment = strings.Replace(deployment, VarGitCredsSecretName, getEnvGitCredsSecretNameIfRequired(details.EnvId, repo), -1)
 	deployment = strings.Replace(deployment, VarGitRepo, repo.Repo, -1)
 	deployment = strings.Replace(deployment, VarGitBranch, repo.Branch, -1)
+	deployment = strings.Replace(deployment, VarGitCommit, repo.Commit, -1)
 	deployment = strings.Replace(deployment, VarAppProxyPort, details.AppProxyPort, -1)
 	deployment = strings.Replace(deployment, VarLogPort, details.LogPort, -1)
 	deployment = strings.Replace(deployment, VarEditorPort, details.EditorPort, -1)
 	deployment = strings.Replace(deployment, VarDeploymentName, getEnvDeploymentName(details.EnvId), -1)
 	deployment = strings.Replace(deployment, VarAppLabel, getEnvAppLabel(details.EnvId, details.ClaimToken), -1)
 	deployment = strings.Replace(deployment, VarClaimToken, details.ClaimToken, -1)
+	deployment = strings.Replace(deployment, VarAccessTokenKeys, getEnvAccessTokenKeys(details.EnvId, details.ClaimToken), -1)
 	deployment = strings.Replace(deployment, VarEnvDetails, detailsString, -1)
 	deployment = strings.Replace(deployment, VarEnvVars, envVarsYaml, -1)
+	deployment = strings.Replace(deployment, VarComposeFiles, composeFiles, -1)
+	deployment = strings.Replace(deployment, VarComposeProfiles, composeProfiles, -1)
+	deployment = strings.Replace(deployment, VarResourceProfile, repo.ResourceProfile, -1)
+	deployment = strings.Replace(deployment, VarPool, repo.Pool, -1)
 	deployment = strings.Replace(deployment, VarPvcName, getPersistentVolumeClaimName(details.EnvId), -1)
 	return deployment
 }
 
+// getYamlString quotes and escapes a value from a request or repo as a double quoted yaml string, so quotes,
+// backslashes or new lines can't end the value and add keys to the deployment
+func getYamlString(s string) string {
+	return strconv.Quote(s)
+}
+
 func (baseEnvManager *BaseKubeEnvManager) GetServiceYaml(_ *Session, template string, details *DeploymentDetails) (string) {
 	service := template
 	service = strings.Replace(service, VarServiceName, getEnvServiceName(details.EnvId, details.ClaimToken), -1)
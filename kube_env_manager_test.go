@@ -0,0 +1,75 @@
+package minienv
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestGetDeploymentYamlComposeFiles(t *testing.T) {
+	envManager := &BaseKubeEnvManager{}
+	details := &DeploymentDetails{
+		EnvId: "1",
+		ClaimToken: "token",
+		ComposeFiles: []string{"app/compose.yml", "app/compose.override.yml"},
+		ComposeProfiles: []string{"debug", "web"},
+	}
+	template := "files=$composeFiles profiles=$composeProfiles\n$envVars"
+	deployment := envManager.GetDeploymentYaml(&Session{Id: "s"}, template, details, "", "", "", "", "", &DeploymentRepo{Repo: "https://example.com/repo.git"}, map[string]string{"A": "1"})
+	if ! strings.Contains(deployment, "files=app/compose.yml:app/compose.override.yml profiles=debug,web") {
+		t.Errorf("Expected compose files and profiles in the deployment, got %s", deployment)
+	}
+	if ! strings.Contains(deployment, "- name: COMPOSE_FILE\n            value: \"app/compose.yml:app/compose.override.yml\"") {
+		t.Errorf("Expected COMPOSE_FILE in the env vars, got %s", deployment)
+	}
+	if ! strings.Contains(deployment, "- name: COMPOSE_PROFILES\n            value: \"debug,web\"") {
+		t.Errorf("Expected COMPOSE_PROFILES in the env vars, got %s", deployment)
+	}
+	// profiles set in the request's env vars aren't repeated
+	deployment = envManager.GetDeploymentYaml(&Session{Id: "s"}, template, details, "", "", "", "", "", &DeploymentRepo{}, map[string]string{"COMPOSE_PROFILES": "web"})
+	if strings.Count(deployment, "COMPOSE_PROFILES") != 1 {
+		t.Errorf("Expected COMPOSE_PROFILES once, got %s", deployment)
+	}
+}
+
+func TestGetDeploymentYamlEscapesEnvVars(t *testing.T) {
+	envManager := &BaseKubeEnvManager{}
+	details := &DeploymentDetails{
+		EnvId: "1",
+		ClaimToken: "token",
+		ComposeFiles: []string{"app/\"compose\".yml"},
+		ComposeProfiles: []string{"web\"\n          - name: PROFILE_INJECTED\n            value: \"x"},
+	}
+	envVars := map[string]string{
+		"A": "quote\" and \\backslash",
+		"B": "line\"\n          - name: INJECTED\n            value: \"x",
+		"C\"\n          - name: NAME_INJECTED\n            value: \"x": "1",
+	}
+	template := "env:\n$envVars"
+	deployment := envManager.GetDeploymentYaml(&Session{Id: "s"}, template, details, "", "", "", "", "", &DeploymentRepo{}, envVars)
+	var parsed struct {
+		Env []struct {
+			Name string `yaml:"name"`
+			Value string `yaml:"value"`
+		} `yaml:"env"`
+	}
+	if err := yaml.Unmarshal([]byte(deployment), &parsed); err != nil {
+		t.Fatalf("Expected valid yaml, got %v: %s", err, deployment)
+	}
+	expected := map[string]string{
+		"A": envVars["A"],
+		"B": envVars["B"],
+		"C\"\n          - name: NAME_INJECTED\n            value: \"x": "1",
+		"COMPOSE_FILE": details.ComposeFiles[0],
+		"COMPOSE_PROFILES": details.ComposeProfiles[0],
+	}
+	if len(parsed.Env) != len(expected) {
+		t.Fatalf("Expected %d env vars, got %+v", len(expected), parsed.Env)
+	}
+	for _, envVar := range parsed.Env {
+		if value, ok := expected[envVar.Name]; ! ok || value != envVar.Value {
+			t.Errorf("Expected %s=%q, got %q", envVar.Name, value, envVar.Value)
+		}
+	}
+}
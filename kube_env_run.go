@@ -2,12 +2,9 @@ package minienv
 
 import (
 	"fmt"
-	"log"
+	"net/url"
 	"os"
-	"reflect"
-	"strconv"
 	"strings"
-
 )
 
 var NodeHostName = os.Getenv("MINIENV_NODE_HOST_NAME")
@@ -19,8 +16,11 @@ var VarMinienvNodeHostProtocol = "$nodeHostProtocol"
 var VarAllowOrigin = "$allowOrigin"
 var VarStorageDriver = "$storageDriver"
 var VarGitRepo = "$gitRepo"
+// no longer includes the credentials unless MINIENV_GIT_CREDS_IN_URL is set; templates read them from $gitCredsSecretName
 var VarGitRepoWithCreds = "$gitRepoWithCreds"
+var VarGitCredsSecretName = "$gitCredsSecretName"
 var VarGitBranch = "$gitBranch"
+var VarGitCommit = "$gitCommit"
 var VarAppProxyPort = "$appProxyPort"
 var VarLogPort = "$logPort"
 var VarEditorPort = "$editorPort"
@@ -35,6 +35,12 @@ var VarAppLabel = "$appLabel"
 var VarClaimToken = "$claimToken"
 var VarEnvDetails = "$envDetails"
 var VarEnvVars = "$envVars"
+var VarResourceProfile = "$resourceProfile"
+var VarPool = "$pool"
+var VarAccessTokenKeys = "$accessTokenKeys"
+// the compose files to run, separated by ':' as in COMPOSE_FILE, and the profiles, separated by ',' as in COMPOSE_PROFILES
+var VarComposeFiles = "$composeFiles"
+var VarComposeProfiles = "$composeProfiles"
 
 var DefaultLogPort = 8001
 var DefaultEditorPort = 8002
@@ -47,13 +53,32 @@ type DeploymentTab struct {
 	Hide bool   `json:"hide"`
 	Name string `json:"name"`
 	Path string `json:"path"`
+	Service string `json:"service"`
 }
 
 type DeploymentRepo struct {
 	Repo string
 	Branch string
+	Tag string
+	PullRequest int
+	// sha of the commit to deploy, set by resolveRepoCommit
+	Commit string
 	Username string
 	Password string
+	SshKey *GitSshKey
+	// set when the credentials are a server-side credential (see applyGitCredential); they're used to read the
+	// repo from the api server, but only given to the env when its catalog entry sets shareGitCredential
+	ServerCredential bool
+	ShareServerCredential bool
+	ComposePath string
+	ComposeFiles []string
+	Profiles []string
+	EnvVars map[string]string
+	// from the catalog entry of the repo, for deployment templates to select resources and nodes
+	ResourceProfile string
+	Pool string
+	// set by loadDockerCompose
+	composeProject *ComposeProject
 }
 
 type DeploymentDetails struct {
@@ -66,6 +91,9 @@ type DeploymentDetails struct {
 	EditorUrl    string `json:"editorUrl"`
 	AppProxyPort string `json:"appProxyPort"`
 	Tabs         *[]*DeploymentTab `json:"tabs"`
+	// the compose files and profiles the tabs were built from, so the environment runs the same services
+	ComposeFiles []string `json:"composeFiles,omitempty"`
+	ComposeProfiles []string `json:"composeProfiles,omitempty"`
 	Props  *map[string]interface{} `json:"-"`
 }
 
@@ -83,46 +111,65 @@ func isEnvDeployed(envId string, kubeServiceToken string, kubeServiceBaseUrl str
 }
 
 func deleteEnv(envId string, claimToken string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) {
-	log.Printf("Deleting env %s...\n", envId)
+	logPrintf("Deleting env %s...\n", envId)
 	deploymentName := getEnvDeploymentName(envId)
 	appLabel := getEnvAppLabel(envId, claimToken)
 	serviceName := getEnvServiceName(envId, claimToken)
 	_, _ = deleteDeployment(deploymentName, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	_, _ = deleteReplicaSet(appLabel, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	_, _ = deleteService(serviceName, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+	_, _ = deleteSecret(getEnvGitCredsSecretName(envId), kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	_, _ = waitForPodTermination(appLabel, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 }
 
-func getUrlWithCredentials(url string, username string, password string) (string) {
-	if username != "" && password != "" {
-		url = strings.Replace(url, "https://", fmt.Sprintf("https://%s:%s@", username, password), 1)
-		url = strings.Replace(url, "http://", fmt.Sprintf("http://%s:%s@", username, password), 1)
+// getRef returns the resolved commit, if any, otherwise the branch
+func (repo *DeploymentRepo) getRef() string {
+	if repo.Commit != "" {
+		return repo.Commit
 	}
-	return url
+	return repo.Branch
 }
 
-func getDownloadUrl(path string, gitRepo string, gitBranch string, gitUsername string, gitPassword string) (string) {
-	url := fmt.Sprintf("%s/%s/%s", gitRepo, gitBranch, path)
-	url = strings.Replace(url, "github.com", "raw.githubusercontent.com", 1)
-	url = getUrlWithCredentials(url, gitUsername, gitPassword)
-	return url
+// saveEnvGitCredsSecret stores the repo credentials, if any, in the secret referenced by the deployment
+func saveEnvGitCredsSecret(envId string, repo *DeploymentRepo, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (error) {
+	secretName := getEnvGitCredsSecretNameIfRequired(envId, repo)
+	if secretName == "" {
+		return nil
+	}
+	stringData := map[string]string{"username": repo.Username, "password": repo.Password}
+	if repo.SshKey != nil {
+		stringData["ssh-privatekey"] = repo.SshKey.PrivateKey
+	}
+	_, err := saveSecret(secretName, stringData, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+	return err
 }
 
 func deployEnv(session *Session, envManager KubeEnvManager, minienvVersion string, envId string, claimToken string, nodeNameOverride string, nodeHostProtocol string, repo *DeploymentRepo, envVars map[string]string, storageDriver string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (*DeploymentDetails, error) {
+	// get the tabs and deployment details; the compose files may fail to load, so this is done before removing the env
+	tabs, err := envManager.GetDeploymentTabsFromDockerCompose(session, repo)
+	if err != nil {
+		logPrintln("Error getting deployment tabs: ", err)
+		return nil, err
+	}
+	details, err := envManager.GetDeploymentDetails(session, envId, claimToken, repo, tabs)
+	if err != nil {
+		logPrintln("Error getting deployment details: ", err)
+		return nil, err
+	} else if details == nil {
+		return nil, ErrDeploymentFailed.WithMessage("no deployment details")
+	}
 	// delete env, if it exists
 	deleteEnv(envId, claimToken, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
-	// get deployment details
-	details, _ := envManager.GetDeploymentDetails(session, envId, claimToken, repo)
 	// create persistent volume if using host paths
 	if envManager.UseHostPathPersistentVolumes() {
 		pvResponse, err := getPersistentVolume(getPersistentVolumeName(envId), kubeServiceToken, kubeServiceBaseUrl)
 		if err != nil {
-			log.Println("Error getting persistent volume: ", err)
+			logPrintln("Error getting persistent volume: ", err)
 			return nil, err
 		} else if pvResponse == nil {
 			_, err = savePersistentVolume(envManager.GetPersistentVolumeYaml(envManager.GetPersistentVolumeYamlTemplate(), envId, envManager.GetProvisionVolumeSize()), kubeServiceToken, kubeServiceBaseUrl)
 			if err != nil {
-				log.Println("Error saving persistent volume: ", err)
+				logPrintln("Error saving persistent volume: ", err)
 				return nil, err
 			}
 		}
@@ -130,75 +177,88 @@ func deployEnv(session *Session, envManager KubeEnvManager, minienvVersion strin
 	// create persistent volume claim, if not exists
 	pvcResponse, err := getPersistentVolumeClaim(getPersistentVolumeClaimName(envId), kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	if err != nil {
-		log.Println("Error getting persistent volume claim: ", err)
+		logPrintln("Error getting persistent volume claim: ", err)
 		return nil, err
 	} else if pvcResponse == nil {
 		_, err = savePersistentVolumeClaim(envManager.GetPersistentVolumeClaimYaml(envManager.GetPersistentVolumeClaimYamlTemplate(), envId, envManager.GetProvisionVolumeSize(), envManager.GetPersistentVolumeStorageClass()), kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 		if err != nil {
-			log.Println("Error saving persistent volume claim: ", err)
+			logPrintln("Error saving persistent volume claim: ", err)
 			return nil, err
 		}
 	}
+	// save git credentials; the old secret was removed with the env
+	err = saveEnvGitCredsSecret(envId, repo, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+	if err != nil {
+		logPrintln("Error saving git credentials secret: ", err)
+		return nil, err
+	}
 	// create the service first - we need the ports to serialize the details with the deployment
 	service := envManager.GetServiceYaml(session, envManager.GetServiceYamlTemplate(), details)
 	_, err = saveService(service, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	if err != nil {
-		log.Println("Error saving service: ", err)
+		logPrintln("Error saving service: ", err)
 		return nil, err
 	}
 	// save deployment
 	deployment := envManager.GetDeploymentYaml(session, envManager.GetDeploymentYamlTemplate(), details, envManager.SerializeDeploymentDetails(details), minienvVersion, nodeNameOverride, nodeHostProtocol, storageDriver, repo, envVars)
 	_, err = saveDeployment(deployment, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	if err != nil {
-		log.Println("Error saving deployment: ", err)
+		logPrintln("Error saving deployment: ", err)
 		return nil, err
 	}
 	// return
 	return details, nil
 }
 
-func populateTabs(v interface{}, tabs *[]*DeploymentTab, parent string) {
-	typ := reflect.TypeOf(v).Kind()
-	if typ == reflect.String {
-		if parent == "ports" {
-			portString := strings.SplitN(v.(string), ":", 2)[0]
-			port, err := strconv.Atoi(portString)
-			if err == nil {
-				tab := &DeploymentTab{}
-				tab.Port = port
-				tab.Name = strconv.Itoa(port)
-				*tabs = append(*tabs, tab)
-			}
-		}
-	} else if typ == reflect.Slice {
-		populateTabsSlice(v.([]interface{}), tabs, parent)
-	} else if typ == reflect.Map {
-		populateTabsMap(v.(map[interface{}]interface{}), tabs)
-	}
+func getPersistentVolumeName(envId string) string {
+	return strings.ToLower(fmt.Sprintf("minienv-env-%s-pv", envId))
 }
 
-func populateTabsMap(m map[interface{}]interface{}, tabs *[]*DeploymentTab) {
-	for k, v := range m {
-		populateTabs(v, tabs, strings.ToLower(k.(string)))
-	}
+func getPersistentVolumePath(envId string) string {
+	return strings.ToLower(fmt.Sprintf("/minienv-env-%s", envId))
 }
 
-func populateTabsSlice(slc []interface{}, tabs *[]*DeploymentTab, parent string) {
-	for _, v := range slc {
-		populateTabs(v, tabs, parent)
+func getPersistentVolumeClaimName(envId string) string {
+	return strings.ToLower(fmt.Sprintf("env-%s-pvc", envId))
+}
+
+func getEnvGitCredsSecretName(envId string) string {
+	return strings.ToLower(fmt.Sprintf("env-%s-git-creds", envId))
+}
+
+// gitCredsInUrl keeps putting credentials in $gitRepoWithCreds, for deployment templates written before the secret
+var gitCredsInUrl = false
+
+// checkDeploymentYamlTemplate fails if the template expects credentials in $gitRepoWithCreds, which it would no longer get
+func checkDeploymentYamlTemplate(template string) (error) {
+	if ! gitCredsInUrl && strings.Contains(template, VarGitRepoWithCreds) {
+		return fmt.Errorf("the deployment template uses %s, which no longer includes credentials; read them from the secret named by %s, or set MINIENV_GIT_CREDS_IN_URL=true", VarGitRepoWithCreds, VarGitCredsSecretName)
 	}
+	return nil
 }
 
-func getPersistentVolumeName(envId string) string {
-	return strings.ToLower(fmt.Sprintf("minienv-env-%s-pv", envId))
+func getUrlWithCredentials(repoUrl string, username string, password string) (string) {
+	if username == "" || password == "" || ! strings.HasPrefix(repoUrl, "https://") {
+		return repoUrl
+	}
+	return "https://" + url.UserPassword(username, password).String() + "@" + strings.TrimPrefix(repoUrl, "https://")
 }
 
-func getPersistentVolumePath(envId string) string {
-	return strings.ToLower(fmt.Sprintf("/minienv-env-%s", envId))
+// getEnvGitCredsSecretNameIfRequired returns the secret name, or an empty string if the env gets no credentials
+func getEnvGitCredsSecretNameIfRequired(envId string, repo *DeploymentRepo) string {
+	if ! repo.hasEnvCredentials() {
+		return ""
+	}
+	return getEnvGitCredsSecretName(envId)
 }
 
-func getPersistentVolumeClaimName(envId string) string {
-	return strings.ToLower(fmt.Sprintf("env-%s-pvc", envId))
+// hasEnvCredentials returns true if the repo has credentials the env may be given; those the user sent, or
+// server credentials shared by the catalog entry. Users can read anything in their env, including the secret.
+func (repo *DeploymentRepo) hasEnvCredentials() bool {
+	if repo.Username == "" && repo.Password == "" && repo.SshKey == nil {
+		return false
+	}
+	return ! repo.ServerCredential || repo.ShareServerCredential
 }
 
 func getEnvDeploymentName(envId string) string {
@@ -2,7 +2,6 @@ package minienv
 
 import (
 	"fmt"
-	"log"
 	"strings"
 )
 
@@ -14,18 +13,18 @@ var PodPhaseFailure = "Failed"
 
 func isProvisionerRunning(envId string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (bool, error) {
 	label := getProvisionerAppLabel(envId)
-	log.Printf("Getting pod name for label '%s'...\n", label)
+	logPrintf("Getting pod name for label '%s'...\n", label)
 	getPodsResponse, err := getPods(kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	if err != nil {
-		log.Println("Error getting pods.", err)
+		logPrintln("Error getting pods.", err)
 		return false, err
 	} else {
 		if getPodsResponse.Items != nil && len(getPodsResponse.Items) > 0 {
 			for _, element := range getPodsResponse.Items {
 				if element.Metadata != nil && element.Metadata.Labels != nil && element.Metadata.Labels.App == label {
-					log.Printf("Pod found for label '%s'.\n", label)
+					logPrintf("Pod found for label '%s'.\n", label)
 					if element.Status != nil && element.Status.Phase != "" {
-						log.Printf("Status for pod '%s' = '%s'.\n", label, element.Status.Phase)
+						logPrintf("Status for pod '%s' = '%s'.\n", label, element.Status.Phase)
 						if element.Status.Phase != PodPhaseSuccess && element.Status.Phase != PodPhaseFailure {
 							return true, nil
 						}
@@ -39,6 +38,16 @@ func isProvisionerRunning(envId string, kubeServiceToken string, kubeServiceBase
 	}
 }
 
+// isEnvProvisioned returns true if the environment's volume claim exists and no provisioner is running
+func isEnvProvisioned(envId string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (bool) {
+	pvcResponse, err := getPersistentVolumeClaim(getPersistentVolumeClaimName(envId), kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+	if err != nil || pvcResponse == nil {
+		return false
+	}
+	running, err := isProvisionerRunning(envId, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+	return err == nil && ! running
+}
+
 func deleteProvisioner(envId string, kubeServiceToken string, kubeServiceBaseUrl string, kubeNamespace string) (bool, error) {
 	deleted, err := deleteJob(getProvisionerJobName(envId), kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	if err != nil {
@@ -48,7 +57,7 @@ func deleteProvisioner(envId string, kubeServiceToken string, kubeServiceBaseUrl
 	label := getProvisionerAppLabel(envId)
 	getPodsResponse, err := getPods(kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	if err != nil {
-		log.Println("Error getting pods for delete job.", err)
+		logPrintln("Error getting pods for delete job.", err)
 	} else {
 		if getPodsResponse.Items != nil && len(getPodsResponse.Items) > 0 {
 			for _, element := range getPodsResponse.Items {
@@ -69,12 +78,12 @@ func deployProvisioner(envManager KubeEnvManager, minienvVersion string, envId s
 	if envManager.UseHostPathPersistentVolumes() {
 		pvResponse, err := getPersistentVolume(getPersistentVolumeName(envId), kubeServiceToken, kubeServiceBaseUrl)
 		if err != nil {
-			log.Println("Error getting persistent volume: ", err)
+			logPrintln("Error getting persistent volume: ", err)
 			return err
 		} else if pvResponse == nil {
 			_, err = savePersistentVolume(envManager.GetPersistentVolumeYaml(envManager.GetPersistentVolumeYamlTemplate(), envId, envManager.GetProvisionVolumeSize()), kubeServiceToken, kubeServiceBaseUrl)
 			if err != nil {
-				log.Println("Error saving persistent volume: ", err)
+				logPrintln("Error saving persistent volume: ", err)
 				return err
 			}
 		}
@@ -82,12 +91,12 @@ func deployProvisioner(envManager KubeEnvManager, minienvVersion string, envId s
 	// create persistent volume claim, if not exists
 	pvcResponse, err := getPersistentVolumeClaim(getPersistentVolumeClaimName(envId), kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	if err != nil {
-		log.Println("Error getting persistent volume claim: ", err)
+		logPrintln("Error getting persistent volume claim: ", err)
 		return err
 	} else if pvcResponse == nil {
 		_, err = savePersistentVolumeClaim(envManager.GetPersistentVolumeClaimYaml(envManager.GetPersistentVolumeClaimYamlTemplate(), envId, envManager.GetProvisionVolumeSize(), envManager.GetPersistentVolumeStorageClass()), kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 		if err != nil {
-			log.Println("Error saving persistent volume claim: ", err)
+			logPrintln("Error saving persistent volume claim: ", err)
 			return err
 		}
 	}
@@ -104,7 +113,7 @@ func deployProvisioner(envManager KubeEnvManager, minienvVersion string, envId s
 	job = strings.Replace(job, VarPvcName, getPersistentVolumeClaimName(envId), -1)
 	_, err = saveJob(job, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
 	if err != nil {
-		log.Println("Error saving job: ", err)
+		logPrintln("Error saving job: ", err)
 		return err
 	}
 	return nil
@@ -0,0 +1,183 @@
+package minienv
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// with more than one api server, only the leader checks, provisions and expires environments;
+// the others only serve requests, sharing the pool through the state store
+const LeaderElectionNone = "none"
+const LeaderElectionStateStore = "state"
+const LeaderElectionKubeLease = "lease"
+
+// a leader that stops renewing is replaced once its lease is this old
+const LeaderLeaseSeconds = 15
+const LeaderRenewSeconds = 5
+
+const DefaultLeaderLeaseName = "minienv-api-leader"
+const LeaderStateKey = "leader"
+
+type LeaderElector interface {
+	// TryAcquireOrRenew takes the lease if it's free or expired, renews it if it's ours,
+	// and returns whether we hold it
+	TryAcquireOrRenew() (bool, error)
+}
+
+var leaderElector LeaderElector
+var replicaId string
+var leaderMutex sync.RWMutex
+var leader = true
+
+func isLeader() bool {
+	leaderMutex.RLock()
+	defer leaderMutex.RUnlock()
+	return leader
+}
+
+// initLeaderElection configures the elector from MINIENV_LEADER_ELECTION (none, state or lease) and runs
+// the first election; without it every api server thinks it's the leader, which is only right for one
+func initLeaderElection() {
+	replicaId = os.Getenv("MINIENV_REPLICA_ID")
+	if replicaId == "" {
+		// the pod name, in kubernetes
+		replicaId, _ = os.Hostname()
+		random, _ := uuid.NewRandom()
+		replicaId += "-" + strings.Replace(random.String(), "-", "", -1)[:8]
+	}
+	mode := os.Getenv("MINIENV_LEADER_ELECTION")
+	if mode == "" {
+		mode = LeaderElectionNone
+		if _, ok := stateStore.(*InMemorySessionStore); ! ok {
+			mode = LeaderElectionStateStore
+		}
+	}
+	switch mode {
+	case LeaderElectionNone:
+		leaderElector = nil
+	case LeaderElectionStateStore:
+		leaderElector = &StateStoreLeaderElector{Key: LeaderStateKey, Id: replicaId, LeaseSeconds: LeaderLeaseSeconds}
+	case LeaderElectionKubeLease:
+		name := os.Getenv("MINIENV_LEADER_LEASE_NAME")
+		if name == "" {
+			name = DefaultLeaderLeaseName
+		}
+		leaderElector = &KubeLeaseLeaderElector{Name: name, Id: replicaId, LeaseSeconds: LeaderLeaseSeconds}
+	default:
+		logFatalf("Invalid MINIENV_LEADER_ELECTION '%s'\n", mode)
+	}
+	if leaderElector == nil {
+		return
+	}
+	logPrintf("Electing leader as %s using %s...\n", replicaId, mode)
+	electLeader()
+	startLeaderElectionTimer()
+}
+
+func electLeader() {
+	acquired, err := leaderElector.TryAcquireOrRenew()
+	if err != nil {
+		// without the lease we may not be the leader any more
+		logPrintf("Error renewing leadership: %v\n", err)
+		acquired = false
+	}
+	leaderMutex.Lock()
+	previous := leader
+	leader = acquired
+	leaderMutex.Unlock()
+	if acquired && ! previous {
+		logPrintf("Replica %s is now the leader.\n", replicaId)
+	} else if ! acquired && previous {
+		logPrintf("Replica %s is no longer the leader.\n", replicaId)
+	}
+}
+
+func startLeaderElectionTimer() {
+	timer := time.NewTimer(time.Second * time.Duration(LeaderRenewSeconds))
+	go func() {
+		<-timer.C
+		electLeader()
+		startLeaderElectionTimer()
+	}()
+}
+
+// StateStoreLeaderElector keeps the lease in the state store, e.g. as a lock in redis
+type StateStoreLeaderElector struct {
+	Key string
+	Id string
+	LeaseSeconds int64
+}
+
+type stateStoreLeaderLease struct {
+	Holder string `json:"holder"`
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+func (elector *StateStoreLeaderElector) TryAcquireOrRenew() (bool, error) {
+	previous, err := stateStore.GetState(elector.Key)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().Unix()
+	if previous != nil {
+		var lease stateStoreLeaderLease
+		err = json.Unmarshal(previous, &lease)
+		if err == nil && lease.Holder != elector.Id && lease.ExpiresAt > now {
+			return false, nil
+		}
+	}
+	bs, err := json.Marshal(&stateStoreLeaderLease{Holder: elector.Id, ExpiresAt: now + elector.LeaseSeconds})
+	if err != nil {
+		return false, err
+	}
+	return stateStore.CompareAndSwapState(elector.Key, previous, bs)
+}
+
+// KubeLeaseLeaderElector keeps the lease in a kubernetes Lease object; updates carry the resourceVersion,
+// so only one replica can take over an expired lease
+type KubeLeaseLeaderElector struct {
+	Name string
+	Id string
+	LeaseSeconds int
+}
+
+func (elector *KubeLeaseLeaderElector) TryAcquireOrRenew() (bool, error) {
+	lease, err := getLease(elector.Name, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	nowStr := now.UTC().Format(LeaseTimeFormat)
+	if lease == nil {
+		lease = &Lease{Metadata: &LeaseMetadata{Name: elector.Name}, Spec: &LeaseSpec{AcquireTime: nowStr}}
+	} else if lease.Spec == nil {
+		lease.Spec = &LeaseSpec{}
+	}
+	if lease.Spec.HolderIdentity != elector.Id {
+		if lease.Spec.HolderIdentity != "" {
+			renewTime, err := time.Parse(LeaseTimeFormat, lease.Spec.RenewTime)
+			if err != nil {
+				return false, fmt.Errorf("invalid renewTime '%s' in lease %s", lease.Spec.RenewTime, elector.Name)
+			}
+			if now.Before(renewTime.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second)) {
+				return false, nil
+			}
+			lease.Spec.LeaseTransitions++
+		}
+		lease.Spec.HolderIdentity = elector.Id
+		lease.Spec.AcquireTime = nowStr
+	}
+	lease.Spec.LeaseDurationSeconds = elector.LeaseSeconds
+	lease.Spec.RenewTime = nowStr
+	saved, err := saveLease(lease, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace)
+	if err != nil {
+		return false, err
+	}
+	return saved != nil, nil
+}
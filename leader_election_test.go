@@ -0,0 +1,188 @@
+package minienv
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setTestLeaderElector(t *testing.T, elector LeaderElector) {
+	previousElector := leaderElector
+	previousLeader := isLeader()
+	leaderElector = elector
+	t.Cleanup(func() {
+		leaderElector = previousElector
+		leaderMutex.Lock()
+		leader = previousLeader
+		leaderMutex.Unlock()
+	})
+}
+
+func setTestLease(t *testing.T, holder string, expiresAt int64) {
+	bs, _ := json.Marshal(&stateStoreLeaderLease{Holder: holder, ExpiresAt: expiresAt})
+	if err := stateStore.SetState(LeaderStateKey, bs); err != nil {
+		t.Fatalf("Error saving lease: %v", err)
+	}
+}
+
+func TestStateStoreLeaderElector(t *testing.T) {
+	setTestStateStore(t)
+	elector1 := &StateStoreLeaderElector{Key: LeaderStateKey, Id: "replica-1", LeaseSeconds: LeaderLeaseSeconds}
+	elector2 := &StateStoreLeaderElector{Key: LeaderStateKey, Id: "replica-2", LeaseSeconds: LeaderLeaseSeconds}
+	tests := []struct {
+		name string
+		elector *StateStoreLeaderElector
+		expected bool
+	}{
+		{"acquire", elector1, true},
+		{"renew", elector1, true},
+		{"held by another replica", elector2, false},
+		{"renew again", elector1, true},
+	}
+	for _, test := range tests {
+		acquired, err := test.elector.TryAcquireOrRenew()
+		if err != nil || acquired != test.expected {
+			t.Errorf("%s: Expected %v, got %v, %v", test.name, test.expected, acquired, err)
+		}
+	}
+	// the holder went away
+	setTestLease(t, "replica-1", time.Now().Unix() - 1)
+	if acquired, err := elector2.TryAcquireOrRenew(); err != nil || ! acquired {
+		t.Errorf("Expected the expired lease to be taken over, got %v, %v", acquired, err)
+	}
+	if acquired, err := elector1.TryAcquireOrRenew(); err != nil || acquired {
+		t.Errorf("Expected the previous holder to lose the lease, got %v, %v", acquired, err)
+	}
+}
+
+func TestStateStoreLeaderElectorOneTakesOver(t *testing.T) {
+	setTestStateStore(t)
+	setTestLease(t, "gone", time.Now().Unix() - 1)
+	var mutex sync.Mutex
+	var wait sync.WaitGroup
+	acquiredCount := 0
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			elector := &StateStoreLeaderElector{Key: LeaderStateKey, Id: "replica-" + strconv.Itoa(i), LeaseSeconds: LeaderLeaseSeconds}
+			if acquired, _ := elector.TryAcquireOrRenew(); acquired {
+				mutex.Lock()
+				acquiredCount++
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wait.Wait()
+	if acquiredCount != 1 {
+		t.Errorf("Expected 1 replica to take over the lease, got %d", acquiredCount)
+	}
+}
+
+func TestElectLeaderFailover(t *testing.T) {
+	setTestStateStore(t)
+	elector := &StateStoreLeaderElector{Key: LeaderStateKey, Id: "replica-2", LeaseSeconds: LeaderLeaseSeconds}
+	setTestLeaderElector(t, elector)
+	setTestLease(t, "replica-1", time.Now().Unix() + LeaderLeaseSeconds)
+	electLeader()
+	if isLeader() {
+		t.Errorf("Expected follower while another replica holds the lease")
+	}
+	setTestLease(t, "replica-1", time.Now().Unix() - 1)
+	electLeader()
+	if ! isLeader() {
+		t.Errorf("Expected leader once the lease expired")
+	}
+	// losing the lease, e.g. after a pause longer than the lease
+	setTestLease(t, "replica-3", time.Now().Unix() + LeaderLeaseSeconds)
+	electLeader()
+	if isLeader() {
+		t.Errorf("Expected follower once another replica took over")
+	}
+}
+
+// testLeaseServer stands in for the kubernetes lease api, rejecting updates to stale resource versions
+type testLeaseServer struct {
+	mutex sync.Mutex
+	lease *Lease
+	version int
+}
+
+func newTestLeaseServer(t *testing.T) *testLeaseServer {
+	server := &testLeaseServer{}
+	setTestKubeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		if r.Method == "GET" {
+			if server.lease == nil {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"kind":"Status"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(server.lease)
+			return
+		}
+		var lease Lease
+		json.NewDecoder(r.Body).Decode(&lease)
+		if (server.lease == nil) != (r.Method == "POST") || (server.lease != nil && lease.Metadata.ResourceVersion != server.lease.Metadata.ResourceVersion) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"kind":"Status"}`))
+			return
+		}
+		server.version++
+		lease.Metadata.ResourceVersion = strconv.Itoa(server.version)
+		server.lease = &lease
+		json.NewEncoder(w).Encode(server.lease)
+	})
+	return server
+}
+
+func TestKubeLeaseLeaderElector(t *testing.T) {
+	server := newTestLeaseServer(t)
+	elector1 := &KubeLeaseLeaderElector{Name: DefaultLeaderLeaseName, Id: "replica-1", LeaseSeconds: LeaderLeaseSeconds}
+	elector2 := &KubeLeaseLeaderElector{Name: DefaultLeaderLeaseName, Id: "replica-2", LeaseSeconds: LeaderLeaseSeconds}
+	if acquired, err := elector1.TryAcquireOrRenew(); err != nil || ! acquired {
+		t.Fatalf("Expected the lease to be created, got %v, %v", acquired, err)
+	}
+	if acquired, err := elector1.TryAcquireOrRenew(); err != nil || ! acquired {
+		t.Errorf("Expected the lease to be renewed, got %v, %v", acquired, err)
+	}
+	if server.lease.Metadata.ResourceVersion != "2" || server.lease.Spec.HolderIdentity != "replica-1" {
+		t.Errorf("Expected replica-1 to renew version 2, got %s version %s", server.lease.Spec.HolderIdentity, server.lease.Metadata.ResourceVersion)
+	}
+	if acquired, err := elector2.TryAcquireOrRenew(); err != nil || acquired {
+		t.Errorf("Expected the lease to be held, got %v, %v", acquired, err)
+	}
+	// the holder stopped renewing
+	server.mutex.Lock()
+	server.lease.Spec.RenewTime = time.Now().Add(-time.Duration(LeaderLeaseSeconds + 1) * time.Second).UTC().Format(LeaseTimeFormat)
+	server.mutex.Unlock()
+	if acquired, err := elector2.TryAcquireOrRenew(); err != nil || ! acquired {
+		t.Errorf("Expected the expired lease to be taken over, got %v, %v", acquired, err)
+	}
+	if server.lease.Spec.HolderIdentity != "replica-2" || server.lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("Expected replica-2 to hold the lease after 1 transition, got %s after %d", server.lease.Spec.HolderIdentity, server.lease.Spec.LeaseTransitions)
+	}
+	if acquired, err := elector1.TryAcquireOrRenew(); err != nil || acquired {
+		t.Errorf("Expected the previous holder to lose the lease, got %v, %v", acquired, err)
+	}
+}
+
+func TestKubeLeaseLeaderElectorConflict(t *testing.T) {
+	server := newTestLeaseServer(t)
+	elector := &KubeLeaseLeaderElector{Name: DefaultLeaderLeaseName, Id: "replica-1", LeaseSeconds: LeaderLeaseSeconds}
+	if acquired, _ := elector.TryAcquireOrRenew(); ! acquired {
+		t.Fatalf("Expected the lease to be created")
+	}
+	// another replica's update lands between the read and the write
+	stale := *server.lease
+	staleMetadata := *stale.Metadata
+	staleMetadata.ResourceVersion = "0"
+	stale.Metadata = &staleMetadata
+	if saved, err := saveLease(&stale, kubeServiceToken, kubeServiceBaseUrl, kubeNamespace); err != nil || saved != nil {
+		t.Errorf("Expected the stale update to be rejected, got %v, %v", saved, err)
+	}
+}
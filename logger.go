@@ -0,0 +1,145 @@
+package minienv
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// all logging in the package goes through these functions, so secrets are redacted before they are written
+
+const RedactedText = "****"
+
+// values shorter than this are not redacted; they would mask too much unrelated text
+const MinRedactedValueLength = 4
+// most recently used values kept from requests (see addLogRedactedRequestValue); older ones are dropped
+const MaxLogRedactedRequestValues = 256
+
+// env vars whose values are always redacted, in addition to MINIENV_LOG_REDACT_ENV_VARS
+var DefaultRedactedEnvVars = []string{"MINIENV_REDIS_PASSWORD", "MINIENV_REDIS_SENTINEL_PASSWORD", "MINIENV_ACCESS_TOKEN_KEYS"}
+
+var urlUserInfoRegexp = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/\s@]+@`)
+var authHeaderRegexp = regexp.MustCompile(`(?i)\b(bearer|token|basic|private-token:?)\s+[A-Za-z0-9._~+/=-]+`)
+// claim tokens and session ids are uuids without dashes; the first characters are kept so logs can still be correlated
+var claimTokenRegexp = regexp.MustCompile(`\b([0-9a-fA-F]{4})[0-9a-fA-F]{28}\b`)
+// key/value pairs (KEY=value, "key": "value", key: value) whose key looks like a secret
+var secretKeyValueRegexp = regexp.MustCompile(`(?i)("?[A-Za-z0-9_.-]*(?:password|passwd|secret|token|api_?key|private_?key)[A-Za-z0-9_.-]*"?\s*[=:]\s*"?)([^\s",}]+)`)
+
+type logRedactor struct {
+	mutex sync.RWMutex
+	values []string
+	// least recently added first
+	requestValues []string
+	// values and requestValues, longest first
+	sortedValues []string
+	envVarRegexps []*regexp.Regexp
+}
+
+var redactor = &logRedactor{}
+
+// addLogRedactedValue masks every occurrence of value in the logs, e.g. the kubernetes service token
+func addLogRedactedValue(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < MinRedactedValueLength {
+		return
+	}
+	redactor.mutex.Lock()
+	defer redactor.mutex.Unlock()
+	if containsString(redactor.values, value) {
+		return
+	}
+	redactor.values = append(redactor.values, value)
+	redactor.requestValues = removeString(redactor.requestValues, value)
+	redactor.sort()
+}
+
+// addLogRedactedRequestValue masks value while handling requests that use it, e.g. a git token or a secret
+// env var; only the MaxLogRedactedRequestValues most recently added are kept, so the set doesn't grow with
+// every value requests send. Values that may show up in the logs at any time belong in addLogRedactedValue.
+func addLogRedactedRequestValue(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < MinRedactedValueLength {
+		return
+	}
+	redactor.mutex.Lock()
+	defer redactor.mutex.Unlock()
+	if containsString(redactor.values, value) {
+		return
+	}
+	redactor.requestValues = append(removeString(redactor.requestValues, value), value)
+	if len(redactor.requestValues) > MaxLogRedactedRequestValues {
+		redactor.requestValues = redactor.requestValues[len(redactor.requestValues) - MaxLogRedactedRequestValues:]
+	}
+	redactor.sort()
+}
+
+// sort replaces longer values first, so a value containing another is fully masked
+func (redactor *logRedactor) sort() {
+	sortedValues := make([]string, 0, len(redactor.values) + len(redactor.requestValues))
+	sortedValues = append(sortedValues, redactor.values...)
+	sortedValues = append(sortedValues, redactor.requestValues...)
+	sort.SliceStable(sortedValues, func(i, j int) bool {
+		return len(sortedValues[i]) > len(sortedValues[j])
+	})
+	redactor.sortedValues = sortedValues
+}
+
+func removeString(values []string, value string) []string {
+	var remaining []string
+	for _, element := range values {
+		if element != value {
+			remaining = append(remaining, element)
+		}
+	}
+	return remaining
+}
+
+// setLogRedactedEnvVars masks the values of the named env vars in this process, and any
+// NAME=value pairs in log messages, such as env vars passed to a deployment
+func setLogRedactedEnvVars(names []string) {
+	var envVarRegexps []*regexp.Regexp
+	for _, name := range names {
+		addLogRedactedValue(os.Getenv(name))
+		envVarRegexps = append(envVarRegexps, regexp.MustCompile(`("?` + regexp.QuoteMeta(name) + `"?\s*[=:]\s*"?)([^\s",}]+)`))
+	}
+	redactor.mutex.Lock()
+	redactor.envVarRegexps = envVarRegexps
+	redactor.mutex.Unlock()
+}
+
+func redactLogMessage(s string) string {
+	s = urlUserInfoRegexp.ReplaceAllString(s, "${1}" + RedactedText + "@")
+	s = authHeaderRegexp.ReplaceAllString(s, "$1 " + RedactedText)
+	s = secretKeyValueRegexp.ReplaceAllString(s, "${1}" + RedactedText)
+	redactor.mutex.RLock()
+	for _, envVarRegexp := range redactor.envVarRegexps {
+		s = envVarRegexp.ReplaceAllString(s, "${1}" + RedactedText)
+	}
+	for _, value := range redactor.sortedValues {
+		s = strings.Replace(s, value, RedactedText, -1)
+	}
+	redactor.mutex.RUnlock()
+	s = claimTokenRegexp.ReplaceAllString(s, "${1}" + RedactedText)
+	return s
+}
+
+func logPrintf(format string, v ...interface{}) {
+	log.Output(2, redactLogMessage(fmt.Sprintf(format, v...)))
+}
+
+func logPrintln(v ...interface{}) {
+	log.Output(2, redactLogMessage(fmt.Sprintln(v...)))
+}
+
+func logPrint(v ...interface{}) {
+	log.Output(2, redactLogMessage(fmt.Sprint(v...)))
+}
+
+func logFatalf(format string, v ...interface{}) {
+	log.Output(2, redactLogMessage(fmt.Sprintf(format, v...)))
+	os.Exit(1)
+}
@@ -0,0 +1,97 @@
+package minienv
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// host paths that give a service control over the node it runs on
+var sensitiveVolumeSources = []string{"/var/run/docker.sock", "/run/docker.sock", "/"}
+
+// analyzeRepo inspects the manifest and compose files of a repo without deploying anything.
+// Problems with the repo itself are returned as warnings in the response rather than as an error.
+func analyzeRepo(repo *DeploymentRepo) *EnvInfoResponse {
+	envInfoResponse := &EnvInfoResponse{
+		Repo: repo.Repo,
+		Branch: repo.Branch,
+		Commit: repo.Commit,
+		Services: []*EnvInfoService{},
+		Tabs: []DeploymentTab{},
+		RequiredEnvVars: []string{},
+		Images: []string{},
+		Warnings: []string{},
+	}
+	manifest, err := loadRepoManifest(repo)
+	if err != nil {
+		envInfoResponse.Warnings = append(envInfoResponse.Warnings, fmt.Sprintf("unable to load manifest: %v", err))
+	}
+	envInfoResponse.Manifest = manifest
+	applyRepoManifest(repo, manifest)
+	project, fileNames, err := analyzeDockerCompose(repo)
+	envInfoResponse.ComposeFiles = fileNames
+	if err != nil {
+		envInfoResponse.Warnings = append(envInfoResponse.Warnings, fmt.Sprintf("unable to load compose files: %v", err))
+		envInfoResponse.EnvVars = getEnvVarSchema(manifest, nil, nil)
+		return envInfoResponse
+	}
+	envInfoResponse.EnvVars = getEnvVarSchema(manifest, project, project.DotEnv)
+	envInfoResponse.Warnings = append(envInfoResponse.Warnings, project.Warnings...)
+	envInfoResponse.RequiredEnvVars = append(envInfoResponse.RequiredEnvVars, project.MissingEnvVars...)
+	sort.Strings(envInfoResponse.RequiredEnvVars)
+	images := make(map[string]bool)
+	for _, service := range project.Services {
+		infoService := &EnvInfoService{
+			Name: service.Name,
+			Image: service.Image,
+			Build: service.Build,
+			Privileged: service.Privileged,
+			Ports: []int{},
+		}
+		for _, port := range service.Ports {
+			infoService.Ports = append(infoService.Ports, port.HostPort())
+		}
+		envInfoResponse.Services = append(envInfoResponse.Services, infoService)
+		if service.Image != "" && ! images[service.Image] {
+			images[service.Image] = true
+			envInfoResponse.Images = append(envInfoResponse.Images, service.Image)
+		}
+		envInfoResponse.Warnings = append(envInfoResponse.Warnings, getComposeServiceWarnings(service)...)
+	}
+	sort.Strings(envInfoResponse.Images)
+	for _, tab := range getComposeTabs(project) {
+		envInfoResponse.Tabs = append(envInfoResponse.Tabs, *tab)
+	}
+	if len(envInfoResponse.Tabs) == 0 {
+		envInfoResponse.Warnings = append(envInfoResponse.Warnings, "no tcp ports are published, so the environment will have no tabs")
+	}
+	return envInfoResponse
+}
+
+func getComposeServiceWarnings(service *ComposeService) []string {
+	var warnings []string
+	if service.Image == "" && ! service.Build {
+		warnings = append(warnings, fmt.Sprintf("service '%s' has neither an image nor a build", service.Name))
+	}
+	if service.Privileged {
+		warnings = append(warnings, fmt.Sprintf("service '%s' runs privileged", service.Name))
+	}
+	if service.NetworkMode == "host" {
+		warnings = append(warnings, fmt.Sprintf("service '%s' uses host networking", service.Name))
+	}
+	if len(service.CapAdd) > 0 {
+		warnings = append(warnings, fmt.Sprintf("service '%s' adds capabilities %s", service.Name, strings.Join(service.CapAdd, ", ")))
+	}
+	for _, source := range service.Volumes {
+		if source != "" && containsString(sensitiveVolumeSources, path.Clean(source)) {
+			warnings = append(warnings, fmt.Sprintf("service '%s' mounts '%s' from the host", service.Name, source))
+		}
+	}
+	for _, port := range service.Ports {
+		if port.Protocol != ProtocolTcp {
+			warnings = append(warnings, fmt.Sprintf("%s port %d of service '%s' won't get a tab", port.Protocol, port.HostPort(), service.Name))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,140 @@
+package minienv
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// how often the catalog file is checked for changes
+const RepoCatalogReloadSeconds = 30
+
+// repoCatalogYaml is the catalog file configured with MINIENV_REPO_CATALOG_FILE (yaml or json), e.g.
+//
+//   repos:
+//     - name: Our Apps
+//       url: github.com/our-org/*
+//       branch: release/*
+//       description: Release builds of our apps
+//       envVars:
+//         LOG_LEVEL: info
+//       allowedEnvVars: [LOG_LEVEL, FEATURE_FLAGS]
+//       maxExpirationSeconds: 3600
+//   denied:
+//     - url: github.com/our-org/secret
+//       branch: "**"
+type repoCatalogYaml struct {
+	Repos []*WhitelistRepo `yaml:"repos" json:"repos"`
+	Denied []*WhitelistRepo `yaml:"denied" json:"denied"`
+}
+
+var repoCatalogFile string
+var repoCatalogModTime time.Time
+
+// loadRepoCatalog reads and compiles the catalog; an empty list of repos allows every repo, as with MINIENV_REPO_WHITELIST
+func loadRepoCatalog(fp string) ([]*WhitelistRepo, []*WhitelistRepo, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, nil, err
+	}
+	var catalog repoCatalogYaml
+	err = yaml.Unmarshal(data, &catalog)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, element := range append(catalog.Repos, catalog.Denied...) {
+		if element == nil || element.Url == "" {
+			return nil, nil, errors.New("catalog entry is missing a url")
+		}
+		if element.Name == "" {
+			element.Name = element.Url
+		}
+		if element.MaxExpirationSeconds < 0 {
+			return nil, nil, fmt.Errorf("catalog entry '%s' has a negative max expiration", element.Name)
+		}
+		err = element.compile()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(catalog.Repos) == 0 {
+		catalog.Repos = nil
+	}
+	return catalog.Repos, catalog.Denied, nil
+}
+
+// reloadRepoCatalog replaces the whitelist and denylist when the catalog file has changed since it was last loaded;
+// if the new catalog can't be loaded the previous one stays in place
+func reloadRepoCatalog(force bool) error {
+	info, err := os.Stat(repoCatalogFile)
+	if err != nil {
+		return err
+	}
+	if ! force && info.ModTime().Equal(repoCatalogModTime) {
+		return nil
+	}
+	whitelist, denylist, err := loadRepoCatalog(repoCatalogFile)
+	if err != nil {
+		return err
+	}
+	logPrintf("Loaded repo catalog with %d repos and %d denied repos.\n", len(whitelist), len(denylist))
+	setWhitelistRepos(whitelist, denylist)
+	repoCatalogModTime = info.ModTime()
+	return nil
+}
+
+func startRepoCatalogReloadTimer() {
+	timer := time.NewTimer(time.Second * time.Duration(RepoCatalogReloadSeconds))
+	go func() {
+		<-timer.C
+		err := reloadRepoCatalog(false)
+		if err != nil {
+			logPrintf("Error reloading repo catalog; keeping previous catalog: %v\n", err)
+		}
+		startRepoCatalogReloadTimer()
+	}()
+}
+
+// getCatalogEnvVars merges the env vars requested for a deployment over the defaults of its catalog entry,
+// rejecting any the entry doesn't allow
+func getCatalogEnvVars(whitelistRepo *WhitelistRepo, requested map[string]string) (map[string]string, error) {
+	if whitelistRepo == nil {
+		return requested, nil
+	}
+	envVars := make(map[string]string)
+	for k, v := range whitelistRepo.EnvVars {
+		envVars[k] = v
+	}
+	for k, v := range requested {
+		if whitelistRepo.AllowedEnvVars != nil && ! containsString(whitelistRepo.AllowedEnvVars, k) {
+			return nil, fmt.Errorf("env var '%s' is not allowed for repo '%s'", k, whitelistRepo.Name)
+		}
+		envVars[k] = v
+	}
+	return envVars, nil
+}
+
+// getCatalogExpirationSeconds caps the requested expiration at the max of the catalog entry, if any
+func getCatalogExpirationSeconds(whitelistRepo *WhitelistRepo, requested int64) int64 {
+	expirationSeconds := requested
+	if expirationSeconds < 0 {
+		expirationSeconds = DefaultEnvExpirationSeconds
+	}
+	if whitelistRepo != nil && whitelistRepo.MaxExpirationSeconds > 0 && (expirationSeconds == 0 || expirationSeconds > whitelistRepo.MaxExpirationSeconds) {
+		expirationSeconds = whitelistRepo.MaxExpirationSeconds
+	}
+	return expirationSeconds
+}
+
+func containsString(list []string, s string) bool {
+	for _, element := range list {
+		if element == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package minienv
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// manifest files tried, in order, at the root of the repo
+var ManifestFileNames = []string{"minienv.yml", "minienv.yaml"}
+
+// RepoManifest holds the minienv settings a repo declares for itself, e.g.
+//
+//   description: Our app with a postgres database
+//   composePath: deploy
+//   composeFiles: [compose.yml, compose.dev.yml]
+//   profiles: [debug]
+//   envVars:
+//     - name: LOG_LEVEL
+//       type: string
+//       default: info
+//       allowedValues: [debug, info, warn]
+//     - name: API_KEY
+//       required: true
+//       secret: true
+//
+// Settings given in a request take precedence over the manifest, which takes precedence over the server defaults.
+type RepoManifest struct {
+	FileName string `yaml:"-" json:"fileName"`
+	Description string `yaml:"description" json:"description,omitempty"`
+	ComposePath string `yaml:"composePath" json:"composePath,omitempty"`
+	ComposeFiles []string `yaml:"composeFiles" json:"composeFiles,omitempty"`
+	Profiles []string `yaml:"profiles" json:"profiles,omitempty"`
+	EnvVars []*EnvVarSchema `yaml:"-" json:"envVars,omitempty"`
+}
+
+type repoManifestEnvVarsYaml struct {
+	EnvVars []*envVarSchemaYaml `yaml:"envVars"`
+}
+
+// loadRepoManifest returns the manifest of the repo, or nil if it has none
+func loadRepoManifest(repo *DeploymentRepo) (*RepoManifest, error) {
+	for _, fileName := range ManifestFileNames {
+		data, err := getRepoFile(repo, fileName)
+		if err == errRepoFileNotFound {
+			continue
+		} else if err != nil {
+			logPrintf("Error downloading manifest '%s': %v\n", fileName, err)
+			return nil, err
+		}
+		manifest := &RepoManifest{}
+		err = yaml.Unmarshal(data, manifest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest '%s': %v", fileName, err)
+		}
+		var envVarsYaml repoManifestEnvVarsYaml
+		err = yaml.Unmarshal(data, &envVarsYaml)
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest '%s': %v", fileName, err)
+		}
+		for _, schemaYaml := range envVarsYaml.EnvVars {
+			if schemaYaml == nil {
+				continue
+			}
+			schema, err := schemaYaml.toSchema()
+			if err != nil {
+				return nil, fmt.Errorf("invalid manifest '%s': %v", fileName, err)
+			}
+			manifest.EnvVars = append(manifest.EnvVars, schema)
+		}
+		manifest.FileName = fileName
+		return manifest, nil
+	}
+	return nil, nil
+}
+
+// applyRepoManifest fills in the compose settings the request left empty
+func applyRepoManifest(repo *DeploymentRepo, manifest *RepoManifest) {
+	if manifest == nil {
+		return
+	}
+	if repo.ComposePath == "" {
+		repo.ComposePath = manifest.ComposePath
+	}
+	if len(repo.ComposeFiles) == 0 {
+		repo.ComposeFiles = manifest.ComposeFiles
+	}
+	if len(repo.Profiles) == 0 {
+		repo.Profiles = manifest.Profiles
+	}
+}
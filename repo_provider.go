@@ -0,0 +1,393 @@
+package minienv
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const RepoProviderGitHub = "github"
+const RepoProviderGitLab = "gitlab"
+const RepoProviderBitbucket = "bitbucket"
+const RepoProviderGitea = "gitea"
+
+var errRepoFileNotFound = errors.New("file not found in repo")
+
+// RepoProvider fetches files from a hosted git repository using the host's own conventions
+type RepoProvider interface {
+	GetName() string
+	GetFile(repo *DeploymentRepo, path string) ([]byte, error)
+	GetPullRequestRef(number int) (string, error)
+}
+
+// rawFileRepoProvider is implemented by providers that serve raw files over plain http
+type rawFileRepoProvider interface {
+	RepoProvider
+	GetFileUrl(repoUrl *RepoUrl, ref string, path string) (string, error)
+	AddAuth(req *http.Request, repo *DeploymentRepo)
+}
+
+// RepoUrl is a repository url split into the parts providers need to build their own urls
+type RepoUrl struct {
+	Scheme string
+	Host string
+	// full path of the repo without the .git suffix, e.g. "group/subgroup/project"
+	Path string
+}
+
+var repoProviders = map[string]RepoProvider{
+	RepoProviderGitHub: &GitHubRepoProvider{},
+	RepoProviderGitLab: &GitLabRepoProvider{},
+	RepoProviderBitbucket: &BitbucketRepoProvider{},
+	RepoProviderGitea: &GiteaRepoProvider{},
+	RepoProviderGit: NewGitRepoProvider(),
+}
+
+var defaultRepoProviderHosts = map[string]string{
+	"github.com": RepoProviderGitHub,
+	"gitlab.com": RepoProviderGitLab,
+	"bitbucket.org": RepoProviderBitbucket,
+	"gitea.com": RepoProviderGitea,
+	"codeberg.org": RepoProviderGitea,
+}
+
+// provider names by host, configured with MINIENV_REPO_PROVIDERS, e.g. "git.example.com=gitlab,code.example.com=git"
+var repoProviderHosts = map[string]string{}
+
+func parseRepoProviderHosts(s string) map[string]string {
+	hosts := map[string]string{}
+	for _, element := range splitList(s) {
+		parts := strings.SplitN(element, "=", 2)
+		if len(parts) != 2 {
+			logPrintf("Ignoring invalid repo provider '%s'.\n", element)
+			continue
+		}
+		host := strings.ToLower(strings.TrimSpace(parts[0]))
+		name := strings.ToLower(strings.TrimSpace(parts[1]))
+		if _, ok := repoProviders[name]; ! ok {
+			logPrintf("Ignoring unknown repo provider '%s' for host '%s'.\n", name, host)
+			continue
+		}
+		hosts[host] = name
+	}
+	return hosts
+}
+
+func parseRepoUrl(repo string) (*RepoUrl, error) {
+	u, err := url.Parse(strings.TrimSpace(repo))
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid repo url '%s'", repo)
+	}
+	path := strings.Trim(u.Path, "/")
+	path = strings.TrimSuffix(path, ".git")
+	if path == "" {
+		return nil, fmt.Errorf("invalid repo url '%s'", repo)
+	}
+	return &RepoUrl{Scheme: u.Scheme, Host: strings.ToLower(u.Host), Path: path}, nil
+}
+
+// getRepoProvider selects the provider by the host of the repo url, configured hosts first;
+// repos on unknown hosts are fetched with plain git
+func getRepoProvider(repo string) (RepoProvider, error) {
+	if strings.HasPrefix(repo, "file://") || strings.HasPrefix(repo, "ssh://") || strings.HasPrefix(repo, "git@") {
+		return repoProviders[RepoProviderGit], nil
+	}
+	repoUrl, err := parseRepoUrl(repo)
+	if err != nil {
+		return nil, err
+	}
+	host := repoUrl.Host
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	name, ok := repoProviderHosts[host]
+	if ! ok {
+		name, ok = defaultRepoProviderHosts[host]
+	}
+	if ! ok {
+		name = RepoProviderGit
+	}
+	return repoProviders[name], nil
+}
+
+// getRepoFile downloads a single file from the repo; errRepoFileNotFound is returned if it does not exist
+func getRepoFile(repo *DeploymentRepo, path string) ([]byte, error) {
+	provider, err := getRepoProvider(repo.Repo)
+	if err != nil {
+		return nil, err
+	}
+	if repo.SshKey != nil {
+		// deploy keys only work over ssh
+		provider = repoProviders[RepoProviderGit]
+	}
+	if err := checkRepoFilePath(path); err != nil {
+		return nil, err
+	}
+	logPrintf("Downloading '%s' from repo '%s' using %s...\n", path, repo.Repo, provider.GetName())
+	data, err := provider.GetFile(repo, path)
+	if err != nil && err != errRepoFileNotFound && provider.GetName() != RepoProviderGit {
+		// the host's api may be disabled or unreachable; git itself should still work
+		logPrintf("Error downloading '%s' using %s, falling back to git: %v\n", path, provider.GetName(), err)
+		return repoProviders[RepoProviderGit].GetFile(repo, path)
+	}
+	return data, err
+}
+
+// resolveRepoCommit resolves the requested commit, pull request, tag or branch (in that order of precedence)
+// to the sha of a commit, which is then used for every file fetched from the repo
+func resolveRepoCommit(repo *DeploymentRepo) error {
+	provider, err := getRepoProvider(repo.Repo)
+	if err != nil {
+		return err
+	}
+	var ref string
+	if repo.Commit != "" {
+		if ! shaRegexp.MatchString(repo.Commit) {
+			return fmt.Errorf("commit '%s' is not a full sha", repo.Commit)
+		}
+		ref = repo.Commit
+	} else if repo.PullRequest > 0 {
+		ref, err = provider.GetPullRequestRef(repo.PullRequest)
+		if err != nil {
+			return err
+		}
+	} else if repo.Tag != "" {
+		ref = "refs/tags/" + repo.Tag
+	} else {
+		ref = "refs/heads/" + repo.Branch
+	}
+	// refs are listed with git for every provider; all of them support it and it returns peeled tags
+	gitProvider := repoProviders[RepoProviderGit].(*GitRepoProvider)
+	_, hash, err := gitProvider.resolveRef(repo, ref)
+	if err != nil {
+		return err
+	}
+	repo.Commit = strings.ToLower(hash.String())
+	logPrintf("Resolved '%s' in repo '%s' to %s.\n", ref, repo.Repo, repo.Commit)
+	return nil
+}
+
+func getRawRepoFile(provider rawFileRepoProvider, repo *DeploymentRepo, path string) ([]byte, error) {
+	repoUrl, err := parseRepoUrl(repo.Repo)
+	if err != nil {
+		return nil, err
+	}
+	fileUrl, err := provider.GetFileUrl(repoUrl, repo.getRef(), path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", fileUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	provider.AddAuth(req, repo)
+	resp, err := getHttpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errRepoFileNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error downloading '%s': %s", path, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// checkRepoFilePath refuses absolute paths and ".." segments, which could reach files outside the repo, or other
+// repos and api endpoints once the path is part of a url
+func checkRepoFilePath(path string) error {
+	if strings.HasPrefix(path, "/") || strings.HasPrefix(path, "\\") {
+		return fmt.Errorf("path '%s' is absolute", path)
+	}
+	for _, segment := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return fmt.Errorf("path '%s' contains '..'", path)
+		}
+	}
+	return nil
+}
+
+func escapePathSegments(path string) (string, error) {
+	if err := checkRepoFilePath(path); err != nil {
+		return "", err
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// GitHubRepoProvider serves public files from raw.githubusercontent.com and private files, or files on
+// GitHub Enterprise, from the contents api; the password is used as a personal access token
+type GitHubRepoProvider struct {
+}
+
+func (provider *GitHubRepoProvider) GetName() string {
+	return RepoProviderGitHub
+}
+
+func (provider *GitHubRepoProvider) GetFile(repo *DeploymentRepo, path string) ([]byte, error) {
+	if repo.Password != "" {
+		return getRawRepoFile(&gitHubApiRepoProvider{provider}, repo, path)
+	}
+	return getRawRepoFile(provider, repo, path)
+}
+
+func (provider *GitHubRepoProvider) GetPullRequestRef(number int) (string, error) {
+	return fmt.Sprintf("refs/pull/%d/head", number), nil
+}
+
+func (provider *GitHubRepoProvider) GetFileUrl(repoUrl *RepoUrl, ref string, path string) (string, error) {
+	if repoUrl.Host != "github.com" {
+		return (&gitHubApiRepoProvider{provider}).GetFileUrl(repoUrl, ref, path)
+	}
+	escapedPath, err := escapePathSegments(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s", repoUrl.Path, url.PathEscape(ref), escapedPath), nil
+}
+
+func (provider *GitHubRepoProvider) AddAuth(req *http.Request, repo *DeploymentRepo) {
+	if repo.Password != "" {
+		req.Header.Set("Authorization", "token " + repo.Password)
+	}
+}
+
+type gitHubApiRepoProvider struct {
+	*GitHubRepoProvider
+}
+
+func (provider *gitHubApiRepoProvider) GetFileUrl(repoUrl *RepoUrl, ref string, path string) (string, error) {
+	apiBaseUrl := "https://api.github.com"
+	if repoUrl.Host != "github.com" {
+		apiBaseUrl = fmt.Sprintf("%s://%s/api/v3", repoUrl.Scheme, repoUrl.Host)
+	}
+	escapedPath, err := escapePathSegments(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/repos/%s/contents/%s?ref=%s", apiBaseUrl, repoUrl.Path, escapedPath, url.QueryEscape(ref)), nil
+}
+
+func (provider *gitHubApiRepoProvider) AddAuth(req *http.Request, repo *DeploymentRepo) {
+	req.Header.Set("Accept", "application/vnd.github.v3.raw")
+	provider.GitHubRepoProvider.AddAuth(req, repo)
+}
+
+// GitLabRepoProvider uses the repository files api; the password is sent as a personal or project access token
+type GitLabRepoProvider struct {
+}
+
+func (provider *GitLabRepoProvider) GetName() string {
+	return RepoProviderGitLab
+}
+
+func (provider *GitLabRepoProvider) GetFile(repo *DeploymentRepo, path string) ([]byte, error) {
+	return getRawRepoFile(provider, repo, path)
+}
+
+func (provider *GitLabRepoProvider) GetPullRequestRef(number int) (string, error) {
+	return fmt.Sprintf("refs/merge-requests/%d/head", number), nil
+}
+
+func (provider *GitLabRepoProvider) GetFileUrl(repoUrl *RepoUrl, ref string, path string) (string, error) {
+	if err := checkRepoFilePath(path); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s://%s/api/v4/projects/%s/repository/files/%s/raw?ref=%s", repoUrl.Scheme, repoUrl.Host, url.PathEscape(repoUrl.Path), url.PathEscape(path), url.QueryEscape(ref)), nil
+}
+
+func (provider *GitLabRepoProvider) AddAuth(req *http.Request, repo *DeploymentRepo) {
+	if repo.Password != "" {
+		req.Header.Set("PRIVATE-TOKEN", repo.Password)
+	}
+}
+
+// BitbucketRepoProvider supports Bitbucket Cloud (bitbucket.org, app passwords) and
+// Bitbucket Server (repos under /scm/<project>/<repo>, http access tokens)
+type BitbucketRepoProvider struct {
+}
+
+func (provider *BitbucketRepoProvider) GetName() string {
+	return RepoProviderBitbucket
+}
+
+func (provider *BitbucketRepoProvider) GetFile(repo *DeploymentRepo, path string) ([]byte, error) {
+	return getRawRepoFile(provider, repo, path)
+}
+
+// GetPullRequestRef is only supported by Bitbucket Server; Bitbucket Cloud does not publish pull request refs
+func (provider *BitbucketRepoProvider) GetPullRequestRef(number int) (string, error) {
+	return fmt.Sprintf("refs/pull-requests/%d/from", number), nil
+}
+
+func (provider *BitbucketRepoProvider) GetFileUrl(repoUrl *RepoUrl, ref string, path string) (string, error) {
+	escapedPath, err := escapePathSegments(path)
+	if err != nil {
+		return "", err
+	}
+	if repoUrl.Host == "bitbucket.org" {
+		return fmt.Sprintf("https://api.bitbucket.org/2.0/repositories/%s/src/%s/%s", repoUrl.Path, url.PathEscape(ref), escapedPath), nil
+	}
+	parts := strings.Split(strings.TrimPrefix(repoUrl.Path, "scm/"), "/")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid bitbucket server repo path '%s'", repoUrl.Path)
+	}
+	return fmt.Sprintf("%s://%s/rest/api/1.0/projects/%s/repos/%s/raw/%s?at=%s", repoUrl.Scheme, repoUrl.Host, url.PathEscape(parts[0]), url.PathEscape(parts[1]), escapedPath, url.QueryEscape(ref)), nil
+}
+
+func (provider *BitbucketRepoProvider) AddAuth(req *http.Request, repo *DeploymentRepo) {
+	if repo.Password != "" {
+		if repo.Username != "" {
+			req.SetBasicAuth(repo.Username, repo.Password)
+		} else {
+			req.Header.Set("Authorization", "Bearer " + repo.Password)
+		}
+	}
+}
+
+// GiteaRepoProvider uses the raw file api shared by Gitea, Forgejo and Codeberg
+type GiteaRepoProvider struct {
+}
+
+func (provider *GiteaRepoProvider) GetName() string {
+	return RepoProviderGitea
+}
+
+func (provider *GiteaRepoProvider) GetFile(repo *DeploymentRepo, path string) ([]byte, error) {
+	return getRawRepoFile(provider, repo, path)
+}
+
+func (provider *GiteaRepoProvider) GetPullRequestRef(number int) (string, error) {
+	return fmt.Sprintf("refs/pull/%d/head", number), nil
+}
+
+func (provider *GiteaRepoProvider) GetFileUrl(repoUrl *RepoUrl, ref string, path string) (string, error) {
+	if strings.Count(repoUrl.Path, "/") != 1 {
+		return "", errors.New("invalid gitea repo path '" + repoUrl.Path + "'")
+	}
+	escapedPath, err := escapePathSegments(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s://%s/api/v1/repos/%s/raw/%s?ref=%s", repoUrl.Scheme, repoUrl.Host, repoUrl.Path, escapedPath, url.QueryEscape(ref)), nil
+}
+
+func (provider *GiteaRepoProvider) AddAuth(req *http.Request, repo *DeploymentRepo) {
+	if repo.Password != "" {
+		if repo.Username != "" {
+			req.SetBasicAuth(repo.Username, repo.Password)
+		} else {
+			req.Header.Set("Authorization", "token " + repo.Password)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package minienv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitclient "github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"golang.org/x/crypto/ssh"
+)
+
+const RepoProviderGit = "git"
+
+// how long the refs listed from a remote are reused before listing them again
+const GitRefCacheSeconds int64 = 30
+// number of fetched commits kept in memory
+const GitCommitCacheSize = 16
+// reading from a commit fails once the objects fetched for it would add up to more than this, unless MINIENV_GIT_FETCH_MAX_BYTES is set
+const DefaultGitFetchMaxBytes int64 = 32 * 1024 * 1024
+// fetched commits are evicted once they add up to this, unless MINIENV_GIT_CACHE_MAX_BYTES is set
+const DefaultGitCacheMaxBytes int64 = 128 * 1024 * 1024
+
+var shaRegexp = regexp.MustCompile("^[0-9a-fA-F]{40}$")
+
+var errGitFetchTooLarge = errors.New("repo too large to fetch")
+var errGitTransportNotAllowed = errors.New("only repos served over http, https or ssh can be fetched")
+
+var gitFetchMaxBytes = DefaultGitFetchMaxBytes
+var gitCacheMaxBytes = DefaultGitCacheMaxBytes
+
+// GitRepoProvider works with any git remote over smart http or ssh by fetching only the tip commit of the
+// requested ref into memory and reading files from its tree. Remotes that support partial fetches (the
+// "filter" and "allow-reachable-sha1-in-want" capabilities, as GitHub, GitLab and Gitea do) are asked for the
+// commit and its trees without any blobs, and each file's blob is fetched as it's read, so only the files
+// minienv reads are downloaded. Other remotes send the whole tree of the commit.
+// Fetched commits are cached by sha, so repeated reads for the same deployment only fetch once; the objects
+// fetched for a commit are limited to gitFetchMaxBytes, and the cache is kept under gitCacheMaxBytes.
+// Local repos (file:// urls and paths) are refused, so a request can't read the server's own files.
+type GitRepoProvider struct {
+	mutex sync.Mutex
+	refs map[string]*gitRefsCacheEntry
+	commits map[string]*gitCommitCacheEntry
+	commitKeys []string
+	commitBytes int64
+}
+
+type gitCommitCacheEntry struct {
+	Commit *object.Commit
+	Size int64
+	// true if the commit was fetched without blobs, which are then fetched as files are read
+	Partial bool
+	storage *limitedGitStorage
+	// guards the storage, which blobs are added to as files are read
+	mutex sync.Mutex
+}
+
+// limitedGitStorage is the in-memory storage of a commit, failing once the objects stored would add up to more than maxSize
+type limitedGitStorage struct {
+	*memory.Storage
+	size int64
+	maxSize int64
+}
+
+func (storage *limitedGitStorage) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	if storage.maxSize > 0 && storage.size + obj.Size() > storage.maxSize {
+		return plumbing.ZeroHash, errGitFetchTooLarge
+	}
+	storage.size += obj.Size()
+	return storage.Storage.SetEncodedObject(obj)
+}
+
+type gitRefsCacheEntry struct {
+	Refs []*plumbing.Reference
+	Timestamp int64
+}
+
+func NewGitRepoProvider() *GitRepoProvider {
+	return &GitRepoProvider{
+		refs: make(map[string]*gitRefsCacheEntry),
+		commits: make(map[string]*gitCommitCacheEntry),
+	}
+}
+
+func (provider *GitRepoProvider) GetName() string {
+	return RepoProviderGit
+}
+
+// GetPullRequestRef follows the GitHub convention, which Gitea and others share
+func (provider *GitRepoProvider) GetPullRequestRef(number int) (string, error) {
+	return fmt.Sprintf("refs/pull/%d/head", number), nil
+}
+
+func (provider *GitRepoProvider) GetFile(repo *DeploymentRepo, path string) ([]byte, error) {
+	entry, err := provider.getCommit(repo, repo.getRef())
+	if err != nil {
+		return nil, err
+	}
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	tree, err := entry.Commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	treeEntry, err := tree.FindEntry(strings.Trim(path, "/"))
+	if err == object.ErrEntryNotFound || err == object.ErrDirectoryNotFound {
+		return nil, errRepoFileNotFound
+	} else if err != nil {
+		return nil, err
+	} else if ! treeEntry.Mode.IsFile() {
+		return nil, errRepoFileNotFound
+	}
+	if entry.Partial && entry.storage.HasEncodedObject(treeEntry.Hash) != nil {
+		err = provider.fetchBlob(repo, entry, treeEntry.Hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	blob, err := object.GetBlob(entry.storage, treeEntry.Hash)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// resolveRef returns the name of a branch, tag or full ref on the remote and the sha of the commit it points to.
+// A full sha is returned as is, along with the name of a ref pointing to it, if any, so it can be fetched as that ref.
+func (provider *GitRepoProvider) resolveRef(repo *DeploymentRepo, ref string) (plumbing.ReferenceName, plumbing.Hash, error) {
+	refs, err := provider.listRefs(repo)
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+	// peeled tags are listed as "refs/tags/<tag>^{}" and point to the tagged commit
+	hashes := make(map[plumbing.ReferenceName]plumbing.Hash)
+	for _, element := range refs {
+		if element.Type() == plumbing.HashReference {
+			hashes[element.Name()] = element.Hash()
+		}
+	}
+	for _, element := range refs {
+		if peeled, ok := hashes[element.Name() + "^{}"]; ok {
+			hashes[element.Name()] = peeled
+		}
+	}
+	if shaRegexp.MatchString(ref) {
+		hash := plumbing.NewHash(strings.ToLower(ref))
+		for name, element := range hashes {
+			if element == hash && ! strings.HasSuffix(name.String(), "^{}") {
+				return name, hash, nil
+			}
+		}
+		return "", hash, nil
+	}
+	candidates := []plumbing.ReferenceName{
+		plumbing.ReferenceName(ref),
+		plumbing.NewBranchReferenceName(ref),
+		plumbing.NewTagReferenceName(ref),
+	}
+	for _, candidate := range candidates {
+		if hash, ok := hashes[candidate]; ok {
+			return candidate, hash, nil
+		}
+	}
+	return "", plumbing.ZeroHash, fmt.Errorf("ref '%s' not found", ref)
+}
+
+func (provider *GitRepoProvider) listRefs(repo *DeploymentRepo) ([]*plumbing.Reference, error) {
+	now := time.Now().Unix()
+	key := getGitCacheKey(repo)
+	provider.mutex.Lock()
+	entry := provider.refs[key]
+	provider.mutex.Unlock()
+	if entry != nil && now - entry.Timestamp < GitRefCacheSeconds {
+		return entry.Refs, nil
+	}
+	auth, err := getGitAuth(repo)
+	if err != nil {
+		return nil, err
+	}
+	remoteUrl, err := getGitRemoteUrl(repo)
+	if err != nil {
+		return nil, err
+	}
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{remoteUrl}})
+	refs, err := remote.List(&git.ListOptions{Auth: auth, PeelingOption: git.AppendPeeled})
+	if err != nil {
+		logPrintf("Error listing refs for repo '%s': %v\n", repo.Repo, err)
+		return nil, err
+	}
+	provider.mutex.Lock()
+	provider.refs[key] = &gitRefsCacheEntry{Refs: refs, Timestamp: now}
+	provider.mutex.Unlock()
+	return refs, nil
+}
+
+func (provider *GitRepoProvider) getCommit(repo *DeploymentRepo, ref string) (*gitCommitCacheEntry, error) {
+	refName, hash, err := provider.resolveRef(repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	key := getGitCacheKey(repo) + "@" + hash.String()
+	provider.mutex.Lock()
+	entry := provider.commits[key]
+	provider.mutex.Unlock()
+	if entry != nil {
+		return entry, nil
+	}
+	logPrintf("Fetching %s from repo '%s'...\n", hash.String(), repo.Repo)
+	session, advRefs, err := openGitUploadPackSession(repo)
+	if err != nil {
+		logPrintf("Error fetching %s from repo '%s': %v\n", hash.String(), repo.Repo, err)
+		return nil, err
+	}
+	defer session.Close()
+	// a ref is fetched by the hash it's advertised with, which servers allow even when they don't allow
+	// fetching other commits; for annotated tags that's the tag, which brings the commit along
+	want := hash
+	if advertised, ok := advRefs.References[refName.String()]; ok {
+		want = advertised
+	}
+	entry = &gitCommitCacheEntry{
+		Partial: supportsGitPartialFetch(advRefs),
+		storage: &limitedGitStorage{Storage: memory.NewStorage(), maxSize: gitFetchMaxBytes},
+	}
+	var filter packp.Filter
+	if entry.Partial {
+		filter = packp.FilterBlobNone()
+	}
+	err = fetchGitObjects(session, advRefs, entry.storage, want, 1, filter)
+	if err == errGitFetchTooLarge {
+		logPrintf("Error fetching %s from repo '%s'; more than %d bytes.\n", hash.String(), repo.Repo, gitFetchMaxBytes)
+		return nil, err
+	} else if err != nil {
+		logPrintf("Error fetching %s from repo '%s': %v\n", hash.String(), repo.Repo, err)
+		return nil, err
+	}
+	entry.Commit, err = object.GetCommit(entry.storage, hash)
+	if err != nil {
+		// annotated tags point to a tag object rather than the commit
+		tag, tagErr := object.GetTag(entry.storage, hash)
+		if tagErr != nil {
+			return nil, err
+		}
+		entry.Commit, err = tag.Commit()
+		if err != nil {
+			return nil, err
+		}
+	}
+	entry.Size = entry.storage.size
+	provider.mutex.Lock()
+	if cached, ok := provider.commits[key]; ok {
+		entry = cached
+	} else {
+		provider.commits[key] = entry
+		provider.commitKeys = append(provider.commitKeys, key)
+		provider.commitBytes += entry.Size
+		provider.trimCommits()
+	}
+	provider.mutex.Unlock()
+	return entry, nil
+}
+
+// fetchBlob adds a blob to a partially fetched commit; the caller holds the entry's mutex
+func (provider *GitRepoProvider) fetchBlob(repo *DeploymentRepo, entry *gitCommitCacheEntry, hash plumbing.Hash) (error) {
+	session, advRefs, err := openGitUploadPackSession(repo)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	size := entry.storage.size
+	err = fetchGitObjects(session, advRefs, entry.storage, hash, 0, "")
+	if err == errGitFetchTooLarge {
+		logPrintf("Error fetching %s from repo '%s'; more than %d bytes.\n", hash.String(), repo.Repo, gitFetchMaxBytes)
+		return err
+	} else if err != nil {
+		logPrintf("Error fetching %s from repo '%s': %v\n", hash.String(), repo.Repo, err)
+		return err
+	}
+	provider.mutex.Lock()
+	entry.Size = entry.storage.size
+	for _, key := range provider.commitKeys {
+		if provider.commits[key] == entry {
+			provider.commitBytes += entry.storage.size - size
+			provider.trimCommits()
+			break
+		}
+	}
+	provider.mutex.Unlock()
+	return nil
+}
+
+// trimCommits evicts the oldest commits until the cache is within its limits, keeping at least the newest;
+// the caller holds the provider's mutex
+func (provider *GitRepoProvider) trimCommits() {
+	for len(provider.commitKeys) > GitCommitCacheSize || (provider.commitBytes > gitCacheMaxBytes && len(provider.commitKeys) > 1) {
+		provider.commitBytes -= provider.commits[provider.commitKeys[0]].Size
+		delete(provider.commits, provider.commitKeys[0])
+		provider.commitKeys = provider.commitKeys[1:]
+	}
+}
+
+func openGitUploadPackSession(repo *DeploymentRepo) (transport.UploadPackSession, *packp.AdvRefs, error) {
+	remoteUrl, err := getGitRemoteUrl(repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	endpoint, err := transport.NewEndpoint(remoteUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := gitclient.NewClient(endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	auth, err := getGitAuth(repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := client.NewUploadPackSession(endpoint, auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	advRefs, err := session.AdvertisedReferences()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	return session, advRefs, nil
+}
+
+// supportsGitPartialFetch returns true if the remote can send a commit without its blobs, then the blobs by hash
+func supportsGitPartialFetch(advRefs *packp.AdvRefs) bool {
+	return advRefs.Capabilities.Supports(capability.Filter) && advRefs.Capabilities.Supports(capability.AllowReachableSHA1InWant)
+}
+
+// fetchGitObjects fetches want and the objects it references, down to depth commits if depth is set and
+// leaving out what the filter excludes, into storage
+func fetchGitObjects(session transport.UploadPackSession, advRefs *packp.AdvRefs, storage *limitedGitStorage, want plumbing.Hash, depth int, filter packp.Filter) (error) {
+	request := packp.NewUploadPackRequest()
+	request.Wants = []plumbing.Hash{want}
+	for _, c := range []capability.Capability{capability.OFSDelta, capability.NoProgress} {
+		if advRefs.Capabilities.Supports(c) {
+			request.Capabilities.Set(c)
+		}
+	}
+	if depth > 0 && advRefs.Capabilities.Supports(capability.Shallow) {
+		request.Capabilities.Set(capability.Shallow)
+		request.Depth = packp.DepthCommits(depth)
+	}
+	if filter != "" {
+		request.Capabilities.Set(capability.Filter)
+		request.Filter = filter
+	}
+	response, err := session.UploadPack(context.Background(), request)
+	if err != nil {
+		return err
+	}
+	defer response.Close()
+	err = packfile.UpdateObjectStorage(storage, response)
+	if errors.Is(err, errGitFetchTooLarge) {
+		return errGitFetchTooLarge
+	}
+	return err
+}
+
+// getGitCacheKey identifies the repo and the credentials used to fetch it, so what one user can
+// read with their credentials isn't served from the cache to users without them
+func getGitCacheKey(repo *DeploymentRepo) string {
+	if repo.Username == "" && repo.Password == "" && repo.SshKey == nil {
+		return repo.Repo
+	}
+	hash := sha256.New()
+	hash.Write([]byte(repo.Username + "\x00" + repo.Password + "\x00"))
+	if repo.SshKey != nil {
+		hash.Write([]byte(repo.SshKey.PrivateKey))
+	}
+	return repo.Repo + "#" + hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// getGitRemoteUrl returns the url to fetch from; repos using a deploy key are fetched over ssh.
+// errGitTransportNotAllowed is returned for urls git would fetch any other way than http, https or ssh.
+func getGitRemoteUrl(repo *DeploymentRepo) (string, error) {
+	remoteUrl := repo.Repo
+	if repo.SshKey != nil && (strings.HasPrefix(repo.Repo, "https://") || strings.HasPrefix(repo.Repo, "http://")) {
+		if repoUrl, err := parseRepoUrl(repo.Repo); err == nil {
+			host := repoUrl.Host
+			if i := strings.LastIndex(host, ":"); i >= 0 {
+				host = host[:i]
+			}
+			remoteUrl = fmt.Sprintf("ssh://git@%s/%s.git", host, repoUrl.Path)
+		}
+	}
+	endpoint, err := transport.NewEndpoint(remoteUrl)
+	if err != nil {
+		return "", err
+	}
+	if ! allowedRepoUrlSchemes[endpoint.Protocol] {
+		logPrintf("Refusing to fetch repo '%s' over %s.\n", repo.Repo, endpoint.Protocol)
+		return "", errGitTransportNotAllowed
+	}
+	return remoteUrl, nil
+}
+
+func getGitAuth(repo *DeploymentRepo) (transport.AuthMethod, error) {
+	if repo.SshKey != nil {
+		auth, err := gitssh.NewPublicKeys("git", []byte(repo.SshKey.PrivateKey), "")
+		if err != nil {
+			return nil, err
+		}
+		if repo.SshKey.KnownHostsFile != "" {
+			auth.HostKeyCallback, err = gitssh.NewKnownHostsCallback(repo.SshKey.KnownHostsFile)
+			if err != nil {
+				return nil, err
+			}
+		} else if repo.SshKey.InsecureIgnoreHostKey {
+			auth.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		}
+		return auth, nil
+	}
+	if repo.Password == "" {
+		return nil, nil
+	}
+	username := repo.Username
+	if username == "" {
+		// token based auth ignores the username, but it can't be empty
+		username = "git"
+	}
+	return &githttp.BasicAuth{Username: username, Password: repo.Password}, nil
+}
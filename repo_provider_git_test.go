@@ -0,0 +1,297 @@
+package minienv
+
+import (
+	"fmt"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// createTestGitRepo creates a repo with a commit for each map of files, tagged v1, v2..., returning its directory and the shas
+func createTestGitRepo(t *testing.T, commits ...map[string]string) (string, []string) {
+	dir := t.TempDir()
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatalf("Error creating repo: %v", err)
+	}
+	worktree, err := r.Worktree()
+	if err != nil {
+		t.Fatalf("Error opening worktree: %v", err)
+	}
+	var shas []string
+	for i, files := range commits {
+		for name, contents := range files {
+			path := filepath.Join(dir, name)
+			os.MkdirAll(filepath.Dir(path), 0755)
+			if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+				t.Fatalf("Error writing %s: %v", name, err)
+			}
+			worktree.Add(name)
+		}
+		hash, err := worktree.Commit("commit", &git.CommitOptions{Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now().Add(time.Duration(i) * time.Second)}})
+		if err != nil {
+			t.Fatalf("Error committing: %v", err)
+		}
+		if _, err := r.CreateTag(fmt.Sprintf("v%d", i + 1), hash, nil); err != nil {
+			t.Fatalf("Error tagging: %v", err)
+		}
+		shas = append(shas, hash.String())
+	}
+	return dir, shas
+}
+
+// newTestGitRepo creates a repo like createTestGitRepo, served by a remote that supports partial fetches; it returns its url and the shas
+func newTestGitRepo(t *testing.T, commits ...map[string]string) (string, []string) {
+	dir, shas := createTestGitRepo(t, commits...)
+	return serveTestGitRepo(t, dir, true), shas
+}
+
+// serveTestGitRepo serves the repo in dir over smart http with git's own http backend, returning its url
+func serveTestGitRepo(t *testing.T, dir string, partial bool) string {
+	execPath, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Skipf("Skipping, git is not installed: %v", err)
+	}
+	server := httptest.NewServer(&cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend"),
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + filepath.Dir(dir),
+			"GIT_HTTP_EXPORT_ALL=1",
+			"GIT_CONFIG_COUNT=2",
+			"GIT_CONFIG_KEY_0=uploadpack.allowFilter",
+			fmt.Sprintf("GIT_CONFIG_VALUE_0=%t", partial),
+			"GIT_CONFIG_KEY_1=uploadpack.allowAnySHA1InWant",
+			fmt.Sprintf("GIT_CONFIG_VALUE_1=%t", partial),
+		},
+	})
+	t.Cleanup(server.Close)
+	return server.URL + "/" + filepath.Base(dir)
+}
+
+func TestGitRepoProviderGetFile(t *testing.T) {
+	repoUrl, shas := newTestGitRepo(t,
+		map[string]string{"docker-compose.yml": "v1", "app/minienv.yml": "manifest"},
+		map[string]string{"docker-compose.yml": "v2"},
+	)
+	provider := NewGitRepoProvider()
+	tests := []struct {
+		ref string
+		path string
+		expected string
+		err error
+	}{
+		{"master", "docker-compose.yml", "v2", nil},
+		{"refs/heads/master", "/docker-compose.yml", "v2", nil},
+		{"v1", "docker-compose.yml", "v1", nil},
+		{"refs/tags/v1", "app/minienv.yml", "manifest", nil},
+		// shas are fetched by the name of a ref pointing to them, when there is one
+		{shas[1], "docker-compose.yml", "v2", nil},
+		{shas[1], "app/minienv.yml", "manifest", nil},
+		{"master", "missing.yml", "", errRepoFileNotFound},
+	}
+	for _, test := range tests {
+		data, err := provider.GetFile(&DeploymentRepo{Repo: repoUrl, Branch: test.ref}, test.path)
+		if err != test.err {
+			t.Errorf("%s %s: expected error %v, got %v", test.ref, test.path, test.err, err)
+		} else if string(data) != test.expected {
+			t.Errorf("%s %s: expected '%s', got '%s'", test.ref, test.path, test.expected, data)
+		}
+	}
+	if _, err := provider.GetFile(&DeploymentRepo{Repo: repoUrl, Branch: "missing"}, "docker-compose.yml"); err == nil || ! strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected missing ref error, got %v", err)
+	}
+}
+
+func TestGitRepoProviderCacheKeysIncludeCredentials(t *testing.T) {
+	repoUrl, _ := newTestGitRepo(t, map[string]string{"docker-compose.yml": "v1"})
+	provider := NewGitRepoProvider()
+	repos := []*DeploymentRepo{
+		{Repo: repoUrl, Branch: "master"},
+		{Repo: repoUrl, Branch: "master", Username: "user", Password: "token"},
+		{Repo: repoUrl, Branch: "master", Username: "user", Password: "other"},
+	}
+	for _, repo := range repos {
+		if _, err := provider.GetFile(repo, "docker-compose.yml"); err != nil {
+			t.Fatalf("Error getting file: %v", err)
+		}
+	}
+	if len(provider.refs) != 3 || len(provider.commits) != 3 {
+		t.Errorf("Expected refs and commits cached per credential, got %d and %d", len(provider.refs), len(provider.commits))
+	}
+	if key := getGitCacheKey(repos[1]); strings.Contains(key, "token") {
+		t.Errorf("Expected credentials to be hashed in cache key %s", key)
+	}
+}
+
+func TestGitRepoProviderFetchLimit(t *testing.T) {
+	dir, _ := createTestGitRepo(t, map[string]string{"docker-compose.yml": "v1", "big.bin": strings.Repeat("x", 64 * 1024)})
+	defer func(maxBytes int64) { gitFetchMaxBytes = maxBytes }(gitFetchMaxBytes)
+	gitFetchMaxBytes = 16 * 1024
+	tests := []struct {
+		name string
+		partial bool
+		path string
+		err error
+	}{
+		// only the blobs read are fetched from remotes that support it
+		{"partial, small file", true, "docker-compose.yml", nil},
+		{"partial, big file", true, "big.bin", errGitFetchTooLarge},
+		// others send the whole tree
+		{"whole tree, small file", false, "docker-compose.yml", errGitFetchTooLarge},
+	}
+	for _, test := range tests {
+		provider := NewGitRepoProvider()
+		repo := &DeploymentRepo{Repo: serveTestGitRepo(t, dir, test.partial), Branch: "master"}
+		if _, err := provider.GetFile(repo, test.path); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+	gitFetchMaxBytes = 1024 * 1024
+	provider := NewGitRepoProvider()
+	if _, err := provider.GetFile(&DeploymentRepo{Repo: serveTestGitRepo(t, dir, false), Branch: "master"}, "docker-compose.yml"); err != nil {
+		t.Errorf("Expected fetch under the limit to succeed, got %v", err)
+	}
+}
+
+func TestGitRepoProviderPartialFetch(t *testing.T) {
+	dir, _ := createTestGitRepo(t, map[string]string{"docker-compose.yml": "v1", "app/minienv.yml": "manifest", "big.bin": strings.Repeat("x", 64 * 1024)})
+	tests := []struct {
+		partial bool
+		expectedMax int64
+		expectedMin int64
+	}{
+		{true, 16 * 1024, 0},
+		{false, 0, 64 * 1024},
+	}
+	for _, test := range tests {
+		provider := NewGitRepoProvider()
+		repo := &DeploymentRepo{Repo: serveTestGitRepo(t, dir, test.partial), Branch: "master"}
+		for _, path := range []string{"docker-compose.yml", "app/minienv.yml", "docker-compose.yml"} {
+			if _, err := provider.GetFile(repo, path); err != nil {
+				t.Fatalf("Error getting %s: %v", path, err)
+			}
+		}
+		if _, err := provider.GetFile(repo, "app"); err != errRepoFileNotFound {
+			t.Errorf("Expected %v for a directory, got %v", errRepoFileNotFound, err)
+		}
+		if len(provider.commits) != 1 {
+			t.Fatalf("Expected one cached commit, got %d", len(provider.commits))
+		}
+		for _, entry := range provider.commits {
+			if entry.Partial != test.partial || (test.expectedMax > 0 && entry.Size > test.expectedMax) || entry.Size < test.expectedMin {
+				t.Errorf("partial=%t: expected between %d and %d bytes, got %d (partial=%t)", test.partial, test.expectedMin, test.expectedMax, entry.Size, entry.Partial)
+			}
+			if entry.Size != provider.commitBytes {
+				t.Errorf("Expected the blobs fetched to be counted in the cache, got %d and %d", entry.Size, provider.commitBytes)
+			}
+		}
+	}
+}
+
+func TestGitRepoProviderRefusesLocalRepos(t *testing.T) {
+	dir, _ := createTestGitRepo(t, map[string]string{"docker-compose.yml": "v1"})
+	provider := NewGitRepoProvider()
+	for _, repoUrl := range []string{"file://" + dir, dir, "git://127.0.0.1/repo"} {
+		if _, err := provider.GetFile(&DeploymentRepo{Repo: repoUrl, Branch: "master"}, "docker-compose.yml"); err != errGitTransportNotAllowed {
+			t.Errorf("%s: expected %v, got %v", repoUrl, errGitTransportNotAllowed, err)
+		}
+	}
+}
+
+func TestGitRepoProviderCacheLimit(t *testing.T) {
+	repoUrl, shas := newTestGitRepo(t,
+		map[string]string{"a": strings.Repeat("a", 8 * 1024)},
+		map[string]string{"a": strings.Repeat("b", 8 * 1024)},
+		map[string]string{"a": strings.Repeat("c", 8 * 1024)},
+	)
+	defer func(maxBytes int64) { gitCacheMaxBytes = maxBytes }(gitCacheMaxBytes)
+	gitCacheMaxBytes = 20 * 1024
+	provider := NewGitRepoProvider()
+	for i := range shas {
+		tag := fmt.Sprintf("v%d", i + 1)
+		if _, err := provider.GetFile(&DeploymentRepo{Repo: repoUrl, Branch: tag}, "a"); err != nil {
+			t.Fatalf("Error getting file at %s: %v", tag, err)
+		}
+	}
+	if len(provider.commits) != 2 || provider.commitBytes > gitCacheMaxBytes {
+		t.Errorf("Expected the oldest commit to be evicted, got %d commits of %d bytes", len(provider.commits), provider.commitBytes)
+	}
+}
+
+func TestResolveRepoCommit(t *testing.T) {
+	dir, shas := createTestGitRepo(t,
+		map[string]string{"docker-compose.yml": "v1"},
+		map[string]string{"docker-compose.yml": "v2"},
+		map[string]string{"docker-compose.yml": "v3"},
+	)
+	// an annotated tag, a branch and a pull request ref, each on an older commit
+	repoUrl := serveTestGitRepo(t, dir, true)
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatalf("Error opening repo: %v", err)
+	}
+	tagger := &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}
+	if _, err := r.CreateTag("release", plumbing.NewHash(shas[0]), &git.CreateTagOptions{Tagger: tagger, Message: "release"}); err != nil {
+		t.Fatalf("Error tagging: %v", err)
+	}
+	for name, sha := range map[string]string{"refs/heads/feature/x": shas[1], "refs/pull/7/head": shas[0]} {
+		if err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(name), plumbing.NewHash(sha))); err != nil {
+			t.Fatalf("Error creating %s: %v", name, err)
+		}
+	}
+	tests := []struct {
+		name string
+		repo *DeploymentRepo
+		expected string
+	}{
+		{"default branch", &DeploymentRepo{Branch: "master"}, shas[2]},
+		{"branch with a slash", &DeploymentRepo{Branch: "feature/x"}, shas[1]},
+		{"lightweight tag", &DeploymentRepo{Branch: "master", Tag: "v2"}, shas[1]},
+		{"annotated tag", &DeploymentRepo{Branch: "master", Tag: "release"}, shas[0]},
+		{"pull request", &DeploymentRepo{Branch: "master", PullRequest: 7}, shas[0]},
+		{"commit", &DeploymentRepo{Branch: "master", Commit: shas[1]}, shas[1]},
+		{"upper case commit", &DeploymentRepo{Branch: "master", Commit: strings.ToUpper(shas[0])}, shas[0]},
+		{"commit over tag and branch", &DeploymentRepo{Branch: "feature/x", Tag: "v3", Commit: shas[0]}, shas[0]},
+		{"pull request over tag", &DeploymentRepo{Branch: "master", Tag: "v3", PullRequest: 7}, shas[0]},
+		{"tag over branch", &DeploymentRepo{Branch: "feature/x", Tag: "v3"}, shas[2]},
+	}
+	for _, test := range tests {
+		test.repo.Repo = repoUrl
+		if err := resolveRepoCommit(test.repo); err != nil {
+			t.Errorf("%s: expected no error, got %v", test.name, err)
+		} else if test.repo.Commit != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, test.repo.Commit)
+		}
+	}
+	// files are read at the resolved commit, whatever the branch
+	repo := &DeploymentRepo{Repo: repoUrl, Branch: "master", Tag: "v1"}
+	resolveRepoCommit(repo)
+	if data, err := getRepoFile(repo, "docker-compose.yml"); err != nil || string(data) != "v1" {
+		t.Errorf("Expected the file at the tag, got '%s', %v", data, err)
+	}
+	unknown := []struct {
+		name string
+		repo *DeploymentRepo
+	}{
+		{"unknown branch", &DeploymentRepo{Branch: "missing"}},
+		{"unknown tag", &DeploymentRepo{Branch: "master", Tag: "v9"}},
+		{"tag given as a branch", &DeploymentRepo{Branch: "refs/tags/v1"}},
+		{"unknown pull request", &DeploymentRepo{Branch: "master", PullRequest: 8}},
+		{"short commit", &DeploymentRepo{Branch: "master", Commit: shas[0][:7]}},
+	}
+	for _, test := range unknown {
+		test.repo.Repo = repoUrl
+		if err := resolveRepoCommit(test.repo); err == nil {
+			t.Errorf("%s: expected error, got %s", test.name, test.repo.Commit)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package minienv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func setTestRepoProviderHosts(t *testing.T, s string) {
+	previous := repoProviderHosts
+	repoProviderHosts = parseRepoProviderHosts(s)
+	t.Cleanup(func() { repoProviderHosts = previous })
+}
+
+// setTestRepoServer serves a gitea repo's raw files from files, by path; it returns the repo url
+func setTestRepoServer(t *testing.T, files map[string]string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if ! ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	t.Cleanup(server.Close)
+	serverUrl, _ := url.Parse(server.URL)
+	setTestRepoProviderHosts(t, serverUrl.Hostname() + "=gitea")
+	return server.URL + "/org/repo"
+}
+
+func TestParseRepoUrl(t *testing.T) {
+	tests := []struct {
+		repo string
+		scheme string
+		host string
+		path string
+	}{
+		{"https://github.com/org/repo", "https", "github.com", "org/repo"},
+		{"https://github.com/org/repo.git", "https", "github.com", "org/repo"},
+		{" https://GitLab.com/group/sub/project/ ", "https", "gitlab.com", "group/sub/project"},
+		{"http://git.example.com:8080/org/repo", "http", "git.example.com:8080", "org/repo"},
+		{"ssh://git@example.com/org/repo.git", "ssh", "example.com", "org/repo"},
+	}
+	for _, test := range tests {
+		repoUrl, err := parseRepoUrl(test.repo)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", test.repo, err)
+			continue
+		}
+		if repoUrl.Scheme != test.scheme || repoUrl.Host != test.host || repoUrl.Path != test.path {
+			t.Errorf("%s: expected %s, %s, %s, got %+v", test.repo, test.scheme, test.host, test.path, repoUrl)
+		}
+	}
+	for _, repo := range []string{"", "org/repo", "https://github.com", "https://github.com/", "https://github.com/.git", "http://[::1"} {
+		if _, err := parseRepoUrl(repo); err == nil {
+			t.Errorf("%s: expected error", repo)
+		}
+	}
+}
+
+func TestParseRepoProviderHosts(t *testing.T) {
+	hosts := parseRepoProviderHosts(" Git.Example.com = GitLab ,code.example.com=git,bad,other.example.com=svn,gitea.example.com=gitea")
+	expected := map[string]string{
+		"git.example.com": RepoProviderGitLab,
+		"code.example.com": RepoProviderGit,
+		"gitea.example.com": RepoProviderGitea,
+	}
+	if len(hosts) != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, hosts)
+	}
+	for host, name := range expected {
+		if hosts[host] != name {
+			t.Errorf("Expected %s for %s, got '%s'", name, host, hosts[host])
+		}
+	}
+	if hosts := parseRepoProviderHosts(""); len(hosts) != 0 {
+		t.Errorf("Expected no hosts, got %v", hosts)
+	}
+}
+
+func TestGetRepoProvider(t *testing.T) {
+	setTestRepoProviderHosts(t, "git.example.com=gitlab,github.com=git,code.example.com=bitbucket")
+	tests := []struct {
+		repo string
+		expected string
+	}{
+		{"https://gitlab.com/group/project", RepoProviderGitLab},
+		{"https://bitbucket.org/team/repo", RepoProviderBitbucket},
+		{"https://codeberg.org/org/repo", RepoProviderGitea},
+		{"https://gitea.com/org/repo", RepoProviderGitea},
+		{"https://unknown.example.com/org/repo", RepoProviderGit},
+		{"file:///tmp/repo", RepoProviderGit},
+		{"ssh://git@gitlab.com/group/project.git", RepoProviderGit},
+		{"git@gitlab.com:group/project.git", RepoProviderGit},
+		// configured hosts, with ports ignored, take precedence over the defaults
+		{"https://git.example.com/group/project", RepoProviderGitLab},
+		{"https://git.example.com:8443/group/project", RepoProviderGitLab},
+		{"https://GITHUB.com/org/repo", RepoProviderGit},
+		{"http://code.example.com/scm/proj/repo.git", RepoProviderBitbucket},
+	}
+	for _, test := range tests {
+		provider, err := getRepoProvider(test.repo)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", test.repo, err)
+		} else if provider.GetName() != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.repo, test.expected, provider.GetName())
+		}
+	}
+	if _, err := getRepoProvider("not a repo"); err == nil {
+		t.Errorf("Expected error for invalid repo")
+	}
+}
+
+func TestGetRepoProviderDefaults(t *testing.T) {
+	setTestRepoProviderHosts(t, "")
+	provider, err := getRepoProvider("https://github.com/org/repo")
+	if err != nil || provider.GetName() != RepoProviderGitHub {
+		t.Errorf("Expected github, got %v, %v", provider, err)
+	}
+}
+
+func TestGetFileUrl(t *testing.T) {
+	tests := []struct {
+		provider string
+		repo string
+		expected string
+	}{
+		{RepoProviderGitHub, "https://github.com/org/repo", "https://raw.githubusercontent.com/org/repo/main/dir/docker%20compose.yml"},
+		{RepoProviderGitHub, "https://ghe.example.com/org/repo", "https://ghe.example.com/api/v3/repos/org/repo/contents/dir/docker%20compose.yml?ref=main"},
+		{RepoProviderGitLab, "https://gitlab.com/group/sub/project", "https://gitlab.com/api/v4/projects/group%2Fsub%2Fproject/repository/files/dir%2Fdocker%20compose.yml/raw?ref=main"},
+		{RepoProviderBitbucket, "https://bitbucket.org/team/repo", "https://api.bitbucket.org/2.0/repositories/team/repo/src/main/dir/docker%20compose.yml"},
+		{RepoProviderBitbucket, "https://bb.example.com/scm/proj/repo.git", "https://bb.example.com/rest/api/1.0/projects/proj/repos/repo/raw/dir/docker%20compose.yml?at=main"},
+		{RepoProviderGitea, "https://codeberg.org/org/repo", "https://codeberg.org/api/v1/repos/org/repo/raw/dir/docker%20compose.yml?ref=main"},
+	}
+	for _, test := range tests {
+		repoUrl, _ := parseRepoUrl(test.repo)
+		provider := repoProviders[test.provider].(rawFileRepoProvider)
+		actual, err := provider.GetFileUrl(repoUrl, "main", "dir/docker compose.yml")
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", test.repo, err)
+		} else if actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.repo, test.expected, actual)
+		}
+	}
+	invalid := []struct {
+		provider string
+		repo string
+	}{
+		{RepoProviderBitbucket, "https://bb.example.com/scm/proj/sub/repo.git"},
+		{RepoProviderGitea, "https://codeberg.org/org/sub/repo"},
+	}
+	for _, test := range invalid {
+		repoUrl, _ := parseRepoUrl(test.repo)
+		if _, err := repoProviders[test.provider].(rawFileRepoProvider).GetFileUrl(repoUrl, "main", "file"); err == nil {
+			t.Errorf("%s: expected error", test.repo)
+		}
+	}	// paths can't leave the repo
+	for _, test := range tests {
+		repoUrl, _ := parseRepoUrl(test.repo)
+		for _, path := range []string{"/etc/passwd", "../other/docker-compose.yml", "dir/../../docker-compose.yml", "dir\\..\\..\\file"} {
+			if _, err := repoProviders[test.provider].(rawFileRepoProvider).GetFileUrl(repoUrl, "main", path); err == nil {
+				t.Errorf("%s: expected error for %s", test.repo, path)
+			}
+		}
+	}
+}
+
+func TestAddAuth(t *testing.T) {
+	tests := []struct {
+		provider string
+		username string
+		header string
+		expected string
+	}{
+		{RepoProviderGitHub, "", "Authorization", "token pat"},
+		{RepoProviderGitLab, "", "PRIVATE-TOKEN", "pat"},
+		{RepoProviderBitbucket, "", "Authorization", "Bearer pat"},
+		{RepoProviderBitbucket, "user", "Authorization", "Basic dXNlcjpwYXQ="},
+		{RepoProviderGitea, "", "Authorization", "token pat"},
+		{RepoProviderGitea, "user", "Authorization", "Basic dXNlcjpwYXQ="},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "https://example.com", nil)
+		repoProviders[test.provider].(rawFileRepoProvider).AddAuth(req, &DeploymentRepo{Username: test.username, Password: "pat"})
+		if actual := req.Header.Get(test.header); actual != test.expected {
+			t.Errorf("%s: expected %s '%s', got '%s'", test.provider, test.header, test.expected, actual)
+		}
+		req, _ = http.NewRequest("GET", "https://example.com", nil)
+		repoProviders[test.provider].(rawFileRepoProvider).AddAuth(req, &DeploymentRepo{})
+		if actual := req.Header.Get(test.header); actual != "" {
+			t.Errorf("%s: expected no %s without credentials, got '%s'", test.provider, test.header, actual)
+		}
+	}
+}
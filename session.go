@@ -1,12 +1,76 @@
 package minienv
 
+// sessions not touched for this long expire, unless MINIENV_SESSION_TTL_SECONDS is set
+const DefaultSessionTtlSeconds int64 = 7 * 24 * 60 * 60
+const DefaultSessionListCount = 100
+// the most sessions the in-memory store keeps, unless MINIENV_SESSION_MAX_COUNT is set
+const DefaultSessionMaxCount = 100000
+
 type SessionStore interface {
 	SetSession(id string, session *Session) (error)
 	GetSession(id string) (*Session, error)
+	DeleteSession(id string) (error)
+	// ListSessions returns up to count sessions starting at cursor ("" for the first page),
+	// and the cursor of the next page, which is "" after the last page
+	ListSessions(cursor string, count int) ([]*Session, string, error)
+	// Touch extends the ttl of the session
+	Touch(id string) (error)
+}
+
+// HealthChecker is implemented by session stores backed by a server, which may become unreachable
+type HealthChecker interface {
+	// Health returns nil while the store is reachable
+	Health() (error)
 }
 
 type Session struct {
 	Id string  `json:"sessionId"`
+	// set by the embedding server once it has authenticated the user; claims made by the session are bound to the user too
+	UserId string `json:"userId,omitempty"`
 	EnvId string `json:"envId"`
 	EnvServiceName string `json:"envServiceName"`
-}
\ No newline at end of file
+}
+
+var sessionTtlSeconds = DefaultSessionTtlSeconds
+var sessionMaxCount = DefaultSessionMaxCount
+
+// clearEnvSession removes the environment from the session that deployed it, once the environment is torn down
+func clearEnvSession(sessionId string, envId string) {
+	if sessionId == "" {
+		return
+	}
+	session, err := sessionStore.GetSession(sessionId)
+	if err != nil || session == nil || session.EnvId != envId {
+		return
+	}
+	logPrintf("Clearing environment %s from session %s.\n", envId, session.Id)
+	session.EnvId = ""
+	session.EnvServiceName = ""
+	err = sessionStore.SetSession(session.Id, session)
+	if err != nil {
+		logPrintf("Error clearing environment from session %s: %v\n", session.Id, err)
+	}
+}
+
+// findEnvSessionIds returns the ids of the sessions holding each environment, by environment id;
+// environments loaded from running deployments at startup don't know their session otherwise
+func findEnvSessionIds() (map[string]string, error) {
+	sessionIds := make(map[string]string)
+	cursor := ""
+	for true {
+		sessions, next, err := sessionStore.ListSessions(cursor, DefaultSessionListCount)
+		if err != nil {
+			return nil, err
+		}
+		for _, session := range sessions {
+			if session.EnvId != "" {
+				sessionIds[session.EnvId] = session.Id
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	return sessionIds, nil
+}
@@ -0,0 +1,327 @@
+package minienv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// expired sessions are deleted this often
+const FileSessionSweepSeconds = 60
+
+const FileSessionStoreScheme = "file://"
+
+var fileSessionsBucket = []byte("sessions")
+var fileStateBucket = []byte("state")
+var fileAppendedStateBucket = []byte("appendedState")
+
+// FileSessionStore keeps sessions and state in a bbolt database, so a single api server keeps them across restarts
+// without redis. Every change is written in its own transaction, which bbolt commits atomically.
+type FileSessionStore struct {
+	Db *bolt.DB
+	TtlSeconds int64
+	// returns the current time; time.Now unless set by tests
+	now func() time.Time
+}
+
+type fileSessionEntry struct {
+	Session *Session `json:"session"`
+	// unix time; 0 if the session doesn't expire
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// NewFileSessionStore opens (or creates) the database at path, e.g. from MINIENV_SESSION_STORE=file:///data/minienv.db
+func NewFileSessionStore(path string) (*FileSessionStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		logPrintf("Failed to open session store '%s': %v\n", path, err)
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{fileSessionsBucket, fileStateBucket, fileAppendedStateBucket} {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	store := &FileSessionStore{Db: db, TtlSeconds: sessionTtlSeconds, now: time.Now}
+	store.sweep()
+	store.startSweepTimer()
+	return store, nil
+}
+
+// getFileSessionStorePath returns the path of a file:// session store url, or "" if it isn't one
+func getFileSessionStorePath(url string) string {
+	if ! strings.HasPrefix(url, FileSessionStoreScheme) {
+		return ""
+	}
+	return strings.TrimPrefix(url, FileSessionStoreScheme)
+}
+
+func (store *FileSessionStore) SetSession(id string, session *Session) (error) {
+	bs, err := json.Marshal(&fileSessionEntry{Session: session, ExpiresAt: store.getExpiresAt()})
+	if err != nil {
+		return err
+	}
+	err = store.Db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileSessionsBucket).Put([]byte(id), bs)
+	})
+	if err != nil {
+		logPrintf("Error setting session %s: %v\n", id, err)
+	}
+	return err
+}
+
+func (store *FileSessionStore) GetSession(id string) (*Session, error) {
+	var entry *fileSessionEntry
+	err := store.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, err = getFileSessionEntry(tx, id)
+		return err
+	})
+	if err != nil {
+		logPrintf("Error getting session %s: %v\n", id, err)
+		return nil, err
+	}
+	if entry == nil || store.isExpired(entry, store.now().Unix()) {
+		return nil, nil
+	}
+	return entry.Session, nil
+}
+
+func (store *FileSessionStore) DeleteSession(id string) (error) {
+	return store.Db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileSessionsBucket).Delete([]byte(id))
+	})
+}
+
+// ListSessions pages through the sessions in id order; the cursor is the last id returned
+func (store *FileSessionStore) ListSessions(cursor string, count int) ([]*Session, string, error) {
+	if count <= 0 {
+		count = DefaultSessionListCount
+	}
+	now := store.now().Unix()
+	sessions := []*Session{}
+	next := ""
+	err := store.Db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(fileSessionsBucket).Cursor()
+		k, v := c.First()
+		if cursor != "" {
+			k, v = c.Seek([]byte(cursor))
+			if k != nil && string(k) == cursor {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil; k, v = c.Next() {
+			var entry fileSessionEntry
+			if json.Unmarshal(v, &entry) != nil || entry.Session == nil || store.isExpired(&entry, now) {
+				continue
+			}
+			if len(sessions) == count {
+				next = sessions[count - 1].Id
+				break
+			}
+			sessions = append(sessions, entry.Session)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return sessions, next, nil
+}
+
+func (store *FileSessionStore) Touch(id string) (error) {
+	return store.Db.Update(func(tx *bolt.Tx) error {
+		entry, err := getFileSessionEntry(tx, id)
+		if err != nil || entry == nil || store.isExpired(entry, store.now().Unix()) {
+			return err
+		}
+		entry.ExpiresAt = store.getExpiresAt()
+		bs, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(fileSessionsBucket).Put([]byte(id), bs)
+	})
+}
+
+func getFileSessionEntry(tx *bolt.Tx, id string) (*fileSessionEntry, error) {
+	v := tx.Bucket(fileSessionsBucket).Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+	var entry fileSessionEntry
+	err := json.Unmarshal(v, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (store *FileSessionStore) sweep() {
+	now := store.now().Unix()
+	deleted := 0
+	err := store.Db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(fileSessionsBucket)
+		// deleting moves the cursor and invalidates the keys it returned, so the expired keys are copied and
+		// deleted once the walk is done
+		var expired [][]byte
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var entry fileSessionEntry
+			if json.Unmarshal(v, &entry) != nil || store.isExpired(&entry, now) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+		}
+		for _, k := range expired {
+			err := bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		logPrintf("Error removing expired sessions: %v\n", err)
+	} else if deleted > 0 {
+		logPrintf("Removed %d expired sessions.\n", deleted)
+	}
+}
+
+func (store *FileSessionStore) startSweepTimer() {
+	timer := time.NewTimer(time.Second * time.Duration(FileSessionSweepSeconds))
+	go func() {
+		<-timer.C
+		store.sweep()
+		store.startSweepTimer()
+	}()
+}
+
+func (store *FileSessionStore) isExpired(entry *fileSessionEntry, now int64) bool {
+	return entry.ExpiresAt > 0 && now > entry.ExpiresAt
+}
+
+func (store *FileSessionStore) getExpiresAt() int64 {
+	if store.TtlSeconds <= 0 {
+		return 0
+	}
+	return store.now().Unix() + store.TtlSeconds
+}
+
+func (store *FileSessionStore) GetState(key string) ([]byte, error) {
+	var value []byte
+	err := store.Db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(fileStateBucket).Get([]byte(key))
+		if v != nil {
+			// values are only valid for the life of the transaction
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (store *FileSessionStore) SetState(key string, value []byte) (error) {
+	return store.Db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileStateBucket).Put([]byte(key), value)
+	})
+}
+
+func (store *FileSessionStore) DeleteState(key string) (error) {
+	return store.Db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileStateBucket).Delete([]byte(key))
+	})
+}
+
+func (store *FileSessionStore) CompareAndSwapState(key string, previous []byte, value []byte) (bool, error) {
+	swapped := false
+	err := store.Db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(fileStateBucket)
+		current := bucket.Get([]byte(key))
+		if (current != nil) != (previous != nil) || ! bytes.Equal(current, previous) {
+			return nil
+		}
+		swapped = true
+		return bucket.Put([]byte(key), value)
+	})
+	return swapped, err
+}
+
+func (store *FileSessionStore) ListState(prefix string) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	err := store.Db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(fileStateBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			values[string(k)] = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return values, err
+}
+
+// AppendState keeps each list in its own bucket, keyed by a big-endian sequence number so values stay in order
+func (store *FileSessionStore) AppendState(key string, value []byte, max int) (error) {
+	return store.Db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(fileAppendedStateBucket).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		err = bucket.Put(getFileSequenceKey(seq), value)
+		if err != nil {
+			return err
+		}
+		if max > 0 {
+			c := bucket.Cursor()
+			n := 0
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				n++
+			}
+			for ; n > max; n-- {
+				c.First()
+				err = c.Delete()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (store *FileSessionStore) GetAppendedState(key string, count int) ([][]byte, error) {
+	var values [][]byte
+	err := store.Db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(fileAppendedStateBucket).Bucket([]byte(key))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Last(); k != nil && (count <= 0 || len(values) < count); k, v = c.Prev() {
+			values = append([][]byte{append([]byte{}, v...)}, values...)
+		}
+		return nil
+	})
+	return values, err
+}
+
+func getFileSequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
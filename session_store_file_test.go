@@ -0,0 +1,155 @@
+package minienv
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestFileSessionStore opens a store in a temporary directory, with a clock that only moves when the
+// returned func is called
+func newTestFileSessionStore(t *testing.T, ttlSeconds int64) (*FileSessionStore, func(seconds int64)) {
+	store, err := NewFileSessionStore(filepath.Join(t.TempDir(), "minienv.db"))
+	if err != nil {
+		t.Fatalf("Error opening session store: %v", err)
+	}
+	t.Cleanup(func() { store.Db.Close() })
+	store.TtlSeconds = ttlSeconds
+	now := time.Unix(1000000, 0)
+	store.now = func() time.Time { return now }
+	return store, func(seconds int64) {
+		now = now.Add(time.Duration(seconds) * time.Second)
+	}
+}
+
+func getTestFileSessionKeys(t *testing.T, store *FileSessionStore) []string {
+	var keys []string
+	err := store.Db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileSessionsBucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("Error reading sessions: %v", err)
+	}
+	return keys
+}
+
+func TestFileSessionStoreSweep(t *testing.T) {
+	store, wait := newTestFileSessionStore(t, 60)
+	for i := 0; i < 10; i++ {
+		store.SetSession(fmt.Sprintf("s%d", i), &Session{Id: fmt.Sprintf("s%d", i)})
+	}
+	// runs of expired sessions, next to each other, between sessions that are kept
+	wait(30)
+	for _, id := range []string{"s0", "s4", "s9"} {
+		store.Touch(id)
+	}
+	store.Db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileSessionsBucket).Put([]byte("s5-corrupt"), []byte("{"))
+	})
+	wait(31)
+	store.sweep()
+	if keys := fmt.Sprint(getTestFileSessionKeys(t, store)); keys != "[s0 s4 s9]" {
+		t.Errorf("Expected [s0 s4 s9], got %s", keys)
+	}
+	if session, _ := store.GetSession("s4"); session == nil {
+		t.Errorf("Expected touched session to be kept")
+	}
+	wait(30)
+	store.sweep()
+	if keys := getTestFileSessionKeys(t, store); len(keys) != 0 {
+		t.Errorf("Expected every session to be removed, got %v", keys)
+	}
+}
+
+func TestFileSessionStoreExpiresSessions(t *testing.T) {
+	store, wait := newTestFileSessionStore(t, 60)
+	store.SetSession("a", &Session{Id: "a", EnvId: "1"})
+	wait(60)
+	if session, _ := store.GetSession("a"); session == nil || session.EnvId != "1" {
+		t.Errorf("Expected session, got %v", session)
+	}
+	wait(1)
+	if session, _ := store.GetSession("a"); session != nil {
+		t.Errorf("Expected expired session to be gone before it's swept, got %v", session)
+	}
+	// an expired session can't be touched back
+	store.Touch("a")
+	if session, _ := store.GetSession("a"); session != nil {
+		t.Errorf("Expected expired session to stay expired, got %v", session)
+	}
+}
+
+func TestFileSessionStoreListSessions(t *testing.T) {
+	store, wait := newTestFileSessionStore(t, 60)
+	for _, id := range []string{"e", "b", "d", "a"} {
+		store.SetSession(id, &Session{Id: id})
+	}
+	wait(30)
+	store.SetSession("c", &Session{Id: "c"})
+	store.SetSession("f", &Session{Id: "f"})
+	store.Touch("a")
+	wait(31)
+	// b, d and e have expired, but haven't been swept
+	tests := []struct {
+		cursor string
+		count int
+		expected string
+		next string
+	}{
+		{"", 2, "[a c]", "c"},
+		{"c", 2, "[f]", ""},
+		{"", 3, "[a c f]", ""},
+		{"b", 1, "[c]", "c"},
+		{"a", 0, "[c f]", ""},
+		{"f", 2, "[]", ""},
+	}
+	for _, test := range tests {
+		sessions, next, err := store.ListSessions(test.cursor, test.count)
+		var ids []string
+		for _, session := range sessions {
+			ids = append(ids, session.Id)
+		}
+		if err != nil || fmt.Sprint(ids) != test.expected || next != test.next {
+			t.Errorf("%s, %d: expected %s, '%s', got %v, '%s', %v", test.cursor, test.count, test.expected, test.next, ids, next, err)
+		}
+	}
+}
+
+func TestFileSessionStoreCompareAndSwapState(t *testing.T) {
+	store, _ := newTestFileSessionStore(t, 0)
+	tests := []struct {
+		name string
+		previous []byte
+		value []byte
+		swapped bool
+		expected string
+	}{
+		{"set when absent", nil, []byte("1"), true, "1"},
+		{"set again when absent", nil, []byte("2"), false, "1"},
+		{"stale previous", []byte("0"), []byte("2"), false, "1"},
+		{"current previous", []byte("1"), []byte("2"), true, "2"},
+		{"previous reused", []byte("1"), []byte("3"), false, "2"},
+	}
+	for _, test := range tests {
+		swapped, err := store.CompareAndSwapState("key", test.previous, test.value)
+		if err != nil || swapped != test.swapped {
+			t.Errorf("%s: expected swapped=%t, got %t, %v", test.name, test.swapped, swapped, err)
+		}
+		if value, _ := store.GetState("key"); string(value) != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, value)
+		}
+	}
+	if swapped, _ := store.CompareAndSwapState("other", []byte("1"), []byte("2")); swapped {
+		t.Errorf("Expected no swap for an absent key with a previous value")
+	}
+	store.DeleteState("key")
+	if swapped, _ := store.CompareAndSwapState("key", nil, []byte("4")); ! swapped {
+		t.Errorf("Expected swap once the key is deleted")
+	}
+}
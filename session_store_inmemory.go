@@ -1,20 +1,254 @@
 package minienv
 
+import (
+	"bytes"
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InMemorySessionStore keeps sessions in a map guarded by a mutex. Sessions expire TtlSeconds after they were
+// last set or touched and, once MaxSessions is reached, the least recently used session is evicted. Sessions are
+// copied in and out, so requests for the same session never share one.
 type InMemorySessionStore struct {
-	SessionsById map[string]*Session
+	TtlSeconds int64
+	// 0 for no limit
+	MaxSessions int
+	mutex sync.Mutex
+	entries map[string]*list.Element
+	// most recently used first
+	lru *list.List
+	stats InMemorySessionStoreStats
+	stateByKey map[string][]byte
+	appendedStateByKey map[string][][]byte
+	// returns the current time; time.Now unless set by tests
+	now func() time.Time
+}
+
+type InMemorySessionStoreStats struct {
+	Sessions int `json:"sessions"`
+	Hits int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Expirations int64 `json:"expirations"`
+}
+
+type inMemorySessionEntry struct {
+	Id string
+	Session *Session
+	ExpiresAt int64
 }
 
 func NewInMemorySessionStore() (*InMemorySessionStore) {
 	return &InMemorySessionStore{
-		SessionsById: make(map[string]*Session),
+		TtlSeconds: sessionTtlSeconds,
+		MaxSessions: sessionMaxCount,
+		entries: make(map[string]*list.Element),
+		lru: list.New(),
+		stateByKey: make(map[string][]byte),
+		appendedStateByKey: make(map[string][][]byte),
+		now: time.Now,
+	}
+}
+
+func copySession(session *Session) *Session {
+	if session == nil {
+		return nil
+	}
+	copied := *session
+	return &copied
+}
+
+func (store *InMemorySessionStore) SetSession(id string, session *Session) (error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if element, ok := store.entries[id]; ok {
+		entry := element.Value.(*inMemorySessionEntry)
+		entry.Session = copySession(session)
+		entry.ExpiresAt = store.getExpiresAt()
+		store.lru.MoveToFront(element)
+		return nil
+	}
+	store.removeExpired()
+	for store.MaxSessions > 0 && store.lru.Len() >= store.MaxSessions {
+		oldest := store.lru.Back()
+		store.remove(oldest)
+		store.stats.Evictions++
+	}
+	store.entries[id] = store.lru.PushFront(&inMemorySessionEntry{Id: id, Session: copySession(session), ExpiresAt: store.getExpiresAt()})
+	return nil
+}
+
+func (store *InMemorySessionStore) GetSession(id string) (*Session, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	element := store.get(id)
+	if element == nil {
+		store.stats.Misses++
+		return nil, nil
 	}
+	store.stats.Hits++
+	store.lru.MoveToFront(element)
+	return copySession(element.Value.(*inMemorySessionEntry).Session), nil
 }
 
-func (store InMemorySessionStore) SetSession(id string, session *Session) (error) {
-	store.SessionsById[id] = session
+func (store *InMemorySessionStore) DeleteSession(id string) (error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if element, ok := store.entries[id]; ok {
+		store.remove(element)
+	}
+	return nil
+}
+
+// ListSessions pages through the sessions in id order; the cursor is the last id returned
+func (store *InMemorySessionStore) ListSessions(cursor string, count int) ([]*Session, string, error) {
+	if count <= 0 {
+		count = DefaultSessionListCount
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	ids := make([]string, 0, len(store.entries))
+	for id := range store.entries {
+		if id > cursor && store.get(id) != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	next := ""
+	if len(ids) > count {
+		ids = ids[:count]
+		next = ids[count - 1]
+	}
+	sessions := []*Session{}
+	for _, id := range ids {
+		sessions = append(sessions, copySession(store.entries[id].Value.(*inMemorySessionEntry).Session))
+	}
+	return sessions, next, nil
+}
+
+func (store *InMemorySessionStore) Touch(id string) (error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	element := store.get(id)
+	if element != nil {
+		element.Value.(*inMemorySessionEntry).ExpiresAt = store.getExpiresAt()
+		store.lru.MoveToFront(element)
+	}
 	return nil
 }
 
-func (store InMemorySessionStore) GetSession(id string) (*Session, error) {
-	return store.SessionsById[id], nil
-}
\ No newline at end of file
+func (store *InMemorySessionStore) Stats() InMemorySessionStoreStats {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	stats := store.stats
+	stats.Sessions = store.lru.Len()
+	return stats
+}
+
+// get returns the entry of an unexpired session, removing it if it has expired; the mutex must be held
+func (store *InMemorySessionStore) get(id string) *list.Element {
+	element, ok := store.entries[id]
+	if ! ok {
+		return nil
+	}
+	if store.isExpired(element, store.now().Unix()) {
+		store.remove(element)
+		store.stats.Expirations++
+		return nil
+	}
+	return element
+}
+
+// removeExpired walks from the least recently used session and stops at the first one still valid; as reads
+// don't extend the ttl, a few expired sessions may remain until they're read or listed
+func (store *InMemorySessionStore) removeExpired() {
+	now := store.now().Unix()
+	for element := store.lru.Back(); element != nil && store.isExpired(element, now); element = store.lru.Back() {
+		store.remove(element)
+		store.stats.Expirations++
+	}
+}
+
+func (store *InMemorySessionStore) remove(element *list.Element) {
+	store.lru.Remove(element)
+	delete(store.entries, element.Value.(*inMemorySessionEntry).Id)
+}
+
+func (store *InMemorySessionStore) isExpired(element *list.Element, now int64) bool {
+	expiresAt := element.Value.(*inMemorySessionEntry).ExpiresAt
+	return expiresAt > 0 && now > expiresAt
+}
+
+func (store *InMemorySessionStore) getExpiresAt() int64 {
+	if store.TtlSeconds <= 0 {
+		return 0
+	}
+	return store.now().Unix() + store.TtlSeconds
+}
+
+func (store *InMemorySessionStore) GetState(key string) ([]byte, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.stateByKey[key], nil
+}
+
+func (store *InMemorySessionStore) SetState(key string, value []byte) (error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.stateByKey[key] = value
+	return nil
+}
+
+func (store *InMemorySessionStore) DeleteState(key string) (error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.stateByKey, key)
+	return nil
+}
+
+func (store *InMemorySessionStore) CompareAndSwapState(key string, previous []byte, value []byte) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	current, ok := store.stateByKey[key]
+	if ok != (previous != nil) || ! bytes.Equal(current, previous) {
+		return false, nil
+	}
+	store.stateByKey[key] = value
+	return true, nil
+}
+
+func (store *InMemorySessionStore) ListState(prefix string) (map[string][]byte, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	values := make(map[string][]byte)
+	for k, v := range store.stateByKey {
+		if strings.HasPrefix(k, prefix) {
+			values[k] = v
+		}
+	}
+	return values, nil
+}
+
+func (store *InMemorySessionStore) AppendState(key string, value []byte, max int) (error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	values := append(store.appendedStateByKey[key], value)
+	if max > 0 && len(values) > max {
+		values = append([][]byte{}, values[len(values) - max:]...)
+	}
+	store.appendedStateByKey[key] = values
+	return nil
+}
+
+func (store *InMemorySessionStore) GetAppendedState(key string, count int) ([][]byte, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	values := store.appendedStateByKey[key]
+	if count > 0 && len(values) > count {
+		values = values[len(values) - count:]
+	}
+	return append([][]byte{}, values...), nil
+}
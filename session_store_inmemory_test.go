@@ -0,0 +1,161 @@
+package minienv
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestInMemorySessionStore returns a store whose clock only moves when the returned func is called
+func newTestInMemorySessionStore(ttlSeconds int64, maxSessions int) (*InMemorySessionStore, func(seconds int64)) {
+	store := NewInMemorySessionStore()
+	store.TtlSeconds = ttlSeconds
+	store.MaxSessions = maxSessions
+	now := time.Unix(1000000, 0)
+	store.now = func() time.Time { return now }
+	return store, func(seconds int64) {
+		now = now.Add(time.Duration(seconds) * time.Second)
+	}
+}
+
+func getTestSessionIds(store *InMemorySessionStore) []string {
+	var ids []string
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if session, _ := store.GetSession(id); session != nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestInMemorySessionStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store, _ := newTestInMemorySessionStore(0, 3)
+	for _, id := range []string{"a", "b", "c"} {
+		store.SetSession(id, &Session{Id: id})
+	}
+	// a is used, and b touched, so c is the least recently used
+	store.GetSession("a")
+	store.Touch("b")
+	store.SetSession("d", &Session{Id: "d"})
+	if ids := fmt.Sprint(getTestSessionIds(store)); ids != "[a b d]" {
+		t.Errorf("Expected [a b d], got %s", ids)
+	}
+	// setting an existing session doesn't evict
+	store.SetSession("a", &Session{Id: "a", EnvId: "1"})
+	if stats := store.Stats(); stats.Sessions != 3 || stats.Evictions != 1 {
+		t.Errorf("Expected 3 sessions and 1 eviction, got %+v", stats)
+	}
+}
+
+func TestInMemorySessionStoreExpiresSessions(t *testing.T) {
+	store, wait := newTestInMemorySessionStore(60, 0)
+	store.SetSession("a", &Session{Id: "a"})
+	store.SetSession("b", &Session{Id: "b"})
+	wait(30)
+	store.Touch("a")
+	store.SetSession("c", &Session{Id: "c"})
+	wait(31)
+	// b was set 61 seconds ago; reads don't extend the ttl
+	if ids := fmt.Sprint(getTestSessionIds(store)); ids != "[a c]" {
+		t.Errorf("Expected [a c], got %s", ids)
+	}
+	wait(30)
+	if sessions, _, _ := store.ListSessions("", 10); len(sessions) != 0 {
+		t.Errorf("Expected every session to have expired, got %d", len(sessions))
+	}
+	if stats := store.Stats(); stats.Sessions != 0 || stats.Expirations != 3 {
+		t.Errorf("Expected 0 sessions and 3 expirations, got %+v", stats)
+	}
+	// without a ttl sessions are kept
+	store.TtlSeconds = 0
+	store.SetSession("d", &Session{Id: "d"})
+	wait(1000000)
+	if session, _ := store.GetSession("d"); session == nil {
+		t.Errorf("Expected session without ttl to be kept")
+	}
+}
+
+func TestInMemorySessionStoreRemovesExpiredBeforeEvicting(t *testing.T) {
+	store, wait := newTestInMemorySessionStore(60, 2)
+	store.SetSession("a", &Session{Id: "a"})
+	wait(30)
+	store.SetSession("b", &Session{Id: "b"})
+	wait(31)
+	store.SetSession("c", &Session{Id: "c"})
+	if stats := store.Stats(); stats.Sessions != 2 || stats.Expirations != 1 || stats.Evictions != 0 {
+		t.Errorf("Expected the expired session to make room, got %+v", stats)
+	}
+}
+
+func TestInMemorySessionStoreStats(t *testing.T) {
+	store, _ := newTestInMemorySessionStore(0, 0)
+	store.SetSession("a", &Session{Id: "a"})
+	store.GetSession("a")
+	store.GetSession("a")
+	store.GetSession("b")
+	store.DeleteSession("a")
+	store.GetSession("a")
+	expected := InMemorySessionStoreStats{Sessions: 0, Hits: 2, Misses: 2}
+	if stats := store.Stats(); stats != expected {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestInMemorySessionStoreCopiesSessions(t *testing.T) {
+	store, _ := newTestInMemorySessionStore(0, 0)
+	session := &Session{Id: "a"}
+	store.SetSession("a", session)
+	session.EnvId = "changed"
+	got, _ := store.GetSession("a")
+	if got == session || got.EnvId != "" {
+		t.Fatalf("Expected a copy of the session as it was set, got %+v", got)
+	}
+	got.EnvId = "changed"
+	if again, _ := store.GetSession("a"); again == got || again.EnvId != "" {
+		t.Errorf("Expected changes to a session to stay out of the store until set, got %+v", again)
+	}
+	sessions, _, _ := store.ListSessions("", 10)
+	sessions[0].EnvId = "changed"
+	if again, _ := store.GetSession("a"); again.EnvId != "" {
+		t.Errorf("Expected listed sessions to be copies, got %+v", again)
+	}
+}
+
+func TestInMemorySessionStoreConcurrentAccess(t *testing.T) {
+	store, _ := newTestInMemorySessionStore(60, 50)
+	var wait sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			for j := 0; j < 100; j++ {
+				id := fmt.Sprintf("s%d", (i * 7 + j) % 80)
+				// requests on the same session update their own copy, then set it
+				session, _ := store.GetSession(id)
+				if session == nil {
+					session = &Session{Id: id}
+				}
+				session.EnvId = fmt.Sprintf("%d", j)
+				session.EnvServiceName = fmt.Sprintf("env-%d", j)
+				store.SetSession(id, session)
+				store.Touch(id)
+				store.ListSessions("", 10)
+				if j % 10 == 0 {
+					store.DeleteSession(id)
+				}
+			}
+		}(i)
+	}
+	wait.Wait()
+	stats := store.Stats()
+	if stats.Sessions > 50 {
+		t.Errorf("Expected at most 50 sessions, got %d", stats.Sessions)
+	}
+	sessions, _, _ := store.ListSessions("", 100)
+	for _, session := range sessions {
+		if "env-" + session.EnvId != session.EnvServiceName {
+			t.Errorf("Expected consistent session, got %+v", session)
+		}
+	}
+}
@@ -1,58 +1,553 @@
 package minienv
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
-	"github.com/go-redis/redis"
-	"log"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"io/ioutil"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// all keys start with the prefix (MINIENV_REDIS_KEY_PREFIX), so several installations can share a redis
+const DefaultRedisKeyPrefix = "minienv:"
+
+// how often the connection is checked; the client reconnects on its own, this only reports the state
+const RedisHealthCheckSeconds = 10
+
+// ids of sessions and state keys are kept in sorted sets, so they can be paged by id without SCAN,
+// which only covers a single node of a cluster
+const redisSessionKeys = "session:"
+const redisSessionIndexKey = "sessions"
+const redisStateKeys = "state:"
+const redisStateIndexKey = "state-keys"
+
+// ids of generated sessions; only these are looked up under their bare id, when moving legacy sessions
+var legacySessionIdRegexp = regexp.MustCompile("^[0-9a-f]{32}$")
+
+type RedisSessionStoreOptions struct {
+	// a single address, the addresses of the sentinels when MasterName is set, or of cluster nodes
+	Addresses []string
+	Username string
+	Password string
+	Db int
+	// name of the master monitored by the sentinels
+	MasterName string
+	SentinelPassword string
+	Cluster bool
+	TLSConfig *tls.Config
+	KeyPrefix string
+	// move sessions saved under their bare id, by versions before keys were prefixed, as they're used
+	MigrateLegacySessions bool
+}
+
 type RedisSessionStore struct {
-	Client *redis.Client
+	Client redis.UniversalClient
+	Ttl time.Duration
+	KeyPrefix string
+	MigrateLegacySessions bool
+	healthMutex sync.RWMutex
+	healthErr error
+}
+
+// NewRedisSessionStoreOptionsFromEnv reads the MINIENV_REDIS_* env vars, failing on invalid values
+func NewRedisSessionStoreOptionsFromEnv() (*RedisSessionStoreOptions, error) {
+	options := &RedisSessionStoreOptions{
+		Username: os.Getenv("MINIENV_REDIS_USERNAME"),
+		Password: os.Getenv("MINIENV_REDIS_PASSWORD"),
+		MasterName: os.Getenv("MINIENV_REDIS_SENTINEL_MASTER"),
+		SentinelPassword: os.Getenv("MINIENV_REDIS_SENTINEL_PASSWORD"),
+		KeyPrefix: DefaultRedisKeyPrefix,
+	}
+	if prefix, ok := os.LookupEnv("MINIENV_REDIS_KEY_PREFIX"); ok {
+		options.KeyPrefix = prefix
+	}
+	useTls := false
+	for _, address := range splitList(os.Getenv("MINIENV_REDIS_ADDRESS")) {
+		if strings.HasPrefix(address, "rediss://") {
+			useTls = true
+		}
+		address = strings.TrimPrefix(strings.TrimPrefix(address, "rediss://"), "redis://")
+		options.Addresses = append(options.Addresses, strings.TrimSuffix(address, "/"))
+	}
+	if dbStr := os.Getenv("MINIENV_REDIS_DB"); dbStr != "" {
+		db, err := strconv.Atoi(dbStr)
+		if err != nil || db < 0 {
+			return nil, fmt.Errorf("invalid MINIENV_REDIS_DB '%s'", dbStr)
+		}
+		options.Db = db
+	}
+	var err error
+	if clusterStr := os.Getenv("MINIENV_REDIS_CLUSTER"); clusterStr != "" {
+		options.Cluster, err = strconv.ParseBool(clusterStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MINIENV_REDIS_CLUSTER '%s'", clusterStr)
+		}
+	}
+	if migrateStr := os.Getenv("MINIENV_REDIS_MIGRATE_LEGACY_SESSIONS"); migrateStr != "" {
+		options.MigrateLegacySessions, err = strconv.ParseBool(migrateStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MINIENV_REDIS_MIGRATE_LEGACY_SESSIONS '%s'", migrateStr)
+		}
+	}
+	if options.Cluster && options.MasterName != "" {
+		return nil, errors.New("MINIENV_REDIS_CLUSTER and MINIENV_REDIS_SENTINEL_MASTER can't both be set")
+	}
+	if options.Cluster && options.Db != 0 {
+		return nil, errors.New("MINIENV_REDIS_DB isn't supported by redis cluster")
+	}
+	if tlsStr := os.Getenv("MINIENV_REDIS_TLS"); tlsStr != "" {
+		useTls, err = strconv.ParseBool(tlsStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MINIENV_REDIS_TLS '%s'", tlsStr)
+		}
+	}
+	if useTls {
+		options.TLSConfig, err = getRedisTlsConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return options, nil
 }
 
-func NewRedisSessionStore(address string, password string, dbStr string) (*RedisSessionStore, error) {
-	db, _ := strconv.ParseInt(dbStr, 10, 64)
-	client := redis.NewClient(&redis.Options{
-		Addr: address,
-		Password: password,
-		DB: int(db),
-	})
+func getRedisTlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: os.Getenv("MINIENV_REDIS_TLS_SERVER_NAME"),
+	}
+	if skipVerifyStr := os.Getenv("MINIENV_REDIS_TLS_SKIP_VERIFY"); skipVerifyStr != "" {
+		skipVerify, err := strconv.ParseBool(skipVerifyStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MINIENV_REDIS_TLS_SKIP_VERIFY '%s'", skipVerifyStr)
+		}
+		tlsConfig.InsecureSkipVerify = skipVerify
+	}
+	if caFile := os.Getenv("MINIENV_REDIS_TLS_CA_FILE"); caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if ! tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in '%s'", caFile)
+		}
+	}
+	certFile := os.Getenv("MINIENV_REDIS_TLS_CERT_FILE")
+	keyFile := os.Getenv("MINIENV_REDIS_TLS_KEY_FILE")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func initRedisSessionStore() (*RedisSessionStore, error) {
+	options, err := NewRedisSessionStoreOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisSessionStore(options)
+}
+
+func NewRedisSessionStore(options *RedisSessionStoreOptions) (*RedisSessionStore, error) {
+	if len(options.Addresses) == 0 {
+		return nil, errors.New("no redis address")
+	}
+	universalOptions := &redis.UniversalOptions{
+		Addrs: options.Addresses,
+		Username: options.Username,
+		Password: options.Password,
+		DB: options.Db,
+		MasterName: options.MasterName,
+		SentinelPassword: options.SentinelPassword,
+		TLSConfig: options.TLSConfig,
+	}
+	var client redis.UniversalClient
+	if options.Cluster {
+		// NewUniversalClient only picks cluster mode for more than one address
+		client = redis.NewClusterClient(universalOptions.Cluster())
+	} else {
+		client = redis.NewUniversalClient(universalOptions)
+	}
 	_, err := client.Ping(client.Context()).Result()
 	if err != nil {
-		log.Printf("Failed to ping Redis: %v\n", err)
+		logPrintf("Failed to ping Redis: %v\n", err)
+		client.Close()
 		return nil, err
 	}
-	return &RedisSessionStore{
+	store := &RedisSessionStore{
 		Client: client,
-	}, nil
+		Ttl: time.Duration(sessionTtlSeconds) * time.Second,
+		KeyPrefix: options.KeyPrefix,
+		MigrateLegacySessions: options.MigrateLegacySessions,
+	}
+	err = store.indexKeys()
+	if err != nil {
+		logPrintf("Error indexing existing Redis keys: %v\n", err)
+	}
+	store.startHealthCheckTimer()
+	return store, nil
 }
 
-func (store RedisSessionStore) SetSession(id string, session *Session) (error) {
+func (store *RedisSessionStore) key(name string) string {
+	return store.KeyPrefix + name
+}
+
+func (store *RedisSessionStore) sessionKey(id string) string {
+	return store.KeyPrefix + redisSessionKeys + id
+}
+
+func (store *RedisSessionStore) stateKey(key string) string {
+	return store.KeyPrefix + redisStateKeys + key
+}
+
+// Health returns the error of the last failed health check, or nil if redis is reachable
+func (store *RedisSessionStore) Health() (error) {
+	store.healthMutex.RLock()
+	defer store.healthMutex.RUnlock()
+	return store.healthErr
+}
+
+func (store *RedisSessionStore) checkHealth() {
+	err := store.Client.Ping(store.Client.Context()).Err()
+	store.healthMutex.Lock()
+	previousErr := store.healthErr
+	store.healthErr = err
+	store.healthMutex.Unlock()
+	if err != nil && previousErr == nil {
+		logPrintf("Redis connection lost: %v\n", err)
+	} else if err == nil && previousErr != nil {
+		logPrintln("Redis connection restored.")
+	}
+}
+
+func (store *RedisSessionStore) startHealthCheckTimer() {
+	timer := time.NewTimer(time.Second * time.Duration(RedisHealthCheckSeconds))
+	go func() {
+		<-timer.C
+		store.checkHealth()
+		store.startHealthCheckTimer()
+	}()
+}
+
+// indexKeys adds sessions and state saved before the indexes existed to them
+func (store *RedisSessionStore) indexKeys() error {
+	ctx := store.Client.Context()
+	scan := func(ctx context.Context, client *redis.Client) error {
+		for _, index := range []struct{ Keys string; IndexKey string }{{redisSessionKeys, redisSessionIndexKey}, {redisStateKeys, redisStateIndexKey}} {
+			prefix := store.key(index.Keys)
+			iter := client.Scan(ctx, 0, prefix + "*", 100).Iterator()
+			for iter.Next(ctx) {
+				// appended state is kept in lists, which aren't indexed
+				if client.Type(ctx, iter.Val()).Val() != "string" {
+					continue
+				}
+				err := store.Client.ZAdd(ctx, store.key(index.IndexKey), &redis.Z{Member: strings.TrimPrefix(iter.Val(), prefix)}).Err()
+				if err != nil {
+					return err
+				}
+			}
+			if iter.Err() != nil {
+				return iter.Err()
+			}
+		}
+		return nil
+	}
+	if clusterClient, ok := store.Client.(*redis.ClusterClient); ok {
+		return clusterClient.ForEachMaster(ctx, scan)
+	} else if client, ok := store.Client.(*redis.Client); ok {
+		return scan(ctx, client)
+	}
+	return nil
+}
+
+func (store *RedisSessionStore) SetSession(id string, session *Session) (error) {
 	bs, err := json.Marshal(session)
 	if err != nil {
 		return err
 	}
-	log.Printf("Redis setting session: %s\n", string(bs))
-	err = store.Client.Set(store.Client.Context(), id, bs, 0).Err()
+	logPrintf("Redis setting session %s.\n", id)
+	ctx := store.Client.Context()
+	pipe := store.Client.Pipeline()
+	pipe.Set(ctx, store.sessionKey(id), bs, store.Ttl)
+	pipe.ZAdd(ctx, store.key(redisSessionIndexKey), &redis.Z{Member: id})
+	_, err = pipe.Exec(ctx)
 	if err != nil {
-		log.Printf("Redis error setting session: %v\n", err)
+		logPrintf("Redis error setting session: %v\n", err)
 		return err
 	}
 	return nil
 }
 
-func (store RedisSessionStore) GetSession(id string) (*Session, error) {
-	bs, err := store.Client.Get(store.Client.Context(), id).Bytes()
-	if err != nil {
+func (store *RedisSessionStore) GetSession(id string) (*Session, error) {
+	bs, err := store.Client.Get(store.Client.Context(), store.sessionKey(id)).Bytes()
+	if err == redis.Nil && store.MigrateLegacySessions {
+		return store.getLegacySession(id)
+	} else if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
-	log.Printf("Redis getting session: %s\n", string(bs))
+	logPrintf("Redis getting session %s.\n", id)
 	var session Session
 	err = json.Unmarshal(bs, &session)
 	if err != nil {
-		log.Printf("Redis error getting session: %v\n", err)
+		logPrintf("Redis error getting session: %v\n", err)
 		return nil, err
 	}
 	return &session, nil
-}
\ No newline at end of file
+}
+
+// getLegacySession moves a session saved under its bare id, by versions before sessions were prefixed. The id
+// comes from the client, so only ids in the generated format are looked up, and only values holding the same
+// id are taken as sessions; anything else in the database (e.g. state, or another installation's keys) is left alone.
+func (store *RedisSessionStore) getLegacySession(id string) (*Session, error) {
+	if ! legacySessionIdRegexp.MatchString(id) {
+		return nil, nil
+	}
+	bs, err := store.Client.Get(store.Client.Context(), id).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var session Session
+	err = json.Unmarshal(bs, &session)
+	if err != nil || session.Id != id {
+		return nil, nil
+	}
+	logPrintf("Redis moving session %s.\n", id)
+	err = store.SetSession(id, &session)
+	if err == nil {
+		store.Client.Del(store.Client.Context(), id)
+	}
+	return &session, nil
+}
+
+func (store *RedisSessionStore) DeleteSession(id string) (error) {
+	ctx := store.Client.Context()
+	pipe := store.Client.Pipeline()
+	pipe.Del(ctx, store.sessionKey(id))
+	pipe.ZRem(ctx, store.key(redisSessionIndexKey), id)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		logPrintf("Redis error deleting session %s: %v\n", id, err)
+		return err
+	}
+	return nil
+}
+
+// ListSessions pages through the session index in id order; the cursor is the last id examined.
+// Sessions that expired are removed from the index as they're found, so a page may hold fewer than count sessions.
+func (store *RedisSessionStore) ListSessions(cursor string, count int) ([]*Session, string, error) {
+	ctx := store.Client.Context()
+	if count <= 0 {
+		count = DefaultSessionListCount
+	}
+	min := "-"
+	if cursor != "" {
+		min = "(" + cursor
+	}
+	ids, err := store.Client.ZRangeByLex(ctx, store.key(redisSessionIndexKey), &redis.ZRangeBy{Min: min, Max: "+", Count: int64(count + 1)}).Result()
+	if err != nil {
+		logPrintf("Redis error listing sessions: %v\n", err)
+		return nil, "", err
+	}
+	next := ""
+	if len(ids) > count {
+		ids = ids[:count]
+		next = ids[count - 1]
+	}
+	values, err := store.getValues(ids, store.sessionKey)
+	if err != nil {
+		logPrintf("Redis error listing sessions: %v\n", err)
+		return nil, "", err
+	}
+	sessions := []*Session{}
+	var expired []interface{}
+	for i, value := range values {
+		if value == nil {
+			expired = append(expired, ids[i])
+			continue
+		}
+		var session Session
+		if json.Unmarshal(value, &session) == nil {
+			sessions = append(sessions, &session)
+		}
+	}
+	if len(expired) > 0 {
+		store.Client.ZRem(ctx, store.key(redisSessionIndexKey), expired...)
+	}
+	return sessions, next, nil
+}
+
+// getValues gets the value of each key in a pipeline rather than MGET, which a cluster only allows
+// for keys in the same slot; missing keys have a nil value
+func (store *RedisSessionStore) getValues(names []string, key func(string) string) ([][]byte, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	ctx := store.Client.Context()
+	pipe := store.Client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(names))
+	for i, name := range names {
+		cmds[i] = pipe.Get(ctx, key(name))
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	values := make([][]byte, len(names))
+	for i, cmd := range cmds {
+		bs, err := cmd.Bytes()
+		if err == nil {
+			values[i] = bs
+		}
+	}
+	return values, nil
+}
+
+func (store *RedisSessionStore) Touch(id string) (error) {
+	if store.Ttl <= 0 {
+		return nil
+	}
+	err := store.Client.Expire(store.Client.Context(), store.sessionKey(id), store.Ttl).Err()
+	if err != nil {
+		logPrintf("Redis error touching session %s: %v\n", id, err)
+		return err
+	}
+	return nil
+}
+
+func (store *RedisSessionStore) GetState(key string) ([]byte, error) {
+	bs, err := store.Client.Get(store.Client.Context(), store.stateKey(key)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		logPrintf("Redis error getting state %s: %v\n", key, err)
+		return nil, err
+	}
+	return bs, nil
+}
+
+func (store *RedisSessionStore) SetState(key string, value []byte) (error) {
+	ctx := store.Client.Context()
+	pipe := store.Client.Pipeline()
+	pipe.Set(ctx, store.stateKey(key), value, 0)
+	pipe.ZAdd(ctx, store.key(redisStateIndexKey), &redis.Z{Member: key})
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		logPrintf("Redis error setting state %s: %v\n", key, err)
+		return err
+	}
+	return nil
+}
+
+func (store *RedisSessionStore) DeleteState(key string) (error) {
+	ctx := store.Client.Context()
+	pipe := store.Client.Pipeline()
+	pipe.Del(ctx, store.stateKey(key))
+	pipe.ZRem(ctx, store.key(redisStateIndexKey), key)
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		logPrintf("Redis error deleting state %s: %v\n", key, err)
+		return err
+	}
+	return nil
+}
+
+// CompareAndSwapState watches the key, so the transaction fails if another client changes it in between
+func (store *RedisSessionStore) CompareAndSwapState(key string, previous []byte, value []byte) (bool, error) {
+	ctx := store.Client.Context()
+	err := store.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, store.stateKey(key)).Bytes()
+		if err == redis.Nil {
+			current = nil
+		} else if err != nil {
+			return err
+		}
+		if (current != nil) != (previous != nil) || ! bytes.Equal(current, previous) {
+			return redis.TxFailedErr
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, store.stateKey(key), value, 0)
+			return nil
+		})
+		return err
+	}, store.stateKey(key))
+	if err == redis.TxFailedErr {
+		return false, nil
+	} else if err != nil {
+		logPrintf("Redis error swapping state %s: %v\n", key, err)
+		return false, err
+	}
+	// the index may be in another slot of a cluster, so it's updated outside the transaction
+	store.Client.ZAdd(ctx, store.key(redisStateIndexKey), &redis.Z{Member: key})
+	return true, nil
+}
+
+func (store *RedisSessionStore) ListState(prefix string) (map[string][]byte, error) {
+	ctx := store.Client.Context()
+	keys, err := store.Client.ZRangeByLex(ctx, store.key(redisStateIndexKey), &redis.ZRangeBy{Min: "[" + prefix, Max: "[" + prefix + "\xff"}).Result()
+	if err != nil {
+		logPrintf("Redis error listing state %s: %v\n", prefix, err)
+		return nil, err
+	}
+	values, err := store.getValues(keys, store.stateKey)
+	if err != nil {
+		logPrintf("Redis error listing state %s: %v\n", prefix, err)
+		return nil, err
+	}
+	state := make(map[string][]byte)
+	for i, value := range values {
+		if value != nil {
+			state[keys[i]] = value
+		}
+	}
+	return state, nil
+}
+
+func (store *RedisSessionStore) AppendState(key string, value []byte, max int) (error) {
+	ctx := store.Client.Context()
+	pipe := store.Client.TxPipeline()
+	pipe.RPush(ctx, store.stateKey(key), value)
+	if max > 0 {
+		pipe.LTrim(ctx, store.stateKey(key), int64(-max), -1)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		logPrintf("Redis error appending state %s: %v\n", key, err)
+		return err
+	}
+	return nil
+}
+
+func (store *RedisSessionStore) GetAppendedState(key string, count int) ([][]byte, error) {
+	start := int64(0)
+	if count > 0 {
+		start = int64(-count)
+	}
+	strs, err := store.Client.LRange(store.Client.Context(), store.stateKey(key), start, -1).Result()
+	if err != nil {
+		logPrintf("Redis error getting state %s: %v\n", key, err)
+		return nil, err
+	}
+	var values [][]byte
+	for _, element := range strs {
+		values = append(values, []byte(element))
+	}
+	return values, nil
+}
@@ -0,0 +1,217 @@
+package minienv
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisSessionStore(t *testing.T) (*RedisSessionStore, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	t.Setenv("MINIENV_REDIS_ADDRESS", "redis://" + server.Addr())
+	t.Setenv("MINIENV_REDIS_KEY_PREFIX", "test:")
+	store, err := initRedisSessionStore()
+	if err != nil {
+		t.Fatalf("Error connecting to redis: %v", err)
+	}
+	return store, server
+}
+
+func TestRedisSessionStoreSessions(t *testing.T) {
+	store, server := newTestRedisSessionStore(t)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.SetSession(id, &Session{Id: id}); err != nil {
+			t.Fatalf("Error setting session %s: %v", id, err)
+		}
+	}
+	session, err := store.GetSession("b")
+	if err != nil || session == nil || session.Id != "b" {
+		t.Fatalf("Expected session b, got %v, %v", session, err)
+	}
+	var ids []string
+	cursor := ""
+	for true {
+		sessions, next, err := store.ListSessions(cursor, 2)
+		if err != nil {
+			t.Fatalf("Error listing sessions: %v", err)
+		}
+		for _, session := range sessions {
+			ids = append(ids, session.Id)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(ids) != 3 {
+		t.Errorf("Expected 3 sessions, got %v", ids)
+	}
+	// sessions that expired in redis drop out of the listing
+	server.Del("test:session:b")
+	sessions, _, _ := store.ListSessions("", 10)
+	if len(sessions) != 2 {
+		t.Errorf("Expected 2 sessions, got %d", len(sessions))
+	}
+	if err := store.DeleteSession("a"); err != nil {
+		t.Fatalf("Error deleting session: %v", err)
+	}
+	if session, _ := store.GetSession("a"); session != nil {
+		t.Errorf("Expected deleted session to be gone")
+	}
+}
+
+func TestRedisSessionStoreIndexesExistingKeys(t *testing.T) {
+	server := miniredis.RunT(t)
+	// sessions saved before the index (with the prefix) and before the prefix (bare ids)
+	legacyId := "0123456789abcdef0123456789abcdef"
+	server.Set("test:session:s0", `{"sessionId":"s0"}`)
+	server.Set(legacyId, `{"sessionId":"` + legacyId + `"}`)
+	t.Setenv("MINIENV_REDIS_ADDRESS", "redis://" + server.Addr())
+	t.Setenv("MINIENV_REDIS_KEY_PREFIX", "test:")
+	t.Setenv("MINIENV_REDIS_MIGRATE_LEGACY_SESSIONS", "true")
+	store, err := initRedisSessionStore()
+	if err != nil {
+		t.Fatalf("Error connecting to redis: %v", err)
+	}
+	session, err := store.GetSession(legacyId)
+	if err != nil || session == nil || session.Id != legacyId {
+		t.Fatalf("Expected legacy session, got %v, %v", session, err)
+	}
+	if server.Exists(legacyId) {
+		t.Errorf("Expected legacy session to be moved under the prefix")
+	}
+	sessions, _, _ := store.ListSessions("", 10)
+	if len(sessions) != 2 {
+		t.Errorf("Expected 2 sessions, got %d", len(sessions))
+	}
+}
+
+func TestRedisSessionStoreLeavesOtherKeysAlone(t *testing.T) {
+	server := miniredis.RunT(t)
+	legacyId := "0123456789abcdef0123456789abcdef"
+	otherId := "fedcba9876543210fedcba9876543210"
+	keys := map[string]string{
+		"test:state:env/1": `{"status":1}`,
+		"other:session:s1": `{"sessionId":"s1"}`,
+		legacyId: `{"sessionId":"` + legacyId + `"}`,
+		// not a session, though it parses as one
+		otherId: `{"status":1}`,
+	}
+	for key, value := range keys {
+		server.Set(key, value)
+	}
+	t.Setenv("MINIENV_REDIS_ADDRESS", "redis://" + server.Addr())
+	t.Setenv("MINIENV_REDIS_KEY_PREFIX", "test:")
+	tests := []struct {
+		migrate string
+		id string
+	}{
+		{"false", legacyId},
+		{"true", "test:state:env/1"},
+		{"true", "other:session:s1"},
+		{"true", otherId},
+	}
+	for _, test := range tests {
+		t.Setenv("MINIENV_REDIS_MIGRATE_LEGACY_SESSIONS", test.migrate)
+		store, err := initRedisSessionStore()
+		if err != nil {
+			t.Fatalf("Error connecting to redis: %v", err)
+		}
+		if session, err := store.GetSession(test.id); session != nil || err != nil {
+			t.Errorf("Expected no session for %s (migrate=%s), got %v, %v", test.id, test.migrate, session, err)
+		}
+		if err := store.DeleteSession(test.id); err != nil {
+			t.Errorf("Error deleting session %s: %v", test.id, err)
+		}
+		store.Client.Close()
+	}
+	for key, value := range keys {
+		if actual, err := server.Get(key); err != nil || actual != value {
+			t.Errorf("Expected %s to be left alone, got %s, %v", key, actual, err)
+		}
+	}
+}
+
+func TestRedisSessionStoreState(t *testing.T) {
+	store, _ := newTestRedisSessionStore(t)
+	store.SetState("w/a", []byte("1"))
+	store.SetState("w/b", []byte("2"))
+	store.SetState("x/c", []byte("3"))
+	state, err := store.ListState("w/")
+	if err != nil || len(state) != 2 || string(state["w/b"]) != "2" {
+		t.Fatalf("Expected 2 values under w/, got %v, %v", state, err)
+	}
+	store.DeleteState("w/a")
+	if state, _ = store.ListState("w/"); len(state) != 1 {
+		t.Errorf("Expected 1 value under w/, got %v", state)
+	}
+	for i := 0; i < 5; i++ {
+		store.AppendState("log", []byte{byte('0' + i)}, 3)
+	}
+	values, _ := store.GetAppendedState("log", 0)
+	if len(values) != 3 || string(values[0]) != "2" {
+		t.Errorf("Expected the last 3 values, got %q", values)
+	}
+}
+
+func TestRedisSessionStoreCompareAndSwapState(t *testing.T) {
+	store, _ := newTestRedisSessionStore(t)
+	swapped, err := store.CompareAndSwapState("k", nil, []byte("1"))
+	if err != nil || ! swapped {
+		t.Fatalf("Expected swap of absent key, got %t, %v", swapped, err)
+	}
+	if swapped, _ = store.CompareAndSwapState("k", nil, []byte("2")); swapped {
+		t.Errorf("Expected swap of present key as absent to fail")
+	}
+	if swapped, _ = store.CompareAndSwapState("k", []byte("0"), []byte("2")); swapped {
+		t.Errorf("Expected swap with stale value to fail")
+	}
+	if swapped, _ = store.CompareAndSwapState("k", []byte("1"), []byte("2")); ! swapped {
+		t.Errorf("Expected swap with current value to succeed")
+	}
+	if value, _ := store.GetState("k"); string(value) != "2" {
+		t.Errorf("Expected 2, got %s", value)
+	}
+}
+
+func TestRedisSessionStoreHealth(t *testing.T) {
+	store, server := newTestRedisSessionStore(t)
+	if err := store.Health(); err != nil {
+		t.Fatalf("Expected healthy store, got %v", err)
+	}
+	server.Close()
+	store.checkHealth()
+	if store.Health() == nil {
+		t.Errorf("Expected unhealthy store once redis is down")
+	}
+}
+
+func TestRedisSessionStoreOptionsFromEnv(t *testing.T) {
+	t.Setenv("MINIENV_REDIS_ADDRESS", "rediss://host1:6380/,host2:6380")
+	t.Setenv("MINIENV_REDIS_DB", "2")
+	t.Setenv("MINIENV_REDIS_KEY_PREFIX", "")
+	options, err := NewRedisSessionStoreOptionsFromEnv()
+	if err != nil {
+		t.Fatalf("Error parsing options: %v", err)
+	}
+	if len(options.Addresses) != 2 || options.Addresses[0] != "host1:6380" || options.Db != 2 || options.TLSConfig == nil || options.KeyPrefix != "" {
+		t.Errorf("Unexpected options %+v", options)
+	}
+	t.Setenv("MINIENV_REDIS_DB", "x")
+	if _, err := NewRedisSessionStoreOptionsFromEnv(); err == nil {
+		t.Errorf("Expected error for invalid db")
+	}
+	t.Setenv("MINIENV_REDIS_DB", "")
+	t.Setenv("MINIENV_REDIS_CLUSTER", "true")
+	t.Setenv("MINIENV_REDIS_SENTINEL_MASTER", "master")
+	if _, err := NewRedisSessionStoreOptionsFromEnv(); err == nil {
+		t.Errorf("Expected error for cluster with sentinel")
+	}
+	t.Setenv("MINIENV_REDIS_CLUSTER", "")
+	t.Setenv("MINIENV_REDIS_SENTINEL_MASTER", "")
+	t.Setenv("MINIENV_REDIS_TLS", "true")
+	t.Setenv("MINIENV_REDIS_TLS_CA_FILE", "/nonexistent")
+	if _, err := NewRedisSessionStoreOptionsFromEnv(); err == nil {
+		t.Errorf("Expected error for missing ca file")
+	}
+}
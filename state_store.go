@@ -0,0 +1,21 @@
+package minienv
+
+// StateStore keeps state shared by all api servers, such as the whitelist entries managed through the admin api.
+// The session stores implement it, so state lives wherever sessions do.
+type StateStore interface {
+	// GetState returns nil when the key doesn't exist
+	GetState(key string) ([]byte, error)
+	SetState(key string, value []byte) (error)
+	DeleteState(key string) (error)
+	// CompareAndSwapState sets key to value only if its value is still previous (nil if it must not exist);
+	// it returns false, without an error, if the value was changed by someone else
+	CompareAndSwapState(key string, previous []byte, value []byte) (bool, error)
+	// ListState returns the values of all keys starting with prefix
+	ListState(prefix string) (map[string][]byte, error)
+	// AppendState adds a value to the list stored at key, dropping the oldest values beyond max
+	AppendState(key string, value []byte, max int) (error)
+	// GetAppendedState returns up to the last count values appended to key, oldest first
+	GetAppendedState(key string, count int) ([][]byte, error)
+}
+
+var stateStore StateStore
@@ -0,0 +1,246 @@
+package minienv
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// prefix marking a url or branch pattern as a regular expression rather than a glob
+const PatternRegexpPrefix = "re:"
+
+// the url schemes repos may be fetched with; scp style urls, e.g. git@github.com:org/repo, are also ssh
+var allowedRepoUrlSchemes = map[string]bool{"https": true, "http": true, "ssh": true}
+
+var denylistRepos []*WhitelistRepo
+// the whitelist is made up of the entries configured by env var or catalog, and those managed through the admin api
+var configuredWhitelistRepos []*WhitelistRepo
+var managedWhitelistRepos []*WhitelistRepo
+// guards the lists, which are replaced when the catalog is reloaded or managed entries change
+var whitelistMutex sync.RWMutex
+// a configured whitelist is always enforced; without one, the managed entries only restrict repos when
+// MINIENV_WHITELIST_ENFORCE is set, so adding the first entry through the admin api doesn't close an open server
+var whitelistEnforced = false
+
+// IsRepoAllowed checks the repo url and requested ref (branch, tag, "pull/<n>" or commit sha) against the
+// denylist, which always takes precedence, and then the whitelist; unless the whitelist is enforced every repo is allowed
+func IsRepoAllowed(repo string, ref string) bool {
+	if normalizeRepoUrl(repo) == "" {
+		logPrintf("Repo '%s' is not a supported repo url.\n", repo)
+		return false
+	}
+	whitelistMutex.RLock()
+	defer whitelistMutex.RUnlock()
+	for _, element := range denylistRepos {
+		if element.matches(repo, ref) {
+			logPrintf("Repo '%s' (%s) is denied by '%s'.\n", repo, ref, element.Url)
+			return false
+		}
+	}
+	if configuredWhitelistRepos == nil && ! whitelistEnforced {
+		return true
+	}
+	for _, element := range whitelistRepos {
+		if element.matches(repo, ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// getWhitelistRepo returns the first whitelist entry matching the repo and ref, or nil
+func getWhitelistRepo(repo string, ref string) *WhitelistRepo {
+	whitelistMutex.RLock()
+	defer whitelistMutex.RUnlock()
+	for _, element := range whitelistRepos {
+		if element.matches(repo, ref) {
+			return element
+		}
+	}
+	return nil
+}
+
+func getWhitelistRepos() []*WhitelistRepo {
+	whitelistMutex.RLock()
+	defer whitelistMutex.RUnlock()
+	return whitelistRepos
+}
+
+// getPublicWhitelistRepo returns a copy of the entry without the values of its env vars, or the server settings
+func getPublicWhitelistRepo(whitelistRepo *WhitelistRepo) *WhitelistRepo {
+	repo := *whitelistRepo
+	repo.EnvVars = nil
+	repo.ShareGitCredential = false
+	for name := range whitelistRepo.EnvVars {
+		repo.EnvVarNames = append(repo.EnvVarNames, name)
+	}
+	sort.Strings(repo.EnvVarNames)
+	return &repo
+}
+
+func setWhitelistRepos(whitelist []*WhitelistRepo, denylist []*WhitelistRepo) {
+	whitelistMutex.Lock()
+	configuredWhitelistRepos = whitelist
+	denylistRepos = denylist
+	updateWhitelistRepos()
+	whitelistMutex.Unlock()
+}
+
+func setManagedWhitelistRepos(managed []*WhitelistRepo) {
+	whitelistMutex.Lock()
+	managedWhitelistRepos = managed
+	updateWhitelistRepos()
+	whitelistMutex.Unlock()
+}
+
+// updateWhitelistRepos combines the configured and managed entries; configured entries come first, so their
+// settings apply when both match. Must be called with whitelistMutex locked.
+func updateWhitelistRepos() {
+	if configuredWhitelistRepos == nil && len(managedWhitelistRepos) == 0 {
+		whitelistRepos = nil
+		return
+	}
+	repos := []*WhitelistRepo{}
+	repos = append(repos, configuredWhitelistRepos...)
+	repos = append(repos, managedWhitelistRepos...)
+	whitelistRepos = repos
+}
+
+// parseWhitelistRepos parses the MINIENV_REPO_WHITELIST (and MINIENV_REPO_DENYLIST) format, a comma separated list
+// of "url", "name|url" or "name|url|branch". Urls may contain globs, e.g. "github.com/our-org/*", and branches
+// globs, e.g. "release/*"; either may instead be a regular expression prefixed with "re:" (a branch
+// regular expression may contain "|", as everything after the second "|" is the branch).
+func parseWhitelistRepos(s string) ([]*WhitelistRepo, error) {
+	elements := splitList(s)
+	if len(elements) == 0 {
+		return nil, nil
+	}
+	repos := []*WhitelistRepo{}
+	for _, element := range elements {
+		var name string
+		var url string
+		var branch string
+		elementStrs := strings.SplitN(element, "|", 3)
+		if len(elementStrs) >= 2 {
+			name = elementStrs[0]
+			url = elementStrs[1]
+			if len(elementStrs) == 3 {
+				branch = elementStrs[2]
+			} else {
+				branch = DefaultBranch
+			}
+		} else {
+			name = element
+			url = element
+			branch = DefaultBranch
+		}
+		repo := &WhitelistRepo{Name: name, Url: url, Branch: branch}
+		err := repo.compile()
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+	return repos, nil
+}
+
+func (whitelistRepo *WhitelistRepo) compile() error {
+	urlPattern := strings.TrimSpace(whitelistRepo.Url)
+	if ! strings.HasPrefix(urlPattern, PatternRegexpPrefix) {
+		urlPattern = normalizeRepoUrl(urlPattern)
+		if urlPattern == "" {
+			return fmt.Errorf("invalid repo pattern '%s'", whitelistRepo.Url)
+		}
+	}
+	urlRegexp, err := compileRepoPattern(urlPattern, "[^/]*")
+	if err != nil {
+		return fmt.Errorf("invalid repo pattern '%s': %v", whitelistRepo.Url, err)
+	}
+	branch := whitelistRepo.Branch
+	if branch == "" {
+		branch = DefaultBranch
+	}
+	branchRegexp, err := compileRepoPattern(branch, ".*")
+	if err != nil {
+		return fmt.Errorf("invalid branch pattern '%s': %v", whitelistRepo.Branch, err)
+	}
+	whitelistRepo.urlRegexp = urlRegexp
+	whitelistRepo.branchRegexp = branchRegexp
+	return nil
+}
+
+func (whitelistRepo *WhitelistRepo) matches(repo string, ref string) bool {
+	// entries are compiled when they are parsed or loaded
+	if whitelistRepo.urlRegexp == nil || whitelistRepo.branchRegexp == nil {
+		return false
+	}
+	normalizedRepo := normalizeRepoUrl(repo)
+	return normalizedRepo != "" && whitelistRepo.urlRegexp.MatchString(normalizedRepo) && whitelistRepo.branchRegexp.MatchString(ref)
+}
+
+// compileRepoPattern compiles a "re:" regular expression, anchored so it has to match the whole url or ref, or
+// a glob where "**" matches anything and "*" matches star, e.g. anything but a slash for urls
+func compileRepoPattern(pattern string, star string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, PatternRegexpPrefix) {
+		return regexp.Compile("^(?:" + strings.TrimPrefix(pattern, PatternRegexpPrefix) + ")$")
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		if strings.HasPrefix(pattern[i:], "**") {
+			b.WriteString(".*")
+			i++
+		} else if pattern[i] == '*' {
+			b.WriteString(star)
+		} else if pattern[i] == '?' {
+			b.WriteString(".")
+		} else {
+			b.WriteString(regexp.QuoteMeta(pattern[i:i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// normalizeRepoUrl reduces a repo url to "host/path" in lower case, so "https://GitHub.com/org/repo.git/"
+// and "github.com/org/repo" match. Urls git would fetch some other way than https, http or ssh (file://, the
+// "<transport>::" remote helpers, local paths) and paths with "." or ".." segments normalize to "", matching nothing.
+func normalizeRepoUrl(repo string) string {
+	repo = strings.TrimSpace(repo)
+	var host string
+	var path string
+	if strings.Contains(repo, "://") {
+		u, err := url.Parse(repo)
+		if err != nil || ! allowedRepoUrlSchemes[u.Scheme] || u.Host == "" {
+			return ""
+		}
+		host = u.Host
+		path = u.Path
+	} else if strings.Contains(repo, "::") {
+		return ""
+	} else if i := strings.Index(repo, ":"); i >= 0 && ! strings.Contains(repo[:i], "/") {
+		// scp style, e.g. git@github.com:org/repo.git
+		host = repo[strings.LastIndex(repo[:i], "@") + 1:i]
+		path = "/" + repo[i + 1:]
+	} else if i := strings.Index(repo, "/"); i > 0 {
+		// e.g. github.com/org/repo, as in whitelist patterns
+		host = repo[:i]
+		path = repo[i:]
+	} else {
+		return ""
+	}
+	if host == "" || strings.Contains(host, "@") {
+		return ""
+	}
+	for _, segment := range strings.Split(host + path, "/") {
+		if segment == "." || segment == ".." {
+			return ""
+		}
+	}
+	repo = strings.TrimSuffix(host + path, "/")
+	repo = strings.TrimSuffix(repo, ".git")
+	return strings.ToLower(repo)
+}
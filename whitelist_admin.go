@@ -0,0 +1,284 @@
+package minienv
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+const WhitelistAuditActionAdd = "add"
+const WhitelistAuditActionUpdate = "update"
+const WhitelistAuditActionRemove = "remove"
+
+// managed entries are stored individually under this prefix, so concurrent changes to different entries don't conflict
+const WhitelistStateKeyPrefix = "whitelist/"
+const WhitelistAuditStateKey = "whitelist-audit"
+const MaxWhitelistAuditEntries = 1000
+const DefaultWhitelistAuditCount = 100
+
+// how often managed entries are re-read from the state store, to pick up changes made through other api servers
+const WhitelistSyncSeconds = 10
+
+var adminToken string
+
+// authorizeAdmin checks the token configured with MINIENV_ADMIN_TOKEN; the admin api is disabled without one
+func authorizeAdmin(token string) error {
+	if adminToken == "" {
+		return ErrAdminApiDisabled
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		logPrintln("Admin request failed; invalid admin token.")
+		return ErrAdminUnauthorized
+	}
+	return nil
+}
+
+func (apiServer *ApiServer) AddWhitelistRepo(request *WhitelistAdminRequest) (*WhitelistResponse, error) {
+	err := authorizeAdmin(request.AdminToken)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := getWhitelistAdminRequestRepo(request)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getManagedWhitelistRepo(repo.Name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil || isConfiguredWhitelistRepo(repo.Name) {
+		return nil, ErrConflict.WithMessage("whitelist entry '%s' already exists", repo.Name)
+	}
+	err = saveManagedWhitelistRepo(request.Actor, WhitelistAuditActionAdd, repo, nil)
+	if err != nil {
+		return nil, err
+	}
+	return getAdminWhitelistResponse(), nil
+}
+
+func (apiServer *ApiServer) UpdateWhitelistRepo(request *WhitelistAdminRequest) (*WhitelistResponse, error) {
+	err := authorizeAdmin(request.AdminToken)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := getWhitelistAdminRequestRepo(request)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getManagedWhitelistRepo(repo.Name)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, getMissingWhitelistRepoError(repo.Name)
+	}
+	err = saveManagedWhitelistRepo(request.Actor, WhitelistAuditActionUpdate, repo, existing)
+	if err != nil {
+		return nil, err
+	}
+	return getAdminWhitelistResponse(), nil
+}
+
+func (apiServer *ApiServer) RemoveWhitelistRepo(request *WhitelistAdminRequest) (*WhitelistResponse, error) {
+	err := authorizeAdmin(request.AdminToken)
+	if err != nil {
+		return nil, err
+	}
+	name := request.Name
+	if name == "" && request.Repo != nil {
+		name = request.Repo.Name
+	}
+	existing, err := getManagedWhitelistRepo(name)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, getMissingWhitelistRepoError(name)
+	}
+	err = saveManagedWhitelistRepo(request.Actor, WhitelistAuditActionRemove, nil, existing)
+	if err != nil {
+		return nil, err
+	}
+	return getAdminWhitelistResponse(), nil
+}
+
+// ListWhitelistRepos returns the whitelist with the env var defaults of its entries
+func (apiServer *ApiServer) ListWhitelistRepos(request *WhitelistListRequest) (*WhitelistResponse, error) {
+	err := authorizeAdmin(request.AdminToken)
+	if err != nil {
+		return nil, err
+	}
+	return getAdminWhitelistResponse(), nil
+}
+
+func getAdminWhitelistResponse() *WhitelistResponse {
+	return &WhitelistResponse{Repos: getWhitelistRepos()}
+}
+
+func (apiServer *ApiServer) WhitelistAudit(request *WhitelistAuditRequest) (*WhitelistAuditResponse, error) {
+	err := authorizeAdmin(request.AdminToken)
+	if err != nil {
+		return nil, err
+	}
+	count := request.Count
+	if count <= 0 {
+		count = DefaultWhitelistAuditCount
+	}
+	values, err := stateStore.GetAppendedState(WhitelistAuditStateKey, count)
+	if err != nil {
+		return nil, ErrBackendUnavailable.WithCause(err)
+	}
+	whitelistAuditResponse := &WhitelistAuditResponse{Entries: []*WhitelistAuditEntry{}}
+	for _, value := range values {
+		var entry WhitelistAuditEntry
+		if json.Unmarshal(value, &entry) == nil {
+			whitelistAuditResponse.Entries = append(whitelistAuditResponse.Entries, &entry)
+		}
+	}
+	return whitelistAuditResponse, nil
+}
+
+func getWhitelistAdminRequestRepo(request *WhitelistAdminRequest) (*WhitelistRepo, error) {
+	if request.Repo == nil || strings.TrimSpace(request.Repo.Url) == "" {
+		return nil, ErrBadRequest.WithMessage("whitelist entry is missing a url")
+	}
+	repo := *request.Repo
+	if request.Name != "" {
+		repo.Name = request.Name
+	}
+	if repo.Name == "" {
+		repo.Name = repo.Url
+	}
+	if repo.MaxExpirationSeconds < 0 {
+		return nil, ErrBadRequest.WithMessage("whitelist entry has a negative max expiration")
+	}
+	err := repo.compile()
+	if err != nil {
+		return nil, ErrBadRequest.WithMessage("%v", err)
+	}
+	return &repo, nil
+}
+
+func getMissingWhitelistRepoError(name string) error {
+	if isConfiguredWhitelistRepo(name) {
+		return ErrConflict.WithMessage("whitelist entry '%s' is configured on the server and can't be changed", name)
+	}
+	return ErrNotFound.WithMessage("whitelist entry '%s' not found", name)
+}
+
+func isConfiguredWhitelistRepo(name string) bool {
+	whitelistMutex.RLock()
+	defer whitelistMutex.RUnlock()
+	for _, element := range configuredWhitelistRepos {
+		if element.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func getManagedWhitelistRepo(name string) (*WhitelistRepo, error) {
+	value, err := stateStore.GetState(WhitelistStateKeyPrefix + name)
+	if err != nil {
+		return nil, ErrBackendUnavailable.WithCause(err)
+	}
+	if value == nil {
+		return nil, nil
+	}
+	var repo WhitelistRepo
+	err = json.Unmarshal(value, &repo)
+	if err != nil {
+		return nil, ErrInternal.WithCause(err)
+	}
+	return &repo, nil
+}
+
+// saveManagedWhitelistRepo stores (or, when repo is nil, deletes) a managed entry, records the change
+// in the audit and reloads the whitelist. A new entry (previous is nil) is only stored if no other api
+// server stored it first, so concurrent adds of the same entry leave a single audit entry.
+func saveManagedWhitelistRepo(actor string, action string, repo *WhitelistRepo, previous *WhitelistRepo) error {
+	var err error
+	if repo == nil {
+		err = stateStore.DeleteState(WhitelistStateKeyPrefix + previous.Name)
+	} else {
+		var value []byte
+		value, err = json.Marshal(repo)
+		if err == nil && previous == nil {
+			var swapped bool
+			swapped, err = stateStore.CompareAndSwapState(WhitelistStateKeyPrefix + repo.Name, nil, value)
+			if err == nil && ! swapped {
+				return ErrConflict.WithMessage("whitelist entry '%s' already exists", repo.Name)
+			}
+		} else if err == nil {
+			err = stateStore.SetState(WhitelistStateKeyPrefix + repo.Name, value)
+		}
+	}
+	if err != nil {
+		return ErrBackendUnavailable.WithCause(err)
+	}
+	entry := &WhitelistAuditEntry{
+		Timestamp: time.Now().Unix(),
+		Actor: actor,
+		Action: action,
+		Repo: repo,
+		Previous: previous,
+	}
+	if repo != nil {
+		entry.Name = repo.Name
+	} else {
+		entry.Name = previous.Name
+	}
+	logPrintf("Whitelist entry '%s' changed by '%s'; action=%s\n", entry.Name, actor, action)
+	value, err := json.Marshal(entry)
+	if err == nil {
+		err = stateStore.AppendState(WhitelistAuditStateKey, value, MaxWhitelistAuditEntries)
+	}
+	if err != nil {
+		logPrintf("Error recording whitelist audit entry: %v\n", err)
+	}
+	err = syncManagedWhitelistRepos()
+	if err != nil {
+		return ErrBackendUnavailable.WithCause(err)
+	}
+	return nil
+}
+
+// syncManagedWhitelistRepos loads the managed entries from the state store, sorted by name
+func syncManagedWhitelistRepos() error {
+	values, err := stateStore.ListState(WhitelistStateKeyPrefix)
+	if err != nil {
+		return err
+	}
+	repos := []*WhitelistRepo{}
+	for key, value := range values {
+		var repo WhitelistRepo
+		err = json.Unmarshal(value, &repo)
+		if err == nil {
+			err = repo.compile()
+		}
+		if err != nil {
+			logPrintf("Skipping invalid whitelist entry %s: %v\n", key, err)
+			continue
+		}
+		repos = append(repos, &repo)
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].Name < repos[j].Name
+	})
+	setManagedWhitelistRepos(repos)
+	return nil
+}
+
+func startWhitelistSyncTimer() {
+	timer := time.NewTimer(time.Second * time.Duration(WhitelistSyncSeconds))
+	go func() {
+		<-timer.C
+		err := syncManagedWhitelistRepos()
+		if err != nil {
+			logPrintf("Error syncing whitelist: %v\n", err)
+		}
+		startWhitelistSyncTimer()
+	}()
+}
@@ -0,0 +1,104 @@
+package minienv
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func setTestAdminToken(t *testing.T, token string) {
+	previous := adminToken
+	adminToken = token
+	t.Cleanup(func() {
+		adminToken = previous
+		setManagedWhitelistRepos(nil)
+	})
+}
+
+// barrierStateStore holds every GetState until all the expected reads have happened, so concurrent requests
+// all see the state as it was before any of them changed it
+type barrierStateStore struct {
+	*InMemorySessionStore
+	barrier sync.WaitGroup
+}
+
+func (store *barrierStateStore) GetState(key string) ([]byte, error) {
+	value, err := store.InMemorySessionStore.GetState(key)
+	store.barrier.Done()
+	store.barrier.Wait()
+	return value, err
+}
+
+func TestAddWhitelistRepoConcurrently(t *testing.T) {
+	store := &barrierStateStore{InMemorySessionStore: setTestStateStore(t)}
+	stateStore = store
+	setTestAdminToken(t, "admin-token")
+	apiServer := &ApiServer{}
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	store.barrier.Add(len(errs))
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = apiServer.AddWhitelistRepo(&WhitelistAdminRequest{
+				AdminToken: "admin-token",
+				Actor: fmt.Sprintf("admin%d", i),
+				Repo: &WhitelistRepo{Name: "app", Url: "github.com/org/app"},
+			})
+		}(i)
+	}
+	wg.Wait()
+	stateStore = store.InMemorySessionStore
+	added := 0
+	for _, err := range errs {
+		if err == nil {
+			added++
+		} else if ! errors.Is(err, ErrConflict) {
+			t.Errorf("Expected %v, got %v", ErrConflict, err)
+		}
+	}
+	if added != 1 {
+		t.Errorf("Expected one add to succeed, got %d", added)
+	}
+	response, err := apiServer.WhitelistAudit(&WhitelistAuditRequest{AdminToken: "admin-token"})
+	if err != nil || len(response.Entries) != 1 || response.Entries[0].Action != WhitelistAuditActionAdd {
+		t.Errorf("Expected a single add in the audit, got %v, %v", response, err)
+	}
+	if repo := getWhitelistRepo("https://github.com/org/app", DefaultBranch); repo == nil || repo.Name != "app" {
+		t.Errorf("Expected the added entry, got %v", repo)
+	}
+}
+
+func TestAddWhitelistRepoExisting(t *testing.T) {
+	setTestStateStore(t)
+	setTestAdminToken(t, "admin-token")
+	setTestWhitelist(t, "configured|github.com/org/configured", "")
+	apiServer := &ApiServer{}
+	request := &WhitelistAdminRequest{AdminToken: "admin-token", Repo: &WhitelistRepo{Name: "app", Url: "github.com/org/app"}}
+	if _, err := apiServer.AddWhitelistRepo(request); err != nil {
+		t.Fatalf("Expected entry to be added, got %v", err)
+	}
+	for _, name := range []string{"app", "configured"} {
+		request := &WhitelistAdminRequest{AdminToken: "admin-token", Repo: &WhitelistRepo{Name: name, Url: "github.com/org/other"}}
+		if _, err := apiServer.AddWhitelistRepo(request); ! errors.Is(err, ErrConflict) {
+			t.Errorf("%s: expected %v, got %v", name, ErrConflict, err)
+		}
+	}
+	// removed entries can be added again
+	if _, err := apiServer.RemoveWhitelistRepo(&WhitelistAdminRequest{AdminToken: "admin-token", Name: "app"}); err != nil {
+		t.Fatalf("Expected entry to be removed, got %v", err)
+	}
+	if _, err := apiServer.AddWhitelistRepo(request); err != nil {
+		t.Errorf("Expected removed entry to be added again, got %v", err)
+	}
+	response, _ := apiServer.WhitelistAudit(&WhitelistAuditRequest{AdminToken: "admin-token"})
+	var actions []string
+	for _, entry := range response.Entries {
+		actions = append(actions, entry.Action)
+	}
+	if fmt.Sprint(actions) != "[add remove add]" {
+		t.Errorf("Expected [add remove add], got %v", actions)
+	}
+}